@@ -2,41 +2,118 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/onemorebsmith/kaspastratum/src/kaspastratum"
-	"gopkg.in/yaml.v2"
+	"github.com/pkg/errors"
 )
 
-func main() {
-	pwd, _ := os.Getwd()
-	fullPath := path.Join(pwd, "config.yaml")
-	log.Printf("loading config @ `%s`", fullPath)
-	rawCfg, err := ioutil.ReadFile(fullPath)
-	if err != nil {
-		log.Printf("config file not found: %s", err)
-		os.Exit(1)
+// bindFlags registers command line overrides for the config file values
+func bindFlags(fs *flag.FlagSet, cfg *kaspastratum.BridgeConfig, fallbacks, allow, deny, wallets, windows, webhooks *string) {
+	fs.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on, default `:5555`")
+	fs.StringVar(&cfg.StratumTLSPort, "stratumtls", cfg.StratumTLSPort, "stratum+ssl port to listen on, disabled if empty")
+	fs.StringVar(&cfg.TLSCertFile, "tlscert", cfg.TLSCertFile, "path to the tls cert for the stratum+ssl port")
+	fs.StringVar(&cfg.TLSKeyFile, "tlskey", cfg.TLSKeyFile, "path to the tls key for the stratum+ssl port")
+	fs.BoolVar(&cfg.TLSSelfSigned, "tlsselfsigned", cfg.TLSSelfSigned, "true to generate a self signed cert if none exists, default `false`")
+	fs.BoolVar(&cfg.PrintStats, "stats", cfg.PrintStats, "true to show periodic stats to console, default `true`")
+	fs.StringVar(&cfg.RPCServer, "kaspa", cfg.RPCServer, "address of the kaspad node, default `localhost:16110`")
+	fs.StringVar(fallbacks, "kaspafallback", strings.Join(cfg.FallbackServers, ","), "comma separated list of fallback kaspad nodes, in priority order")
+	fs.BoolVar(&cfg.SubmitAllNodes, "submitall", cfg.SubmitAllNodes, "true to submit found blocks to all healthy kaspad nodes in parallel, default `false`")
+	fs.DurationVar(&cfg.BlockWaitTime, "blockwait", cfg.BlockWaitTime, "time in ms to wait before manually requesting new block, default `500`")
+	fs.UintVar(&cfg.MinShareDiff, "mindiff", cfg.MinShareDiff, "minimum share difficulty to accept from miner(s), default `4`")
+	fs.BoolVar(&cfg.VarDiff, "vardiff", cfg.VarDiff, "true to enable per-worker variable difficulty, default `false`")
+	fs.UintVar(&cfg.SharesPerMin, "sharespermin", cfg.SharesPerMin, "number of shares per minute the vardiff engine targets, default `20`")
+	fs.UintVar(&cfg.VarDiffMin, "vardiffmin", cfg.VarDiffMin, "minimum difficulty vardiff will assign, defaults to mindiff")
+	fs.UintVar(&cfg.VarDiffMax, "vardiffmax", cfg.VarDiffMax, "maximum difficulty vardiff will assign, 0 for unbounded, default `0`")
+	fs.DurationVar(&cfg.VarDiffRetarget, "vardiffretarget", cfg.VarDiffRetarget, "how often the vardiff engine re-evaluates worker difficulty, default `30s`")
+	fs.UintVar(&cfg.ExtranonceSize, "extranonce", cfg.ExtranonceSize, "size in bytes of extranonce, default `0`")
+	fs.Uint64Var(&cfg.StaleWindow, "stalewindow", cfg.StaleWindow, "max blue score the tip can advance past a job before its shares are stale, default `8`")
+	fs.DurationVar(&cfg.MaxJobAge, "maxjobage", cfg.MaxJobAge, "max age of a job before its shares are stale, 0 to disable, default `0`")
+	fs.StringVar(windows, "hashratewindows", joinDurations(cfg.HashrateWindows), "comma separated windows hashrate is reported over, default `5m,1h,24h`")
+	fs.IntVar(&cfg.MaxConns, "maxconns", cfg.MaxConns, "max concurrent miner connections, 0 for unlimited, default `0`")
+	fs.IntVar(&cfg.MaxConnsPerIP, "maxconnsperip", cfg.MaxConnsPerIP, "max concurrent miner connections from a single ip, 0 for unlimited, default `0`")
+	fs.Float64Var(&cfg.AcceptRate, "acceptrate", cfg.AcceptRate, "max new connections accepted per second, 0 for unlimited, default `0`")
+	fs.StringVar(allow, "allow", strings.Join(cfg.AllowCIDRs, ","), "comma separated ips/cidrs allowed to connect, everyone if empty")
+	fs.StringVar(deny, "deny", strings.Join(cfg.DenyCIDRs, ","), "comma separated ips/cidrs refused")
+	fs.IntVar(&cfg.BanThreshold, "banthreshold", cfg.BanThreshold, "repeat offenses within the ban window before an ip is banned, 0 (default) disables automatic bans")
+	fs.DurationVar(&cfg.BanWindow, "banwindow", cfg.BanWindow, "window offenses are counted over, default `10m`")
+	fs.DurationVar(&cfg.BanDuration, "banduration", cfg.BanDuration, "how long automatic bans last, default `1h`")
+	fs.StringVar((*string)(&cfg.AuthMode), "authmode", string(cfg.AuthMode), "who may mine: open, allowlist or default_wallet, default `open`")
+	fs.StringVar(wallets, "allowwallets", strings.Join(cfg.AllowedWallets, ","), "comma separated wallets allowed to mine in allowlist/default_wallet auth modes")
+	fs.StringVar(&cfg.DefaultWallet, "defaultwallet", cfg.DefaultWallet, "wallet unknown workers mine to in default_wallet auth mode")
+	fs.StringVar(&cfg.WorkerPassword, "workerpassword", cfg.WorkerPassword, "password miners must authorize with, none if empty")
+	fs.StringVar(&cfg.AdminToken, "admintoken", cfg.AdminToken, "bearer token required by admin api endpoints, admin endpoints disabled if empty")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdowntimeout", cfg.ShutdownTimeout, "how long to spend draining miners and flushing on shutdown before exiting, default `30s`")
+	fs.StringVar(webhooks, "alertwebhooks", strings.Join(cfg.Alerts.Webhooks, ","), "comma separated urls alerts are posted to as json")
+	fs.StringVar(&cfg.ShutdownReconnect, "shutdownreconnect", cfg.ShutdownReconnect, `host:port miners are sent to with client.reconnect on shutdown, default ""`)
+	fs.StringVar(&cfg.UpstreamPool, "upstream", cfg.UpstreamPool, "if set the bridge proxies miners to this upstream pool instead of mining against kaspad")
+	fs.StringVar(&cfg.UpstreamUser, "upstreamuser", cfg.UpstreamUser, "user (wallet.worker) to authorize with on the upstream pool")
+	fs.StringVar(&cfg.UpstreamPass, "upstreampass", cfg.UpstreamPass, "password to authorize with on the upstream pool")
+	fs.UintVar(&cfg.UpstreamConns, "upstreamconns", cfg.UpstreamConns, "number of connections to open to the upstream pool, default `1`")
+	fs.StringVar(&cfg.StorePath, "store", cfg.StorePath, "path of the embedded share/block store, empty to disable persistence")
+	fs.DurationVar(&cfg.StoreRetention, "storeretention", cfg.StoreRetention, "how long individual share and block records are kept, default `168h`")
+	fs.DurationVar(&cfg.StoreCompact, "storecompact", cfg.StoreCompact, "how often the store is compacted to reclaim space, negative to disable, default `24h`")
+	fs.StringVar(&cfg.PoolAddress, "pooladdress", cfg.PoolAddress, "if set runs in pool mode, templates pay this address and rewards are split PPLNS")
+	fs.Float64Var(&cfg.PoolFee, "poolfee", cfg.PoolFee, "percentage of each block reward kept by the pool, default `0`")
+	fs.UintVar(&cfg.PPLNSWindow, "pplnswindow", cfg.PPLNSWindow, "number of recent shares rewards are split across, default `10000`")
+	fs.Uint64Var(&cfg.BlockMaturity, "blockmaturity", cfg.BlockMaturity, "blue score a found block must be behind the tip before its split is credited, default `100`")
+	fs.Uint64Var(&cfg.PayoutThreshold, "payoutthreshold", cfg.PayoutThreshold, "minimum balance in sompi before a wallet is paid out, default `100000000`")
+	fs.StringVar(&cfg.APIPort, "api", cfg.APIPort, `address to serve the web dashboard and json stats api, default ""`)
+	fs.StringVar(&cfg.PromPort, "prom", cfg.PromPort, "address to serve prom stats, default `:2112`")
+	fs.BoolVar(&cfg.UseLogFile, "log", cfg.UseLogFile, "if true will output errors to log file, default `true`")
+	fs.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, "minimum level to log (debug, info, warn, error), default `info`")
+	fs.IntVar(&cfg.MaxLineLength, "maxline", cfg.MaxLineLength, "longest message in bytes accepted from a miner before it's disconnected, default `16384`")
+	fs.StringVar(&cfg.RecordDir, "record", cfg.RecordDir, `directory to record raw stratum sessions to for replay, default ""`)
+	fs.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, `(rarely used) if defined will expose a health check on /readyz, default ""`)
+}
+
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
 	}
-	cfg := kaspastratum.BridgeConfig{}
-	if err := yaml.Unmarshal(rawCfg, &cfg); err != nil {
-		log.Printf("failed parsing config file: %s", err)
-		os.Exit(1)
+	return entries
+}
+
+func joinDurations(durations []time.Duration) string {
+	entries := make([]string, 0, len(durations))
+	for _, d := range durations {
+		entries = append(entries, d.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+// loadConfig reads the config file and applies command line overrides on
+// top, called at startup and again whenever the bridge reloads its config
+func loadConfig(fullPath string) (kaspastratum.BridgeConfig, error) {
+	cfg, err := kaspastratum.LoadConfigFile(fullPath)
+	if err != nil {
+		return cfg, err
 	}
 
-	flag.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on, default `:5555`")
-	flag.BoolVar(&cfg.PrintStats, "stats", cfg.PrintStats, "true to show periodic stats to console, default `true`")
-	flag.StringVar(&cfg.RPCServer, "kaspa", cfg.RPCServer, "address of the kaspad node, default `localhost:16110`")
-	flag.DurationVar(&cfg.BlockWaitTime, "blockwait", cfg.BlockWaitTime, "time in ms to wait before manually requesting new block, default `500`")
-	flag.UintVar(&cfg.MinShareDiff, "mindiff", cfg.MinShareDiff, "minimum share difficulty to accept from miner(s), default `4`")
-	flag.UintVar(&cfg.ExtranonceSize, "extranonce", cfg.ExtranonceSize, "size in bytes of extranonce, default `0`")
-	flag.StringVar(&cfg.PromPort, "prom", cfg.PromPort, "address to serve prom stats, default `:2112`")
-	flag.BoolVar(&cfg.UseLogFile, "log", cfg.UseLogFile, "if true will output errors to log file, default `true`")
-	flag.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, `(rarely used) if defined will expose a health check on /readyz, default ""`)
-	flag.Parse()
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var fallbacks, allow, deny, wallets, windows, webhooks string
+	bindFlags(fs, &cfg, &fallbacks, &allow, &deny, &wallets, &windows, &webhooks)
+	fs.Parse(os.Args[1:])
+	cfg.FallbackServers = splitList(fallbacks)
+	cfg.AllowCIDRs = splitList(allow)
+	cfg.DenyCIDRs = splitList(deny)
+	cfg.AllowedWallets = splitList(wallets)
+	cfg.Alerts.Webhooks = splitList(webhooks)
+	cfg.HashrateWindows = nil
+	for _, entry := range splitList(windows) {
+		window, err := time.ParseDuration(entry)
+		if err != nil {
+			return cfg, errors.Wrap(err, "invalid -hashratewindows")
+		}
+		cfg.HashrateWindows = append(cfg.HashrateWindows, window)
+	}
 
 	if cfg.MinShareDiff == 0 {
 		cfg.MinShareDiff = 4
@@ -44,17 +121,127 @@ func main() {
 	if cfg.BlockWaitTime == 0 {
 		cfg.BlockWaitTime = 5 * time.Second // this should never happen due to kas 1s block times
 	}
+	return cfg, nil
+}
+
+func main() {
+	pwd, _ := os.Getwd()
+	fullPath := path.Join(pwd, "config.yaml")
+	log.Printf("loading config @ `%s`", fullPath)
+	cfg, err := loadConfig(fullPath)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	cfg.ConfigPath = fullPath
+	cfg.ConfigLoader = func() (kaspastratum.BridgeConfig, error) { return loadConfig(fullPath) }
 
 	log.Println("----------------------------------")
 	log.Printf("initializing bridge")
-	log.Printf("\tkaspad:          %s", cfg.RPCServer)
-	log.Printf("\tstratum:         %s", cfg.StratumPort)
+	if cfg.UpstreamPool != "" {
+		log.Printf("\tupstream pool:   %s", cfg.UpstreamPool)
+		log.Printf("\tupstream user:   %s", cfg.UpstreamUser)
+		log.Printf("\tupstream conns:  %d", cfg.UpstreamConns)
+	} else {
+		log.Printf("\tkaspad:          %s", cfg.RPCServer)
+		for _, addr := range cfg.FallbackServers {
+			log.Printf("\tkaspad fallback: %s", addr)
+		}
+		log.Printf("\tsubmit all:      %t", cfg.SubmitAllNodes)
+		if cfg.PoolAddress != "" {
+			log.Printf("\tpool address:    %s", cfg.PoolAddress)
+			log.Printf("\tpool fee:        %.2f%%", cfg.PoolFee)
+			log.Printf("\tpplns window:    %d", cfg.PPLNSWindow)
+			log.Printf("\tblock maturity:  %d", cfg.BlockMaturity)
+			log.Printf("\tpayout thresh:   %d", cfg.PayoutThreshold)
+		}
+	}
+	if cfg.StratumPort != "" {
+		log.Printf("\tstratum:         %s", cfg.StratumPort)
+	}
+	if cfg.StratumTLSPort != "" {
+		log.Printf("\tstratum tls:     %s", cfg.StratumTLSPort)
+		log.Printf("\ttls cert:        %s", cfg.TLSCertFile)
+		log.Printf("\ttls self signed: %t", cfg.TLSSelfSigned)
+	}
+	for _, p := range cfg.Ports {
+		log.Printf("\tport profile:    %s on %s", p.Name, p.Port)
+	}
+	for _, rule := range cfg.JobEncoders {
+		log.Printf("\tjob encoder:     %s -> %s", rule.Match, rule.Encoder)
+	}
 	log.Printf("\tprom:            %s", cfg.PromPort)
+	log.Printf("\tapi:             %s", cfg.APIPort)
 	log.Printf("\tstats:           %t", cfg.PrintStats)
 	log.Printf("\tlog:             %t", cfg.UseLogFile)
+	log.Printf("\tlog level:       %s", cfg.LogLevel)
 	log.Printf("\tmin diff:        %d", cfg.MinShareDiff)
+	log.Printf("\tvar diff:        %t", cfg.VarDiff)
+	if cfg.VarDiff {
+		log.Printf("\tshares per min:  %d", cfg.SharesPerMin)
+		log.Printf("\tvar diff min:    %d", cfg.VarDiffMin)
+		log.Printf("\tvar diff max:    %d", cfg.VarDiffMax)
+		log.Printf("\tvar diff retgt:  %s", cfg.VarDiffRetarget)
+	}
 	log.Printf("\tblock wait:      %s", cfg.BlockWaitTime)
 	log.Printf("\textranonce size: %d", cfg.ExtranonceSize)
+	log.Printf("\tstale window:    %d", cfg.StaleWindow)
+	log.Printf("\tmax job age:     %s", cfg.MaxJobAge)
+	if len(cfg.HashrateWindows) > 0 {
+		log.Printf("\thashrate wins:   %s", joinDurations(cfg.HashrateWindows))
+	}
+	if cfg.MaxLineLength > 0 {
+		log.Printf("\tmax line length: %d", cfg.MaxLineLength)
+	}
+	if cfg.RecordDir != "" {
+		log.Printf("\trecording to:    %s", cfg.RecordDir)
+	}
+	if cfg.MaxConns > 0 || cfg.MaxConnsPerIP > 0 {
+		log.Printf("\tmax conns:       %d (%d per ip)", cfg.MaxConns, cfg.MaxConnsPerIP)
+	}
+	if cfg.AcceptRate > 0 {
+		log.Printf("\taccept rate:     %.1f/s", cfg.AcceptRate)
+	}
+	if len(cfg.AllowCIDRs) > 0 {
+		log.Printf("\tallow:           %s", strings.Join(cfg.AllowCIDRs, ", "))
+	}
+	if len(cfg.DenyCIDRs) > 0 {
+		log.Printf("\tdeny:            %s", strings.Join(cfg.DenyCIDRs, ", "))
+	}
+	log.Printf("\tban threshold:   %d", cfg.BanThreshold)
+	if cfg.AuthMode != "" {
+		log.Printf("\tauth mode:       %s", cfg.AuthMode)
+		log.Printf("\tallowed wallets: %d", len(cfg.AllowedWallets))
+	}
+	if cfg.DefaultWallet != "" {
+		log.Printf("\tdefault wallet:  %s", cfg.DefaultWallet)
+	}
+	log.Printf("\tpasswords:       %t", cfg.WorkerPassword != "" || len(cfg.WorkerPasswords) > 0)
+	for _, rule := range cfg.Alerts.Rules {
+		name := rule.Name
+		if name == "" {
+			name = string(rule.Type)
+		}
+		log.Printf("\talert rule:      %s (%s)", name, rule.Type)
+	}
+	for _, hook := range cfg.Alerts.Webhooks {
+		log.Printf("\talert webhook:   %s", hook)
+	}
+	if cfg.Alerts.SMTP.Server != "" {
+		log.Printf("\talert email:     %s via %s", strings.Join(cfg.Alerts.SMTP.To, ", "), cfg.Alerts.SMTP.Server)
+	}
+	if len(cfg.Alerts.Command) > 0 {
+		log.Printf("\talert command:   %s", strings.Join(cfg.Alerts.Command, " "))
+	}
+	log.Printf("\tshutdown:        %s", cfg.ShutdownTimeout)
+	if cfg.ShutdownReconnect != "" {
+		log.Printf("\tshutdown recon:  %s", cfg.ShutdownReconnect)
+	}
+	if cfg.StorePath != "" {
+		log.Printf("\tstore:           %s", cfg.StorePath)
+		log.Printf("\tstore retention: %s", cfg.StoreRetention)
+		log.Printf("\tstore compact:   %s", cfg.StoreCompact)
+	}
 	log.Printf("\thealth check:    %s", cfg.HealthCheckPort)
 	log.Println("----------------------------------")
 
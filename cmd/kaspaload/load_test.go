@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	samples := []time.Duration{}
+	for i := 100; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	s := summarize(samples)
+	if s.Count != 100 || s.P50 != 50*time.Millisecond || s.P99 != 99*time.Millisecond || s.Max != 100*time.Millisecond {
+		t.Fatalf("unexpected summary %s", s)
+	}
+	if s := summarize(nil); s.Count != 0 {
+		t.Fatalf("expected empty summary")
+	}
+}
+
+// TestLoadRun is a small run against the in process bridge
+func TestLoadRun(t *testing.T) {
+	r, err := runLoad(context.Background(), loadConfig{
+		Miners:        20,
+		Agents:        []string{"lolMiner 1.76", "BzMiner-v13.1.0"},
+		SharesPerMin:  600,
+		Duration:      2 * time.Second,
+		RampUp:        200 * time.Millisecond,
+		BlockInterval: 250 * time.Millisecond,
+		SubmitTimeout: 5 * time.Second,
+		Wallet:        loadWallet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Connected != 20 || r.Failed != 0 {
+		t.Fatalf("expected all miners connected, got %d (%d failed)", r.Connected, r.Failed)
+	}
+	if r.Templates == 0 || r.Jobs < r.Templates || !r.FromTemplate {
+		t.Fatalf("expected jobs timed from templates, got %d jobs for %d templates", r.Jobs, r.Templates)
+	}
+	if r.Submits == 0 || r.Replies[replyLowDiff] == 0 || r.SubmitRTT.Count == 0 {
+		t.Fatalf("expected submits answered as low diff, got %d submits, replies %v", r.Submits, r.Replies)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/kaspastratum"
+)
+
+const loadWallet = "kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4"
+
+type loadConfig struct {
+	// Address of the bridge under test, empty to start one in process
+	// backed by a fake kaspad
+	Address       string
+	Miners        int
+	Agents        []string
+	SharesPerMin  float64
+	Duration      time.Duration
+	RampUp        time.Duration
+	BlockInterval time.Duration // in process bridge only
+	SubmitTimeout time.Duration
+	Wallet        string
+	PromPort      string // in process bridge only
+}
+
+// startBridge runs a bridge against a fake kaspad on a free local port,
+// sending it a new template every BlockInterval. The bridge runs until the
+// process exits
+func startBridge(ctx context.Context, cfg loadConfig, stats *collector) (string, error) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	fake := kaspastratum.NewFakeKaspad(1)
+	go func() {
+		err := kaspastratum.ListenAndServe(kaspastratum.BridgeConfig{
+			StratumPort:    address,
+			RPCServer:      "fake",
+			KaspadDialer:   fake.Dial,
+			PromPort:       cfg.PromPort,
+			LogLevel:       "error",
+			MinShareDiff:   4,
+			ExtranonceSize: 2,
+			StaleWindow:    8,
+			// templates come from notifications, polling only as a fallback
+			BlockWaitTime: 10 * cfg.BlockInterval,
+			// simulated shares are all invalid, don't ban the load generator
+			BanThreshold: -1,
+		})
+		log.Fatalf("bridge exited: %s", err)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(cfg.BlockInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sent := time.Now()
+				fake.NewTemplate()
+				header, err := kaspastratum.SerializeBlockHeader(fake.Template())
+				if err == nil {
+					stats.templateSent(hex.EncodeToString(header), sent)
+				}
+			}
+		}
+	}()
+	return address, nil
+}
+
+// runLoad connects the miners, spread over the ramp up, and keeps them
+// submitting until the duration is up
+func runLoad(ctx context.Context, cfg loadConfig) (report, error) {
+	stats := newCollector()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if cfg.Address == "" {
+		address, err := startBridge(ctx, cfg, stats)
+		if err != nil {
+			return report{}, err
+		}
+		cfg.Address = address
+		waitForBridge(ctx, address)
+	}
+
+	start := time.Now()
+	runCtx, stop := context.WithTimeout(ctx, cfg.RampUp+cfg.Duration)
+	defer stop()
+	wg := sync.WaitGroup{}
+	for i := 0; i < cfg.Miners && runCtx.Err() == nil; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			newSimMiner(cfg, i, stats).run(runCtx)
+		}(i)
+		if cfg.Miners > 1 {
+			time.Sleep(cfg.RampUp / time.Duration(cfg.Miners))
+		}
+	}
+	wg.Wait()
+	return stats.report(cfg.Miners, time.Since(start)), nil
+}
+
+func waitForBridge(ctx context.Context, address string) {
+	for ctx.Err() == nil {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func main() {
+	cfg := loadConfig{Wallet: loadWallet}
+	var agents, jsonPath string
+	flag.StringVar(&cfg.Address, "bridge", "", "stratum address of the bridge to test, empty to start one in process against a fake kaspad")
+	flag.IntVar(&cfg.Miners, "miners", 1000, "number of simulated miners")
+	flag.StringVar(&agents, "agents", "lolMiner 1.76,BzMiner-v13.1.0,SRBMiner-MULTI/2.2.5", "comma separated user agents, assigned to miners round robin")
+	flag.Float64Var(&cfg.SharesPerMin, "sharespermin", 20, "average shares per minute submitted by each miner")
+	flag.DurationVar(&cfg.Duration, "duration", time.Minute, "how long to run once all miners are connected")
+	flag.DurationVar(&cfg.RampUp, "rampup", 10*time.Second, "time over which miners are connected")
+	flag.DurationVar(&cfg.BlockInterval, "blockinterval", time.Second, "how often the fake kaspad produces a new template")
+	flag.DurationVar(&cfg.SubmitTimeout, "timeout", 10*time.Second, "how long to wait for a reply before counting a submit as timed out")
+	flag.StringVar(&cfg.PromPort, "prom", "", "address to serve prom stats of the in process bridge on, default \"\"")
+	flag.StringVar(&jsonPath, "json", "", "also write the report as json to this path")
+	flag.Parse()
+	for _, agent := range strings.Split(agents, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			cfg.Agents = append(cfg.Agents, agent)
+		}
+	}
+	if len(cfg.Agents) == 0 || cfg.Miners < 1 || cfg.SharesPerMin <= 0 || cfg.BlockInterval <= 0 {
+		log.Println("-agents, -miners, -sharespermin and -blockinterval must be set")
+		os.Exit(1)
+	}
+
+	log.Println("----------------------------------")
+	log.Printf("initializing load test")
+	if cfg.Address != "" {
+		log.Printf("\tbridge:          %s", cfg.Address)
+	} else {
+		log.Printf("\tbridge:          in process, fake kaspad")
+		log.Printf("\tblock interval:  %s", cfg.BlockInterval)
+	}
+	log.Printf("\tminers:          %d", cfg.Miners)
+	log.Printf("\tagents:          %s", strings.Join(cfg.Agents, ", "))
+	log.Printf("\tshares per min:  %g", cfg.SharesPerMin)
+	log.Printf("\tramp up:         %s", cfg.RampUp)
+	log.Printf("\tduration:        %s", cfg.Duration)
+	log.Println("----------------------------------")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	r, err := runLoad(ctx, cfg)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	r.print(os.Stdout)
+	if jsonPath != "" {
+		file, err := os.Create(jsonPath)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		if err := r.writeJSON(file); err != nil {
+			log.Println(err)
+		}
+	}
+}
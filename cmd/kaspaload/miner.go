@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	subscribeId = 1
+	authorizeId = 2
+)
+
+// simMiner is a single simulated miner session. It doesn't hash, shares are
+// random nonces sent at the configured rate against the latest job
+type simMiner struct {
+	cfg        loadConfig
+	worker     string
+	agent      string
+	stats      *collector
+	rand       *rand.Rand
+	conn       net.Conn
+	writeLock  sync.Mutex
+	lock       sync.Mutex // guards everything below
+	jobId      string
+	header     string
+	extranonce string
+	nextId     int64
+	pending    map[int64]time.Time
+}
+
+func newSimMiner(cfg loadConfig, idx int, stats *collector) *simMiner {
+	return &simMiner{
+		cfg:     cfg,
+		worker:  fmt.Sprintf("%s.load%d", cfg.Wallet, idx),
+		agent:   cfg.Agents[idx%len(cfg.Agents)],
+		stats:   stats,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano() + int64(idx))),
+		nextId:  authorizeId,
+		pending: map[int64]time.Time{},
+	}
+}
+
+// run holds the session open until the context is done
+func (m *simMiner) run(ctx context.Context) {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", m.cfg.Address)
+	if err != nil {
+		m.stats.connection(false)
+		return
+	}
+	m.conn = conn
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	authorized := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.readLoop(authorized)
+		if ctx.Err() == nil {
+			m.stats.disconnected()
+		}
+	}()
+
+	m.send(subscribeId, "mining.subscribe", m.agent)
+	m.send(authorizeId, "mining.authorize", m.worker, "x")
+	select {
+	case ok := <-authorized:
+		m.stats.connection(ok)
+		if !ok {
+			conn.Close()
+			return
+		}
+	case <-done:
+		m.stats.connection(false)
+		return
+	case <-time.After(m.cfg.SubmitTimeout):
+		m.stats.connection(false)
+		conn.Close()
+		return
+	}
+
+	mean := time.Duration(float64(time.Minute) / m.cfg.SharesPerMin)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-time.After(time.Duration(m.rand.ExpFloat64() * float64(mean))):
+			m.submit()
+			m.expire()
+		}
+	}
+}
+
+func (m *simMiner) send(id int64, method string, params ...any) error {
+	raw, err := json.Marshal(map[string]any{"id": id, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(m.cfg.SubmitTimeout))
+	_, err = m.conn.Write(append(raw, '\n'))
+	return err
+}
+
+func (m *simMiner) submit() {
+	m.lock.Lock()
+	if m.jobId == "" {
+		m.lock.Unlock()
+		return
+	}
+	m.nextId++
+	id, jobId := m.nextId, m.jobId
+	nonce := fmt.Sprintf("%016x", m.rand.Uint64())[len(m.extranonce):]
+	m.pending[id] = time.Now()
+	m.lock.Unlock()
+
+	m.stats.submitted()
+	if err := m.send(id, "mining.submit", m.worker, jobId, nonce); err != nil {
+		m.conn.Close() // counted as a disconnect by the read loop
+	}
+}
+
+// expire counts submits that went unanswered for too long as timeouts
+func (m *simMiner) expire() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, sent := range m.pending {
+		if time.Since(sent) > m.cfg.SubmitTimeout {
+			delete(m.pending, id)
+			m.stats.reply(replyTimeout, 0)
+		}
+	}
+}
+
+type message struct {
+	Id     any    `json:"id"`
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+	Result any    `json:"result"`
+	Error  []any  `json:"error"`
+}
+
+func (m *simMiner) readLoop(authorized chan bool) {
+	reader := bufio.NewReader(m.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		msg := message{}
+		decoder := json.NewDecoder(bytes.NewReader(bytes.Trim(line, "\x00\r\n\t ")))
+		decoder.UseNumber() // job words are full uint64s
+		if err := decoder.Decode(&msg); err != nil {
+			continue
+		}
+		switch msg.Method {
+		case "mining.notify":
+			m.handleJob(msg.Params, received)
+		case "set_extranonce", "mining.set_extranonce":
+			if len(msg.Params) > 0 {
+				if extranonce, ok := msg.Params[0].(string); ok && len(extranonce) < 16 {
+					m.lock.Lock()
+					m.extranonce = extranonce
+					m.lock.Unlock()
+				}
+			}
+		case "":
+			m.handleReply(msg, received, authorized)
+		}
+	}
+}
+
+func (m *simMiner) handleJob(params []any, received time.Time) {
+	header, err := jobHeader(params)
+	if err != nil || len(params) == 0 {
+		return
+	}
+	m.lock.Lock()
+	m.jobId = fmt.Sprint(params[0])
+	// the bridge resends the current template on a timer, only count the
+	// first time each header turns up
+	isNew := header != m.header
+	m.header = header
+	m.lock.Unlock()
+	if isNew {
+		m.stats.jobReceived(header, received)
+	}
+}
+
+func (m *simMiner) handleReply(msg message, received time.Time, authorized chan bool) {
+	id := toInt(msg.Id)
+	switch id {
+	case subscribeId:
+		return
+	case authorizeId:
+		authorized <- msg.Error == nil && msg.Result == true
+		return
+	}
+	m.lock.Lock()
+	sent, exists := m.pending[id]
+	delete(m.pending, id)
+	m.lock.Unlock()
+	if !exists {
+		return // already counted as a timeout
+	}
+	class := replyAccepted
+	if msg.Result != true {
+		class = replyOther
+		if len(msg.Error) > 0 {
+			if known, exists := replyCodes[int(toInt(msg.Error[0]))]; exists {
+				class = known
+			}
+		}
+	}
+	m.stats.reply(class, received.Sub(sent))
+}
+
+// jobHeader returns the pre pow hash of a job in either format as hex, used
+// to match up the same template across miners
+func jobHeader(params []any) (string, error) {
+	if len(params) < 2 {
+		return "", fmt.Errorf("expected at least 2 params")
+	}
+	switch header := params[1].(type) {
+	case []any: // 4 little endian uint64s
+		if len(header) != 4 {
+			return "", fmt.Errorf("expected 4 header words")
+		}
+		raw := make([]byte, 32)
+		for i, word := range header {
+			val, err := strconv.ParseUint(fmt.Sprint(word), 10, 64)
+			if err != nil {
+				return "", err
+			}
+			binary.LittleEndian.PutUint64(raw[i*8:], val)
+		}
+		return hex.EncodeToString(raw), nil
+	case string: // header then timestamp as hex
+		if len(header) != 80 {
+			return "", fmt.Errorf("expected 80 hex chars")
+		}
+		return header[:64], nil
+	}
+	return "", fmt.Errorf("unknown job format %T", params[1])
+}
+
+func toInt(v any) int64 {
+	n, ok := v.(json.Number)
+	if !ok {
+		return -1
+	}
+	i, _ := n.Int64()
+	return i
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reply classes, anything other than accepted and lowDiff counts as an
+// error since simulated work is expected to miss the share target
+const (
+	replyAccepted     = "accepted"
+	replyLowDiff      = "low_diff"
+	replyStale        = "stale"
+	replyDupe         = "dupe"
+	replyUnknown      = "unknown"
+	replyUnauthorized = "unauthorized"
+	replyTimeout      = "timeout"
+	replyOther        = "other"
+)
+
+var replyCodes = map[int]string{
+	20: replyUnknown,
+	21: replyStale,
+	22: replyDupe,
+	23: replyLowDiff,
+	24: replyUnauthorized,
+}
+
+// jobArrivals is when each miner first saw a job header, origin is when
+// the template was triggered if known
+type jobArrivals struct {
+	origin   time.Time
+	arrivals []time.Time
+}
+
+// collector gathers measurements from every simulated miner
+type collector struct {
+	lock        sync.Mutex
+	jobs        map[string]*jobArrivals
+	rtts        []time.Duration
+	replies     map[string]int
+	submits     int
+	connected   int
+	failed      int
+	disconnects int
+}
+
+func newCollector() *collector {
+	return &collector{jobs: map[string]*jobArrivals{}, replies: map[string]int{}}
+}
+
+func (c *collector) job(header string) *jobArrivals {
+	arrivals, exists := c.jobs[header]
+	if !exists {
+		arrivals = &jobArrivals{}
+		c.jobs[header] = arrivals
+	}
+	return arrivals
+}
+
+// templateSent records when the bridge was given a new template
+func (c *collector) templateSent(header string, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.job(header).origin = at
+}
+
+func (c *collector) jobReceived(header string, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	arrivals := c.job(header)
+	arrivals.arrivals = append(arrivals.arrivals, at)
+}
+
+func (c *collector) submitted() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.submits++
+}
+
+func (c *collector) reply(class string, rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replies[class]++
+	if class != replyTimeout {
+		c.rtts = append(c.rtts, rtt)
+	}
+}
+
+func (c *collector) connection(ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ok {
+		c.connected++
+	} else {
+		c.failed++
+	}
+}
+
+func (c *collector) disconnected() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disconnects++
+}
+
+// latencySummary is the distribution of a set of latencies
+type latencySummary struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func summarize(samples []time.Duration) latencySummary {
+	if len(samples) == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration { return sorted[int(p*float64(len(sorted)-1))] }
+	return latencySummary{Count: len(sorted), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: sorted[len(sorted)-1]}
+}
+
+func (s latencySummary) String() string {
+	return fmt.Sprintf("p50 %s  p90 %s  p99 %s  max %s  (%d samples)", s.P50.Round(time.Microsecond),
+		s.P90.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond), s.Count)
+}
+
+type report struct {
+	Miners      int            `json:"miners"`
+	Connected   int            `json:"connected"`
+	Failed      int            `json:"failed"`
+	Disconnects int            `json:"disconnects"`
+	Duration    time.Duration  `json:"duration_ns"`
+	Templates   int            `json:"templates"`
+	Jobs        int            `json:"jobs"`
+	JobLatency  latencySummary `json:"job_latency"`
+	// latency is measured from when the template was sent to kaspad if the
+	// bridge was started in process, otherwise from the first miner to get it
+	FromTemplate bool           `json:"from_template"`
+	Submits      int            `json:"submits"`
+	SubmitRTT    latencySummary `json:"submit_rtt"`
+	Replies      map[string]int `json:"replies"`
+	Errors       int            `json:"errors"`
+	ErrorRate    float64        `json:"error_rate"`
+}
+
+func (c *collector) report(miners int, duration time.Duration) report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r := report{
+		Miners:      miners,
+		Connected:   c.connected,
+		Failed:      c.failed,
+		Disconnects: c.disconnects,
+		Duration:    duration,
+		Submits:     c.submits,
+		SubmitRTT:   summarize(c.rtts),
+		Replies:     map[string]int{},
+	}
+	var latencies []time.Duration
+	for _, job := range c.jobs {
+		if len(job.arrivals) == 0 {
+			continue
+		}
+		r.Templates++
+		origin := job.origin
+		if !origin.IsZero() {
+			r.FromTemplate = true
+		} else {
+			origin = job.arrivals[0]
+			for _, at := range job.arrivals {
+				if at.Before(origin) {
+					origin = at
+				}
+			}
+		}
+		for _, at := range job.arrivals {
+			latencies = append(latencies, at.Sub(origin))
+		}
+	}
+	r.Jobs = len(latencies)
+	r.JobLatency = summarize(latencies)
+	for class, count := range c.replies {
+		r.Replies[class] = count
+		if class != replyAccepted && class != replyLowDiff {
+			r.Errors += count
+		}
+	}
+	if r.Submits > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Submits)
+	}
+	return r
+}
+
+func (r report) print(w io.Writer) {
+	fmt.Fprintln(w, "----------------------------------")
+	fmt.Fprintln(w, "load test report")
+	fmt.Fprintf(w, "\tminers:          %d (%d connected, %d failed, %d disconnects)\n", r.Miners, r.Connected, r.Failed, r.Disconnects)
+	fmt.Fprintf(w, "\tduration:        %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "\ttemplates:       %d\n", r.Templates)
+	fmt.Fprintf(w, "\tjobs received:   %d\n", r.Jobs)
+	from := "first miner to receive it"
+	if r.FromTemplate {
+		from = "template"
+	}
+	fmt.Fprintf(w, "\tjob latency:     %s, from %s\n", r.JobLatency, from)
+	fmt.Fprintf(w, "\tsubmits:         %d (%.1f/s)\n", r.Submits, float64(r.Submits)/r.Duration.Seconds())
+	fmt.Fprintf(w, "\tsubmit rtt:      %s\n", r.SubmitRTT)
+	classes := make([]string, 0, len(r.Replies))
+	for class := range r.Replies {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	replies := make([]string, 0, len(classes))
+	for _, class := range classes {
+		replies = append(replies, fmt.Sprintf("%s %d", class, r.Replies[class]))
+	}
+	fmt.Fprintf(w, "\treplies:         %s\n", strings.Join(replies, ", "))
+	fmt.Fprintf(w, "\terror rate:      %.3f%% (%d)\n", r.ErrorRate*100, r.Errors)
+	fmt.Fprintln(w, "----------------------------------")
+}
+
+func (r report) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
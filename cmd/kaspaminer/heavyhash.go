@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/kaspanet/kaspad/domain/consensus/utils/hashes"
+)
+
+// kaspad's pow package only works from a full block header, a stratum miner
+// only gets the pre pow hash. This is the same kHeavyHash built on kaspad's
+// hash writers, checked against pow.State in the tests
+
+type matrix [64][64]uint16
+
+// powHasher computes pow values for a single job, the matrix only depends
+// on the pre pow hash so it's generated once up front
+type powHasher struct {
+	prePowHash [32]byte
+	mat        *matrix
+}
+
+func newPowHasher(prePowHash [32]byte) *powHasher {
+	return &powHasher{prePowHash: prePowHash, mat: generateMatrix(prePowHash)}
+}
+
+// value is the pow value of the job at the given nonce, compared against
+// the target the same way kaspad does
+func (h *powHasher) value(timestamp int64, nonce uint64) *big.Int {
+	// PRE_POW_HASH || TIME || 32 zero byte padding || NONCE
+	var buf [8]byte
+	writer := hashes.NewPoWHashWriter()
+	writer.InfallibleWrite(h.prePowHash[:])
+	binary.LittleEndian.PutUint64(buf[:], uint64(timestamp))
+	writer.InfallibleWrite(buf[:])
+	writer.InfallibleWrite(make([]byte, 32))
+	binary.LittleEndian.PutUint64(buf[:], nonce)
+	writer.InfallibleWrite(buf[:])
+	powHash := writer.Finalize().ByteArray()
+
+	heavy := h.mat.heavyHash(*powHash)
+	// the hash is little endian for pow purposes
+	for i := 0; i < len(heavy)/2; i++ {
+		heavy[i], heavy[len(heavy)-1-i] = heavy[len(heavy)-1-i], heavy[i]
+	}
+	return new(big.Int).SetBytes(heavy[:])
+}
+
+func generateMatrix(hash [32]byte) *matrix {
+	var mat matrix
+	generator := newXoShiRo256PlusPlus(hash)
+	for {
+		for i := range mat {
+			for j := 0; j < 64; j += 16 {
+				val := generator.Uint64()
+				for shift := 0; shift < 16; shift++ {
+					mat[i][j+shift] = uint16(val >> (4 * shift) & 0x0F)
+				}
+			}
+		}
+		if mat.computeRank() == 64 {
+			return &mat
+		}
+	}
+}
+
+func (mat *matrix) computeRank() int {
+	const eps = 1e-9
+	var b [64][64]float64
+	for i := range b {
+		for j := range b[0] {
+			b[i][j] = float64(mat[i][j])
+		}
+	}
+	var rank int
+	var rowSelected [64]bool
+	for i := 0; i < 64; i++ {
+		var j int
+		for j = 0; j < 64; j++ {
+			if !rowSelected[j] && math.Abs(b[j][i]) > eps {
+				break
+			}
+		}
+		if j != 64 {
+			rank++
+			rowSelected[j] = true
+			for p := i + 1; p < 64; p++ {
+				b[j][p] /= b[j][i]
+			}
+			for k := 0; k < 64; k++ {
+				if k != j && math.Abs(b[k][i]) > eps {
+					for p := i + 1; p < 64; p++ {
+						b[k][p] -= b[j][p] * b[k][i]
+					}
+				}
+			}
+		}
+	}
+	return rank
+}
+
+func (mat *matrix) heavyHash(hash [32]byte) [32]byte {
+	var vector [64]uint16
+	var product [64]uint16
+	for i := 0; i < 32; i++ {
+		vector[2*i] = uint16(hash[i] >> 4)
+		vector[2*i+1] = uint16(hash[i] & 0x0F)
+	}
+	for i := 0; i < 64; i++ {
+		var sum uint16
+		for j := 0; j < 64; j++ {
+			sum += mat[i][j] * vector[j]
+		}
+		product[i] = sum >> 10
+	}
+	var res [32]byte
+	for i := range res {
+		res[i] = hash[i] ^ (byte(product[2*i]<<4) | byte(product[2*i+1]))
+	}
+	writer := hashes.NewHeavyHashWriter()
+	writer.InfallibleWrite(res[:])
+	return *writer.Finalize().ByteArray()
+}
+
+type xoShiRo256PlusPlus struct {
+	s0, s1, s2, s3 uint64
+}
+
+func newXoShiRo256PlusPlus(hash [32]byte) *xoShiRo256PlusPlus {
+	return &xoShiRo256PlusPlus{
+		s0: binary.LittleEndian.Uint64(hash[:8]),
+		s1: binary.LittleEndian.Uint64(hash[8:16]),
+		s2: binary.LittleEndian.Uint64(hash[16:24]),
+		s3: binary.LittleEndian.Uint64(hash[24:32]),
+	}
+}
+
+func (x *xoShiRo256PlusPlus) Uint64() uint64 {
+	res := bits.RotateLeft64(x.s0+x.s3, 23) + x.s0
+	t := x.s1 << 17
+	x.s2 ^= x.s0
+	x.s3 ^= x.s1
+	x.s1 ^= x.s2
+	x.s0 ^= x.s3
+	x.s2 ^= t
+	x.s3 = bits.RotateLeft64(x.s3, 45)
+	return res
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// kaspaminer is a reference CPU miner for testing the bridge end to end on
+// devnets/simnets, it's far too slow for mainnet
+func main() {
+	cfg := minerConfig{}
+	flag.StringVar(&cfg.Address, "bridge", "localhost:5555", "stratum address of the bridge")
+	flag.StringVar(&cfg.Worker, "worker", "", "wallet.worker to mine as")
+	flag.StringVar(&cfg.Password, "password", "x", "password to authorize with")
+	flag.StringVar(&cfg.UserAgent, "agent", "kaspaminer/1.0", "user agent sent in mining.subscribe, e.g. BzMiner to get large jobs")
+	flag.IntVar(&cfg.Threads, "threads", runtime.NumCPU(), "number of hashing threads")
+	flag.Float64Var(&cfg.Diff, "diff", 0, "share difficulty to mine at in place of the bridge's, for devnets where blocks are easier than the minimum share diff. 0 follows set_difficulty")
+	flag.DurationVar(&cfg.StatsInterval, "stats", 10*time.Second, "how often to print hashrate and share counts, 0 to disable")
+	flag.Parse()
+	if cfg.Worker == "" {
+		log.Println("-worker is required")
+		os.Exit(1)
+	}
+	if cfg.Threads < 1 {
+		cfg.Threads = 1
+	}
+
+	log.Println("----------------------------------")
+	log.Printf("initializing miner")
+	log.Printf("\tbridge:          %s", cfg.Address)
+	log.Printf("\tworker:          %s", cfg.Worker)
+	log.Printf("\tuser agent:      %s", cfg.UserAgent)
+	log.Printf("\tthreads:         %d", cfg.Threads)
+	if cfg.Diff > 0 {
+		log.Printf("\tdiff override:   %g", cfg.Diff)
+	}
+	log.Println("----------------------------------")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	for {
+		if err := newMiner(cfg).run(ctx); err != nil {
+			log.Printf("%s, reconnecting in 5s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
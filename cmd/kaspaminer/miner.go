@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/kaspastratum"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+const (
+	subscribeId = 1
+	authorizeId = 2
+	// nonces hashed between checks for new work
+	hashBatch = 256
+)
+
+type minerConfig struct {
+	Address   string
+	Worker    string // wallet.worker
+	Password  string
+	UserAgent string
+	Threads   int
+	// Diff overrides the difficulty sent by the bridge, 0 to follow it
+	Diff          float64
+	StatsInterval time.Duration
+}
+
+// job is a mining.notify in either of the formats the bridge sends
+type job struct {
+	id         string
+	prePowHash [32]byte
+	timestamp  int64
+}
+
+// work is everything the hashing threads need, replaced as a whole whenever
+// the job, difficulty or extranonce changes
+type work struct {
+	job        job
+	hasher     *powHasher
+	target     *big.Int
+	extranonce string
+	prefix     uint64 // extranonce shifted into the top of the nonce
+	mask       uint64 // bits of the nonce the miner is free to set
+}
+
+type miner struct {
+	cfg        minerConfig
+	conn       net.Conn
+	writeLock  sync.Mutex
+	nextId     atomic.Int64
+	lock       sync.Mutex // guards everything below
+	job        *job
+	diff       float64
+	extranonce string
+	work       *work
+	changed    chan struct{} // closed when work is replaced
+	hashes     atomic.Uint64
+	accepted   atomic.Uint64
+	rejected   atomic.Uint64
+}
+
+func newMiner(cfg minerConfig) *miner {
+	m := &miner{cfg: cfg, diff: 1, changed: make(chan struct{})}
+	m.nextId.Store(authorizeId)
+	return m
+}
+
+// run mines until the context is cancelled or the connection drops
+func (m *miner) run(ctx context.Context) error {
+	conn, err := net.DialTimeout("tcp", m.cfg.Address, 10*time.Second)
+	if err != nil {
+		return errors.Wrap(err, "failed connecting to bridge")
+	}
+	m.conn = conn
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := m.send(subscribeId, "mining.subscribe", m.cfg.UserAgent); err != nil {
+		return err
+	}
+	if err := m.send(authorizeId, "mining.authorize", m.cfg.Worker, m.cfg.Password); err != nil {
+		return err
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.cfg.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.mine(ctx)
+		}()
+	}
+	if m.cfg.StatsInterval > 0 {
+		go m.reportStats(ctx)
+	}
+	err = m.readLoop()
+	cancel()
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (m *miner) send(id int64, method string, params ...any) error {
+	raw, err := json.Marshal(map[string]any{"id": id, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = m.conn.Write(append(raw, '\n'))
+	return errors.Wrapf(err, "failed sending %s", method)
+}
+
+// message is either a request from the bridge or a reply to one of ours
+type message struct {
+	Id     any    `json:"id"`
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+	Result any    `json:"result"`
+	Error  any    `json:"error"`
+}
+
+func (m *miner) readLoop() error {
+	reader := bufio.NewReader(m.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return errors.Wrap(err, "connection to bridge lost")
+		}
+		line = bytes.Trim(line, "\x00\r\n\t ")
+		if len(line) == 0 {
+			continue
+		}
+		msg := message{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber() // job words are full uint64s
+		if err := decoder.Decode(&msg); err != nil {
+			log.Printf("ignoring malformed message from bridge: %s", line)
+			continue
+		}
+		if err := m.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *miner) handle(msg message) error {
+	switch msg.Method {
+	case "mining.notify":
+		j, err := parseJob(msg.Params)
+		if err != nil {
+			log.Printf("bad job from bridge: %s", err)
+			return nil
+		}
+		m.update(func() { m.job = &j })
+	case "mining.set_difficulty":
+		if len(msg.Params) > 0 {
+			if diff, err := parseFloat(msg.Params[0]); err == nil && diff > 0 {
+				m.update(func() { m.diff = diff })
+			}
+		}
+	case "set_extranonce", "mining.set_extranonce":
+		if len(msg.Params) > 0 {
+			if extranonce, ok := msg.Params[0].(string); ok && len(extranonce) < 16 {
+				m.update(func() { m.extranonce = extranonce })
+			}
+		}
+	case "":
+		return m.handleReply(msg)
+	}
+	return nil
+}
+
+func (m *miner) handleReply(msg message) error {
+	id, _ := parseUint(msg.Id)
+	switch {
+	case id == subscribeId:
+		if msg.Error != nil {
+			return fmt.Errorf("subscribe refused: %v", msg.Error)
+		}
+	case id == authorizeId:
+		if msg.Error != nil || msg.Result != true {
+			return fmt.Errorf("authorize refused: %v", msg.Error)
+		}
+		log.Printf("authorized as %s", m.cfg.Worker)
+	case msg.Result == true:
+		m.accepted.Inc()
+	default:
+		m.rejected.Inc()
+		log.Printf("share %d rejected: %v", id, msg.Error)
+	}
+	return nil
+}
+
+// update applies a change and hands the threads fresh work
+func (m *miner) update(change func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	change()
+	if m.job == nil {
+		return
+	}
+	diff := m.diff
+	if m.cfg.Diff > 0 {
+		diff = m.cfg.Diff
+	}
+	w := &work{
+		job:        *m.job,
+		target:     kaspastratum.DiffToTarget(diff),
+		extranonce: m.extranonce,
+		mask:       ^uint64(0),
+	}
+	if m.work != nil && m.work.job.prePowHash == w.job.prePowHash {
+		w.hasher = m.work.hasher
+	} else {
+		w.hasher = newPowHasher(w.job.prePowHash)
+	}
+	if bits := uint(len(w.extranonce) * 4); bits > 0 {
+		prefix, _ := strconv.ParseUint(w.extranonce, 16, 64)
+		w.prefix = prefix << (64 - bits)
+		w.mask = ^uint64(0) >> bits
+	}
+	m.work = w
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *miner) currentWork() (*work, chan struct{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.work, m.changed
+}
+
+// mine hashes the current work from a random starting nonce until the work
+// changes, submitting anything that meets the target
+func (m *miner) mine(ctx context.Context) {
+	for {
+		w, changed := m.currentWork()
+		if w == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+		counter := rand.Uint64()
+	hashing:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				break hashing
+			default:
+			}
+			for i := 0; i < hashBatch; i++ {
+				nonce := w.prefix | (counter & w.mask)
+				counter++
+				if w.hasher.value(w.job.timestamp, nonce).Cmp(w.target) <= 0 {
+					m.submit(w, nonce)
+				}
+			}
+			m.hashes.Add(hashBatch)
+		}
+	}
+}
+
+func (m *miner) submit(w *work, nonce uint64) {
+	noncestr := fmt.Sprintf("%0*x", 16-len(w.extranonce), nonce&w.mask)
+	id := m.nextId.Inc()
+	if err := m.send(id, "mining.submit", m.cfg.Worker, w.job.id, noncestr); err != nil {
+		log.Printf("failed submitting share: %s", err)
+	}
+}
+
+func (m *miner) reportStats(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.StatsInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			hashes := m.hashes.Swap(0)
+			m.lock.Lock()
+			diff := m.diff
+			m.lock.Unlock()
+			log.Printf("%.2f kH/s, diff %g, %d accepted, %d rejected",
+				float64(hashes)/now.Sub(last).Seconds()/1000, diff, m.accepted.Load(), m.rejected.Load())
+			last = now
+		}
+	}
+}
+
+// parseJob reads a mining.notify sent with either GenerateJobHeader (header
+// as 4 little endian uint64s then the timestamp) or GenerateLargeJobParams
+// (header and little endian timestamp as a single hex string)
+func parseJob(params []any) (job, error) {
+	if len(params) < 2 {
+		return job{}, fmt.Errorf("expected at least 2 params, got %d", len(params))
+	}
+	j := job{id: fmt.Sprint(params[0])}
+	switch header := params[1].(type) {
+	case []any:
+		if len(header) != 4 || len(params) < 3 {
+			return job{}, fmt.Errorf("expected 4 header words and a timestamp")
+		}
+		for i, word := range header {
+			val, err := parseUint(word)
+			if err != nil {
+				return job{}, errors.Wrap(err, "bad header word")
+			}
+			binary.LittleEndian.PutUint64(j.prePowHash[i*8:], val)
+		}
+		timestamp, err := parseUint(params[2])
+		if err != nil {
+			return job{}, errors.Wrap(err, "bad timestamp")
+		}
+		j.timestamp = int64(timestamp)
+	case string:
+		raw, err := hex.DecodeString(header)
+		if err != nil || len(raw) != 40 {
+			return job{}, fmt.Errorf("expected 80 hex chars of header and timestamp, got %q", header)
+		}
+		copy(j.prePowHash[:], raw[:32])
+		j.timestamp = int64(binary.LittleEndian.Uint64(raw[32:]))
+	default:
+		return job{}, fmt.Errorf("unknown job format %T", params[1])
+	}
+	return j, nil
+}
+
+func parseUint(v any) (uint64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(n.String(), 10, 64)
+	case float64:
+		return uint64(n), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", v)
+}
+
+func parseFloat(v any) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", v)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
+	"github.com/onemorebsmith/kaspastratum/src/kaspastratum"
+)
+
+func loadExampleBlock(t *testing.T) *appmessage.RPCBlock {
+	raw, err := ioutil.ReadFile("../../src/kaspastratum/example_header.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{}}
+	if err := json.Unmarshal(raw, block.Header); err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+func TestPowHasher(t *testing.T) {
+	block := loadExampleBlock(t)
+	prePowHash, err := kaspastratum.SerializeBlockHeader(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := appmessage.RPCBlockToDomainBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := [32]byte{}
+	copy(hash[:], prePowHash)
+	hasher := newPowHasher(hash)
+	header := converted.Header.ToMutable()
+	for _, nonce := range []uint64{0, 1, 123456789, 0xdeadbeefcafef00d} {
+		header.SetNonce(nonce)
+		expected := pow.NewState(header).CalculateProofOfWorkValue()
+		if got := hasher.value(header.TimeInMilliseconds(), nonce); got.Cmp(expected) != 0 {
+			t.Errorf("nonce %x: expected pow %x, got %x", nonce, expected, got)
+		}
+	}
+}
+
+// decodeParams round trips notify params through json the way they arrive
+// from the bridge
+func decodeParams(t *testing.T, params ...any) []any {
+	raw, _ := json.Marshal(params)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var decoded []any
+	if err := decoder.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestParseJob(t *testing.T) {
+	header, err := kaspastratum.SerializeBlockHeader(loadExampleBlock(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const timestamp = 1662696346123
+	for name, params := range map[string][]any{
+		"standard": decodeParams(t, "7", kaspastratum.GenerateJobHeader(header), timestamp),
+		"large":    decodeParams(t, "7", kaspastratum.GenerateLargeJobParams(header, timestamp)),
+	} {
+		j, err := parseJob(params)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if j.id != "7" || !bytes.Equal(j.prePowHash[:], header) || j.timestamp != timestamp {
+			t.Errorf("%s: decoded job %s %x %d", name, j.id, j.prePowHash, j.timestamp)
+		}
+	}
+	if _, err := parseJob(decodeParams(t, "7", "abcd")); err == nil {
+		t.Errorf("expected short large job to be rejected")
+	}
+}
+
+// TestMineBlocks mines against a bridge backed by the fake kaspad, once with
+// each job format, until both miners have found a block
+func TestMineBlocks(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().String()
+	free.Close()
+
+	fake := kaspastratum.NewFakeKaspad(1e-6)
+	// never stopped, goes away with the test binary
+	go kaspastratum.ListenAndServe(kaspastratum.BridgeConfig{
+		StratumPort:    port,
+		RPCServer:      "fake",
+		KaspadDialer:   fake.Dial,
+		LogLevel:       "error",
+		MinShareDiff:   1,
+		ExtranonceSize: 2,
+		StaleWindow:    8,
+		BlockWaitTime:  time.Second,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	miners := []*miner{}
+	for _, agent := range []string{"kaspaminer/1.0", "BzMiner-v13.1.0"} {
+		m := newMiner(minerConfig{
+			Address:   port,
+			Worker:    "kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.test",
+			UserAgent: agent,
+			Threads:   1,
+			Diff:      1e-6, // blocks are easier than the bridge's shares
+		})
+		miners = append(miners, m)
+		go func() {
+			for ctx.Err() == nil { // the bridge may not be up yet
+				m.run(ctx)
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+	}
+	for ctx.Err() == nil && (miners[0].accepted.Load() == 0 || miners[1].accepted.Load() == 0) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i, m := range miners {
+		if m.accepted.Load() == 0 {
+			t.Errorf("miner %d found no blocks, %d rejected", i, m.rejected.Load())
+		}
+	}
+	if blocks := fake.Blocks(); len(blocks) < 2 {
+		t.Errorf("expected at least 2 blocks at kaspad, got %d", len(blocks))
+	}
+}
@@ -0,0 +1,292 @@
+package gostratum
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// offense counters are swept for expired entries past this many ips so
+// scanners hitting from all over don't grow the map forever
+const maxTrackedOffenders = 10000
+
+// Offense is misbehaviour that counts toward an automatic ban
+type Offense string
+
+const (
+	OffenseNoAddress     Offense = "no_address"     // connected but never authorized
+	OffenseMalformed     Offense = "malformed_json" // sent something that isn't json-rpc
+	OffenseInvalidShares Offense = "invalid_share"  // share failing pow or diff checks
+	OffenseUnauthorized  Offense = "unauthorized"   // authorize refused by policy
+)
+
+var (
+	ErrorDenied         = fmt.Errorf("address denied")
+	ErrorBanned         = fmt.Errorf("address banned")
+	ErrorTooManyConns   = fmt.Errorf("connection limit reached")
+	ErrorTooManyForIP   = fmt.Errorf("per ip connection limit reached")
+	ErrorAcceptThrottle = fmt.Errorf("accept rate limited")
+)
+
+// AdmissionConfig controls which connections the listener accepts. Zero
+// values disable the respective check
+type AdmissionConfig struct {
+	MaxConns      int
+	MaxConnsPerIP int
+	AcceptRate    float64  // new connections per second across all ips
+	Allow         []string // cidrs or ips, if set nothing else may connect
+	Deny          []string // cidrs or ips
+	// an ip committing BanThreshold offenses of the same kind within
+	// BanWindow is banned for BanDuration
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	// optional hooks, mostly for metrics
+	OnReject func(ip string, reason error)
+	OnBan    func(ban Ban)
+}
+
+type Ban struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type offenseCount struct {
+	count   int
+	started time.Time
+}
+
+// Admission tracks open connections, bans and offenses per ip. A nil
+// *Admission admits everything
+type Admission struct {
+	cfg      AdmissionConfig
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	lock     sync.Mutex
+	conns    map[string]int
+	total    int
+	bans     map[string]Ban
+	offenses map[string]map[Offense]*offenseCount
+	tokens   float64
+	lastFill time.Time
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cidr %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func NewAdmission(cfg AdmissionConfig) (*Admission, error) {
+	allow, err := parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing allow list")
+	}
+	deny, err := parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing deny list")
+	}
+	return &Admission{
+		cfg:      cfg,
+		allow:    allow,
+		deny:     deny,
+		conns:    map[string]int{},
+		bans:     map[string]Ban{},
+		offenses: map[string]map[Offense]*offenseCount{},
+		tokens:   acceptBurst(cfg.AcceptRate),
+		lastFill: time.Now(),
+	}, nil
+}
+
+// up to a second's worth of connections can arrive at once
+func acceptBurst(rate float64) float64 {
+	return math.Max(1, math.Ceil(rate))
+}
+
+func matchesAny(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Admit decides whether a new connection from ip is accepted, on success
+// the connection counts against the limits until Release is called
+func (a *Admission) Admit(ip string) error {
+	if a == nil {
+		return nil
+	}
+	err := a.admit(ip, time.Now())
+	if err != nil && a.cfg.OnReject != nil {
+		a.cfg.OnReject(ip, err)
+	}
+	return err
+}
+
+func (a *Admission) admit(ip string, now time.Time) error {
+	parsed := net.ParseIP(ip)
+	if parsed != nil && matchesAny(a.deny, parsed) {
+		return ErrorDenied
+	}
+	if len(a.allow) > 0 && (parsed == nil || !matchesAny(a.allow, parsed)) {
+		return ErrorDenied
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if ban, banned := a.bans[ip]; banned {
+		if now.Before(ban.Expires) {
+			return ErrorBanned
+		}
+		delete(a.bans, ip)
+	}
+	if a.cfg.MaxConns > 0 && a.total >= a.cfg.MaxConns {
+		return ErrorTooManyConns
+	}
+	if a.cfg.MaxConnsPerIP > 0 && a.conns[ip] >= a.cfg.MaxConnsPerIP {
+		return ErrorTooManyForIP
+	}
+	if a.cfg.AcceptRate > 0 {
+		burst := acceptBurst(a.cfg.AcceptRate)
+		a.tokens = math.Min(burst, a.tokens+now.Sub(a.lastFill).Seconds()*a.cfg.AcceptRate)
+		a.lastFill = now
+		if a.tokens < 1 {
+			return ErrorAcceptThrottle
+		}
+		a.tokens--
+	}
+	a.conns[ip]++
+	a.total++
+	return nil
+}
+
+// Release frees the slot taken by an admitted connection
+func (a *Admission) Release(ip string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.conns[ip] <= 0 {
+		return
+	}
+	a.total--
+	if a.conns[ip]--; a.conns[ip] == 0 {
+		delete(a.conns, ip)
+	}
+}
+
+// RecordOffense counts misbehaviour from ip, returning true if it tipped
+// the ip into a ban
+func (a *Admission) RecordOffense(ip string, offense Offense) bool {
+	if a == nil || a.cfg.BanThreshold <= 0 {
+		return false
+	}
+	now := time.Now()
+	a.lock.Lock()
+	if len(a.offenses) > maxTrackedOffenders {
+		a.sweepOffenses(now)
+	}
+	byType, exists := a.offenses[ip]
+	if !exists {
+		byType = map[Offense]*offenseCount{}
+		a.offenses[ip] = byType
+	}
+	count, exists := byType[offense]
+	if !exists || now.Sub(count.started) > a.cfg.BanWindow {
+		count = &offenseCount{started: now}
+		byType[offense] = count
+	}
+	count.count++
+	if count.count < a.cfg.BanThreshold {
+		a.lock.Unlock()
+		return false
+	}
+	delete(a.offenses, ip)
+	a.lock.Unlock()
+
+	a.Ban(ip, a.cfg.BanDuration, fmt.Sprintf("%d %s offenses within %s", count.count, offense, a.cfg.BanWindow))
+	return true
+}
+
+func (a *Admission) sweepOffenses(now time.Time) {
+	for ip, byType := range a.offenses {
+		for offense, count := range byType {
+			if now.Sub(count.started) > a.cfg.BanWindow {
+				delete(byType, offense)
+			}
+		}
+		if len(byType) == 0 {
+			delete(a.offenses, ip)
+		}
+	}
+}
+
+// Ban blocks new connections from ip for the given duration. Existing
+// connections are left to the caller to deal with
+func (a *Admission) Ban(ip string, duration time.Duration, reason string) Ban {
+	now := time.Now()
+	ban := Ban{IP: ip, Reason: reason, Created: now, Expires: now.Add(duration)}
+	a.lock.Lock()
+	a.bans[ip] = ban
+	a.lock.Unlock()
+	if a.cfg.OnBan != nil {
+		a.cfg.OnBan(ban)
+	}
+	return ban
+}
+
+// Unban lifts a ban, returning false if the ip wasn't banned
+func (a *Admission) Unban(ip string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, banned := a.bans[ip]
+	delete(a.bans, ip)
+	delete(a.offenses, ip)
+	return banned
+}
+
+// Bans lists active bans, soonest to expire first
+func (a *Admission) Bans() []Ban {
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	bans := []Ban{}
+	for ip, ban := range a.bans {
+		if !now.Before(ban.Expires) {
+			delete(a.bans, ip)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Expires.Before(bans[j].Expires) })
+	return bans
+}
@@ -0,0 +1,124 @@
+package gostratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	a, err := NewAdmission(AdmissionConfig{MaxConns: 3, MaxConnsPerIP: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Admit("10.0.0.1"); err != nil {
+		t.Fatalf("unexpected rejection: %s", err)
+	}
+	if err := a.Admit("10.0.0.1"); err != nil {
+		t.Fatalf("unexpected rejection: %s", err)
+	}
+	if err := a.Admit("10.0.0.1"); err != ErrorTooManyForIP {
+		t.Fatalf("expected per ip limit, got %v", err)
+	}
+	if err := a.Admit("10.0.0.2"); err != nil {
+		t.Fatalf("unexpected rejection: %s", err)
+	}
+	if err := a.Admit("10.0.0.3"); err != ErrorTooManyConns {
+		t.Fatalf("expected global limit, got %v", err)
+	}
+	a.Release("10.0.0.1")
+	if err := a.Admit("10.0.0.3"); err != nil {
+		t.Fatalf("slot not freed by release: %s", err)
+	}
+	a.Release("10.0.0.9") // never admitted, must not free anything
+	if err := a.Admit("10.0.0.4"); err != ErrorTooManyConns {
+		t.Fatalf("expected global limit, got %v", err)
+	}
+}
+
+func TestAdmissionCIDRs(t *testing.T) {
+	if _, err := NewAdmission(AdmissionConfig{Deny: []string{"not-an-ip"}}); err == nil {
+		t.Fatalf("expected invalid deny entry to error")
+	}
+	a, err := NewAdmission(AdmissionConfig{
+		Allow: []string{"10.0.0.0/8", "192.168.1.5"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]error{
+		"10.0.0.1":    nil,
+		"192.168.1.5": nil,
+		"192.168.1.6": ErrorDenied,
+		"10.1.2.3":    ErrorDenied,
+		"8.8.8.8":     ErrorDenied,
+	}
+	for ip, expected := range cases {
+		if err := a.Admit(ip); err != expected {
+			t.Errorf("%s: expected %v, got %v", ip, expected, err)
+		}
+	}
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{AcceptRate: 2})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := a.admit("10.0.0.1", now); err != nil {
+			t.Fatalf("burst rejected: %s", err)
+		}
+	}
+	if err := a.admit("10.0.0.1", now); err != ErrorAcceptThrottle {
+		t.Fatalf("expected throttle, got %v", err)
+	}
+	if err := a.admit("10.0.0.1", now.Add(600*time.Millisecond)); err != nil {
+		t.Fatalf("bucket didn't refill: %s", err)
+	}
+}
+
+func TestAdmissionBans(t *testing.T) {
+	var banned []Ban
+	a, _ := NewAdmission(AdmissionConfig{
+		BanThreshold: 3,
+		BanWindow:    time.Minute,
+		BanDuration:  time.Hour,
+		OnBan:        func(ban Ban) { banned = append(banned, ban) },
+	})
+	// offenses of different kinds are counted separately
+	a.RecordOffense("10.0.0.1", OffenseMalformed)
+	a.RecordOffense("10.0.0.1", OffenseNoAddress)
+	if a.RecordOffense("10.0.0.1", OffenseMalformed) {
+		t.Fatalf("banned before threshold")
+	}
+	if !a.RecordOffense("10.0.0.1", OffenseMalformed) {
+		t.Fatalf("expected ban at threshold")
+	}
+	if err := a.Admit("10.0.0.1"); err != ErrorBanned {
+		t.Fatalf("expected banned ip to be rejected, got %v", err)
+	}
+	if bans := a.Bans(); len(bans) != 1 || bans[0].IP != "10.0.0.1" || len(banned) != 1 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	if !a.Unban("10.0.0.1") || a.Unban("10.0.0.1") {
+		t.Fatalf("unban should succeed exactly once")
+	}
+	if err := a.Admit("10.0.0.1"); err != nil {
+		t.Fatalf("unbanned ip rejected: %s", err)
+	}
+
+	a.Ban("10.0.0.2", -time.Second, "already expired")
+	if err := a.Admit("10.0.0.2"); err != nil {
+		t.Fatalf("expired ban still enforced: %s", err)
+	}
+}
+
+func TestNilAdmission(t *testing.T) {
+	var a *Admission
+	if err := a.Admit("10.0.0.1"); err != nil {
+		t.Fatalf("nil admission should admit everything")
+	}
+	a.Release("10.0.0.1")
+	if a.RecordOffense("10.0.0.1", OffenseMalformed) {
+		t.Fatalf("nil admission should never ban")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/kaspanet/kaspad/util"
 	"github.com/mattn/go-colorable"
@@ -47,29 +48,59 @@ func DefaultHandlers() StratumHandlerMap {
 	}
 }
 
-func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+// AuthorizeRequest is the parsed form of a mining.authorize call, Wallet is
+// left as sent by the miner
+type AuthorizeRequest struct {
+	Wallet   string
+	Worker   string
+	Password string
+}
+
+func ParseAuthorize(event JsonRpcEvent) (AuthorizeRequest, error) {
+	req := AuthorizeRequest{}
 	if len(event.Params) < 1 {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address")
+		return req, fmt.Errorf("malformed event from miner, expected param[1] to be address")
 	}
 	address, ok := event.Params[0].(string)
 	if !ok {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address string")
+		return req, fmt.Errorf("malformed event from miner, expected param[1] to be address string")
 	}
+	req.Wallet = address
 	parts := strings.Split(address, ".")
-	var workerName string
 	if len(parts) >= 2 {
-		address = parts[0]
-		workerName = parts[1]
+		req.Wallet = parts[0]
+		req.Worker = parts[1]
 	}
-	var err error
-	address, err = CleanWallet(address)
+	if len(event.Params) >= 2 {
+		req.Password, _ = event.Params[1].(string)
+	}
+	return req, nil
+}
+
+func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+	req, err := ParseAuthorize(event)
+	if err != nil {
+		return err
+	}
+	address, err := CleanWallet(req.Wallet)
 	if err != nil {
-		return fmt.Errorf("invalid wallet format %s: %w", address, err)
+		return fmt.Errorf("invalid wallet format %s: %w", req.Wallet, err)
 	}
+	return CompleteAuthorize(ctx, event, address, req.Worker)
+}
 
+// CompleteAuthorize binds the worker to the wallet and acks the authorize,
+// for handlers that have done their own checks on the request. The binding
+// is fixed once made, a repeat authorize is acked without changing it
+func CompleteAuthorize(ctx *StratumContext, event JsonRpcEvent, address, workerName string) error {
+	if ctx.Authorized() {
+		ctx.Logger.Info("ignoring repeat authorize", zap.String("address", address), zap.String("requested_worker", workerName))
+		return errors.Wrap(ctx.Reply(NewResponse(event, true, nil)), "failed to send response to authorize")
+	}
 	ctx.WalletAddr = address
 	ctx.WorkerName = workerName
 	ctx.Logger = ctx.Logger.With(zap.String("worker", ctx.WorkerName), zap.String("addr", ctx.WalletAddr))
+	atomic.StoreInt32(&ctx.authorized, 1)
 
 	if err := ctx.Reply(NewResponse(event, true, nil)); err != nil {
 		return errors.Wrap(err, "failed to send response to authorize")
@@ -87,7 +118,9 @@ func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
 		[]any{true, "EthereumStratum/1.0.0"}, nil)); err != nil {
 		return errors.Wrap(err, "failed to send response to subscribe")
 	}
-	if len(event.Params) > 0 {
+	// the user agent is read by other goroutines once authorized, a late
+	// subscribe doesn't get to change it
+	if len(event.Params) > 0 && !ctx.Authorized() {
 		app, ok := event.Params[0].(string)
 		if ok {
 			ctx.RemoteApp = app
@@ -123,7 +156,7 @@ func CleanWallet(in string) (string, error) {
 	}
 
 	// has kaspa: prefix but other weirdness somewhere
-	if walletRegex.MatchString(in) {
+	if walletRegex.MatchString(in) && len(in) >= 67 {
 		return in[0:67], nil
 	}
 	return "", errors.New("unable to coerce wallet to valid kaspa address")
@@ -1,19 +1,25 @@
 package gostratum
 
 import (
-	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type MockConnection struct {
-	id      string
-	lock    sync.Mutex // to prevent double closing of channel
-	inChan  chan []byte
-	outChan chan []byte
+	id            string
+	lock          sync.Mutex // guards the deadlines
+	inChan        chan []byte
+	outChan       chan []byte
+	closed        chan struct{}
+	closeOnce     sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+	unread        []byte // data written to the read buffer that didn't fit in the last Read
 }
 
 var channelCounter int32
@@ -24,45 +30,87 @@ func NewMockConnection() *MockConnection {
 		lock:    sync.Mutex{},
 		inChan:  make(chan []byte),
 		outChan: make(chan []byte),
+		closed:  make(chan struct{}),
 	}
 }
 
 func (mc *MockConnection) AsyncWriteTestDataToReadBuffer(s string) {
-	go func() {
-		mc.inChan <- []byte(s)
-	}()
+	go mc.WriteTestDataToReadBuffer(s)
 }
 
+// WriteTestDataToReadBuffer blocks until the data has been picked up by a
+// Read, use this over the async version when ordering of writes matters.
+// Data written after the connection is closed is dropped
+func (mc *MockConnection) WriteTestDataToReadBuffer(s string) {
+	select {
+	case mc.inChan <- []byte(s):
+	case <-mc.closed:
+	}
+}
+
+// ReadTestDataFromBuffer passes the next write to handler, or nil once the
+// connection is closed
 func (mc *MockConnection) ReadTestDataFromBuffer(handler func([]byte)) {
-	read := <-mc.outChan
-	handler(read)
+	select {
+	case read := <-mc.outChan:
+		handler(read)
+	case <-mc.closed:
+		handler(nil)
+	}
 }
 
 func (mc *MockConnection) AsyncReadTestDataFromBuffer(handler func([]byte)) {
-	go func() {
-		read := <-mc.outChan
-		handler(read)
-	}()
+	go mc.ReadTestDataFromBuffer(handler)
+}
+
+// deadline returns a channel firing at t, nil (never fires) for no deadline
+func deadline(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
 }
 
 func (mc *MockConnection) Read(b []byte) (int, error) {
-	data, ok := <-mc.inChan
-	if !ok {
-		return 0, context.DeadlineExceeded
+	if len(mc.unread) > 0 {
+		n := copy(b, mc.unread)
+		mc.unread = mc.unread[n:]
+		return n, nil
+	}
+	mc.lock.Lock()
+	timeout, stop := deadline(mc.readDeadline)
+	mc.lock.Unlock()
+	defer stop()
+	select {
+	case data := <-mc.inChan:
+		n := copy(b, data)
+		mc.unread = data[n:]
+		return n, nil
+	case <-mc.closed:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
 	}
-	return copy(b, data), nil
 }
 
 func (mc *MockConnection) Write(b []byte) (int, error) {
-	mc.outChan <- b
-	return len(b), nil
+	mc.lock.Lock()
+	timeout, stop := deadline(mc.writeDeadline)
+	mc.lock.Unlock()
+	defer stop()
+	select {
+	case mc.outChan <- b:
+		return len(b), nil
+	case <-mc.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
 }
 
 func (mc *MockConnection) Close() error {
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
-	close(mc.inChan)
-	close(mc.outChan)
+	mc.closeOnce.Do(func() { close(mc.closed) })
 	return nil
 }
 
@@ -88,25 +136,15 @@ func (mc *MockConnection) SetDeadline(t time.Time) error {
 }
 
 func (mc *MockConnection) SetReadDeadline(t time.Time) error {
-	go func() {
-		mc.lock.Lock()
-		defer mc.lock.Unlock()
-		time.Sleep(time.Until(t))
-		close(mc.inChan)
-		mc.inChan = make(chan []byte)
-	}()
-
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.readDeadline = t
 	return nil
 }
 
 func (mc *MockConnection) SetWriteDeadline(t time.Time) error {
-	go func() {
-		mc.lock.Lock()
-		defer mc.lock.Unlock()
-		time.Sleep(time.Until(t))
-		close(mc.outChan)
-		mc.outChan = make(chan []byte)
-	}()
-
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.writeDeadline = t
 	return nil
 }
@@ -0,0 +1,189 @@
+package gostratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// directions of recorded traffic, relative to the listener
+const (
+	RecordIn  = "in"  // miner -> listener
+	RecordOut = "out" // listener -> miner
+)
+
+// RecordedMessage is a single chunk of traffic as it came off (or went on to)
+// the socket, so fragmented and coalesced messages replay exactly as seen
+type RecordedMessage struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Data      string    `json:"data"`
+}
+
+// redactedPassword stands in for the mining.authorize password in recordings
+const redactedPassword = "redacted"
+
+var sessionCounter int32
+
+// recordingConn tees everything read from and written to the connection into
+// a session file, one json encoded RecordedMessage per line. Inbound chunks
+// are held until they end on a line break so authorize passwords can be
+// redacted before anything hits the disk
+type recordingConn struct {
+	net.Conn
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	held    []RecordedMessage // inbound chunks of an unfinished line
+}
+
+func newRecordingConn(conn net.Conn, dir string) (*recordingConn, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed creating record dir")
+	}
+	addr := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+	name := fmt.Sprintf("%s_%s_%d.jsonl", time.Now().UTC().Format("20060102T150405"), addr,
+		atomic.AddInt32(&sessionCounter, 1))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating session file")
+	}
+	return &recordingConn{Conn: conn, file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (rc *recordingConn) record(direction string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.file == nil {
+		return // closed
+	}
+	msg := RecordedMessage{Time: time.Now(), Direction: direction, Data: string(data)}
+	if direction == RecordOut {
+		rc.encoder.Encode(msg)
+		return
+	}
+	rc.held = append(rc.held, msg)
+	if data[len(data)-1] == '\n' {
+		rc.flushHeld()
+	}
+}
+
+// flushHeld writes the held inbound chunks as they arrived, unless they carry
+// an authorize in which case the redacted lines go out as a single chunk.
+// Caller holds the lock
+func (rc *recordingConn) flushHeld() {
+	if len(rc.held) == 0 {
+		return
+	}
+	var raw strings.Builder
+	for _, msg := range rc.held {
+		raw.WriteString(msg.Data)
+	}
+	if redacted, changed := redactAuthorize(raw.String()); changed {
+		rc.held = []RecordedMessage{{Time: rc.held[0].Time, Direction: RecordIn, Data: redacted}}
+		if redacted == "" {
+			rc.held = nil
+		}
+	}
+	for _, msg := range rc.held {
+		rc.encoder.Encode(msg)
+	}
+	rc.held = nil
+}
+
+// redactAuthorize replaces the password of any mining.authorize in data,
+// reporting whether anything was changed. An authorize that can't be parsed
+// (e.g. cut off by a disconnect) is dropped entirely
+func redactAuthorize(data string) (string, bool) {
+	if !strings.Contains(data, string(StratumMethodAuthorize)) {
+		return data, false
+	}
+	lines := strings.SplitAfter(data, "\n")
+	changed := false
+	for i, line := range lines {
+		if !strings.Contains(line, string(StratumMethodAuthorize)) {
+			continue
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		fields := map[string]json.RawMessage{}
+		method := ""
+		params := []any{}
+		if json.Unmarshal([]byte(trimmed), &fields) != nil ||
+			json.Unmarshal(fields["method"], &method) != nil ||
+			json.Unmarshal(fields["params"], &params) != nil {
+			lines[i], changed = "", true
+			continue
+		}
+		if method != string(StratumMethodAuthorize) || len(params) < 2 {
+			continue
+		}
+		params[1] = redactedPassword
+		fields["params"], _ = json.Marshal(params)
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			lines[i], changed = "", true
+			continue
+		}
+		lines[i], changed = string(encoded)+line[len(trimmed):], true
+	}
+	return strings.Join(lines, ""), changed
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	rc.record(RecordIn, b[:n])
+	return n, err
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	n, err := rc.Conn.Write(b)
+	rc.record(RecordOut, b[:n])
+	return n, err
+}
+
+func (rc *recordingConn) Close() error {
+	rc.lock.Lock()
+	if rc.file != nil {
+		rc.flushHeld()
+		rc.file.Close()
+		rc.file = nil
+	}
+	rc.lock.Unlock()
+	return rc.Conn.Close()
+}
+
+// LoadSession reads a session file written by a listener with RecordDir set
+func LoadSession(path string) ([]RecordedMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening session")
+	}
+	defer file.Close()
+
+	var session []RecordedMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, readBufferSize), DefaultMaxLineLength*4)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		msg := RecordedMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, errors.Wrapf(err, "malformed session line %d", len(session)+1)
+		}
+		session = append(session, msg)
+	}
+	return session, errors.Wrap(scanner.Err(), "failed reading session")
+}
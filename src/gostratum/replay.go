@@ -0,0 +1,272 @@
+package gostratum
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReplayWait = time.Second
+
+// ReplayConfig controls how a recorded session is fed back into a listener
+type ReplayConfig struct {
+	// Wait is how long to wait for the listener to send each message the
+	// recording shows going out before moving on, 0 for a second
+	Wait time.Duration
+	// OnNotify is called where the recording shows a mining.notify going
+	// out, the caller should make the listener send the client a job
+	OnNotify func(ctx *StratumContext)
+}
+
+// ReplayResult is what the listener sent back during a replay
+type ReplayResult struct {
+	Received []string
+}
+
+// replayOutput collects the lines written to the mock connection
+type replayOutput struct {
+	lock     sync.Mutex
+	lines    []string
+	notifies []string // job ids of received mining.notify, in order
+	replies  int
+	updated  chan struct{}
+}
+
+// replayProgress is how much of the recording's output has been matched
+type replayProgress struct {
+	lines, notifies, replies int
+}
+
+func (o *replayOutput) add(data []byte) {
+	o.lock.Lock()
+	for _, line := range splitLines(string(data)) {
+		o.lines = append(o.lines, line)
+		if _, ok := parseResponse(line); ok {
+			o.replies++
+		}
+		if event, ok := parseEvent(line); ok && event.Method == "mining.notify" && len(event.Params) > 0 {
+			o.notifies = append(o.notifies, fmt.Sprint(event.Params[0]))
+		}
+	}
+	o.lock.Unlock()
+	select {
+	case o.updated <- struct{}{}:
+	default:
+	}
+}
+
+// waitFor blocks until the listener has sent at least as much as expected
+// or the wait expires
+func (o *replayOutput) waitFor(expected replayProgress, wait time.Duration) {
+	timeout := time.After(wait)
+	for {
+		o.lock.Lock()
+		done := len(o.lines) >= expected.lines && len(o.notifies) >= expected.notifies && o.replies >= expected.replies
+		o.lock.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-o.updated:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (o *replayOutput) notify(idx int) (string, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if idx >= len(o.notifies) {
+		return "", false
+	}
+	return o.notifies[idx], true
+}
+
+// Replay feeds the miner side of a recorded session to the listener over a
+// MockConnection, pacing it by the listener's replies. Job ids in submits
+// are rewritten to the ids of the jobs sent during the replay. The listener
+// doesn't need to be listening
+func (s *StratumListener) Replay(ctx context.Context, session []RecordedMessage, cfg ReplayConfig) *ReplayResult {
+	if cfg.Wait <= 0 {
+		cfg.Wait = defaultReplayWait
+	}
+	replayCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.workerGroup.Add(1)
+	go s.disconnectListener(replayCtx)
+
+	mc := NewMockConnection()
+	output := &replayOutput{updated: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var data []byte
+			mc.ReadTestDataFromBuffer(func(b []byte) { data = b })
+			if data == nil {
+				return // closed
+			}
+			output.add(data)
+		}
+	}()
+	client := s.newClient(replayCtx, mc)
+
+	jobIds := map[string]string{} // recorded -> replayed
+	expected := replayProgress{}
+	var pending []string // chunks of a line still being sent
+	flush := func() {
+		for _, chunk := range rewriteChunks(pending, jobIds) {
+			mc.WriteTestDataToReadBuffer(chunk)
+		}
+		pending = nil
+	}
+	for i := 0; i < len(session); i++ {
+		if session[i].Direction == RecordIn {
+			// held until the line completes so a submit split over packets
+			// can still have its job id rewritten
+			if pending = append(pending, session[i].Data); strings.HasSuffix(session[i].Data, "\n") {
+				flush()
+			}
+			continue
+		}
+		flush()
+		// everything sent between two miner messages is waited on together.
+		// Jobs are triggered one at a time, once replies to the miner's
+		// earlier messages are in, so their ids pair up in order
+		for ; i < len(session) && session[i].Direction == RecordOut; i++ {
+			for _, line := range splitLines(session[i].Data) {
+				expected.lines++
+				if _, ok := parseResponse(line); ok {
+					expected.replies++
+				}
+				event, ok := parseEvent(line)
+				if !ok || event.Method != "mining.notify" || len(event.Params) == 0 {
+					continue
+				}
+				output.waitFor(replayProgress{replies: expected.replies}, cfg.Wait)
+				if cfg.OnNotify != nil {
+					cfg.OnNotify(client)
+				}
+				output.waitFor(replayProgress{notifies: expected.notifies + 1}, cfg.Wait)
+				if replayed, ok := output.notify(expected.notifies); ok {
+					jobIds[fmt.Sprint(event.Params[0])] = replayed
+				}
+				expected.notifies++
+			}
+		}
+		i--
+		output.waitFor(expected, cfg.Wait)
+	}
+	flush()
+	output.waitFor(expected, cfg.Wait)
+	mc.Close()
+	<-done
+
+	output.lock.Lock()
+	defer output.lock.Unlock()
+	return &ReplayResult{Received: output.lines}
+}
+
+// Mismatches compares the replies received during the replay with those in
+// the recording, matched up by request id. Notifications aren't compared,
+// their contents depend on the node the jobs came from
+func (r *ReplayResult) Mismatches(session []RecordedMessage) []string {
+	received := map[string]JsonRpcResponse{}
+	for _, line := range r.Received {
+		if resp, ok := parseResponse(line); ok {
+			received[fmt.Sprint(resp.Id)] = resp
+		}
+	}
+	var mismatches []string
+	for _, msg := range session {
+		if msg.Direction != RecordOut {
+			continue
+		}
+		for _, line := range splitLines(msg.Data) {
+			recorded, ok := parseResponse(line)
+			if !ok {
+				continue
+			}
+			id := fmt.Sprint(recorded.Id)
+			got, exists := received[id]
+			if !exists {
+				mismatches = append(mismatches, fmt.Sprintf("id %s: no reply, expected %s", id, line))
+				continue
+			}
+			if !reflect.DeepEqual(recorded.Result, got.Result) || !reflect.DeepEqual(recorded.Error, got.Error) {
+				mismatches = append(mismatches, fmt.Sprintf("id %s: expected result %v error %v, got result %v error %v",
+					id, recorded.Result, recorded.Error, got.Result, got.Error))
+			}
+		}
+	}
+	return mismatches
+}
+
+// rewriteChunks rewrites job ids across the chunks as a whole, then splits
+// the result back up at the original chunk boundaries
+func rewriteChunks(chunks []string, jobIds map[string]string) []string {
+	rewritten := rewriteJobIds(strings.Join(chunks, ""), jobIds)
+	split := make([]string, 0, len(chunks))
+	for i, chunk := range chunks {
+		if i == len(chunks)-1 || len(chunk) >= len(rewritten) {
+			split = append(split, rewritten) // last chunk takes any change in length
+			break
+		}
+		split = append(split, rewritten[:len(chunk)])
+		rewritten = rewritten[len(chunk):]
+	}
+	return split
+}
+
+// rewriteJobIds swaps recorded job ids in any complete submit lines in the
+// chunk, everything else passes through untouched
+func rewriteJobIds(data string, jobIds map[string]string) string {
+	if len(jobIds) == 0 || !strings.Contains(data, "mining.submit") {
+		return data
+	}
+	parts := strings.Split(data, "\n")
+	for i, part := range parts[:len(parts)-1] { // the last part may be a fragment
+		event, ok := parseEvent(part)
+		if !ok || event.Method != StratumMethodSubmit || len(event.Params) < 2 {
+			continue
+		}
+		replayed, exists := jobIds[fmt.Sprint(event.Params[1])]
+		if !exists {
+			continue
+		}
+		event.Params[1] = replayed
+		if raw, err := json.Marshal(event); err == nil {
+			parts[i] = string(raw)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func splitLines(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if line = string(bytes.Trim([]byte(line), "\x00\r\t ")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseEvent(line string) (JsonRpcEvent, bool) {
+	event, err := UnmarshalEvent(line)
+	return event, err == nil && event.Method != ""
+}
+
+func parseResponse(line string) (JsonRpcResponse, bool) {
+	if _, isEvent := parseEvent(line); isEvent {
+		return JsonRpcResponse{}, false
+	}
+	resp, err := UnmarshalResponse(line)
+	return resp, err == nil && resp.Id != nil
+}
@@ -1,11 +1,10 @@
 package gostratum
 
 import (
-	"bufio"
 	"bytes"
+	"fmt"
 	"net"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,23 +14,34 @@ import (
 func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumListener) error {
 	defer ctx.Disconnect()
 
+	framer := newLineFramer(connection, s.MaxLineLength)
 	for {
-		err := readFromConnection(connection, func(line string) error {
+		err := framer.readLines(func(line string) error {
 			event, err := UnmarshalEvent(line)
 			if err != nil {
 				ctx.Logger.Error("error unmarshalling event", zap.String("raw", line))
+				ctx.RecordOffense(OffenseMalformed)
 				return err
 			}
 			return s.HandleEvent(ctx, event)
 		})
+		// checked before timeouts, a closed tls conn keeps returning the
+		// deadline error rather than io.EOF
+		if ctx.disconnected() {
+			return nil
+		}
+		if ctx.parentContext.Err() != nil {
+			return ctx.parentContext.Err() // parent context cancelled
+		}
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			continue // expected timeout
 		}
 		if ctx.Err() != nil {
 			return ctx.Err() // context cancelled
 		}
-		if ctx.parentContext.Err() != nil {
-			return ctx.parentContext.Err() // parent context cancelled
+		if errors.Is(err, ErrLineTooLong) {
+			ctx.Logger.Warn("client sent oversized message, disconnecting", zap.Error(err))
+			return err
 		}
 		if err != nil { // actual error
 			ctx.Logger.Error("error reading from socket", zap.Error(err))
@@ -42,23 +52,74 @@ func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumLis
 
 type LineCallback func(line string) error
 
-func readFromConnection(connection net.Conn, cb LineCallback) error {
+const (
+	readBufferSize       = 4096
+	DefaultMaxLineLength = 16 * 1024
+)
+
+var ErrLineTooLong = fmt.Errorf("line exceeds max length")
+
+// lineFramer splits the stream coming off of a connection into newline
+// delimited messages. Partial lines are held between reads so messages
+// split across tcp packets are reassembled rather than dropped
+type lineFramer struct {
+	connection net.Conn
+	maxLine    int
+	readBuffer []byte
+	pending    []byte
+}
+
+func newLineFramer(connection net.Conn, maxLine int) *lineFramer {
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineLength
+	}
+	return &lineFramer{
+		connection: connection,
+		maxLine:    maxLine,
+		readBuffer: make([]byte, readBufferSize),
+	}
+}
+
+// readLines performs a single read from the connection and calls cb for
+// every complete line available, in order
+func (f *lineFramer) readLines(cb LineCallback) error {
 	deadline := time.Now().Add(5 * time.Second).UTC()
-	if err := connection.SetReadDeadline(deadline); err != nil {
+	if err := f.connection.SetReadDeadline(deadline); err != nil {
 		return err
 	}
 
-	buffer := make([]byte, 1024)
-	_, err := connection.Read(buffer)
-	if err != nil {
-		return errors.Wrapf(err, "error reading from connection")
-	}
-	buffer = bytes.ReplaceAll(buffer, []byte("\x00"), nil)
-	scanner := bufio.NewScanner(strings.NewReader(string(buffer)))
-	for scanner.Scan() {
-		if err := cb(scanner.Text()); err != nil {
+	n, readErr := f.connection.Read(f.readBuffer)
+	// process whatever was read before looking at the error, a read can
+	// return data along with EOF
+	data := f.readBuffer[:n]
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			if len(f.pending)+len(data) > f.maxLine {
+				return errors.Wrapf(ErrLineTooLong, "partial line of %d bytes", len(f.pending)+len(data))
+			}
+			f.pending = append(f.pending, data...)
+			break
+		}
+		if len(f.pending)+idx > f.maxLine {
+			return errors.Wrapf(ErrLineTooLong, "line of %d bytes", len(f.pending)+idx)
+		}
+		line := append(f.pending, data[:idx]...)
+		f.pending = f.pending[:0]
+		data = data[idx+1:]
+
+		// some miners pad messages with nulls, strip those along with any
+		// trailing \r
+		line = bytes.Trim(line, "\x00\r\t ")
+		if len(line) == 0 {
+			continue
+		}
+		if err := cb(string(line)); err != nil {
 			return err
 		}
 	}
+	if readErr != nil {
+		return errors.Wrapf(readErr, "error reading from connection")
+	}
 	return nil
 }
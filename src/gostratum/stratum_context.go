@@ -13,20 +13,26 @@ import (
 	"go.uber.org/zap"
 )
 
+// StratumContext is a single miner connection. WalletAddr, WorkerName,
+// RemoteApp and Logger are set by the connection's own goroutine while it
+// handles subscribe and authorize, other goroutines may only read them once
+// Authorized returns true
 type StratumContext struct {
 	parentContext context.Context
 	RemoteAddr    string
 	WalletAddr    string
 	WorkerName    string
 	RemoteApp     string
+	authorized    int32
 	Id            int32
 	Logger        *zap.Logger
 	connection    net.Conn
-	disconnecting bool
+	disconnecting int32
 	onDisconnect  chan *StratumContext
 	State         any // gross, but go generics aren't mature enough this can be typed 😭
 	writeLock     int32
 	Extranonce    string
+	admission     *Admission
 }
 
 type ContextSummary struct {
@@ -39,7 +45,13 @@ type ContextSummary struct {
 var ErrorDisconnected = fmt.Errorf("disconnecting")
 
 func (sc *StratumContext) Connected() bool {
-	return !sc.disconnecting
+	return atomic.LoadInt32(&sc.disconnecting) == 0
+}
+
+// Authorized reports whether the miner has been bound to a wallet, after
+// which its identity no longer changes
+func (sc *StratumContext) Authorized() bool {
+	return atomic.LoadInt32(&sc.authorized) == 1
 }
 
 func (sc *StratumContext) Summary() ContextSummary {
@@ -60,6 +72,7 @@ func NewMockContext(ctx context.Context, logger *zap.Logger, state any) (*Stratu
 		WalletAddr:    uuid.NewString(),
 		WorkerName:    uuid.NewString(),
 		RemoteApp:     "mock.context",
+		authorized:    1,
 		Logger:        logger,
 		connection:    mc,
 	}, mc
@@ -71,7 +84,7 @@ func (sc *StratumContext) String() string {
 }
 
 func (sc *StratumContext) Reply(response JsonRpcResponse) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
 	encoded, err := json.Marshal(response)
@@ -83,7 +96,7 @@ func (sc *StratumContext) Reply(response JsonRpcResponse) error {
 }
 
 func (sc *StratumContext) Send(event JsonRpcEvent) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
 	encoded, err := json.Marshal(event)
@@ -160,14 +173,43 @@ func (sc *StratumContext) ReplyLowDiffShare(id any) error {
 	})
 }
 
+func (sc *StratumContext) ReplyUnauthorized(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, "Unauthorized worker", nil},
+	})
+}
+
 func (sc *StratumContext) Disconnect() {
-	if !sc.disconnecting {
+	if atomic.CompareAndSwapInt32(&sc.disconnecting, 0, 1) {
 		sc.Logger.Info("disconnecting")
-		sc.disconnecting = true
 		if sc.connection != nil {
 			sc.connection.Close()
 		}
-		sc.onDisconnect <- sc
+		if sc.parentContext == nil {
+			sc.onDisconnect <- sc
+			return
+		}
+		// nobody is listening for disconnects once the server has stopped
+		select {
+		case sc.onDisconnect <- sc:
+		case <-sc.parentContext.Done():
+		}
+	}
+}
+
+// disconnected reports whether Disconnect has been called
+func (sc *StratumContext) disconnected() bool {
+	return atomic.LoadInt32(&sc.disconnecting) == 1
+}
+
+// RecordOffense counts misbehaviour against the client's ip, disconnecting
+// it if that earned the ip a ban
+func (sc *StratumContext) RecordOffense(offense Offense) {
+	if sc.admission.RecordOffense(sc.RemoteAddr, offense) {
+		sc.Logger.Warn("banned for repeat offenses", zap.String("offense", string(offense)))
+		go sc.Disconnect()
 	}
 }
 
@@ -179,18 +221,18 @@ func (sc *StratumContext) checkDisconnect(err error) {
 
 // Context interface impl
 
-func (StratumContext) Deadline() (time.Time, bool) {
+func (*StratumContext) Deadline() (time.Time, bool) {
 	return time.Time{}, false
 }
 
-func (StratumContext) Done() <-chan struct{} {
+func (*StratumContext) Done() <-chan struct{} {
 	return nil
 }
 
-func (StratumContext) Err() error {
+func (*StratumContext) Err() error {
 	return nil
 }
 
-func (d StratumContext) Value(key any) any {
+func (d *StratumContext) Value(key any) any {
 	return d.parentContext.Value(key)
 }
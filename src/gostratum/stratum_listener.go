@@ -2,15 +2,20 @@ package gostratum
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// how long a stratum+ssl client has to complete the handshake
+var tlsHandshakeTimeout = 10 * time.Second
+
 type DisconnectChannel chan *StratumContext
 type StateGenerator func() any
 type EventHandler func(ctx *StratumContext, event JsonRpcEvent) error
@@ -32,11 +37,17 @@ type StratumListenerConfig struct {
 	ClientListener StratumClientListener
 	StateGenerator StateGenerator
 	Port           string
+	MaxLineLength  int // max size of a single message from a client, 0 for default
+	TLS            *TLSConfig
+	Admission      *Admission // nil accepts everyone
+	RecordDir      string     // raw traffic of each session is written here if set
 }
 
 type StratumListener struct {
 	StratumListenerConfig
-	shuttingDown      bool
+	shuttingDown      int32
+	serverLock        sync.Mutex
+	servers           []net.Listener
 	disconnectChannel DisconnectChannel
 	stats             StratumStats
 	workerGroup       sync.WaitGroup
@@ -63,34 +74,87 @@ func NewListener(cfg StratumListenerConfig) *StratumListener {
 }
 
 func (s *StratumListener) Listen(ctx context.Context) error {
-	s.shuttingDown = false
+	atomic.StoreInt32(&s.shuttingDown, 0)
 
 	serverContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var servers []net.Listener
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
 	lc := net.ListenConfig{}
-	server, err := lc.Listen(ctx, "tcp", s.Port)
-	if err != nil {
-		return errors.Wrapf(err, "failed listening to socket %s", s.Port)
+	if s.Port != "" {
+		server, err := lc.Listen(ctx, "tcp", s.Port)
+		if err != nil {
+			return errors.Wrapf(err, "failed listening to socket %s", s.Port)
+		}
+		servers = append(servers, server)
 	}
-	defer server.Close()
 
+	if s.TLS != nil && s.TLS.Port != "" {
+		certs, err := newCertReloader(*s.TLS, s.Logger)
+		if err != nil {
+			return errors.Wrap(err, "failed configuring tls")
+		}
+		raw, err := lc.Listen(ctx, "tcp", s.TLS.Port)
+		if err != nil {
+			return errors.Wrapf(err, "failed listening to tls socket %s", s.TLS.Port)
+		}
+		servers = append(servers, tls.NewListener(raw, &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}))
+		go certs.watch(serverContext)
+		s.Logger.Info("listening for stratum+ssl on " + s.TLS.Port)
+	}
+
+	if len(servers) == 0 {
+		return errors.New("no stratum port configured")
+	}
+
+	s.serverLock.Lock()
+	s.servers = servers
+	s.serverLock.Unlock()
+
+	// added up front, an Add racing the Wait below could be missed
+	s.workerGroup.Add(1 + len(servers))
 	go s.disconnectListener(serverContext)
-	go s.tcpListener(serverContext, server)
+	for _, server := range servers {
+		go s.tcpListener(serverContext, server)
+	}
 
 	// block here until the context is killed
 	<-ctx.Done() // context cancelled, so kill the server
-	s.shuttingDown = true
-	server.Close()
+	s.StopAccepting()
 	s.workerGroup.Wait()
 	return context.Canceled
 }
 
-func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
-	addr := connection.RemoteAddr().String()
-	parts := strings.Split(addr, ":")
-	if len(parts) > 0 {
-		addr = parts[0] // trim off the port
+// StopAccepting closes the listening sockets so no new miners can connect.
+// Connected clients are left alone until the context passed to Listen is
+// cancelled, giving the caller a chance to drain them
+func (s *StratumListener) StopAccepting() {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	for _, server := range s.servers {
+		server.Close()
+	}
+	s.servers = nil
+}
+
+func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) *StratumContext {
+	addr := remoteIP(connection)
+	if s.RecordDir != "" {
+		if recorder, err := newRecordingConn(connection, s.RecordDir); err != nil {
+			s.Logger.Warn("not recording session", zap.String("client", addr), zap.Error(err))
+		} else {
+			connection = recorder
+		}
 	}
 	clientContext := &StratumContext{
 		parentContext: ctx,
@@ -99,6 +163,7 @@ func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
 		connection:    connection,
 		State:         s.StateGenerator(),
 		onDisconnect:  s.disconnectChannel,
+		admission:     s.Admission,
 	}
 
 	s.Logger.Info(fmt.Sprintf("new client connecting - %s", addr))
@@ -108,7 +173,7 @@ func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
 	}
 
 	go spawnClientListener(clientContext, connection, s)
-
+	return clientContext
 }
 
 func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) error {
@@ -120,7 +185,6 @@ func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) e
 }
 
 func (s *StratumListener) disconnectListener(ctx context.Context) {
-	s.workerGroup.Add(1)
 	defer s.workerGroup.Done()
 	for {
 		select {
@@ -129,6 +193,7 @@ func (s *StratumListener) disconnectListener(ctx context.Context) {
 		case client := <-s.disconnectChannel:
 			s.Logger.Info(fmt.Sprintf("client disconnecting - %s", client.RemoteAddr))
 			s.stats.Disconnects++
+			s.Admission.Release(client.RemoteAddr)
 			if s.ClientListener != nil {
 				s.ClientListener.OnDisconnect(client)
 			}
@@ -137,18 +202,50 @@ func (s *StratumListener) disconnectListener(ctx context.Context) {
 }
 
 func (s *StratumListener) tcpListener(ctx context.Context, server net.Listener) {
-	s.workerGroup.Add(1)
 	defer s.workerGroup.Done()
 	for { // listen and spin forever
 		connection, err := server.Accept()
 		if err != nil {
-			if s.shuttingDown {
+			if atomic.LoadInt32(&s.shuttingDown) == 1 {
 				s.Logger.Error("stopping listening due to server shutdown")
 				return
 			}
 			s.Logger.Error("failed to accept incoming connection", zap.Error(err))
 			continue
 		}
+		if err := s.Admission.Admit(remoteIP(connection)); err != nil {
+			s.Logger.Debug("rejected connection", zap.String("client", remoteIP(connection)), zap.Error(err))
+			connection.Close()
+			continue
+		}
+		if tlsConn, ok := connection.(*tls.Conn); ok {
+			go s.handshake(ctx, tlsConn) // slow handshakes mustn't hold up accepting
+			continue
+		}
 		s.newClient(ctx, connection)
 	}
 }
+
+// handshake completes the tls handshake before handing the connection off.
+// A tls.Conn remembers a failed handshake and returns the same error from
+// every read, so it has to succeed up front under its own deadline
+func (s *StratumListener) handshake(ctx context.Context, connection *tls.Conn) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := connection.HandshakeContext(handshakeCtx); err != nil {
+		s.Logger.Debug("tls handshake failed", zap.String("client", remoteIP(connection)), zap.Error(err))
+		connection.Close()
+		s.Admission.Release(remoteIP(connection))
+		return
+	}
+	s.newClient(ctx, connection)
+}
+
+// remoteIP is the connection's address without the port
+func remoteIP(connection net.Conn) string {
+	addr := connection.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
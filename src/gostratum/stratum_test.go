@@ -1,13 +1,21 @@
 package gostratum
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/mattn/go-colorable"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -42,9 +50,9 @@ func TestNewClient(t *testing.T) {
 	listener.newClient(ctx, mc)
 	// send in the authorize event
 	event, _ := json.Marshal(NewEvent("1", "mining.authorize", []any{
-		"", "test",
+		"kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.test", "test",
 	}))
-	mc.AsyncWriteTestDataToReadBuffer(string(event))
+	mc.AsyncWriteTestDataToReadBuffer(string(event) + "\n")
 
 	responseReceived := false
 	mc.ReadTestDataFromBuffer(func(b []byte) {
@@ -87,6 +95,10 @@ func TestWalletValidation(t *testing.T) {
 			in:       "qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm,Rig_3784816",
 			expected: "kaspa:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm",
 		},
+		{
+			in:        "kaspa:short",
+			shouldErr: true,
+		},
 	}
 
 	for _, v := range tests {
@@ -99,3 +111,442 @@ func TestWalletValidation(t *testing.T) {
 		}
 	}
 }
+
+func readAllLines(t *testing.T, framer *lineFramer, reads int) []string {
+	var lines []string
+	for i := 0; i < reads; i++ {
+		if err := framer.readLines(func(line string) error {
+			lines = append(lines, line)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return lines
+}
+
+func TestLineFramerFragmented(t *testing.T) {
+	mc := NewMockConnection()
+	framer := newLineFramer(mc, 0)
+	go func() {
+		mc.WriteTestDataToReadBuffer(`{"id":1,"method":"mining.subs`)
+		mc.WriteTestDataToReadBuffer(`cribe","params":[]}`)
+		mc.WriteTestDataToReadBuffer("\n")
+	}()
+
+	lines := readAllLines(t, framer, 3)
+	expected := []string{`{"id":1,"method":"mining.subscribe","params":[]}`}
+	if d := cmp.Diff(expected, lines); d != "" {
+		t.Fatalf("fragmented message framed incorrectly: %s", d)
+	}
+}
+
+func TestLineFramerCoalesced(t *testing.T) {
+	mc := NewMockConnection()
+	framer := newLineFramer(mc, 0)
+	go func() {
+		// two full messages and the start of a third, padded with nulls and
+		// crlf like some miners do
+		mc.WriteTestDataToReadBuffer("{\"id\":1}\n{\"id\":2}\r\n\x00\x00{\"id\"")
+		mc.WriteTestDataToReadBuffer(":3}\n")
+	}()
+
+	lines := readAllLines(t, framer, 2)
+	expected := []string{`{"id":1}`, `{"id":2}`, `{"id":3}`}
+	if d := cmp.Diff(expected, lines); d != "" {
+		t.Fatalf("coalesced messages framed incorrectly: %s", d)
+	}
+}
+
+func TestLineFramerLargeMessage(t *testing.T) {
+	mc := NewMockConnection()
+	framer := newLineFramer(mc, 0)
+	// larger than a single read buffer, must be reassembled across reads
+	big := fmt.Sprintf(`{"id":1,"params":["%s"]}`, strings.Repeat("a", readBufferSize*2))
+	go mc.WriteTestDataToReadBuffer(big + "\n")
+
+	lines := readAllLines(t, framer, 3)
+	if len(lines) != 1 || lines[0] != big {
+		t.Fatalf("large message framed incorrectly, got %d lines", len(lines))
+	}
+}
+
+func TestLineFramerMaxLength(t *testing.T) {
+	mc := NewMockConnection()
+	framer := newLineFramer(mc, 16)
+	go mc.WriteTestDataToReadBuffer(strings.Repeat("a", 8))
+	if err := framer.readLines(func(string) error { return nil }); err != nil {
+		t.Fatalf("unexpected error on partial line: %s", err)
+	}
+	go mc.WriteTestDataToReadBuffer(strings.Repeat("a", 9))
+	err := framer.readLines(func(string) error { return nil })
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("expected ErrLineTooLong, got %v", err)
+	}
+}
+
+func TestNewClientPipelined(t *testing.T) {
+	logger := testLogger()
+	listener := NewListener(DefaultConfig(logger))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	mc := NewMockConnection()
+	listener.newClient(ctx, mc)
+
+	subscribe, _ := json.Marshal(NewEvent("1", "mining.subscribe", []any{"test/1.0"}))
+	authorize, _ := json.Marshal(NewEvent("2", "mining.authorize", []any{
+		"kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.test", "x",
+	}))
+	mc.AsyncWriteTestDataToReadBuffer(string(subscribe) + "\n" + string(authorize) + "\n")
+
+	for _, id := range []string{"1", "2"} {
+		mc.ReadTestDataFromBuffer(func(b []byte) {
+			decoded := JsonRpcResponse{}
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Id != id {
+				t.Fatalf("expected response to %s, got %+v", id, decoded)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	cfg := TLSConfig{
+		Port:       ":0",
+		CertFile:   path.Join(dir, "cert.pem"),
+		KeyFile:    path.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}
+	certs, err := newCertReloader(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := certs.GetCertificate(nil)
+	if original == nil {
+		t.Fatal("expected self signed cert to be generated")
+	}
+
+	// no change on disk, cert should be untouched
+	certs.checkReload()
+	if current, _ := certs.GetCertificate(nil); current != original {
+		t.Fatal("cert reloaded without file change")
+	}
+
+	// garbage on disk keeps the current cert
+	future := time.Now().Add(time.Minute)
+	os.WriteFile(cfg.CertFile, []byte("garbage"), 0644)
+	os.Chtimes(cfg.CertFile, future, future)
+	certs.checkReload()
+	if current, _ := certs.GetCertificate(nil); current != original {
+		t.Fatal("cert swapped for an invalid file")
+	}
+
+	// valid replacement gets picked up
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(cfg.CertFile, certPEM, 0644)
+	os.WriteFile(cfg.KeyFile, keyPEM, 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(cfg.CertFile, future, future)
+	certs.checkReload()
+	if current, _ := certs.GetCertificate(nil); current == original {
+		t.Fatal("cert not reloaded after file change")
+	}
+}
+
+func TestCertReloaderRequiresCert(t *testing.T) {
+	if _, err := newCertReloader(TLSConfig{Port: ":0"}, testLogger()); err == nil {
+		t.Fatal("expected error with no cert and self signed disabled")
+	}
+}
+
+// fakePool answers subscribe/authorize/submit on the server end of a pipe and
+// pushes a notify once the client is authorized
+func fakePool(t *testing.T, conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	write := func(v any) {
+		encoded, _ := json.Marshal(v)
+		conn.Write(append(encoded, '\n'))
+	}
+	for scanner.Scan() {
+		event, err := UnmarshalEvent(scanner.Text())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch event.Method {
+		case StratumMethodSubscribe:
+			write(NewResponse(event, []any{true, "EthereumStratum/1.0.0"}, nil))
+		case StratumMethodAuthorize:
+			write(NewResponse(event, true, nil))
+			write(NewEvent("", "set_extranonce", []any{"abcd", 2}))
+			write(NewEvent("", "mining.notify", []any{"1", "deadbeef", 1234}))
+		case StratumMethodSubmit:
+			if event.Params[2] == "dupe" {
+				write(NewResponse(event, nil, []any{22, "Duplicate share submitted", nil}))
+				continue
+			}
+			if event.Params[2] == "lowdiff" { // json-rpc 2.0 style error object
+				write(map[string]any{"id": event.Id, "result": nil,
+					"error": map[string]any{"code": 23, "message": "Low difficulty share"}})
+				continue
+			}
+			write(NewResponse(event, true, nil))
+		}
+	}
+}
+
+func TestStratumClient(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go fakePool(t, serverConn)
+
+	events := make(chan JsonRpcEvent, 2)
+	client := NewStratumClient(clientConn, StratumClientConfig{
+		User:         "kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.proxy",
+		Agent:        "test/1.0",
+		Logger:       testLogger(),
+		EventHandler: func(event JsonRpcEvent) { events <- event },
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []StratumMethod{"set_extranonce", "mining.notify"} {
+		select {
+		case event := <-events:
+			if event.Method != method {
+				t.Fatalf("expected %s, got %s", method, event.Method)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+
+	resp, err := client.Call(ctx, string(StratumMethodSubmit), []any{"w", "1", "00ff"})
+	if err != nil || resp.Result != true {
+		t.Fatalf("expected accepted share, got %+v (%v)", resp, err)
+	}
+	resp, err = client.Call(ctx, string(StratumMethodSubmit), []any{"w", "1", "dupe"})
+	if err != nil || len(resp.Error) == 0 || resp.Error[0] != json.Number("22") {
+		t.Fatalf("expected dupe rejection, got %+v (%v)", resp, err)
+	}
+	resp, err = client.Call(ctx, string(StratumMethodSubmit), []any{"w", "1", "lowdiff"})
+	if err != nil || len(resp.Error) < 2 || resp.Error[0] != json.Number("23") || resp.Error[1] != "Low difficulty share" {
+		t.Fatalf("expected low diff rejection, got %+v (%v)", resp, err)
+	}
+
+	serverConn.Close()
+	select {
+	case <-client.Done():
+	case <-ctx.Done():
+		t.Fatal("client did not notice the pool disconnecting")
+	}
+	if _, err := client.Call(ctx, string(StratumMethodSubmit), []any{"w", "1", "00ff"}); err == nil {
+		t.Fatal("expected error calling on closed client")
+	}
+}
+
+// replayTestConfig notifies a single job on authorize and only accepts
+// shares for it
+func replayTestConfig(port string, jobId string) StratumListenerConfig {
+	cfg := DefaultConfig(zap.NewNop())
+	cfg.Port = port
+	cfg.HandlerMap[string(StratumMethodAuthorize)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		if err := HandleAuthorize(ctx, event); err != nil {
+			return err
+		}
+		return ctx.Send(NewEvent("", "mining.notify", []any{jobId, "header"}))
+	}
+	cfg.HandlerMap[string(StratumMethodSubmit)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		return ctx.Reply(NewResponse(event, len(event.Params) > 1 && event.Params[1] == jobId, nil))
+	}
+	return cfg
+}
+
+func TestRecordReplay(t *testing.T) {
+	const port = "127.0.0.1:15558"
+	dir := t.TempDir()
+	cfg := replayTestConfig(port, "7")
+	cfg.RecordDir = dir
+	listener := NewListener(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	stopped := make(chan struct{})
+	defer func() {
+		cancel()
+		<-stopped // free the port for the next run
+	}()
+	go func() {
+		listener.Listen(ctx)
+		close(stopped)
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", port); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	fmt.Fprint(conn, `{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`+"\n")
+	readLine()
+	fmt.Fprint(conn, `{"id":2,"method":"mining.authorize","params":["kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.rig","hunter2"]}`+"\n")
+	readLine() // authorize reply
+	readLine() // notify
+	// submit split over two packets
+	fmt.Fprint(conn, `{"id":3,"method":"mining.submit","params":["rig","7",`)
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprint(conn, `"00ff"]}`+"\n")
+	if line := readLine(); !strings.Contains(line, `"result":true`) {
+		t.Fatalf("expected accepted share, got %s", line)
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 session file, got %d", len(files))
+	}
+	session, err := LoadSession(path.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := files[0].Info(); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected session file to be private, got %v (%v)", info.Mode(), err)
+	}
+	fragments := 0
+	for _, msg := range session {
+		if strings.Contains(msg.Data, "mining.authorize") && !strings.Contains(msg.Data, `"redacted"]`) {
+			t.Fatalf("authorize password recorded in plaintext: %q", msg.Data)
+		}
+		if msg.Direction == RecordIn && strings.HasPrefix(msg.Data, `{"id":3`) && !strings.HasSuffix(msg.Data, "\n") {
+			fragments++
+		}
+	}
+	if fragments != 1 {
+		t.Fatalf("expected the fragmented submit to be recorded as is")
+	}
+
+	// the replayed listener hands out a different job id, submits are
+	// rewritten to match
+	replay := NewListener(replayTestConfig("", "1")).Replay(ctx, session, ReplayConfig{})
+	if mismatches := replay.Mismatches(session); len(mismatches) > 0 {
+		t.Fatalf("replay differs from recording: %v", mismatches)
+	}
+	if len(replay.Received) != 4 {
+		t.Fatalf("expected 4 messages from the replayed listener, got %v", replay.Received)
+	}
+
+	// a listener that rejects the share is caught
+	strict := replayTestConfig("", "1")
+	strict.HandlerMap[string(StratumMethodSubmit)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		return ctx.ReplyBadShare(event.Id)
+	}
+	if mismatches := NewListener(strict).Replay(ctx, session, ReplayConfig{}).Mismatches(session); len(mismatches) != 1 {
+		t.Fatalf("expected the rejected share to be reported, got %v", mismatches)
+	}
+}
+
+// TestTLSHandshakeTimeout checks a client that never handshakes is dropped
+// rather than left wedged, while a real tls client still gets through
+func TestTLSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { tlsHandshakeTimeout = timeout }(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = 200 * time.Millisecond
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().String()
+	free.Close()
+	dir := t.TempDir()
+	cfg := DefaultConfig(testLogger())
+	cfg.Port = ""
+	cfg.TLS = &TLSConfig{
+		Port:       port,
+		CertFile:   path.Join(dir, "cert.pem"),
+		KeyFile:    path.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}
+	listener := NewListener(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		listener.Listen(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	var silent net.Conn
+	for i := 0; i < 50; i++ { // wait for the listener to come up
+		if silent, err = net.Dial("tcp", port); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("silent client wasn't dropped after the handshake timeout")
+	}
+
+	client, err := tls.Dial("tcp", port, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	event, _ := json.Marshal(NewEvent("1", "mining.authorize", []any{
+		"kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4.test", "x",
+	}))
+	client.Write(append(event, '\n'))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"result":true`) {
+		t.Fatalf("expected authorize reply over tls, got %q (%v)", line, err)
+	}
+}
+
+func TestRedactAuthorize(t *testing.T) {
+	submit := `{"id":3,"method":"mining.submit","params":["rig","7","00ff"]}` + "\n"
+	if out, changed := redactAuthorize(submit); changed || out != submit {
+		t.Fatalf("non authorize traffic changed: %q", out)
+	}
+	in := `{"id":2,"method":"mining.authorize","params":["kaspa:abc.rig","hunter2"]}` + "\n" + submit
+	out, changed := redactAuthorize(in)
+	if !changed || strings.Contains(out, "hunter2") || !strings.HasSuffix(out, "\n"+submit) {
+		t.Fatalf("expected password redacted and the submit kept, got %q", out)
+	}
+	if _, err := UnmarshalEvent(strings.SplitN(out, "\n", 2)[0]); err != nil {
+		t.Fatalf("redacted authorize no longer parses: %s", err)
+	}
+	if out, _ := redactAuthorize(`{"id":2,"method":"mining.authorize","params":["kaspa:abc.rig","hun`); out != "" {
+		t.Fatalf("expected a cut off authorize to be dropped, got %q", out)
+	}
+}
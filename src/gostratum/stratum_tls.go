@@ -0,0 +1,196 @@
+package gostratum
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const certCheckInterval = 30 * time.Second
+
+// TLSConfig describes a stratum+ssl listener. The listener shares the handler
+// map, state generator and client listener with the plaintext port
+type TLSConfig struct {
+	Port     string
+	CertFile string
+	KeyFile  string
+	// if true a self-signed cert will be generated at startup when no cert
+	// exists. If cert/key paths are provided the generated cert is written
+	// there so it survives restarts, otherwise it's held in memory only
+	SelfSigned bool
+}
+
+// certReloader serves the current certificate to the tls stack and swaps it
+// out when the cert or key file changes on disk
+type certReloader struct {
+	logger   *zap.Logger
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(cfg TLSConfig, logger *zap.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		logger:   logger,
+		certFile: cfg.CertFile,
+		keyFile:  cfg.KeyFile,
+	}
+
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		if !cfg.SelfSigned {
+			return nil, errors.New("tls enabled but no cert/key provided and self signed disabled")
+		}
+		certPEM, keyPEM, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading generated cert")
+		}
+		logger.Info("using in-memory self signed cert for tls")
+		cr.cert = &cert
+		return cr, nil
+	}
+
+	if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) && cfg.SelfSigned {
+		certPEM, keyPEM, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(cfg.CertFile, certPEM, 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed writing self signed cert to %s", cfg.CertFile)
+		}
+		if err := os.WriteFile(cfg.KeyFile, keyPEM, 0600); err != nil {
+			return nil, errors.Wrapf(err, "failed writing self signed key to %s", cfg.KeyFile)
+		}
+		logger.Info("generated self signed cert", zap.String("cert", cfg.CertFile))
+	}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return errors.Wrap(err, "failed checking tls cert files")
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed loading tls cert %s", cr.certFile)
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.lock.Unlock()
+	return nil
+}
+
+// checkReload reloads the cert if the files have changed since the last load.
+// On failure the previous cert is kept so a half-written file doesn't take
+// the port down
+func (cr *certReloader) checkReload() {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		cr.logger.Warn("failed checking tls cert files, keeping current cert", zap.Error(err))
+		return
+	}
+	cr.lock.RLock()
+	changed := modTime.After(cr.modTime)
+	cr.lock.RUnlock()
+	if !changed {
+		return
+	}
+	if err := cr.reload(); err != nil {
+		cr.logger.Warn("failed reloading tls cert, keeping current cert", zap.Error(err))
+		return
+	}
+	cr.logger.Info("tls cert reloaded", zap.String("cert", cr.certFile))
+}
+
+func (cr *certReloader) watch(ctx context.Context) {
+	if cr.certFile == "" {
+		return // in-memory cert, nothing to watch
+	}
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cr.checkReload()
+		}
+	}
+}
+
+func generateSelfSignedCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed generating tls key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed generating cert serial")
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"kaspa-stratum-bridge"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed creating self signed cert")
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed encoding tls key")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
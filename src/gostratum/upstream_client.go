@@ -0,0 +1,277 @@
+package gostratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const upstreamCallTimeout = 10 * time.Second
+
+// StratumClientConfig configures the miner side of a stratum connection,
+// used when relaying work to and from an upstream pool
+type StratumClientConfig struct {
+	Address  string
+	User     string // typically wallet.worker
+	Password string
+	Agent    string
+	Logger   *zap.Logger
+	// called for every server initiated event (mining.notify,
+	// mining.set_difficulty, set_extranonce, ...) in the order received
+	EventHandler func(event JsonRpcEvent)
+}
+
+// StratumClient speaks stratum to a pool as if it were a miner. Calls are
+// correlated to their responses by id so they can be made from any goroutine
+type StratumClient struct {
+	StratumClientConfig
+	connection  net.Conn
+	writeLock   sync.Mutex
+	pendingLock sync.Mutex
+	pending     map[string]chan JsonRpcResponse
+	nextId      int64
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+	// result of the subscribe call, some pools hand out the extranonce here
+	// rather than through set_extranonce
+	SubscribeResult any
+}
+
+// rawMessage covers both requests and responses so a single decode can
+// tell them apart
+type rawMessage struct {
+	Id     any             `json:"id"`
+	Method string          `json:"method"`
+	Params []any           `json:"params"`
+	Result any             `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// upstreamError is the json-rpc 2.0 error object some pools reply with in
+// place of the stratum [code, message, data] array
+type upstreamError struct {
+	Code    any    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data"`
+}
+
+// parseUpstreamError normalizes both error forms to [code, message, data]
+func parseUpstreamError(raw json.RawMessage) []any {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	decode := func(v any) error {
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+		return decoder.Decode(v)
+	}
+	var parts []any
+	if err := decode(&parts); err == nil {
+		return parts
+	}
+	obj := upstreamError{}
+	if err := decode(&obj); err == nil {
+		return []any{obj.Code, obj.Message, obj.Data}
+	}
+	// anything else is still an error, just without a code
+	return []any{nil, string(raw), nil}
+}
+
+var ErrClientClosed = fmt.Errorf("stratum client closed")
+
+// DialStratum connects to the pool, subscribes and authorizes. The returned
+// client is ready to submit work
+func DialStratum(ctx context.Context, cfg StratumClientConfig) (*StratumClient, error) {
+	dialer := net.Dialer{Timeout: upstreamCallTimeout}
+	connection, err := dialer.DialContext(ctx, "tcp", cfg.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed dialing upstream %s", cfg.Address)
+	}
+	client := NewStratumClient(connection, cfg)
+	if err := client.handshake(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewStratumClient wraps an already established connection and starts
+// reading from it. No handshake is performed
+func NewStratumClient(connection net.Conn, cfg StratumClientConfig) *StratumClient {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	cfg.Logger = cfg.Logger.With(zap.String("upstream", cfg.Address))
+	client := &StratumClient{
+		StratumClientConfig: cfg,
+		connection:          connection,
+		pending:             map[string]chan JsonRpcResponse{},
+		done:                make(chan struct{}),
+	}
+	go client.readLoop()
+	return client
+}
+
+func (c *StratumClient) handshake(ctx context.Context) error {
+	subscribe, err := c.Call(ctx, string(StratumMethodSubscribe), []any{c.Agent})
+	if err != nil {
+		return errors.Wrap(err, "upstream subscribe failed")
+	}
+	if len(subscribe.Error) > 0 {
+		return fmt.Errorf("upstream rejected subscribe: %v", subscribe.Error)
+	}
+	c.SubscribeResult = subscribe.Result
+
+	authorize, err := c.Call(ctx, string(StratumMethodAuthorize), []any{c.User, c.Password})
+	if err != nil {
+		return errors.Wrap(err, "upstream authorize failed")
+	}
+	if ok, _ := authorize.Result.(bool); !ok || len(authorize.Error) > 0 {
+		return fmt.Errorf("upstream rejected authorize for %s: %v", c.User, authorize.Error)
+	}
+	c.Logger.Info("upstream authorized", zap.String("user", c.User))
+	return nil
+}
+
+// Call sends a request and blocks until the matching response arrives, the
+// context expires or the connection drops
+func (c *StratumClient) Call(ctx context.Context, method string, params []any) (JsonRpcResponse, error) {
+	id := atomic.AddInt64(&c.nextId, 1)
+	key := fmt.Sprint(id)
+	respChan := make(chan JsonRpcResponse, 1)
+	c.pendingLock.Lock()
+	c.pending[key] = respChan
+	c.pendingLock.Unlock()
+	defer func() {
+		c.pendingLock.Lock()
+		delete(c.pending, key)
+		c.pendingLock.Unlock()
+	}()
+
+	if err := c.send(JsonRpcEvent{
+		Id:      id,
+		Version: "2.0",
+		Method:  StratumMethod(method),
+		Params:  params,
+	}); err != nil {
+		return JsonRpcResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamCallTimeout)
+	defer cancel()
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-c.done:
+		return JsonRpcResponse{}, c.Err()
+	case <-ctx.Done():
+		return JsonRpcResponse{}, errors.Wrapf(ctx.Err(), "no response to %s", method)
+	}
+}
+
+func (c *StratumClient) send(event JsonRpcEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed encoding jsonrpc event")
+	}
+	encoded = append(encoded, '\n')
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.connection.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return errors.Wrap(err, "failed setting write deadline for connection")
+	}
+	if _, err := c.connection.Write(encoded); err != nil {
+		c.closeWithError(err)
+		return errors.Wrap(err, "failed writing to upstream")
+	}
+	return nil
+}
+
+func (c *StratumClient) readLoop() {
+	framer := newLineFramer(c.connection, 0)
+	for {
+		err := framer.readLines(func(line string) error {
+			// numbers are kept as json.Number, job headers are sent as uint64s
+			// which don't survive a round trip through float64
+			msg := rawMessage{}
+			decoder := json.NewDecoder(strings.NewReader(line))
+			decoder.UseNumber()
+			if err := decoder.Decode(&msg); err != nil {
+				c.Logger.Warn("malformed message from upstream", zap.String("raw", line))
+				return nil // don't drop the pool over one bad line
+			}
+			if msg.Method != "" {
+				if c.EventHandler != nil {
+					c.EventHandler(JsonRpcEvent{
+						Id:      msg.Id,
+						Version: "2.0",
+						Method:  StratumMethod(msg.Method),
+						Params:  msg.Params,
+					})
+				}
+				return nil
+			}
+			c.pendingLock.Lock()
+			respChan, exists := c.pending[fmt.Sprint(msg.Id)]
+			c.pendingLock.Unlock()
+			if exists {
+				select { // non-blocking, a repeated response id is dropped
+				case respChan <- JsonRpcResponse{Id: msg.Id, Result: msg.Result, Error: parseUpstreamError(msg.Error)}:
+				default:
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			select {
+			case <-c.done:
+				return
+			default:
+				continue // expected timeout
+			}
+		}
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (c *StratumClient) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.connection.Close()
+		close(c.done)
+	})
+}
+
+// Close drops the connection, any in flight calls fail with ErrClientClosed
+func (c *StratumClient) Close() error {
+	c.closeWithError(ErrClientClosed)
+	return nil
+}
+
+// Done is closed once the connection to the pool is gone
+func (c *StratumClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was closed, nil while connected
+func (c *StratumClient) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+package kaspastratum
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	alertSendTimeout    = 10 * time.Second
+	alertCommandTimeout = 30 * time.Second
+)
+
+// SMTPConfig sends alerts as email, disabled unless Server is set
+type SMTPConfig struct {
+	Server   string   `yaml:"server"` // host:port
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// newAlertSinks builds the sinks configured in the alert config
+func newAlertSinks(cfg AlertConfig) ([]AlertSink, error) {
+	var sinks []AlertSink
+	for _, hook := range cfg.Webhooks {
+		parsed, err := url.Parse(hook)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("invalid alert webhook %q, expected an http(s) url", hook)
+		}
+		sinks = append(sinks, &webhookSink{url: hook, client: &http.Client{Timeout: alertSendTimeout}})
+	}
+	if cfg.SMTP.Server != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTP.Server); err != nil {
+			return nil, errors.Wrap(err, "invalid alert smtp server, expected host:port")
+		}
+		if cfg.SMTP.From == "" || len(cfg.SMTP.To) == 0 {
+			return nil, fmt.Errorf("alert smtp needs from and to addresses")
+		}
+		sinks = append(sinks, &smtpSink{cfg: cfg.SMTP})
+	}
+	if len(cfg.Command) > 0 {
+		sinks = append(sinks, &commandSink{argv: cfg.Command})
+	}
+	return sinks, nil
+}
+
+// webhookSink posts each alert as json
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed posting alert webhook")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+type smtpSink struct {
+	cfg SMTPConfig
+}
+
+func (s *smtpSink) Send(alert Alert) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(s.cfg.Server)
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	err := smtp.SendMail(s.cfg.Server, auth, s.cfg.From, s.cfg.To, s.message(alert))
+	return errors.Wrap(err, "failed sending alert email")
+}
+
+func (s *smtpSink) message(alert Alert) []byte {
+	msg := strings.Builder{}
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	// the subject carries the worker name, encoding it keeps any CR/LF it
+	// might hold from starting new headers
+	subject := fmt.Sprintf("[ks_bridge] %s %s: %s", strings.ToUpper(string(alert.Status)), alert.Rule, alert.Subject)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", alert.Message)
+	return []byte(msg.String())
+}
+
+// commandSink runs a command per alert with the alert as json on stdin and
+// the main fields in ALERT_* environment variables
+type commandSink struct {
+	argv []string
+}
+
+func (s *commandSink) Send(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.argv[0], s.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"ALERT_RULE="+alert.Rule,
+		"ALERT_TYPE="+string(alert.Type),
+		"ALERT_STATUS="+string(alert.Status),
+		"ALERT_SUBJECT="+alert.Subject,
+		"ALERT_MESSAGE="+alert.Message,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "alert command failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
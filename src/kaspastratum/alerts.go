@@ -0,0 +1,485 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAlertInterval    = 30 * time.Second
+	defaultAlertCooldown    = 30 * time.Minute
+	defaultOfflineAfter     = 10 * time.Minute
+	defaultOfflineRetention = 24 * time.Hour
+	defaultDropPercent      = 50
+	defaultDropBaseline     = time.Hour
+	defaultInvalidThreshold = 0.1
+	defaultInvalidWindow    = 10 * time.Minute
+	defaultInvalidMinShares = 20
+	// alerts waiting on slow sinks past this are dropped
+	alertQueueSize = 64
+)
+
+type AlertRuleType string
+
+const (
+	// no accepted share from a worker for `for`
+	AlertWorkerOffline AlertRuleType = "worker_offline"
+	// a worker's hashrate over `window` more than `drop_percent` below its
+	// hashrate over `baseline`
+	AlertHashrateDrop AlertRuleType = "hashrate_drop"
+	// invalid shares over `window` above `threshold` of all shares
+	AlertInvalidShares AlertRuleType = "invalid_shares"
+	// no synced kaspad node for `for`
+	AlertKaspadUnsynced AlertRuleType = "kaspad_unsynced"
+)
+
+// AlertRule is a condition checked against every worker, or the kaspad nodes
+// for kaspad_unsynced. Zero values take the defaults for the rule type
+type AlertRule struct {
+	Name string        `yaml:"name"`
+	Type AlertRuleType `yaml:"type"`
+	// worker names the rule applies to, empty for every worker
+	Workers     []string      `yaml:"workers"`
+	For         time.Duration `yaml:"for"`
+	DropPercent float64       `yaml:"drop_percent"`
+	Window      time.Duration `yaml:"window"`
+	Baseline    time.Duration `yaml:"baseline"`
+	Threshold   float64       `yaml:"threshold"`
+	MinShares   int64         `yaml:"min_shares"`
+	// minimum time between firing notifications for the same worker, so a
+	// flapping rig doesn't flood the sinks
+	Cooldown time.Duration `yaml:"cooldown"`
+	// worker_offline stops watching a disconnected worker with no share for
+	// this long, it's taken as retired rather than offline
+	Retention time.Duration `yaml:"retention"`
+}
+
+// AlertConfig is the rules to check and where to send alerts when they fire
+// or resolve
+type AlertConfig struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
+	Rules         []AlertRule   `yaml:"rules"`
+	Webhooks      []string      `yaml:"webhooks"`
+	SMTP          SMTPConfig    `yaml:"smtp"`
+	// run with the alert as json on stdin, argv style
+	Command []string `yaml:"command"`
+}
+
+type AlertStatus string
+
+const (
+	AlertFiring   AlertStatus = "firing"
+	AlertResolved AlertStatus = "resolved"
+)
+
+// Alert is a notification that a rule started or stopped matching. Subject is
+// the worker name, or "kaspad"
+type Alert struct {
+	Rule    string        `json:"rule"`
+	Type    AlertRuleType `json:"type"`
+	Status  AlertStatus   `json:"status"`
+	Subject string        `json:"subject"`
+	Message string        `json:"message"`
+	Time    time.Time     `json:"time"`
+}
+
+// AlertSink delivers alerts. Send is called from a single goroutine so a slow
+// sink delays the others, but never mining
+type AlertSink interface {
+	Send(alert Alert) error
+}
+
+// withDefaults fills in unset fields for the rule type
+func (r AlertRule) withDefaults(hashrateWindows []time.Duration) AlertRule {
+	if r.Name == "" {
+		r.Name = string(r.Type)
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = defaultAlertCooldown
+	}
+	switch r.Type {
+	case AlertWorkerOffline:
+		if r.For == 0 {
+			r.For = defaultOfflineAfter
+		}
+		if r.Retention == 0 {
+			r.Retention = defaultOfflineRetention
+		}
+	case AlertHashrateDrop:
+		if r.DropPercent == 0 {
+			r.DropPercent = defaultDropPercent
+		}
+		if r.Window == 0 {
+			r.Window = normalizeHashrateWindows(hashrateWindows)[0]
+		}
+		if r.Baseline == 0 {
+			r.Baseline = defaultDropBaseline
+		}
+	case AlertInvalidShares:
+		if r.Threshold == 0 {
+			r.Threshold = defaultInvalidThreshold
+		}
+		if r.Window == 0 {
+			r.Window = defaultInvalidWindow
+		}
+		if r.MinShares == 0 {
+			r.MinShares = defaultInvalidMinShares
+		}
+	}
+	return r
+}
+
+func validateAlerts(cfg AlertConfig, hashrateWindows []time.Duration) error {
+	windows := map[time.Duration]bool{}
+	for _, window := range normalizeHashrateWindows(hashrateWindows) {
+		windows[window] = true
+	}
+	names := map[string]bool{}
+	for _, rule := range cfg.Rules {
+		rule = rule.withDefaults(hashrateWindows)
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate alert rule name %s", rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.Type {
+		case AlertWorkerOffline, AlertKaspadUnsynced:
+		case AlertHashrateDrop:
+			if rule.DropPercent <= 0 || rule.DropPercent > 100 {
+				return fmt.Errorf("alert rule %s: drop_percent must be between 0 and 100", rule.Name)
+			}
+			if !windows[rule.Window] || !windows[rule.Baseline] {
+				return fmt.Errorf("alert rule %s: window (%s) and baseline (%s) must both be hashrate_windows",
+					rule.Name, rule.Window, rule.Baseline)
+			}
+		case AlertInvalidShares:
+			if rule.Threshold <= 0 || rule.Threshold > 1 {
+				return fmt.Errorf("alert rule %s: threshold must be a ratio between 0 and 1", rule.Name)
+			}
+		default:
+			return fmt.Errorf("alert rule %s: unknown type %q", rule.Name, rule.Type)
+		}
+		if rule.For < 0 || rule.Window < 0 || rule.Cooldown < 0 {
+			return fmt.Errorf("alert rule %s: durations can't be negative", rule.Name)
+		}
+	}
+	if _, err := newAlertSinks(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+type alertKey struct {
+	rule    string
+	subject string
+}
+
+type alertState struct {
+	firing    bool
+	notified  bool // the firing was sent, so the resolve is too
+	lastFired time.Time
+}
+
+type shareSample struct {
+	at       time.Time
+	accepted int64
+	invalid  int64
+}
+
+// alertEngine checks the rules against worker stats and node health on an
+// interval, sending an alert when a rule starts matching and again when it
+// resolves
+type alertEngine struct {
+	logger       *zap.SugaredLogger
+	rules        []AlertRule
+	interval     time.Duration
+	sinks        []AlertSink
+	shareHandler *shareHandler
+	kaspa        *KaspaApi // nil in proxy mode
+	states       map[alertKey]*alertState
+	// connection state by worker name, from bridge events
+	connected     map[string]bool
+	samples       map[string][]shareSample
+	unsyncedSince time.Time
+	queue         chan Alert
+}
+
+func newAlertEngine(logger *zap.SugaredLogger, cfg AlertConfig, hashrateWindows []time.Duration,
+	sinks []AlertSink, sh *shareHandler, kaspa *KaspaApi) *alertEngine {
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+	rules := make([]AlertRule, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		rules = append(rules, rule.withDefaults(hashrateWindows))
+	}
+	return &alertEngine{
+		logger:       logger.With(zap.String("component", "alerts")),
+		rules:        rules,
+		interval:     interval,
+		sinks:        sinks,
+		shareHandler: sh,
+		kaspa:        kaspa,
+		states:       map[alertKey]*alertState{},
+		connected:    map[string]bool{},
+		samples:      map[string][]shareSample{},
+		queue:        make(chan Alert, alertQueueSize),
+	}
+}
+
+func (e *alertEngine) start(ctx context.Context) {
+	events := e.shareHandler.events.subscribe(eventFilter{types: map[EventType]bool{
+		EventAuthorize:  true,
+		EventDisconnect: true,
+	}})
+	go func() {
+		defer e.shareHandler.events.unsubscribe(events)
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				close(e.queue)
+				return
+			case ev := <-events.events:
+				e.connectionEvent(ev)
+			case now := <-ticker.C:
+				e.evaluate(now)
+			}
+		}
+	}()
+	go e.sendLoop()
+}
+
+func (e *alertEngine) connectionEvent(ev BridgeEvent) {
+	if ev.Worker == "" {
+		return
+	}
+	e.connected[ev.Worker] = ev.Type == EventAuthorize
+}
+
+func (e *alertEngine) sendLoop() {
+	for alert := range e.queue {
+		for _, sink := range e.sinks {
+			if err := sink.Send(alert); err != nil {
+				e.logger.Error("failed sending alert", zap.String("rule", alert.Rule), zap.Error(err))
+			}
+		}
+	}
+}
+
+// evaluate checks every rule once, queueing alerts for state changes
+func (e *alertEngine) evaluate(now time.Time) {
+	e.shareHandler.statsLock.Lock()
+	workers := make([]*WorkStats, 0, len(e.shareHandler.stats))
+	for _, stats := range e.shareHandler.stats {
+		workers = append(workers, stats)
+	}
+	e.shareHandler.statsLock.Unlock()
+	sort.Slice(workers, func(i, j int) bool { return workers[i].WorkerName < workers[j].WorkerName })
+	e.sampleShares(now, workers)
+
+	for _, rule := range e.rules {
+		if rule.Type == AlertKaspadUnsynced {
+			matched, message := e.checkKaspad(rule, now)
+			e.update(rule, "kaspad", matched, message, now)
+			continue
+		}
+		for _, stats := range workers {
+			if !rule.appliesTo(stats.WorkerName) {
+				continue
+			}
+			var matched bool
+			var message string
+			switch rule.Type {
+			case AlertWorkerOffline:
+				if e.retired(rule, stats, now) {
+					// dropped without a resolve, it never recovered
+					delete(e.states, alertKey{rule: rule.Name, subject: stats.WorkerName})
+					continue
+				}
+				matched, message = e.checkOffline(rule, stats, now)
+			case AlertHashrateDrop:
+				matched, message = checkHashrateDrop(rule, stats, now)
+			case AlertInvalidShares:
+				matched, message = e.checkInvalidShares(rule, stats, now)
+			}
+			e.update(rule, stats.WorkerName, matched, message, now)
+		}
+	}
+}
+
+func (r AlertRule) appliesTo(worker string) bool {
+	if len(r.Workers) == 0 {
+		return true
+	}
+	for _, w := range r.Workers {
+		if w == worker {
+			return true
+		}
+	}
+	return false
+}
+
+// update moves the rule/subject between firing and resolved, queueing a
+// notification for each change outside the cooldown
+func (e *alertEngine) update(rule AlertRule, subject string, matched bool, message string, now time.Time) {
+	key := alertKey{rule: rule.Name, subject: subject}
+	state, exists := e.states[key]
+	if !exists {
+		if !matched {
+			return
+		}
+		state = &alertState{}
+		e.states[key] = state
+	}
+	switch {
+	case matched && !state.firing:
+		state.firing = true
+		state.notified = state.lastFired.IsZero() || now.Sub(state.lastFired) >= rule.Cooldown
+		if state.notified {
+			state.lastFired = now
+			e.notify(rule, AlertFiring, subject, message, now)
+		}
+	case !matched && state.firing:
+		state.firing = false
+		if state.notified {
+			e.notify(rule, AlertResolved, subject, fmt.Sprintf("%s: %s recovered", rule.Name, subject), now)
+		}
+	}
+}
+
+func (e *alertEngine) notify(rule AlertRule, status AlertStatus, subject, message string, now time.Time) {
+	alert := Alert{
+		Rule:    rule.Name,
+		Type:    rule.Type,
+		Status:  status,
+		Subject: subject,
+		Message: message,
+		Time:    now,
+	}
+	e.logger.Warn(fmt.Sprintf("alert %s: %s", status, message))
+	RecordAlert(rule.Name, status)
+	select {
+	case e.queue <- alert:
+	default:
+		e.logger.Error("alert queue full, dropping alert", zap.String("rule", rule.Name))
+	}
+}
+
+func (e *alertEngine) checkOffline(rule AlertRule, stats *WorkStats, now time.Time) (bool, string) {
+	idle := now.Sub(stats.lastShareTime())
+	if idle < rule.For {
+		return false, ""
+	}
+	state := "connected"
+	if connected, seen := e.connected[stats.WorkerName]; seen && !connected {
+		state = "disconnected"
+	}
+	return true, fmt.Sprintf("%s: %s has sent no shares for %s (%s)",
+		rule.Name, stats.WorkerName, idle.Round(time.Second), state)
+}
+
+// retired reports whether the worker is gone for good as far as the offline
+// rule goes: not connected and without a share for the rule's retention.
+// Covers workers restored from the store that never come back
+func (e *alertEngine) retired(rule AlertRule, stats *WorkStats, now time.Time) bool {
+	if e.connected[stats.WorkerName] {
+		return false
+	}
+	return now.Sub(stats.lastShareTime()) > rule.Retention
+}
+
+func checkHashrateDrop(rule AlertRule, stats *WorkStats, now time.Time) (bool, string) {
+	if now.Sub(stats.StartTime) < rule.Baseline {
+		return false, "" // not enough history to compare against
+	}
+	var current, baseline float64
+	for _, rate := range stats.Hashrate.rates(now, stats.StartTime) {
+		if rate.Window == rule.Window {
+			current = rate.GHs
+		}
+		if rate.Window == rule.Baseline {
+			baseline = rate.GHs
+		}
+	}
+	if baseline <= 0 || current >= baseline*(1-rule.DropPercent/100) {
+		return false, ""
+	}
+	return true, fmt.Sprintf("%s: %s hashrate %0.2fGH/s over %s is %.0f%% below its %s average of %0.2fGH/s",
+		rule.Name, stats.WorkerName, current, windowLabel(rule.Window), 100*(1-current/baseline),
+		windowLabel(rule.Baseline), baseline)
+}
+
+// sampleShares records share counts each check so invalid ratios can be
+// taken over a window rather than the lifetime of the worker
+func (e *alertEngine) sampleShares(now time.Time, workers []*WorkStats) {
+	keep := time.Duration(0)
+	for _, rule := range e.rules {
+		if rule.Type == AlertInvalidShares && rule.Window > keep {
+			keep = rule.Window
+		}
+	}
+	if keep == 0 {
+		return
+	}
+	for _, stats := range workers {
+		samples := append(e.samples[stats.WorkerName], shareSample{
+			at:       now,
+			accepted: stats.SharesFound.Load(),
+			invalid:  stats.InvalidShares.Load(),
+		})
+		// keep one sample older than the window to measure from
+		for len(samples) > 1 && now.Sub(samples[1].at) >= keep {
+			samples = samples[1:]
+		}
+		e.samples[stats.WorkerName] = samples
+	}
+}
+
+func (e *alertEngine) checkInvalidShares(rule AlertRule, stats *WorkStats, now time.Time) (bool, string) {
+	samples := e.samples[stats.WorkerName]
+	if len(samples) < 2 {
+		return false, ""
+	}
+	from, latest := samples[0], samples[len(samples)-1]
+	for _, sample := range samples {
+		if now.Sub(sample.at) < rule.Window {
+			break
+		}
+		from = sample
+	}
+	accepted, invalid := latest.accepted-from.accepted, latest.invalid-from.invalid
+	if accepted+invalid < rule.MinShares {
+		return false, ""
+	}
+	ratio := float64(invalid) / float64(accepted+invalid)
+	if ratio <= rule.Threshold {
+		return false, ""
+	}
+	return true, fmt.Sprintf("%s: %s sent %.1f%% invalid shares (%d of %d) over %s",
+		rule.Name, stats.WorkerName, ratio*100, invalid, accepted+invalid, latest.at.Sub(from.at).Round(time.Second))
+}
+
+func (e *alertEngine) checkKaspad(rule AlertRule, now time.Time) (bool, string) {
+	if e.kaspa == nil {
+		return false, "" // proxy mode, no nodes
+	}
+	for _, node := range e.kaspa.Nodes() {
+		if node.Synced && node.RPCOk {
+			e.unsyncedSince = time.Time{}
+			return false, ""
+		}
+	}
+	if e.unsyncedSince.IsZero() {
+		e.unsyncedSince = now
+	}
+	if now.Sub(e.unsyncedSince) < rule.For {
+		return false, ""
+	}
+	return true, fmt.Sprintf("%s: no synced kaspad node for %s", rule.Name, now.Sub(e.unsyncedSince).Round(time.Second))
+}
@@ -0,0 +1,263 @@
+package kaspastratum
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// drainAlerts returns the alerts queued so far without running the sinks
+func drainAlerts(e *alertEngine) []Alert {
+	var alerts []Alert
+	for {
+		select {
+		case alert := <-e.queue:
+			alerts = append(alerts, alert)
+		default:
+			return alerts
+		}
+	}
+}
+
+func testWorker(sh *shareHandler, name string, started time.Time) *WorkStats {
+	stats := &WorkStats{WorkerName: name, StartTime: started}
+	stats.LastShare.Store(started.UnixNano())
+	stats.Hashrate.setWindows(sh.hashrateWindows)
+	sh.stats[name] = stats
+	return stats
+}
+
+func TestAlertWorkerOffline(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	start := time.Now()
+	rig1 := testWorker(sh, "rig1", start)
+	testWorker(sh, "rig2", start)
+	e := newAlertEngine(zap.NewNop().Sugar(), AlertConfig{Rules: []AlertRule{
+		{Type: AlertWorkerOffline, Workers: []string{"rig1"}, For: 5 * time.Minute, Cooldown: time.Hour},
+	}}, nil, nil, sh, nil)
+	e.connectionEvent(BridgeEvent{Type: EventDisconnect, Worker: "rig1"})
+
+	e.evaluate(start.Add(4 * time.Minute))
+	if alerts := drainAlerts(e); len(alerts) != 0 {
+		t.Fatalf("expected no alerts yet, got %+v", alerts)
+	}
+	e.evaluate(start.Add(6 * time.Minute))
+	e.evaluate(start.Add(7 * time.Minute)) // still firing, not sent again
+	alerts := drainAlerts(e)
+	if len(alerts) != 1 || alerts[0].Status != AlertFiring || alerts[0].Subject != "rig1" ||
+		alerts[0].Rule != "worker_offline" || !strings.Contains(alerts[0].Message, "disconnected") {
+		t.Fatalf("expected rig1 offline alert, got %+v", alerts)
+	}
+
+	rig1.LastShare.Store(start.Add(8 * time.Minute).UnixNano())
+	e.evaluate(start.Add(8 * time.Minute))
+	if alerts := drainAlerts(e); len(alerts) != 1 || alerts[0].Status != AlertResolved {
+		t.Fatalf("expected resolve, got %+v", alerts)
+	}
+
+	// flaps again inside the cooldown, neither firing nor resolve are sent
+	e.evaluate(start.Add(14 * time.Minute))
+	rig1.LastShare.Store(start.Add(15 * time.Minute).UnixNano())
+	e.evaluate(start.Add(15 * time.Minute))
+	if alerts := drainAlerts(e); len(alerts) != 0 {
+		t.Fatalf("expected alerts suppressed by cooldown, got %+v", alerts)
+	}
+}
+
+// TestAlertOfflineRetired checks workers restored from the store that never
+// reconnect only alert until they pass the rule's retention
+func TestAlertOfflineRetired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	store, err := newShareStore(path, 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	now := time.Now()
+	store.RecordShare(ShareRecord{Worker: "recent", Type: ShareAccepted, Timestamp: now.Add(-time.Hour)})
+	store.RecordShare(ShareRecord{Worker: "retired", Type: ShareAccepted, Timestamp: now.Add(-72 * time.Hour)})
+	store.Close()
+	store, err = newShareStore(path, 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed reopening store: %s", err)
+	}
+	defer store.Close()
+	sh := newShareHandler(nil, 0, 0)
+	if err := sh.attachStore(store); err != nil {
+		t.Fatal(err)
+	}
+	e := newAlertEngine(zap.NewNop().Sugar(), AlertConfig{Rules: []AlertRule{
+		{Type: AlertWorkerOffline, For: 5 * time.Minute},
+	}}, nil, nil, sh, nil)
+	if e.rules[0].Retention != defaultOfflineRetention {
+		t.Fatalf("expected default retention, got %s", e.rules[0].Retention)
+	}
+
+	e.evaluate(now)
+	alerts := drainAlerts(e)
+	if len(alerts) != 1 || alerts[0].Subject != "recent" {
+		t.Fatalf("expected only the recently seen worker to alert, got %+v", alerts)
+	}
+	// once past retention it's dropped quietly rather than resolved
+	e.evaluate(now.Add(24 * time.Hour))
+	if alerts := drainAlerts(e); len(alerts) != 0 {
+		t.Fatalf("expected retired worker dropped without alerts, got %+v", alerts)
+	}
+	// a connected worker is never retired
+	e.connectionEvent(BridgeEvent{Type: EventAuthorize, Worker: "retired"})
+	e.evaluate(now.Add(24 * time.Hour))
+	if alerts := drainAlerts(e); len(alerts) != 1 || alerts[0].Subject != "retired" {
+		t.Fatalf("expected connected worker to alert, got %+v", alerts)
+	}
+}
+
+func TestAlertHashrateDrop(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	start := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	rig := testWorker(sh, "rig1", start)
+	for at := start; at.Before(start.Add(time.Hour)); at = at.Add(time.Second) {
+		rig.Hashrate.add(at, 10)
+	}
+	e := newAlertEngine(zap.NewNop().Sugar(), AlertConfig{Rules: []AlertRule{
+		{Type: AlertHashrateDrop, DropPercent: 30},
+	}}, nil, nil, sh, nil)
+	if e.rules[0].Window != 5*time.Minute || e.rules[0].Baseline != time.Hour {
+		t.Fatalf("expected default windows, got %+v", e.rules[0])
+	}
+	e.evaluate(start.Add(time.Hour))
+	if alerts := drainAlerts(e); len(alerts) != 0 {
+		t.Fatalf("expected steady hashrate to pass, got %+v", alerts)
+	}
+	// half the rate for 5 minutes
+	for at := start.Add(time.Hour); at.Before(start.Add(65 * time.Minute)); at = at.Add(2 * time.Second) {
+		rig.Hashrate.add(at, 10)
+	}
+	e.evaluate(start.Add(65 * time.Minute))
+	if alerts := drainAlerts(e); len(alerts) != 1 || alerts[0].Type != AlertHashrateDrop {
+		t.Fatalf("expected hashrate drop alert, got %+v", alerts)
+	}
+}
+
+func TestAlertInvalidShares(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	start := time.Now()
+	rig := testWorker(sh, "rig1", start)
+	e := newAlertEngine(zap.NewNop().Sugar(), AlertConfig{Rules: []AlertRule{
+		{Name: "bad shares", Type: AlertInvalidShares, Threshold: 0.2, Window: 10 * time.Minute},
+	}}, nil, nil, sh, nil)
+	// lots of lifetime invalid shares before the window don't count
+	rig.InvalidShares.Store(1000)
+	e.evaluate(start)
+	rig.SharesFound.Add(90)
+	rig.InvalidShares.Add(10)
+	e.evaluate(start.Add(5 * time.Minute))
+	if alerts := drainAlerts(e); len(alerts) != 0 {
+		t.Fatalf("expected 10%% invalid to pass, got %+v", alerts)
+	}
+	rig.SharesFound.Add(10)
+	rig.InvalidShares.Add(40)
+	e.evaluate(start.Add(10 * time.Minute))
+	alerts := drainAlerts(e)
+	if len(alerts) != 1 || alerts[0].Rule != "bad shares" || !strings.Contains(alerts[0].Message, "(50 of 150)") {
+		t.Fatalf("expected invalid share alert, got %+v", alerts)
+	}
+}
+
+func TestAlertKaspadUnsynced(t *testing.T) {
+	fake := NewFakeKaspad(1)
+	ksApi := fakeKaspaApi(t, fake)
+	defer ksApi.Close()
+	sh := newShareHandler(ksApi, 0, 0)
+	e := newAlertEngine(zap.NewNop().Sugar(), AlertConfig{Rules: []AlertRule{
+		{Type: AlertKaspadUnsynced, For: time.Minute},
+	}}, nil, nil, sh, ksApi)
+	now := time.Now()
+	ksApi.checkNodes()
+	e.evaluate(now)
+
+	fake.SetSynced(false)
+	ksApi.checkNodes()
+	e.evaluate(now.Add(time.Minute))
+	e.evaluate(now.Add(2 * time.Minute))
+	fake.SetSynced(true)
+	ksApi.checkNodes()
+	e.evaluate(now.Add(3 * time.Minute))
+	alerts := drainAlerts(e)
+	if len(alerts) != 2 || alerts[0].Status != AlertFiring || alerts[0].Subject != "kaspad" || alerts[1].Status != AlertResolved {
+		t.Fatalf("expected kaspad firing then resolved, got %+v", alerts)
+	}
+}
+
+func TestAlertSinks(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := Alert{}
+		json.NewDecoder(r.Body).Decode(&alert)
+		received <- alert
+	}))
+	defer server.Close()
+
+	cfg := AlertConfig{Webhooks: []string{server.URL}}
+	out := filepath.Join(t.TempDir(), "alert.json")
+	if _, err := exec.LookPath("sh"); err == nil {
+		cfg.Command = []string{"sh", "-c", `cat > "$0"; echo "$ALERT_STATUS" >> "$0"`, out}
+	}
+	sinks, err := newAlertSinks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert := Alert{Rule: "offline", Type: AlertWorkerOffline, Status: AlertFiring, Subject: "rig1", Time: time.Now()}
+	for _, sink := range sinks {
+		if err := sink.Send(alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := <-received; got.Rule != "offline" || got.Subject != "rig1" {
+		t.Errorf("unexpected webhook alert %+v", got)
+	}
+	if len(cfg.Command) > 0 {
+		raw, err := ioutil.ReadFile(out)
+		if err != nil || !strings.Contains(string(raw), `"subject":"rig1"`) || !strings.HasSuffix(string(raw), "firing\n") {
+			t.Errorf("unexpected command output %q (%v)", raw, err)
+		}
+	}
+
+	for _, bad := range []AlertConfig{
+		{Webhooks: []string{"ftp://example.com"}},
+		{SMTP: SMTPConfig{Server: "mail.example.com"}},
+		{SMTP: SMTPConfig{Server: "mail.example.com:25"}},
+		{Rules: []AlertRule{{Type: "nope"}}},
+		{Rules: []AlertRule{{Type: AlertWorkerOffline}, {Type: AlertWorkerOffline}}},
+		{Rules: []AlertRule{{Type: AlertHashrateDrop, Baseline: 2 * time.Hour}}},
+		{Rules: []AlertRule{{Type: AlertInvalidShares, Threshold: 5}}},
+	} {
+		if err := validateAlerts(bad, nil); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestAlertEmailHeaders(t *testing.T) {
+	sink := &smtpSink{cfg: SMTPConfig{From: "bridge@example.com", To: []string{"ops@example.com"}}}
+	alert := Alert{Rule: "offline", Status: AlertFiring, Subject: "rig1\r\nBcc: victim@example.com", Time: time.Now()}
+	headers := strings.SplitN(string(sink.message(alert)), "\r\n\r\n", 2)[0]
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Fatalf("worker name injected a header: %q", headers)
+		}
+	}
+	if !strings.Contains(headers, "Subject: =?utf-8?q?") {
+		t.Fatalf("expected encoded subject, got %q", headers)
+	}
+	plain := Alert{Rule: "offline", Status: AlertFiring, Subject: "rig1", Time: time.Now()}
+	if !strings.Contains(string(sink.message(plain)), "Subject: [ks_bridge] FIRING offline: rig1\r\n") {
+		t.Fatalf("plain subject mangled: %q", sink.message(plain))
+	}
+}
@@ -0,0 +1,404 @@
+package kaspastratum
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAPIBlockLimit = 50
+	maxAPIBlockLimit     = 1000
+	eventWriteTimeout    = 10 * time.Second
+	eventPingInterval    = 30 * time.Second
+)
+
+var eventUpgrader = websocket.Upgrader{}
+
+// clientSource is anything holding the connected miners, the client
+// listener in bridge mode or the proxy in proxy mode
+type clientSource interface {
+	Clients() []*gostratum.StratumContext
+}
+
+type WorkerInfo struct {
+	Id                int32   `json:"id"`
+	Worker            string  `json:"worker"`
+	Wallet            string  `json:"wallet"`
+	RemoteAddr        string  `json:"remote_addr"`
+	MinerApp          string  `json:"miner_app"`
+	Extranonce        string  `json:"extranonce"`
+	Profile           string  `json:"profile"`
+	Difficulty        float64 `json:"difficulty"`
+	RecentHashrateGHs float64 `json:"recent_hashrate_ghs"`
+	// hashrate over each hashrate window keyed by window, e.g. "5m" and "24h".
+	// Recent is the shortest of these
+	Hashrates     map[string]float64 `json:"hashrates_ghs"`
+	SharesFound   int64              `json:"shares_found"`
+	StaleShares   int64              `json:"stale_shares"`
+	DupeShares    int64              `json:"dupe_shares"`
+	InvalidShares int64              `json:"invalid_shares"`
+	BlocksFound   int64              `json:"blocks_found"`
+	StartTime     time.Time          `json:"start_time"`
+	LastShare     time.Time          `json:"last_share"`
+}
+
+type WalletInfo struct {
+	Wallet            string             `json:"wallet"`
+	Workers           int                `json:"workers"`
+	RecentHashrateGHs float64            `json:"recent_hashrate_ghs"`
+	Hashrates         map[string]float64 `json:"hashrates_ghs"`
+	SharesFound       int64              `json:"shares_found"`
+	StaleShares       int64              `json:"stale_shares"`
+	DupeShares        int64              `json:"dupe_shares"`
+	InvalidShares     int64              `json:"invalid_shares"`
+	BlocksFound       int64              `json:"blocks_found"`
+}
+
+type BridgeSummary struct {
+	Version           string             `json:"version"`
+	Uptime            string             `json:"uptime"`
+	Workers           int                `json:"workers"`
+	RecentHashrateGHs float64            `json:"recent_hashrate_ghs"`
+	Hashrates         map[string]float64 `json:"hashrates_ghs"`
+	SharesFound       int64              `json:"shares_found"`
+	StaleShares       int64              `json:"stale_shares"`
+	DupeShares        int64              `json:"dupe_shares"`
+	InvalidShares     int64              `json:"invalid_shares"`
+	BlocksFound       int64              `json:"blocks_found"`
+}
+
+type NetworkInfo struct {
+	Network NetworkStats `json:"network"`
+	Nodes   []NodeStatus `json:"nodes"`
+}
+
+type PoolInfo struct {
+	Splits   []BlockSplit      `json:"splits"`
+	Balances map[string]uint64 `json:"balances"`
+}
+
+// apiServer serves read-only json views of the bridge state for tooling,
+// along with the embedded dashboard built on top of them
+type apiServer struct {
+	logger       *zap.SugaredLogger
+	clients      clientSource
+	shareHandler *shareHandler
+	kaspa        *KaspaApi // nil in proxy mode
+	started      time.Time
+	admission    *gostratum.Admission
+	adminToken   string // empty disables endpoints that change state
+}
+
+func newAPIServer(logger *zap.SugaredLogger, clients clientSource, sh *shareHandler, kaspa *KaspaApi) *apiServer {
+	return &apiServer{
+		logger:       logger.With(zap.String("component", "api")),
+		clients:      clients,
+		shareHandler: sh,
+		kaspa:        kaspa,
+		started:      time.Now(),
+	}
+}
+
+func (api *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/summary", api.handleSummary)
+	mux.HandleFunc("/api/v1/workers", api.handleWorkers)
+	mux.HandleFunc("/api/v1/wallets", api.handleWallets)
+	mux.HandleFunc("/api/v1/blocks", api.handleBlocks)
+	mux.HandleFunc("/api/v1/network", api.handleNetwork)
+	mux.HandleFunc("/api/v1/pool", api.handlePool)
+	mux.HandleFunc("/api/v1/events", api.handleEvents)
+	mux.HandleFunc("/api/v1/bans", api.handleBans)
+	mux.Handle("/", dashboardHandler())
+	return mux
+}
+
+func (api *apiServer) Start(port string) {
+	api.logger.Info("serving json api and dashboard on " + port)
+	go func() {
+		if err := http.ListenAndServe(port, api.handler()); err != nil {
+			api.logger.Error("json api server stopped: ", err)
+		}
+	}()
+}
+
+func (api *apiServer) writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		api.logger.Warn("failed writing api response: ", err)
+	}
+}
+
+func (api *apiServer) writeError(w http.ResponseWriter, status int, msg string) {
+	api.writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (api *apiServer) workers() []WorkerInfo {
+	now := time.Now()
+	var workers []WorkerInfo
+	for _, ctx := range api.clients.Clients() {
+		if !ctx.Connected() {
+			continue
+		}
+		info := WorkerInfo{
+			Id:         ctx.Id,
+			RemoteAddr: ctx.RemoteAddr,
+			Profile:    profileName(ctx),
+		}
+		if ctx.Authorized() { // identity is still being set up until then
+			info.Worker = ctx.WorkerName
+			info.Wallet = ctx.WalletAddr
+			info.MinerApp = ctx.RemoteApp
+			info.Extranonce = ctx.Extranonce
+		}
+		if state, ok := ctx.State.(*MiningState); ok {
+			if diff := state.getStratumDiff(); diff != nil {
+				info.Difficulty = diff.diffValue
+			}
+		}
+		if stats := api.shareHandler.findStats(ctx); stats != nil {
+			info.RecentHashrateGHs, info.Hashrates = hashrateInfo(&stats.Hashrate, now, stats.StartTime)
+			info.SharesFound = stats.SharesFound.Load()
+			info.StaleShares = stats.StaleShares.Load()
+			info.DupeShares = stats.DupeShares.Load()
+			info.InvalidShares = stats.InvalidShares.Load()
+			info.BlocksFound = stats.BlocksFound.Load()
+			info.StartTime = stats.StartTime
+			info.LastShare = stats.lastShareTime()
+		}
+		workers = append(workers, info)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Id < workers[j].Id })
+	return workers
+}
+
+// hashrateInfo returns the shortest window's hashrate along with every
+// window's keyed by label
+func hashrateInfo(h *hashrateWindows, now, started time.Time) (float64, map[string]float64) {
+	rates := h.rates(now, started)
+	byWindow := make(map[string]float64, len(rates))
+	for _, rate := range rates {
+		byWindow[windowLabel(rate.Window)] = rate.GHs
+	}
+	if len(rates) == 0 {
+		return 0, byWindow
+	}
+	return rates[0].GHs, byWindow
+}
+
+func (api *apiServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	overall := &api.shareHandler.overall
+	recent, hashrates := hashrateInfo(&overall.Hashrate, time.Now(), api.started)
+	api.writeJSON(w, http.StatusOK, BridgeSummary{
+		Version:           version,
+		Uptime:            time.Since(api.started).Round(time.Second).String(),
+		Workers:           len(api.workers()),
+		RecentHashrateGHs: recent,
+		Hashrates:         hashrates,
+		SharesFound:       overall.SharesFound.Load(),
+		StaleShares:       overall.StaleShares.Load(),
+		DupeShares:        overall.DupeShares.Load(),
+		InvalidShares:     overall.InvalidShares.Load(),
+		BlocksFound:       overall.BlocksFound.Load(),
+	})
+}
+
+func (api *apiServer) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	workers := api.workers()
+	if wallet := r.URL.Query().Get("wallet"); wallet != "" {
+		filtered := []WorkerInfo{}
+		for _, worker := range workers {
+			if worker.Wallet == wallet {
+				filtered = append(filtered, worker)
+			}
+		}
+		workers = filtered
+	}
+	if workers == nil {
+		workers = []WorkerInfo{}
+	}
+	api.writeJSON(w, http.StatusOK, workers)
+}
+
+func (api *apiServer) handleWallets(w http.ResponseWriter, r *http.Request) {
+	byWallet := map[string]*WalletInfo{}
+	for _, worker := range api.workers() {
+		if worker.Wallet == "" {
+			continue // not authorized yet
+		}
+		wallet, exists := byWallet[worker.Wallet]
+		if !exists {
+			wallet = &WalletInfo{Wallet: worker.Wallet, Hashrates: map[string]float64{}}
+			byWallet[worker.Wallet] = wallet
+		}
+		wallet.Workers++
+		wallet.RecentHashrateGHs += worker.RecentHashrateGHs
+		for window, rate := range worker.Hashrates {
+			wallet.Hashrates[window] += rate
+		}
+		wallet.SharesFound += worker.SharesFound
+		wallet.StaleShares += worker.StaleShares
+		wallet.DupeShares += worker.DupeShares
+		wallet.InvalidShares += worker.InvalidShares
+		wallet.BlocksFound += worker.BlocksFound
+	}
+	wallets := make([]WalletInfo, 0, len(byWallet))
+	for _, wallet := range byWallet {
+		wallets = append(wallets, *wallet)
+	}
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].Wallet < wallets[j].Wallet })
+	api.writeJSON(w, http.StatusOK, wallets)
+}
+
+func (api *apiServer) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAPIBlockLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			api.writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = parsed
+		if limit > maxAPIBlockLimit {
+			limit = maxAPIBlockLimit
+		}
+	}
+	blocks, err := api.shareHandler.RecentBlocks(limit)
+	if err != nil {
+		api.logger.Error("failed loading blocks: ", err)
+		api.writeError(w, http.StatusInternalServerError, "failed loading blocks")
+		return
+	}
+	if blocks == nil {
+		blocks = []BlockRecord{}
+	}
+	api.writeJSON(w, http.StatusOK, blocks)
+}
+
+func (api *apiServer) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	if api.kaspa == nil {
+		api.writeError(w, http.StatusNotFound, "no kaspad connection in proxy mode")
+		return
+	}
+	api.writeJSON(w, http.StatusOK, NetworkInfo{
+		Network: api.kaspa.NetworkStats(),
+		Nodes:   api.kaspa.Nodes(),
+	})
+}
+
+func (api *apiServer) handlePool(w http.ResponseWriter, r *http.Request) {
+	pool := api.shareHandler.pool
+	if pool == nil {
+		api.writeError(w, http.StatusNotFound, "not running in pool mode")
+		return
+	}
+	api.writeJSON(w, http.StatusOK, PoolInfo{
+		Splits:   pool.Splits(),
+		Balances: pool.Balances(),
+	})
+}
+
+// authorized checks the request carries the admin token as a bearer token,
+// writing the error response if not
+func (api *apiServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if api.adminToken == "" {
+		api.writeError(w, http.StatusForbidden, "admin_token not configured")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) != 1 {
+		api.writeError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+// handleBans lists active bans, DELETE with ?ip= lifts one
+func (api *apiServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	if api.admission == nil {
+		api.writeError(w, http.StatusNotFound, "admission control not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		api.writeJSON(w, http.StatusOK, api.admission.Bans())
+	case http.MethodDelete:
+		if !api.authorized(w, r) {
+			return
+		}
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			api.writeError(w, http.StatusBadRequest, "ip is required")
+			return
+		}
+		if !api.admission.Unban(ip) {
+			api.writeError(w, http.StatusNotFound, "ip is not banned")
+			return
+		}
+		api.logger.Info("ban lifted for " + ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		api.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleEvents streams bridge events over a websocket. Subscriptions can be
+// narrowed with comma separated wallet, worker and type query params
+func (api *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := parseEventFilter(query.Get("wallet"), query.Get("worker"), query.Get("type"))
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // upgrader has already replied
+	}
+	defer conn.Close()
+
+	sub := api.shareHandler.events.subscribe(filter)
+	defer api.shareHandler.events.unsubscribe(sub)
+
+	// nothing is expected from the client, but reading is how closes and
+	// pongs are noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				return
+			}
+		case ev := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if dropped := sub.takeDropped(); dropped > 0 {
+				if err := conn.WriteJSON(BridgeEvent{Type: EventDropped, Time: time.Now(), Count: dropped}); err != nil {
+					return
+				}
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		}
+	}
+}
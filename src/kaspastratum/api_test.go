@@ -0,0 +1,145 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+type fakeClients []*gostratum.StratumContext
+
+func (f fakeClients) Clients() []*gostratum.StratumContext {
+	return f
+}
+
+func TestAPIWorkersAndWallets(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	var clients fakeClients
+	for i, name := range []string{"rig1", "rig2", "rig3"} {
+		state := MiningStateGenerator().(*MiningState)
+		state.setStratumDiff(float64(4 * (i + 1)))
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), state)
+		ctx.Id = int32(i + 1)
+		ctx.WorkerName = name
+		ctx.RemoteAddr = fmt.Sprintf("10.0.0.%d", i+1)
+		ctx.WalletAddr = "kaspa:a"
+		ctx.RemoteApp = "BzMiner"
+		if name == "rig3" {
+			ctx.WalletAddr = "kaspa:b"
+		}
+		stats := sh.getCreateStats(ctx)
+		stats.SharesFound.Add(int64(i + 1))
+		stats.Hashrate.add(time.Now(), 10)
+		clients = append(clients, ctx)
+	}
+	server := httptest.NewServer(newAPIServer(zap.NewNop().Sugar(), clients, sh, nil).handler())
+	defer server.Close()
+
+	var workers []WorkerInfo
+	getJSON(t, server.URL+"/api/v1/workers?wallet=kaspa:a", http.StatusOK, &workers)
+	if len(workers) != 2 || workers[0].Difficulty != 4 || workers[1].SharesFound != 2 || workers[0].MinerApp != "BzMiner" {
+		t.Fatalf("unexpected workers %+v", workers)
+	}
+	if workers[0].RecentHashrateGHs <= 0 || workers[0].Hashrates["24h"] <= 0 {
+		t.Fatalf("expected a recent hashrate, got %f", workers[0].RecentHashrateGHs)
+	}
+
+	var wallets []WalletInfo
+	getJSON(t, server.URL+"/api/v1/wallets", http.StatusOK, &wallets)
+	if len(wallets) != 2 || wallets[0].Workers != 2 || wallets[0].SharesFound != 3 || wallets[1].SharesFound != 3 {
+		t.Fatalf("unexpected wallets %+v", wallets)
+	}
+
+	var blocks []BlockRecord
+	sh.recordBlock(clients[0], "abcd", 1, 2)
+	getJSON(t, server.URL+"/api/v1/blocks", http.StatusOK, &blocks)
+	if len(blocks) != 1 || blocks[0].Worker != "rig1" {
+		t.Fatalf("unexpected blocks %+v", blocks)
+	}
+	getJSON(t, server.URL+"/api/v1/blocks?limit=x", http.StatusBadRequest, nil)
+	getJSON(t, server.URL+"/api/v1/network", http.StatusNotFound, nil)
+	getJSON(t, server.URL+"/api/v1/pool", http.StatusNotFound, nil)
+}
+
+func TestDashboardServed(t *testing.T) {
+	server := httptest.NewServer(newAPIServer(zap.NewNop().Sugar(), fakeClients{}, newShareHandler(nil, 0, 0), nil).handler())
+	defer server.Close()
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %s", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIBans(t *testing.T) {
+	api := newAPIServer(zap.NewNop().Sugar(), fakeClients{}, newShareHandler(nil, 0, 0), nil)
+	api.admission, _ = gostratum.NewAdmission(gostratum.AdmissionConfig{})
+	api.admission.Ban("10.0.0.1", time.Hour, "testing")
+	server := httptest.NewServer(api.handler())
+	defer server.Close()
+
+	var bans []gostratum.Ban
+	getJSON(t, server.URL+"/api/v1/bans", http.StatusOK, &bans)
+	if len(bans) != 1 || bans[0].IP != "10.0.0.1" {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+
+	unban := func(ip, token string) int {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/bans?ip="+ip, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := unban("10.0.0.1", "secret"); status != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin token configured, got %d", status)
+	}
+	api.adminToken = "secret"
+	if status := unban("10.0.0.1", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad token, got %d", status)
+	}
+	if status := unban("10.0.0.1", "secret"); status != http.StatusNoContent {
+		t.Fatalf("expected 204 lifting ban, got %d", status)
+	}
+	if status := unban("10.0.0.1", "secret"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for ip that isn't banned, got %d", status)
+	}
+	getJSON(t, server.URL+"/api/v1/bans", http.StatusOK, &bans)
+	if len(bans) != 0 {
+		t.Fatalf("ban not lifted %+v", bans)
+	}
+}
+
+func getJSON(t *testing.T, url string, status int, out any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: expected status %d, got %d", url, status, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("GET %s: failed decoding response: %s", url, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package kaspastratum
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type AuthMode string
+
+const (
+	// any valid kaspa address may mine
+	AuthOpen AuthMode = "open"
+	// only wallets in allowed_wallets may mine
+	AuthAllowlist AuthMode = "allowlist"
+	// workers with an invalid or unlisted wallet mine to default_wallet
+	AuthDefaultWallet AuthMode = "default_wallet"
+)
+
+// wallet label refused authorizes are counted under, whatever the username
+const unauthorizedWalletLabel = "unauthorized"
+
+var (
+	errBadPassword       = fmt.Errorf("bad worker password")
+	errUnknownWorker     = fmt.Errorf("worker not in worker_passwords")
+	errInvalidWallet     = fmt.Errorf("invalid wallet address")
+	errWalletNotAllowed  = fmt.Errorf("wallet not on allowlist")
+	errUnknownAuthMode   = fmt.Errorf("unknown auth_mode")
+	errNoDefaultWallet   = fmt.Errorf("auth_mode default_wallet needs default_wallet set")
+	errEmptyAllowlist    = fmt.Errorf("auth_mode allowlist needs allowed_wallets set")
+	errBadAllowedWallets = fmt.Errorf("invalid wallet in allowed_wallets")
+)
+
+// authPolicy decides which miners may authorize, and which wallet they mine to
+type authPolicy struct {
+	mode            AuthMode
+	allowed         map[string]bool
+	defaultWallet   string
+	password        string
+	workerPasswords map[string]string
+}
+
+func newAuthPolicy(cfg BridgeConfig) (*authPolicy, error) {
+	policy := &authPolicy{
+		mode:            cfg.AuthMode,
+		allowed:         map[string]bool{},
+		password:        cfg.WorkerPassword,
+		workerPasswords: cfg.WorkerPasswords,
+	}
+	if policy.mode == "" {
+		policy.mode = AuthOpen
+	}
+	for _, wallet := range cfg.AllowedWallets {
+		cleaned, err := gostratum.CleanWallet(wallet)
+		if err != nil {
+			return nil, errors.Wrap(errBadAllowedWallets, wallet)
+		}
+		policy.allowed[cleaned] = true
+	}
+	switch policy.mode {
+	case AuthOpen:
+	case AuthAllowlist:
+		if len(policy.allowed) == 0 {
+			return nil, errEmptyAllowlist
+		}
+	case AuthDefaultWallet:
+		if cfg.DefaultWallet == "" {
+			return nil, errNoDefaultWallet
+		}
+		cleaned, err := gostratum.CleanWallet(cfg.DefaultWallet)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid default_wallet")
+		}
+		policy.defaultWallet = cleaned
+	default:
+		return nil, errors.Wrap(errUnknownAuthMode, string(policy.mode))
+	}
+	return policy, nil
+}
+
+// resolve checks the request against the policy, returning the wallet and
+// worker name the miner is bound to
+func (p *authPolicy) resolve(req gostratum.AuthorizeRequest) (string, string, error) {
+	wallet, worker, err := p.resolveWallet(req)
+	if err != nil {
+		return "", "", err
+	}
+	if err := p.checkPassword(worker, req.Password); err != nil {
+		return "", "", err
+	}
+	return wallet, worker, nil
+}
+
+func (p *authPolicy) resolveWallet(req gostratum.AuthorizeRequest) (string, string, error) {
+	wallet, err := gostratum.CleanWallet(req.Wallet)
+	switch p.mode {
+	case AuthAllowlist:
+		if err != nil || !p.allowed[wallet] {
+			return "", "", errWalletNotAllowed
+		}
+	case AuthDefaultWallet:
+		if err != nil || (len(p.allowed) > 0 && !p.allowed[wallet]) {
+			worker := req.Worker
+			if worker == "" && err != nil {
+				worker = req.Wallet // username was just a worker name
+			}
+			return p.defaultWallet, worker, nil
+		}
+	default:
+		if err != nil {
+			return "", "", errInvalidWallet
+		}
+	}
+	return wallet, req.Worker, nil
+}
+
+// checkPassword matches the password against the worker's own, falling back
+// to the shared one. With only per worker passwords set, workers not listed
+// are refused rather than let in without one
+func (p *authPolicy) checkPassword(worker, password string) error {
+	expected, exists := p.workerPasswords[worker]
+	if !exists {
+		if p.password == "" && len(p.workerPasswords) > 0 {
+			return errUnknownWorker
+		}
+		expected = p.password
+	}
+	if expected != "" && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return errBadPassword
+	}
+	return nil
+}
+
+// handle is the mining.authorize handler, refused miners get a stratum
+// unauthorized error and count toward a ban
+func (p *authPolicy) handle(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+	req, err := gostratum.ParseAuthorize(event)
+	if err != nil {
+		return err
+	}
+	wallet, worker, err := p.resolve(req)
+	if err != nil {
+		ctx.Logger.Warn("refusing authorize", zap.String("wallet", req.Wallet),
+			zap.String("worker", req.Worker), zap.Error(err))
+		// the username is unvalidated client input, keep it out of prom labels
+		RecordWorkerError(unauthorizedWalletLabel, ErrUnauthorized)
+		ctx.RecordOffense(gostratum.OffenseUnauthorized)
+		return ctx.ReplyUnauthorized(event.Id)
+	}
+	return gostratum.CompleteAuthorize(ctx, event, wallet, worker)
+}
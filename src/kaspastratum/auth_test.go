@@ -0,0 +1,111 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+const (
+	testWalletA = "kaspa:qqayxgcjfh6d7uxpj4w3qzjvx73vdehfx22fl6cacmn44rpj5geg2rxyuhga4"
+	testWalletB = "kaspa:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm"
+)
+
+func TestAuthPolicyConfig(t *testing.T) {
+	bad := []BridgeConfig{
+		{AuthMode: "closed"},
+		{AuthMode: AuthAllowlist},
+		{AuthMode: AuthDefaultWallet},
+		{AuthMode: AuthDefaultWallet, DefaultWallet: "nope"},
+		{AllowedWallets: []string{"kaspa:nope"}},
+	}
+	for _, cfg := range bad {
+		if _, err := newAuthPolicy(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestAuthPolicyResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    BridgeConfig
+		req    gostratum.AuthorizeRequest
+		wallet string
+		worker string
+		err    error
+	}{
+		{"open", BridgeConfig{}, gostratum.AuthorizeRequest{Wallet: testWalletA, Worker: "rig"}, testWalletA, "rig", nil},
+		{"open invalid", BridgeConfig{}, gostratum.AuthorizeRequest{Wallet: "rig"}, "", "", errInvalidWallet},
+		{"allowlist", BridgeConfig{AuthMode: AuthAllowlist, AllowedWallets: []string{testWalletA}},
+			gostratum.AuthorizeRequest{Wallet: testWalletA}, testWalletA, "", nil},
+		{"allowlist unlisted", BridgeConfig{AuthMode: AuthAllowlist, AllowedWallets: []string{testWalletA}},
+			gostratum.AuthorizeRequest{Wallet: testWalletB}, "", "", errWalletNotAllowed},
+		{"default unknown worker", BridgeConfig{AuthMode: AuthDefaultWallet, DefaultWallet: testWalletA},
+			gostratum.AuthorizeRequest{Wallet: "rig7"}, testWalletA, "rig7", nil},
+		{"default dotted worker", BridgeConfig{AuthMode: AuthDefaultWallet, DefaultWallet: testWalletA},
+			gostratum.AuthorizeRequest{Wallet: "farm.rig7"}, testWalletA, "farm.rig7", nil},
+		{"default valid wallet", BridgeConfig{AuthMode: AuthDefaultWallet, DefaultWallet: testWalletA},
+			gostratum.AuthorizeRequest{Wallet: testWalletB, Worker: "rig"}, testWalletB, "rig", nil},
+		{"default unlisted", BridgeConfig{AuthMode: AuthDefaultWallet, DefaultWallet: testWalletA, AllowedWallets: []string{testWalletA}},
+			gostratum.AuthorizeRequest{Wallet: testWalletB, Worker: "rig"}, testWalletA, "rig", nil},
+		{"shared password", BridgeConfig{WorkerPassword: "hunter2"},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Password: "hunter2"}, testWalletA, "", nil},
+		{"wrong password", BridgeConfig{WorkerPassword: "hunter2"},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Password: "x"}, "", "", errBadPassword},
+		{"worker password", BridgeConfig{WorkerPassword: "hunter2", WorkerPasswords: map[string]string{"rig": "rigpass"}},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Worker: "rig", Password: "rigpass"}, testWalletA, "rig", nil},
+		{"only worker passwords", BridgeConfig{WorkerPasswords: map[string]string{"rig": "rigpass"}},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Worker: "rig", Password: "rigpass"}, testWalletA, "rig", nil},
+		{"unlisted worker", BridgeConfig{WorkerPasswords: map[string]string{"rig": "rigpass"}},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Worker: "stranger"}, "", "", errUnknownWorker},
+		{"default worker password", BridgeConfig{AuthMode: AuthDefaultWallet, DefaultWallet: testWalletA,
+			WorkerPasswords: map[string]string{"rig7": "rigpass"}},
+			gostratum.AuthorizeRequest{Wallet: "rig7", Password: "rigpass"}, testWalletA, "rig7", nil},
+		{"worker ignores shared", BridgeConfig{WorkerPassword: "hunter2", WorkerPasswords: map[string]string{"rig": "rigpass"}},
+			gostratum.AuthorizeRequest{Wallet: testWalletA, Worker: "rig", Password: "hunter2"}, "", "", errBadPassword},
+	}
+	for _, tt := range tests {
+		policy, err := newAuthPolicy(tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		wallet, worker, err := policy.resolve(tt.req)
+		if err != tt.err || wallet != tt.wallet || worker != tt.worker {
+			t.Errorf("%s: got %q %q %v, expected %q %q %v", tt.name, wallet, worker, err, tt.wallet, tt.worker, tt.err)
+		}
+	}
+}
+
+func TestAuthorizeRefused(t *testing.T) {
+	policy, _ := newAuthPolicy(BridgeConfig{WorkerPassword: "hunter2"})
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WalletAddr = ""
+
+	reply := make(chan gostratum.JsonRpcResponse, 1)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) {
+		decoded := gostratum.JsonRpcResponse{}
+		json.Unmarshal(b, &decoded)
+		reply <- decoded
+	})
+	refused := errorByWallet.WithLabelValues(unauthorizedWalletLabel, string(ErrUnauthorized))
+	before, series := testutil.ToFloat64(refused), testutil.CollectAndCount(errorByWallet)
+	event := gostratum.NewEvent("1", string(gostratum.StratumMethodAuthorize), []any{testWalletA + ".rig", "wrong"})
+	if err := policy.handle(ctx, event); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if testutil.ToFloat64(refused) != before+1 || testutil.CollectAndCount(errorByWallet) != series {
+		t.Fatalf("expected refusal counted under the %s label only", unauthorizedWalletLabel)
+	}
+	resp := <-reply
+	if len(resp.Error) == 0 || resp.Error[0] != float64(24) {
+		t.Fatalf("expected unauthorized error, got %+v", resp)
+	}
+	if ctx.WalletAddr != "" {
+		t.Fatalf("refused worker was bound to %s", ctx.WalletAddr)
+	}
+}
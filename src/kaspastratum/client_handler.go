@@ -3,19 +3,18 @@ package kaspastratum
 import (
 	"fmt"
 	"math"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-var bigJobRegex = regexp.MustCompile(".*BzMiner.*")
-
 const balanceDelay = time.Minute
 
 type clientListener struct {
@@ -25,37 +24,155 @@ type clientListener struct {
 	clients          map[int32]*gostratum.StratumContext
 	lastBalanceCheck time.Time
 	clientCounter    int32
-	minShareDiff     float64
-	extranonceSize   int8
-	maxExtranonce    int32
-	nextExtranonce   int32
+	profiles         map[string]*portProfile
+	extranonces      map[int8]*extranonceRange // by extranonce size
+	encoders         *encoderSelector
+}
+
+func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, minShareDiff float64, varDiff varDiffConfig, extranonceSize int8) *clientListener {
+	c := &clientListener{
+		logger:       logger,
+		clientLock:   sync.RWMutex{},
+		shareHandler: shareHandler,
+		clients:      make(map[int32]*gostratum.StratumContext),
+		profiles: map[string]*portProfile{
+			defaultProfileName: newPortProfile(defaultProfileName, minShareDiff, varDiff, extranonceSize, ""),
+		},
+	}
+	c.splitExtranonces()
+	return c
+}
+
+// extranonceRange is the slice of extranonces handed out to miners with a
+// given extranonce size
+type extranonceRange struct {
+	base  int32
+	count int32
+	next  int32
+}
+
+// splitExtranonces divides the extranonce's top byte between the sizes in
+// use. A short extranonce owns every longer one it prefixes, so sizes can't
+// share a counter without ports handing out overlapping nonce ranges. With a
+// single size the whole space is its own. Caller holds clientLock or has
+// yet to share the listener
+func (c *clientListener) splitExtranonces() {
+	var sizes []int8
+	seen := map[int8]bool{}
+	for _, p := range c.profiles {
+		if p.extranonceSize > 0 && !seen[p.extranonceSize] {
+			seen[p.extranonceSize] = true
+			sizes = append(sizes, p.extranonceSize)
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	c.extranonces = map[int8]*extranonceRange{}
+	for i, size := range sizes {
+		lo, hi := int32(256*i/len(sizes)), int32(256*(i+1)/len(sizes))
+		shift := 8 * (int32(size) - 1)
+		c.extranonces[size] = &extranonceRange{base: lo << shift, count: (hi - lo) << shift}
+	}
+}
+
+// profileListener routes connections from a profile's port to the shared
+// client listener, tagging them with the profile
+type profileListener struct {
+	*clientListener
+	profile *portProfile
+}
+
+func (p profileListener) OnConnect(ctx *gostratum.StratumContext) {
+	p.connect(ctx, p.profile)
+}
+
+// addProfile registers an extra port profile, the returned listener goes in
+// that port's stratum config
+func (c *clientListener) addProfile(p *portProfile) gostratum.StratumClientListener {
+	c.clientLock.Lock()
+	c.profiles[p.name] = p
+	c.splitExtranonces()
+	c.clientLock.Unlock()
+	return profileListener{clientListener: c, profile: p}
+}
+
+func (c *clientListener) profile(name string) *portProfile {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	return c.profiles[name]
 }
 
-func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, minShareDiff float64, extranonceSize int8) *clientListener {
-	return &clientListener{
-		logger:         logger,
-		minShareDiff:   minShareDiff,
-		extranonceSize: extranonceSize,
-		maxExtranonce:  int32(math.Pow(2, (8*math.Min(float64(extranonceSize), 3))) - 1),
-		nextExtranonce: 0,
-		clientLock:     sync.RWMutex{},
-		shareHandler:   shareHandler,
-		clients:        make(map[int32]*gostratum.StratumContext),
+// profileFor is the profile a miner connected through
+func (c *clientListener) profileFor(state *MiningState) *portProfile {
+	if state.profile != nil {
+		return state.profile
 	}
+	return c.profile(defaultProfileName)
+}
+
+func (c *clientListener) diffSettings() (float64, varDiffConfig) {
+	return c.profile(defaultProfileName).diffSettings()
+}
+
+// applyDiffSettings swaps in new difficulty settings for a profile and pushes
+// a new diff to any of its connected workers whose current diff no longer
+// fits them. Workers pick it up on their next job
+func (c *clientListener) applyDiffSettings(name string, minShareDiff float64, varDiff varDiffConfig) bool {
+	profile := c.profile(name)
+	if profile == nil {
+		return false
+	}
+	profile.setDiffSettings(minShareDiff, varDiff)
+
+	for _, client := range c.Clients() {
+		state, ok := client.State.(*MiningState)
+		if !ok || !client.Connected() || c.profileFor(state) != profile {
+			continue
+		}
+		c.clampDiff(client, state, minShareDiff, varDiff)
+	}
+	return true
+}
+
+// clampDiff moves a worker's diff into the new settings, holding the notify
+// lock so it can't land between a vardiff retarget and its job
+func (c *clientListener) clampDiff(client *gostratum.StratumContext, state *MiningState, minShareDiff float64, varDiff varDiffConfig) {
+	state.notifyLock.Lock()
+	defer state.notifyLock.Unlock()
+	current := state.getStratumDiff()
+	if current == nil {
+		return // not initialized yet, will get the new diff on first job
+	}
+	target := minShareDiff
+	if varDiff.enabled { // keep the worker's diff, clamped to the new bounds
+		target = math.Max(current.diffValue, varDiff.minDiff)
+		if varDiff.maxDiff > 0 {
+			target = math.Min(target, varDiff.maxDiff)
+		}
+	}
+	if target == current.diffValue {
+		return
+	}
+	client.Logger.Info(fmt.Sprintf("config reload, diff %f -> %f", current.diffValue, target))
+	sendDifficulty(client, state.setStratumDiff(target))
 }
 
 func (c *clientListener) OnConnect(ctx *gostratum.StratumContext) {
+	c.connect(ctx, c.profile(defaultProfileName))
+}
+
+func (c *clientListener) connect(ctx *gostratum.StratumContext, profile *portProfile) {
 	var extranonce int32
 
 	idx := atomic.AddInt32(&c.clientCounter, 1)
 	ctx.Id = idx
+	if state, ok := ctx.State.(*MiningState); ok {
+		state.profile = profile
+	}
 	c.clientLock.Lock()
-	if c.extranonceSize > 0 {
-		extranonce = c.nextExtranonce
-		if c.nextExtranonce < c.maxExtranonce {
-			c.nextExtranonce++
-		} else {
-			c.nextExtranonce = 0
+	if r := c.extranonces[profile.extranonceSize]; r != nil {
+		extranonce = r.base + r.next
+		r.next = (r.next + 1) % r.count
+		if r.next == 0 {
 			c.logger.Warn("wrapped extranonce! new clients may be duplicating work...")
 		}
 	}
@@ -63,16 +180,31 @@ func (c *clientListener) OnConnect(ctx *gostratum.StratumContext) {
 	c.clientLock.Unlock()
 	ctx.Logger = ctx.Logger.With(zap.Int("client_id", int(ctx.Id)))
 
-	if c.extranonceSize > 0 {
-		ctx.Extranonce = fmt.Sprintf("%0*x", c.extranonceSize*2, extranonce)
+	if profile.extranonceSize > 0 {
+		ctx.Extranonce = fmt.Sprintf("%0*x", profile.extranonceSize*2, extranonce)
 	}
+	c.shareHandler.events.publish(newClientEvent(EventConnect, ctx))
 	go func() {
 		// hacky, but give time for the authorize to go through so we can use the worker name
 		time.Sleep(5 * time.Second)
-		c.shareHandler.getCreateStats(ctx) // create the stats if they don't exist
+		if ctx.Authorized() {
+			c.shareHandler.getCreateStats(ctx) // create the stats if they don't exist
+		}
 	}()
 }
 
+// OnSubscribe picks the miner's job encoder now the user agent is known, ahead
+// of the authorize that hands out the extranonce
+func (c *clientListener) OnSubscribe(ctx *gostratum.StratumContext) {
+	state := GetMiningState(ctx)
+	enc := c.profileFor(state).encoderFor(c.encoders, ctx.RemoteApp)
+	state.setEncoder(enc)
+	if !enc.Extranonce() {
+		ctx.Extranonce = ""
+	}
+	ctx.Logger.Debug("job encoder " + enc.Name())
+}
+
 func (c *clientListener) OnDisconnect(ctx *gostratum.StratumContext) {
 	ctx.Done()
 	c.clientLock.Lock()
@@ -81,9 +213,28 @@ func (c *clientListener) OnDisconnect(ctx *gostratum.StratumContext) {
 	c.logger.Info("removed client ", ctx.Id)
 	c.clientLock.Unlock()
 	RecordDisconnect(ctx)
+	c.shareHandler.events.publish(newClientEvent(EventDisconnect, ctx))
+}
+
+// Clients returns the currently connected miners
+func (c *clientListener) Clients() []*gostratum.StratumContext {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	clients := make([]*gostratum.StratumContext, 0, len(c.clients))
+	for _, cl := range c.clients {
+		clients = append(clients, cl)
+	}
+	return clients
+}
+
+// blockTemplateSource is where miners' jobs come from, KaspaApi outside of
+// tests
+type blockTemplateSource interface {
+	GetBlockTemplate(client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, error)
+	GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error)
 }
 
-func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
+func (c *clientListener) NewBlockAvailable(kapi blockTemplateSource) {
 	c.clientLock.Lock()
 	addresses := make([]string, 0, len(c.clients))
 	for _, cl := range c.clients {
@@ -92,15 +243,24 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 		}
 		go func(client *gostratum.StratumContext) {
 			state := GetMiningState(client)
-			if client.WalletAddr == "" {
+			profile := c.profileFor(state)
+			// the miner's identity is still being written until authorized,
+			// only the remote address is safe to use
+			if !client.Authorized() {
 				if time.Since(state.connectTime) > time.Second*20 { // timeout passed
 					// this happens pretty frequently in gcp/aws land since script-kiddies scrape ports
-					client.Logger.Warn("client misconfigured, no miner address specified - disconnecting", zap.String("client", client.String()))
-					RecordWorkerError(client.WalletAddr, ErrNoMinerAddress)
+					c.logger.Warnw("client misconfigured, no miner address specified - disconnecting", "client", client.RemoteAddr)
+					RecordWorkerError("", ErrNoMinerAddress)
+					client.RecordOffense(gostratum.OffenseNoAddress)
 					client.Disconnect() // invalid configuration, boot the worker
 				}
 				return
 			}
+			state.notifyLock.Lock()
+			defer state.notifyLock.Unlock()
+			// read under the lock so a reload can't clamp against settings
+			// this pass is about to overwrite
+			minShareDiff, varDiff := profile.diffSettings()
 			template, err := kapi.GetBlockTemplate(client)
 			if err != nil {
 				if strings.Contains(err.Error(), "Could not decode address") {
@@ -121,31 +281,31 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 				return
 			}
 
-			jobId := state.AddJob(template.Block)
 			if !state.initialized {
 				state.initialized = true
-				state.useBigJob = bigJobRegex.MatchString(client.RemoteApp)
-				// first pass through send the difficulty since it's fixed
-				state.stratumDiff = newKaspaDiff()
-				state.stratumDiff.setDiffValue(c.minShareDiff)
-				if err := client.Send(gostratum.JsonRpcEvent{
-					Version: "2.0",
-					Method:  "mining.set_difficulty",
-					Params:  []any{state.stratumDiff.diffValue},
-				}); err != nil {
-					RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
-					client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error(), zap.Any("context", client))
+				// never subscribed
+				state.pickEncoder(func() JobEncoder { return profile.encoderFor(c.encoders, client.RemoteApp) })
+				// first pass through send the starting difficulty
+				diff := state.setStratumDiff(minShareDiff)
+				state.varDiff.reset(time.Now())
+				if err := sendDifficulty(client, diff); err != nil {
+					return
+				}
+			} else if next, changed := varDiff.nextDiff(&state.varDiff,
+				state.getStratumDiff().diffValue, time.Now()); changed {
+				// retarget goes out ahead of the notify so the new job is
+				// worked (and credited) at the new diff
+				client.Logger.Info(fmt.Sprintf("vardiff retarget %f -> %f", state.getStratumDiff().diffValue, next))
+				diff := state.setStratumDiff(next)
+				if err := sendDifficulty(client, diff); err != nil {
 					return
 				}
 			}
 
-			jobParams := []any{fmt.Sprintf("%d", jobId)}
-			if state.useBigJob {
-				jobParams = append(jobParams, GenerateLargeJobParams(header, uint64(template.Block.Header.Timestamp)))
-			} else {
-				jobParams = append(jobParams, GenerateJobHeader(header))
-				jobParams = append(jobParams, template.Block.Header.Timestamp)
-			}
+			tip := c.shareHandler.updateTip(template.Block.Header.BlueScore)
+			jobId := state.AddJob(template.Block, tip)
+			jobParams := append([]any{fmt.Sprintf("%d", jobId)},
+				state.getEncoder().NotifyParams(header, uint64(template.Block.Header.Timestamp))...)
 
 			// // normal notify flow
 			if err := client.Send(gostratum.JsonRpcEvent{
@@ -163,9 +323,14 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 			}
 
 			RecordNewJob(client)
+			ev := newClientEvent(EventJob, client)
+			ev.JobId = jobId
+			ev.Diff = state.getStratumDiff().diffValue
+			ev.BlueScore = template.Block.Header.BlueScore
+			c.shareHandler.events.publish(ev)
 		}(cl)
 
-		if cl.WalletAddr != "" {
+		if cl.Authorized() {
 			addresses = append(addresses, cl.WalletAddr)
 		}
 	}
@@ -175,7 +340,7 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 		c.lastBalanceCheck = time.Now()
 		if len(addresses) > 0 {
 			go func() {
-				balances, err := kapi.kaspad.GetBalancesByAddresses(addresses)
+				balances, err := kapi.GetBalancesByAddresses(addresses)
 				if err != nil {
 					c.logger.Warn("failed to get balances from kaspa, prom stats will be out of date", zap.Error(err))
 					return
@@ -185,3 +350,17 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 		}
 	}
 }
+
+func sendDifficulty(client *gostratum.StratumContext, diff *kaspaDiff) error {
+	if err := client.Send(gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.set_difficulty",
+		Params:  []any{diff.diffValue},
+	}); err != nil {
+		RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
+		client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error(), zap.Any("context", client))
+		return err
+	}
+	RecordWorkerDifficulty(client, diff.diffValue)
+	return nil
+}
@@ -0,0 +1,273 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+)
+
+const configPollInterval = 5 * time.Second
+
+// config fields (by yaml name) that can be applied to a running bridge,
+// anything else needs a restart to take effect
+var liveConfigFields = map[string]bool{
+	"min_share_diff":    true,
+	"var_diff":          true,
+	"shares_per_min":    true,
+	"var_diff_min":      true,
+	"var_diff_max":      true,
+	"var_diff_retarget": true,
+	"block_wait_time":   true,
+	"log_level":         true,
+	"stale_window":      true,
+	"max_job_age":       true,
+}
+
+// LoadConfigFile parses a yaml config file
+func LoadConfigFile(path string) (BridgeConfig, error) {
+	cfg := BridgeConfig{}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrap(err, "failed reading config file")
+	}
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "failed parsing config file")
+	}
+	return cfg, nil
+}
+
+func parseLogLevel(level string) (zapcore.Level, error) {
+	parsed := zapcore.InfoLevel
+	if level == "" {
+		return parsed, nil
+	}
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return parsed, fmt.Errorf("invalid log_level %q", level)
+	}
+	return parsed, nil
+}
+
+// Validate catches settings that can't work together, checked on startup
+// and before a reloaded config is applied
+func (cfg BridgeConfig) Validate() error {
+	if cfg.StratumPort == "" && cfg.StratumTLSPort == "" {
+		return fmt.Errorf("stratum_port or stratum_tls_port is required")
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if cfg.VarDiffMax > 0 && cfg.VarDiffMax < cfg.VarDiffMin {
+		return fmt.Errorf("var_diff_max (%d) is below var_diff_min (%d)", cfg.VarDiffMax, cfg.VarDiffMin)
+	}
+	if cfg.PoolFee < 0 || cfg.PoolFee > 100 {
+		return fmt.Errorf("pool_fee must be between 0 and 100, got %f", cfg.PoolFee)
+	}
+	if cfg.PoolAddress != "" && cfg.UpstreamPool != "" {
+		return fmt.Errorf("pool_address and upstream_pool can't both be set")
+	}
+	if err := validateHashrateWindows(cfg.HashrateWindows); err != nil {
+		return err
+	}
+	if err := validateAlerts(cfg.Alerts, cfg.HashrateWindows); err != nil {
+		return err
+	}
+	if err := validateProfiles(cfg); err != nil {
+		return err
+	}
+	if _, err := newAuthPolicy(cfg); err != nil {
+		return err
+	}
+	if _, err := newEncoderSelector(cfg.JobEncoders); err != nil {
+		return err
+	}
+	if _, err := newAdmission(cfg, nil); err != nil {
+		return err
+	}
+	if cfg.MaxLineLength < 0 {
+		return fmt.Errorf("max_line_length can't be negative")
+	}
+	if cfg.MaxConns < 0 || cfg.MaxConnsPerIP < 0 || cfg.AcceptRate < 0 {
+		return fmt.Errorf("max_connections, max_connections_per_ip and accept_rate can't be negative")
+	}
+	if cfg.ShutdownReconnect != "" {
+		if _, _, err := parseReconnect(cfg.ShutdownReconnect); err != nil {
+			return err
+		}
+	}
+	if cfg.StratumTLSPort != "" && !cfg.TLSSelfSigned && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return fmt.Errorf("stratum_tls_port needs tls_cert_file and tls_key_file, or tls_self_signed")
+	}
+	return nil
+}
+
+func yamlName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+// restartRequired lists the yaml names of changed fields that can't be
+// applied live
+func restartRequired(old, new BridgeConfig) []string {
+	var fields []string
+	oldVal, newVal := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldVal.NumField(); i++ {
+		name := yamlName(oldVal.Type().Field(i))
+		if name == "" || name == "-" || liveConfigFields[name] {
+			continue
+		}
+		if name == "ports" {
+			if !samePortLayout(old.Ports, new.Ports) {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// configReloader re-reads the config on SIGHUP or when the file changes,
+// applying what it can to the running bridge. Components not running in the
+// current mode are left nil
+type configReloader struct {
+	logger       *zap.SugaredLogger
+	level        zap.AtomicLevel
+	loader       func() (BridgeConfig, error)
+	path         string
+	lock         sync.Mutex
+	current      BridgeConfig
+	lastModified time.Time
+	kaspa        *KaspaApi
+	clients      *clientListener
+	shareHandler *shareHandler
+}
+
+func newConfigReloader(cfg BridgeConfig, logger *zap.SugaredLogger, level zap.AtomicLevel) *configReloader {
+	loader := cfg.ConfigLoader
+	if loader == nil {
+		loader = func() (BridgeConfig, error) { return LoadConfigFile(cfg.ConfigPath) }
+	}
+	r := &configReloader{
+		logger:  logger.With(zap.String("component", "config")),
+		level:   level,
+		loader:  loader,
+		path:    cfg.ConfigPath,
+		current: cfg,
+	}
+	if info, err := os.Stat(cfg.ConfigPath); err == nil {
+		r.lastModified = info.ModTime()
+	}
+	return r
+}
+
+func (r *configReloader) start(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		poll := time.NewTicker(configPollInterval)
+		defer poll.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				r.logger.Info("SIGHUP received, reloading config")
+				r.reload()
+			case <-poll.C:
+				if r.fileChanged() {
+					r.logger.Info("config file changed, reloading")
+					r.reload()
+				}
+			}
+		}
+	}()
+}
+
+func (r *configReloader) fileChanged() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if info.ModTime().Equal(r.lastModified) {
+		return false
+	}
+	r.lastModified = info.ModTime()
+	return true
+}
+
+// reload loads and validates the config, applying live fields and logging
+// any that need a restart. An invalid config leaves the running one in place
+func (r *configReloader) reload() error {
+	next, err := r.loader()
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		r.logger.Error("config reload failed, keeping current config: ", err)
+		return err
+	}
+	// not reloadable, carry them over so they don't read as changes
+	next.Payer = r.current.Payer
+	next.AlertSinks = r.current.AlertSinks
+	next.ConfigLoader = r.current.ConfigLoader
+	next.ConfigPath = r.current.ConfigPath
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if pending := restartRequired(r.current, next); len(pending) > 0 {
+		r.logger.Warn("config changes need a restart to take effect: " + strings.Join(pending, ", "))
+	}
+
+	level, _ := parseLogLevel(next.LogLevel)
+	if level != r.level.Level() {
+		r.logger.Info("log level -> " + level.String())
+		r.level.SetLevel(level)
+	}
+	if r.kaspa != nil {
+		r.kaspa.SetBlockWaitTime(blockWaitTimeFor(next))
+	}
+	if r.shareHandler != nil {
+		r.shareHandler.setStaleLimits(next.StaleWindow, next.MaxJobAge)
+	}
+	if r.clients != nil {
+		minDiff, varDiff := diffSettingsFor(next)
+		r.clients.applyDiffSettings(defaultProfileName, minDiff, varDiff)
+		for _, p := range next.Ports {
+			minDiff, varDiff := diffSettingsFor(profileConfig(next, p))
+			r.clients.applyDiffSettings(p.Name, minDiff, varDiff)
+		}
+	}
+	// restart-only fields keep their running values so they're reported
+	// again if still different on the next reload
+	applied := r.current
+	appliedVal, nextVal := reflect.ValueOf(&applied).Elem(), reflect.ValueOf(next)
+	for i := 0; i < appliedVal.NumField(); i++ {
+		if liveConfigFields[yamlName(appliedVal.Type().Field(i))] {
+			appliedVal.Field(i).Set(nextVal.Field(i))
+		}
+	}
+	if samePortLayout(applied.Ports, next.Ports) {
+		applied.Ports = next.Ports // only the difficulty settings differ
+	}
+	r.current = applied
+	r.logger.Info("config reloaded")
+	return nil
+}
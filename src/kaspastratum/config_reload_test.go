@@ -0,0 +1,101 @@
+package kaspastratum
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestConfigValidate(t *testing.T) {
+	base := BridgeConfig{StratumPort: ":5555"}
+	if err := base.Validate(); err != nil {
+		t.Fatalf("expected base config to validate: %s", err)
+	}
+	cases := map[string]func(cfg *BridgeConfig){
+		"missing port":    func(cfg *BridgeConfig) { cfg.StratumPort = "" },
+		"bad log level":   func(cfg *BridgeConfig) { cfg.LogLevel = "loud" },
+		"vardiff bounds":  func(cfg *BridgeConfig) { cfg.VarDiffMin, cfg.VarDiffMax = 64, 8 },
+		"pool fee":        func(cfg *BridgeConfig) { cfg.PoolFee = 120 },
+		"pool and proxy":  func(cfg *BridgeConfig) { cfg.PoolAddress, cfg.UpstreamPool = "kaspa:a", "pool:3112" },
+		"tls without key": func(cfg *BridgeConfig) { cfg.StratumTLSPort = ":5556" },
+	}
+	for name, mutate := range cases {
+		cfg := base
+		mutate(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	tlsOnly := BridgeConfig{StratumTLSPort: ":5556", TLSSelfSigned: true}
+	if err := tlsOnly.Validate(); err != nil {
+		t.Fatalf("expected tls only config to validate: %s", err)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := BridgeConfig{StratumPort: ":5555", MinShareDiff: 4, PromPort: ":2112"}
+	next := old
+	next.MinShareDiff = 64
+	next.LogLevel = "debug"
+	if pending := restartRequired(old, next); len(pending) != 0 {
+		t.Fatalf("live fields reported as needing restart: %v", pending)
+	}
+	next.StratumPort = ":6666"
+	next.PromPort = ""
+	if pending := restartRequired(old, next); !reflect.DeepEqual(pending, []string{"prom_port", "stratum_port"}) {
+		t.Fatalf("unexpected restart fields %v", pending)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	cfg := BridgeConfig{StratumPort: ":5555", MinShareDiff: 4, StaleWindow: 8}
+	next, loadErr := cfg, error(nil)
+	cfg.ConfigLoader = func() (BridgeConfig, error) { return next, loadErr }
+
+	level := zap.NewAtomicLevel()
+	sh := newShareHandler(nil, cfg.StaleWindow, 0)
+	minDiff, varDiff := diffSettingsFor(cfg)
+	clients := newClientListener(zap.NewNop().Sugar(), sh, minDiff, varDiff, 0)
+	r := newConfigReloader(cfg, zap.NewNop().Sugar(), level)
+	r.shareHandler = sh
+	r.clients = clients
+
+	next.MinShareDiff = 64
+	next.StaleWindow = 20
+	next.MaxJobAge = time.Minute
+	next.LogLevel = "debug"
+	next.StratumPort = ":6666" // restart only
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload failed: %s", err)
+	}
+	if minDiff, _ := clients.diffSettings(); minDiff != 64 {
+		t.Errorf("expected min diff 64 after reload, got %f", minDiff)
+	}
+	if sh.staleWindow.Load() != 20 || sh.maxJobAge.Load() != time.Minute {
+		t.Errorf("stale limits not applied")
+	}
+	if level.Level() != zapcore.DebugLevel {
+		t.Errorf("expected debug level after reload, got %s", level.Level())
+	}
+	if r.current.StratumPort != ":5555" {
+		t.Errorf("restart only field applied live")
+	}
+
+	// bad configs leave the running one alone
+	next.MinShareDiff = 128
+	next.VarDiffMin, next.VarDiffMax = 64, 8
+	if err := r.reload(); err == nil {
+		t.Fatalf("expected invalid config to be rejected")
+	}
+	loadErr = errors.New("unreadable")
+	if err := r.reload(); err == nil {
+		t.Fatalf("expected load error to be returned")
+	}
+	if minDiff, _ := clients.diffSettings(); minDiff != 64 {
+		t.Errorf("rejected reload changed min diff to %f", minDiff)
+	}
+}
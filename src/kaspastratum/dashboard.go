@@ -0,0 +1,20 @@
+package kaspastratum
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the embedded web ui, which polls the json api
+// served alongside it
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // embedded at build time, can't happen
+	}
+	return http.FileServer(http.FS(files))
+}
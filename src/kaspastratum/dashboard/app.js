@@ -0,0 +1,148 @@
+// Polls the bridge's json api and renders it, no dependencies so the page
+// works offline on a home network
+(function () {
+  "use strict";
+
+  const refreshMs = 5000;
+  const idleMs = 5 * 60 * 1000; // workers without a share this long are flagged
+
+  function formatHashrate(ghs) {
+    const units = ["GH/s", "TH/s", "PH/s", "EH/s"];
+    let i = 0;
+    while (ghs >= 1000 && i < units.length - 1) {
+      ghs /= 1000;
+      i++;
+    }
+    return ghs.toFixed(2) + " " + units[i];
+  }
+
+  function acceptance(acc, stale, dupe, invalid) {
+    const total = acc + stale + dupe + invalid;
+    return total === 0 ? "-" : ((100 * acc) / total).toFixed(1) + "%";
+  }
+
+  function ago(ts) {
+    const t = new Date(ts).getTime();
+    if (!t || t < 0) {
+      return "-";
+    }
+    const secs = Math.max(0, Math.round((Date.now() - t) / 1000));
+    if (secs < 60) return secs + "s ago";
+    if (secs < 3600) return Math.round(secs / 60) + "m ago";
+    if (secs < 86400) return Math.round(secs / 3600) + "h ago";
+    return Math.round(secs / 86400) + "d ago";
+  }
+
+  function cell(text, cls) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    if (cls) td.className = cls;
+    return td;
+  }
+
+  function fillTable(id, rows, render) {
+    const body = document.getElementById(id);
+    body.replaceChildren();
+    rows.forEach(function (row) {
+      body.appendChild(render(row));
+    });
+  }
+
+  function setText(id, text) {
+    document.getElementById(id).textContent = text;
+  }
+
+  async function getJSON(path) {
+    const resp = await fetch(path);
+    if (resp.status === 404) return null; // endpoint not available in this mode
+    if (!resp.ok) throw new Error(path + ": " + resp.status);
+    return resp.json();
+  }
+
+  function renderSummary(s) {
+    setText("version", s.version);
+    setText("hashrate", formatHashrate(s.recent_hashrate_ghs));
+    setText("workers-count", s.workers);
+    setText("accepted", s.shares_found);
+    setText("acceptance", acceptance(s.shares_found, s.stale_shares, s.dupe_shares, s.invalid_shares));
+    setText("blocks-count", s.blocks_found);
+    setText("uptime", s.uptime);
+  }
+
+  function renderWorkers(workers) {
+    fillTable("workers", workers, function (w) {
+      const tr = document.createElement("tr");
+      if (Date.now() - new Date(w.last_share).getTime() > idleMs) tr.className = "idle";
+      tr.append(
+        cell(w.worker || w.remote_addr),
+        cell(w.wallet, "wallet"),
+        cell(w.miner_app),
+        cell(w.difficulty),
+        cell(formatHashrate(w.recent_hashrate_ghs)),
+        cell([w.shares_found, w.stale_shares, w.dupe_shares, w.invalid_shares].join("/")),
+        cell(acceptance(w.shares_found, w.stale_shares, w.dupe_shares, w.invalid_shares)),
+        cell(w.blocks_found),
+        cell(ago(w.last_share))
+      );
+      return tr;
+    });
+  }
+
+  function renderBlocks(blocks) {
+    fillTable("blocks", blocks, function (b) {
+      const tr = document.createElement("tr");
+      tr.append(cell(ago(b.timestamp)), cell(b.worker), cell(b.blue_score), cell(b.hash, "hash"));
+      return tr;
+    });
+  }
+
+  function renderNetwork(info) {
+    const section = document.getElementById("network-section");
+    if (!info) {
+      section.hidden = true; // proxy mode
+      return;
+    }
+    section.hidden = false;
+    const n = info.network;
+    setText("network", n.updated_at && new Date(n.updated_at).getTime() > 0
+      ? "network hashrate " + formatHashrate(n.hashrate / 1e9) + ", difficulty " +
+        n.difficulty.toExponential(3) + ", " + n.block_count + " blocks"
+      : "waiting for network stats");
+    fillTable("nodes", info.nodes, function (node) {
+      const tr = document.createElement("tr");
+      tr.append(
+        cell(node.address),
+        cell(node.active ? "yes" : ""),
+        cell(node.synced ? "yes" : "no"),
+        cell(node.rpc_ok ? "ok" : "down"),
+        cell(node.latency_ms + "ms"),
+        cell(ago(node.last_notification))
+      );
+      return tr;
+    });
+  }
+
+  async function refresh() {
+    const status = document.getElementById("status");
+    try {
+      const [summary, workers, blocks, network] = await Promise.all([
+        getJSON("api/v1/summary"),
+        getJSON("api/v1/workers"),
+        getJSON("api/v1/blocks?limit=20"),
+        getJSON("api/v1/network"),
+      ]);
+      renderSummary(summary);
+      renderWorkers(workers);
+      renderBlocks(blocks);
+      renderNetwork(network);
+      status.textContent = "updated " + new Date().toLocaleTimeString();
+      status.className = "status ok";
+    } catch (err) {
+      status.textContent = "bridge unreachable";
+      status.className = "status err";
+    }
+  }
+
+  refresh();
+  setInterval(refresh, refreshMs);
+})();
@@ -11,4 +11,7 @@ const (
 	ErrFailedSendWork    ErrorShortCodeT = "err_failed_sending_work"
 	ErrFailedSetDiff     ErrorShortCodeT = "err_diff_set_failed"
 	ErrDisconnected      ErrorShortCodeT = "err_worker_disconnected"
+	ErrNoUpstream        ErrorShortCodeT = "err_no_upstream_available"
+	ErrUpstreamSubmit    ErrorShortCodeT = "err_upstream_submit_failed"
+	ErrUnauthorized      ErrorShortCodeT = "err_unauthorized_worker"
 )
@@ -0,0 +1,152 @@
+package kaspastratum
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/atomic"
+)
+
+// per subscriber, events past this are dropped rather than blocking mining
+const eventBufferSize = 256
+
+type EventType string
+
+const (
+	EventConnect       EventType = "connect"
+	EventAuthorize     EventType = "authorize"
+	EventDisconnect    EventType = "disconnect"
+	EventJob           EventType = "job"
+	EventShareAccepted EventType = "share_accepted"
+	EventShareRejected EventType = "share_rejected"
+	EventBlockFound    EventType = "block_found"
+	// sent to a subscriber that fell behind, Count is how many were dropped
+	EventDropped EventType = "dropped"
+)
+
+type BridgeEvent struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	ClientId   int32     `json:"client_id,omitempty"`
+	Worker     string    `json:"worker,omitempty"`
+	Wallet     string    `json:"wallet,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	MinerApp   string    `json:"miner_app,omitempty"`
+	JobId      int       `json:"job_id,omitempty"`
+	Diff       float64   `json:"diff,omitempty"`
+	Reason     ShareType `json:"reason,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	BlueScore  uint64    `json:"blue_score,omitempty"`
+	Count      uint64    `json:"count,omitempty"`
+}
+
+func newClientEvent(eventType EventType, ctx *gostratum.StratumContext) BridgeEvent {
+	return BridgeEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		ClientId:   ctx.Id,
+		Worker:     ctx.WorkerName,
+		Wallet:     ctx.WalletAddr,
+		RemoteAddr: ctx.RemoteAddr,
+		MinerApp:   ctx.RemoteApp,
+	}
+}
+
+// eventFilter limits a subscription, empty sets match everything
+type eventFilter struct {
+	wallets map[string]bool
+	workers map[string]bool
+	types   map[EventType]bool
+}
+
+// parseEventFilter builds a filter from comma separated lists
+func parseEventFilter(wallets, workers, types string) eventFilter {
+	split := func(in string) map[string]bool {
+		set := map[string]bool{}
+		for _, v := range strings.Split(in, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				set[v] = true
+			}
+		}
+		return set
+	}
+	filter := eventFilter{
+		wallets: split(wallets),
+		workers: split(workers),
+		types:   map[EventType]bool{},
+	}
+	for t := range split(types) {
+		filter.types[EventType(t)] = true
+	}
+	return filter
+}
+
+func (f eventFilter) matches(ev BridgeEvent) bool {
+	if len(f.types) > 0 && !f.types[ev.Type] {
+		return false
+	}
+	if len(f.wallets) > 0 && !f.wallets[ev.Wallet] {
+		return false
+	}
+	if len(f.workers) > 0 && !f.workers[ev.Worker] {
+		return false
+	}
+	return true
+}
+
+type eventSubscriber struct {
+	filter  eventFilter
+	events  chan BridgeEvent
+	dropped atomic.Uint64
+}
+
+// takeDropped returns and resets the number of events dropped since the
+// last call
+func (s *eventSubscriber) takeDropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+// eventBus fans bridge activity out to subscribers. Publishing never blocks,
+// a subscriber that isn't keeping up just misses events
+type eventBus struct {
+	lock        sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+func (b *eventBus) subscribe(filter eventFilter) *eventSubscriber {
+	sub := &eventSubscriber{
+		filter: filter,
+		events: make(chan BridgeEvent, eventBufferSize),
+	}
+	b.lock.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.lock.Unlock()
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.lock.Lock()
+	delete(b.subscribers, sub)
+	b.lock.Unlock()
+}
+
+func (b *eventBus) publish(ev BridgeEvent) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for sub := range b.subscribers {
+		if !sub.filter.matches(ev) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			sub.dropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package kaspastratum
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestEventFilter(t *testing.T) {
+	filter := parseEventFilter("kaspa:a, kaspa:b", "", "share_accepted,block_found")
+	cases := []struct {
+		ev    BridgeEvent
+		match bool
+	}{
+		{BridgeEvent{Type: EventShareAccepted, Wallet: "kaspa:a"}, true},
+		{BridgeEvent{Type: EventBlockFound, Wallet: "kaspa:b", Worker: "rig"}, true},
+		{BridgeEvent{Type: EventShareRejected, Wallet: "kaspa:a"}, false},
+		{BridgeEvent{Type: EventShareAccepted, Wallet: "kaspa:c"}, false},
+	}
+	for _, c := range cases {
+		if filter.matches(c.ev) != c.match {
+			t.Errorf("expected match %t for %+v", c.match, c.ev)
+		}
+	}
+	if !parseEventFilter("", "", "").matches(BridgeEvent{Type: EventJob}) {
+		t.Errorf("empty filter should match everything")
+	}
+}
+
+func TestEventBusDropsForSlowSubscribers(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.subscribe(eventFilter{})
+	for i := 0; i < eventBufferSize+10; i++ {
+		bus.publish(BridgeEvent{Type: EventJob, JobId: i}) // must not block
+	}
+	if dropped := sub.takeDropped(); dropped != 10 {
+		t.Fatalf("expected 10 dropped events, got %d", dropped)
+	}
+	if dropped := sub.takeDropped(); dropped != 0 {
+		t.Fatalf("dropped count should reset, got %d", dropped)
+	}
+	bus.unsubscribe(sub)
+	bus.publish(BridgeEvent{Type: EventJob})
+	if len(sub.events) != eventBufferSize {
+		t.Fatalf("unsubscribed subscriber still receiving events")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	server := httptest.NewServer(newAPIServer(zap.NewNop().Sugar(), fakeClients{}, sh, nil).handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/events?worker=rig1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed connecting to event stream: %s", err)
+	}
+	defer conn.Close()
+
+	// subscription is registered after the upgrade, give it a moment
+	deadline := time.Now().Add(time.Second)
+	for {
+		sh.events.lock.RLock()
+		subscribed := len(sh.events.subscribers) > 0
+		sh.events.lock.RUnlock()
+		if subscribed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	diff := newKaspaDiff()
+	diff.setDiffValue(4)
+	other := &gostratum.StratumContext{WorkerName: "rig2", WalletAddr: "kaspa:a"}
+	ctx := &gostratum.StratumContext{WorkerName: "rig1", WalletAddr: "kaspa:a"}
+	sh.recordShare(other, ShareAccepted, diff, 10)
+	sh.recordShare(ctx, ShareStale, diff, 11)
+	sh.recordBlock(ctx, "abcd", 1, 12)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var ev BridgeEvent
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatalf("failed reading event: %s", err)
+	}
+	if ev.Type != EventShareRejected || ev.Reason != ShareStale || ev.Worker != "rig1" || ev.Diff != 4 {
+		t.Fatalf("unexpected first event %+v", ev)
+	}
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatalf("failed reading event: %s", err)
+	}
+	if ev.Type != EventBlockFound || ev.Hash != "abcd" {
+		t.Fatalf("unexpected second event %+v", ev)
+	}
+}
@@ -0,0 +1,329 @@
+package kaspastratum
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
+	"github.com/kaspanet/kaspad/util/difficulty"
+	"github.com/pkg/errors"
+)
+
+// FakeKaspad is an in process stand in for a kaspad node. It serves block
+// templates at a fixed difficulty, either scripted or generated on top of
+// the last one, checks the pow of submitted blocks and records those that
+// pass. Pass Dial as BridgeConfig.KaspadDialer to run a bridge against it
+type FakeKaspad struct {
+	lock        sync.Mutex
+	difficulty  float64
+	synced      bool
+	script      []*appmessage.RPCBlock
+	template    *appmessage.RPCBlock
+	templates   int
+	blocks      []*externalapi.DomainBlock
+	accepted    map[string]*externalapi.DomainBlock
+	rejected    int
+	subscribers []func(*appmessage.NewBlockTemplateNotificationMessage)
+	blockFound  chan struct{}
+}
+
+// NewFakeKaspad creates a synced fake node serving templates at the given
+// difficulty, in the same units as share difficulty. Anything below about
+// 1e-6 can be mined by brute force in a test. A difficulty of 0 leaves the
+// bits of scripted templates alone, generated ones are at difficulty 1
+func NewFakeKaspad(diff float64) *FakeKaspad {
+	f := &FakeKaspad{
+		difficulty: diff,
+		synced:     true,
+		accepted:   map[string]*externalapi.DomainBlock{},
+		blockFound: make(chan struct{}, 1),
+	}
+	f.template = f.nextTemplate(nil)
+	return f
+}
+
+// Dial hands out a connection to the fake, suitable as a KaspadDialer
+func (f *FakeKaspad) Dial(string) (KaspadBackend, error) {
+	return &fakeKaspadClient{kaspad: f}, nil
+}
+
+// Script queues templates to be served, in order, by the following calls
+// to NewTemplate. Once the script runs out templates are generated again
+func (f *FakeKaspad) Script(templates ...*appmessage.RPCBlock) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.script = append(f.script, templates...)
+}
+
+// SetDifficulty changes the difficulty, taking effect from the next template
+func (f *FakeKaspad) SetDifficulty(diff float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.difficulty = diff
+}
+
+func (f *FakeKaspad) SetSynced(synced bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.synced = synced
+}
+
+// NewTemplate moves on to the next template and notifies subscribers, as
+// kaspad does when the virtual changes
+func (f *FakeKaspad) NewTemplate() {
+	f.lock.Lock()
+	var next *appmessage.RPCBlock
+	if len(f.script) > 0 {
+		next, f.script = f.script[0], f.script[1:]
+	}
+	f.template = f.nextTemplate(next)
+	subscribers := append([]func(*appmessage.NewBlockTemplateNotificationMessage){}, f.subscribers...)
+	f.lock.Unlock()
+	for _, notify := range subscribers {
+		notify(appmessage.NewNewBlockTemplateNotificationMessage())
+	}
+}
+
+// Template returns the template currently being served
+func (f *FakeKaspad) Template() *appmessage.RPCBlock {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.template
+}
+
+// Blocks returns the blocks accepted so far, in submission order
+func (f *FakeKaspad) Blocks() []*externalapi.DomainBlock {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*externalapi.DomainBlock{}, f.blocks...)
+}
+
+// Rejected is the number of submitted blocks that failed the pow check or
+// were duplicates
+func (f *FakeKaspad) Rejected() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rejected
+}
+
+// WaitForBlocks blocks until at least count blocks have been accepted or
+// the timeout expires, returning the accepted blocks either way
+func (f *FakeKaspad) WaitForBlocks(count int, timeout time.Duration) []*externalapi.DomainBlock {
+	deadline := time.After(timeout)
+	for {
+		if blocks := f.Blocks(); len(blocks) >= count {
+			return blocks
+		}
+		select {
+		case <-f.blockFound:
+		case <-deadline:
+			return f.Blocks()
+		}
+	}
+}
+
+// nextTemplate stamps the template with the current difficulty, building
+// one on top of the current template if nothing was scripted. Called with
+// the lock held
+func (f *FakeKaspad) nextTemplate(scripted *appmessage.RPCBlock) *appmessage.RPCBlock {
+	f.templates++
+	if scripted != nil {
+		header := *scripted.Header
+		template := &appmessage.RPCBlock{Header: &header, Transactions: scripted.Transactions}
+		if f.difficulty > 0 {
+			template.Header.Bits = difficulty.BigToCompact(DiffToTarget(f.difficulty))
+		}
+		return template
+	}
+
+	fakeHash := func(kind string) string {
+		seed := make([]byte, 8)
+		binary.LittleEndian.PutUint64(seed, uint64(f.templates))
+		hash := sha256.Sum256(append([]byte(kind), seed...))
+		return hex.EncodeToString(hash[:])
+	}
+	header := &appmessage.RPCBlockHeader{
+		Version:              1,
+		Parents:              []*appmessage.RPCBlockLevelParents{{ParentHashes: []string{fakeHash("parent")}}},
+		HashMerkleRoot:       fakeHash("merkle"),
+		AcceptedIDMerkleRoot: fakeHash("accepted"),
+		UTXOCommitment:       fakeHash("utxo"),
+		DAAScore:             uint64(f.templates),
+		BlueScore:            uint64(f.templates),
+		BlueWork:             fmt.Sprintf("%x", f.templates),
+		PruningPoint:         fakeHash("pruning"),
+	}
+	if f.template != nil {
+		header.DAAScore = f.template.Header.DAAScore + 1
+		header.BlueScore = f.template.Header.BlueScore + 1
+		if len(f.blocks) > 0 {
+			tip := consensushashing.BlockHash(f.blocks[len(f.blocks)-1]).String()
+			header.Parents = []*appmessage.RPCBlockLevelParents{{ParentHashes: []string{tip}}}
+		}
+	}
+	diff := f.difficulty
+	if diff <= 0 {
+		diff = 1
+	}
+	header.Bits = difficulty.BigToCompact(DiffToTarget(diff))
+	return &appmessage.RPCBlock{Header: header}
+}
+
+func (f *FakeKaspad) submit(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	hash := consensushashing.BlockHash(block).String()
+	if !pow.NewState(block.Header.ToMutable()).CheckProofOfWork() {
+		f.lock.Lock()
+		f.rejected++
+		f.lock.Unlock()
+		return appmessage.RejectReasonBlockInvalid, fmt.Errorf("block %s is invalid: ErrInvalidPoW", hash)
+	}
+	f.lock.Lock()
+	if _, exists := f.accepted[hash]; exists {
+		f.rejected++
+		f.lock.Unlock()
+		return appmessage.RejectReasonBlockInvalid, fmt.Errorf("block %s is invalid: ErrDuplicateBlock", hash)
+	}
+	f.accepted[hash] = block
+	f.blocks = append(f.blocks, block)
+	f.lock.Unlock()
+
+	select { // non-blocking, waiters recheck the count
+	case f.blockFound <- struct{}{}:
+	default:
+	}
+	f.NewTemplate() // the new block moves the virtual on
+	return appmessage.RejectReasonNone, nil
+}
+
+// fakeKaspadClient is a single connection to a FakeKaspad, closing it
+// doesn't affect other connections
+type fakeKaspadClient struct {
+	kaspad *FakeKaspad
+	lock   sync.Mutex
+	closed bool
+}
+
+var errFakeKaspadClosed = errors.New("connection to fake kaspad closed")
+
+func (c *fakeKaspadClient) check() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errFakeKaspadClosed
+	}
+	return nil
+}
+
+func (c *fakeKaspadClient) GetInfo() (*appmessage.GetInfoResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.kaspad.lock.Lock()
+	defer c.kaspad.lock.Unlock()
+	return &appmessage.GetInfoResponseMessage{ServerVersion: "fake", IsSynced: c.kaspad.synced}, nil
+}
+
+func (c *fakeKaspadClient) GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.kaspad.lock.Lock()
+	defer c.kaspad.lock.Unlock()
+	// every request gets its own copy stamped with the current time, as
+	// kaspad does
+	header := *c.kaspad.template.Header
+	header.Timestamp = time.Now().UnixMilli()
+	return &appmessage.GetBlockTemplateResponseMessage{
+		Block:    &appmessage.RPCBlock{Header: &header, Transactions: c.kaspad.template.Transactions},
+		IsSynced: c.kaspad.synced,
+	}, nil
+}
+
+func (c *fakeKaspadClient) SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	if err := c.check(); err != nil {
+		return appmessage.RejectReasonNone, err
+	}
+	return c.kaspad.submit(block)
+}
+
+func (c *fakeKaspadClient) GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.kaspad.lock.Lock()
+	defer c.kaspad.lock.Unlock()
+	header := c.kaspad.template.Header
+	return &appmessage.GetBlockDAGInfoResponseMessage{
+		NetworkName:     "kaspa-fakenet",
+		BlockCount:      header.BlueScore,
+		HeaderCount:     header.BlueScore,
+		TipHashes:       header.Parents[0].ParentHashes,
+		Difficulty:      c.kaspad.difficulty,
+		VirtualDAAScore: header.DAAScore,
+	}, nil
+}
+
+func (c *fakeKaspadClient) EstimateNetworkHashesPerSecond(string, uint32) (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.kaspad.lock.Lock()
+	defer c.kaspad.lock.Unlock()
+	// one block a second
+	return &appmessage.EstimateNetworkHashesPerSecondResponseMessage{
+		NetworkHashesPerSecond: uint64(DiffToHash(c.kaspad.difficulty) * 1e9),
+	}, nil
+}
+
+func (c *fakeKaspadClient) GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	response := &appmessage.GetBalancesByAddressesResponseMessage{}
+	for _, address := range addresses {
+		response.Entries = append(response.Entries, &appmessage.BalancesByAddressesEntry{Address: address})
+	}
+	return response, nil
+}
+
+func (c *fakeKaspadClient) GetBlock(hash string, _ bool) (*appmessage.GetBlockResponseMessage, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.kaspad.lock.Lock()
+	block, exists := c.kaspad.accepted[hash]
+	c.kaspad.lock.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+	return &appmessage.GetBlockResponseMessage{Block: appmessage.DomainBlockToRPCBlock(block)}, nil
+}
+
+func (c *fakeKaspadClient) RegisterForNewBlockTemplateNotifications(
+	onNewBlockTemplate func(*appmessage.NewBlockTemplateNotificationMessage)) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	c.kaspad.lock.Lock()
+	defer c.kaspad.lock.Unlock()
+	c.kaspad.subscribers = append(c.kaspad.subscribers, func(msg *appmessage.NewBlockTemplateNotificationMessage) {
+		if c.check() == nil {
+			onNewBlockTemplate(msg)
+		}
+	})
+	return nil
+}
+
+func (c *fakeKaspadClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,190 @@
+package kaspastratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// fakeKaspaApi connects a KaspaApi to the fake node, ready to serve templates
+func fakeKaspaApi(t *testing.T, fake *FakeKaspad) *KaspaApi {
+	ks, err := NewKaspaAPI([]string{"fake"}, fake.Dial, false, minBlockWaitTime, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.waitForSync(false)
+	return ks
+}
+
+func TestFakeKaspadSubmit(t *testing.T) {
+	fake := NewFakeKaspad(1e-6)
+	client, _ := fake.Dial("fake")
+	template, err := client.GetBlockTemplate(testWalletA, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := appmessage.RPCBlockToDomainBlock(template.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks are easy enough that good and bad nonces both turn up quickly
+	header := block.Header.ToMutable()
+	var good, bad []uint64
+	for nonce := uint64(0); len(good) == 0 || len(bad) == 0; nonce++ {
+		header.SetNonce(nonce)
+		if pow.NewState(header).CheckProofOfWork() {
+			good = append(good, nonce)
+		} else {
+			bad = append(bad, nonce)
+		}
+	}
+	header.SetNonce(bad[0])
+	block.Header = header.ToImmutable()
+	if _, err := client.SubmitBlock(block); err == nil {
+		t.Fatalf("block with bad pow accepted")
+	}
+	header.SetNonce(good[0])
+	block.Header = header.ToImmutable()
+	if _, err := client.SubmitBlock(block); err != nil {
+		t.Fatalf("valid block rejected: %s", err)
+	}
+	if _, err := client.SubmitBlock(block); err == nil {
+		t.Fatalf("duplicate block accepted")
+	}
+	if blocks := fake.Blocks(); len(blocks) != 1 || fake.Rejected() != 2 {
+		t.Fatalf("expected 1 block and 2 rejects, got %d and %d", len(blocks), fake.Rejected())
+	}
+	if next := fake.Template(); next.Header.BlueScore != template.Block.Header.BlueScore+1 {
+		t.Fatalf("template not moved on after block found")
+	}
+}
+
+// TestMinerToBlock runs a miner against a bridge backed by the fake node,
+// from subscribe through to the block arriving at kaspad
+func TestMinerToBlock(t *testing.T) {
+	const port = "127.0.0.1:15559"
+	cfg := BridgeConfig{StratumPort: port, MinShareDiff: 1, ExtranonceSize: 2, StaleWindow: 8}
+	logger := zap.NewNop().Sugar()
+	fake := NewFakeKaspad(1e-6)
+	ksApi := fakeKaspaApi(t, fake)
+	defer ksApi.Close()
+	auth, err := newAuthPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := newShareHandler(ksApi, cfg.StaleWindow, cfg.MaxJobAge)
+	if sh.pool, err = newPoolAccounting(poolConfig{address: testPoolAddress}, ksApi, nil, nil, logger); err != nil {
+		t.Fatal(err)
+	}
+	minDiff, varDiff := diffSettingsFor(cfg)
+	clients := newClientListener(logger, sh, minDiff, varDiff, extranonceSizeFor(cfg))
+	listener := gostratum.NewListener(newStratumConfig(cfg, logger, clients, sh.HandleSubmit, sh.events, auth))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stopped := make(chan struct{})
+	defer func() {
+		cancel()
+		<-stopped // free the port for the next run
+	}()
+	go func() {
+		listener.Listen(ctx)
+		close(stopped)
+	}()
+	ksApi.Start(ctx, func() { clients.NewBlockAvailable(ksApi) })
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", port); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	// next returns the next event with the given method, skipping the rest
+	next := func(method string) gostratum.JsonRpcEvent {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			event, _ := gostratum.UnmarshalEvent(line)
+			if string(event.Method) == method {
+				return event
+			}
+		}
+	}
+
+	fmt.Fprintf(conn, `{"id":1,"method":"mining.subscribe","params":["TestMiner/1.0"]}`+"\n")
+	fmt.Fprintf(conn, `{"id":2,"method":"mining.authorize","params":["%s.rig","x"]}`+"\n", testWalletA)
+	extranonce := next("set_extranonce").Params[0].(string)
+	job := next("mining.notify")
+	jobId := job.Params[0].(string)
+	timestamp := job.Params[2].(float64)
+
+	// the job is the fake's template with the timestamp from the notify
+	template := fake.Template()
+	header := *template.Header
+	header.Timestamp = int64(timestamp)
+	block, err := appmessage.RPCBlockToDomainBlock(&appmessage.RPCBlock{Header: &header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, _ := strconv.ParseUint(extranonce, 16, 64)
+	mutable := block.Header.ToMutable()
+	var nonce uint64
+	for nonce = prefix << 48; ; nonce++ {
+		mutable.SetNonce(nonce)
+		if pow.NewState(mutable).CheckProofOfWork() {
+			break
+		}
+	}
+	fmt.Fprintf(conn, `{"id":3,"method":"mining.submit","params":["%s.rig","%s","%012x"]}`+"\n",
+		testWalletA, jobId, nonce&0xffffffffffff)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event, _ := gostratum.UnmarshalEvent(line); event.Method != "" {
+			continue // notifies are numbered by job id and can collide
+		}
+		response := gostratum.JsonRpcResponse{}
+		if json.Unmarshal([]byte(line), &response) == nil && fmt.Sprint(response.Id) == "3" {
+			if response.Result != true {
+				t.Fatalf("block share rejected: %s", line)
+			}
+			break
+		}
+	}
+	blocks := fake.WaitForBlocks(1, 5*time.Second)
+	if len(blocks) != 1 || blocks[0].Header.Nonce() != nonce {
+		t.Fatalf("expected block with nonce %x at kaspad, got %d blocks", nonce, len(blocks))
+	}
+	if found := sh.overall.BlocksFound.Load(); found != 1 {
+		t.Fatalf("expected 1 block found, bridge counted %d", found)
+	}
+	// the first share of a fresh pool found the block, it's all in the split
+	if splits := sh.pool.Splits(); len(splits) != 1 || len(splits[0].Shares) != 1 || splits[0].Shares[testWalletA] <= 0 {
+		t.Fatalf("expected the block's own share in its split, got %+v", splits)
+	}
+	// the found block moves kaspad on, which should reach the miner
+	if next("mining.notify").Params[0] == jobId {
+		t.Fatalf("no new job after block found")
+	}
+}
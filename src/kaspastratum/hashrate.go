@@ -0,0 +1,160 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buckets per window, the resolution hashrate over a window is reported at
+const hashrateBuckets = 60
+
+// windows hashrate is reported over when hashrate_windows isn't set
+var defaultHashrateWindows = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+
+type hashrateBucket struct {
+	start time.Time
+	diff  float64
+}
+
+// shareWindow buckets accepted share difficulty over a fixed span so the
+// hashrate over that span can be reported rather than the lifetime average
+type shareWindow struct {
+	span       time.Duration
+	bucketSize time.Duration
+	buckets    [hashrateBuckets]hashrateBucket
+}
+
+func newShareWindow(span time.Duration) *shareWindow {
+	bucketSize := span / hashrateBuckets
+	if bucketSize < time.Second {
+		bucketSize = time.Second
+	}
+	return &shareWindow{span: span, bucketSize: bucketSize}
+}
+
+func (w *shareWindow) add(now time.Time, hashValue float64) {
+	start := now.Truncate(w.bucketSize)
+	idx := int(start.UnixNano()/int64(w.bucketSize)) % hashrateBuckets
+	if !w.buckets[idx].start.Equal(start) { // bucket is from a previous lap
+		w.buckets[idx] = hashrateBucket{start: start}
+	}
+	w.buckets[idx].diff += hashValue
+}
+
+// rateGHs returns the hashrate over the window, or since started if that's
+// more recent so new workers don't read low
+func (w *shareWindow) rateGHs(now, started time.Time) float64 {
+	windowStart := now.Truncate(w.bucketSize).Add(w.bucketSize - w.span)
+	total := float64(0)
+	for _, b := range w.buckets {
+		if !b.start.Before(windowStart) {
+			total += b.diff
+		}
+	}
+	if started.After(windowStart) {
+		windowStart = started
+	}
+	elapsed := now.Sub(windowStart).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return total / elapsed
+}
+
+// WindowRate is the hashrate over one hashrate window
+type WindowRate struct {
+	Window time.Duration
+	GHs    float64
+}
+
+// hashrateWindows tracks share difficulty over each configured window. The
+// zero value tracks defaultHashrateWindows
+type hashrateWindows struct {
+	lock    sync.Mutex
+	windows []*shareWindow
+}
+
+// setWindows replaces the tracked windows, dropping anything recorded so
+// far. Windows are kept shortest first, nil means the defaults
+func (h *hashrateWindows) setWindows(spans []time.Duration) {
+	spans = normalizeHashrateWindows(spans)
+	windows := make([]*shareWindow, 0, len(spans))
+	for _, span := range spans {
+		windows = append(windows, newShareWindow(span))
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.windows = windows
+}
+
+func (h *hashrateWindows) add(now time.Time, hashValue float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.windows == nil {
+		for _, span := range defaultHashrateWindows {
+			h.windows = append(h.windows, newShareWindow(span))
+		}
+	}
+	for _, w := range h.windows {
+		w.add(now, hashValue)
+	}
+}
+
+// rates returns the hashrate over every window, shortest first
+func (h *hashrateWindows) rates(now, started time.Time) []WindowRate {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.windows == nil { // nothing recorded yet
+		rates := make([]WindowRate, 0, len(defaultHashrateWindows))
+		for _, span := range defaultHashrateWindows {
+			rates = append(rates, WindowRate{Window: span})
+		}
+		return rates
+	}
+	rates := make([]WindowRate, 0, len(h.windows))
+	for _, w := range h.windows {
+		rates = append(rates, WindowRate{Window: w.span, GHs: w.rateGHs(now, started)})
+	}
+	return rates
+}
+
+// normalizeHashrateWindows sorts and dedupes the windows, falling back to the
+// defaults if there are none
+func normalizeHashrateWindows(spans []time.Duration) []time.Duration {
+	if len(spans) == 0 {
+		return defaultHashrateWindows
+	}
+	sorted := append([]time.Duration{}, spans...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	unique := sorted[:1]
+	for _, span := range sorted[1:] {
+		if span != unique[len(unique)-1] {
+			unique = append(unique, span)
+		}
+	}
+	return unique
+}
+
+func validateHashrateWindows(spans []time.Duration) error {
+	for _, span := range spans {
+		if span <= 0 {
+			return fmt.Errorf("hashrate_windows must be positive, got %s", span)
+		}
+	}
+	return nil
+}
+
+// windowLabel formats a window for display and metric labels, e.g. 5m or 24h
+func windowLabel(window time.Duration) string {
+	label := window.String()
+	if strings.HasSuffix(label, "m0s") {
+		label = strings.TrimSuffix(label, "0s")
+	}
+	if strings.HasSuffix(label, "h0m") {
+		label = strings.TrimSuffix(label, "0m")
+	}
+	return label
+}
@@ -0,0 +1,75 @@
+package kaspastratum
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestHashrateWindows(t *testing.T) {
+	h := hashrateWindows{}
+	h.setWindows([]time.Duration{time.Hour, 5 * time.Minute, time.Hour})
+	started := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	// 1 share a second for 30 minutes, then the rig goes down for 10
+	for at := started; at.Before(started.Add(30 * time.Minute)); at = at.Add(time.Second) {
+		h.add(at, 4)
+	}
+	now := started.Add(40 * time.Minute)
+	rates := h.rates(now, started)
+	if len(rates) != 2 || rates[0].Window != 5*time.Minute || rates[1].Window != time.Hour {
+		t.Fatalf("expected sorted, deduped windows, got %+v", rates)
+	}
+	if rates[0].GHs != 0 {
+		t.Errorf("expected nothing in the last 5m, got %f", rates[0].GHs)
+	}
+	// under an hour of history, the rate is since started
+	if expected := 4 * 1800 / (40 * 60.0); math.Abs(rates[1].GHs-expected) > 0.01 {
+		t.Errorf("expected 1h rate %f, got %f", expected, rates[1].GHs)
+	}
+
+	// back up, the short window recovers well before the long one
+	for at := now; at.Before(now.Add(5 * time.Minute)); at = at.Add(time.Second) {
+		h.add(at, 4)
+	}
+	rates = h.rates(now.Add(5*time.Minute), started)
+	if math.Abs(rates[0].GHs-4) > 0.1 || rates[1].GHs >= rates[0].GHs {
+		t.Errorf("expected 5m rate near 4 above the 1h rate, got %+v", rates)
+	}
+}
+
+func TestHashrateWindowDefaults(t *testing.T) {
+	h := hashrateWindows{}
+	now := time.Now()
+	h.add(now, 10)
+	rates := h.rates(now.Add(time.Second), now.Add(-time.Second))
+	if len(rates) != len(defaultHashrateWindows) || rates[0].GHs != 5 {
+		t.Fatalf("expected default windows, got %+v", rates)
+	}
+	for window, label := range map[time.Duration]string{
+		5 * time.Minute:  "5m",
+		time.Hour:        "1h",
+		24 * time.Hour:   "24h",
+		90 * time.Minute: "1h30m",
+		30 * time.Second: "30s",
+	} {
+		if got := windowLabel(window); got != label {
+			t.Errorf("expected label %s, got %s", label, got)
+		}
+	}
+}
+
+func TestHashrateWindowsConfig(t *testing.T) {
+	cfg := BridgeConfig{}
+	if err := yaml.Unmarshal([]byte("stratum_port: :5555\nhashrate_windows: [1m, 6h]\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HashrateWindows) != 2 || cfg.HashrateWindows[1] != 6*time.Hour {
+		t.Fatalf("unexpected windows %v", cfg.HashrateWindows)
+	}
+	cfg.HashrateWindows = []time.Duration{0}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected zero window to be rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// JobEncoder covers the parts of the protocol that vary between miners: how
+// jobs are laid out in mining.notify, how submitted nonces are read back and
+// whether the miner is handed an extranonce
+type JobEncoder interface {
+	Name() string
+	// NotifyParams is everything after the job id in mining.notify
+	NotifyParams(header []byte, timestamp uint64) []any
+	// ParseNonce returns the full 64 bit nonce for a submit, filling in the
+	// extranonce if the miner only sent its own part of the nonce
+	ParseNonce(extranonce, noncestr string) (uint64, error)
+	// Extranonce is false for miners that search the whole nonce space
+	// themselves and shouldn't be sent set_extranonce
+	Extranonce() bool
+}
+
+// JobEncoderRule picks an encoder for miners whose user agent (as sent in
+// mining.subscribe) matches the pattern
+type JobEncoderRule struct {
+	Match   string `yaml:"match"`
+	Encoder string `yaml:"encoder"`
+}
+
+const (
+	encoderStandard    = "standard"
+	encoderBig         = "big"
+	encoderFullNonce   = "standard_full_nonce"
+	defaultEncoderName = encoderStandard
+	nonceHexLen        = 16
+)
+
+// checked after any configured rules
+var defaultEncoderRules = []JobEncoderRule{
+	{Match: ".*BzMiner.*", Encoder: encoderBig},
+}
+
+var encoderLock sync.RWMutex
+var jobEncoders = map[string]JobEncoder{
+	encoderStandard:  standardEncoder{},
+	encoderBig:       bigJobEncoder{},
+	encoderFullNonce: fullNonceEncoder{},
+}
+
+// RegisterJobEncoder makes an encoder available to job_encoders rules and
+// port profiles, replacing any registered under the same name
+func RegisterJobEncoder(enc JobEncoder) {
+	encoderLock.Lock()
+	defer encoderLock.Unlock()
+	jobEncoders[enc.Name()] = enc
+}
+
+func jobEncoder(name string) (JobEncoder, bool) {
+	encoderLock.RLock()
+	defer encoderLock.RUnlock()
+	enc, exists := jobEncoders[name]
+	return enc, exists
+}
+
+// parseNonce is the nonce handling shared by the built in encoders, short
+// nonces are padded out behind the extranonce
+func parseNonce(extranonce, noncestr string) (uint64, error) {
+	noncestr = strings.Replace(noncestr, "0x", "", 1)
+	if extranonce != "" {
+		if extranonce2Len := nonceHexLen - len(extranonce); len(noncestr) <= extranonce2Len {
+			noncestr = extranonce + fmt.Sprintf("%0*s", extranonce2Len, noncestr)
+		}
+	}
+	nonce, err := strconv.ParseUint(noncestr, 16, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed parsing noncestr")
+	}
+	return nonce, nil
+}
+
+// standardEncoder sends the header as 4 uint64s plus the timestamp
+type standardEncoder struct{}
+
+func (standardEncoder) Name() string { return encoderStandard }
+
+func (standardEncoder) NotifyParams(header []byte, timestamp uint64) []any {
+	return []any{GenerateJobHeader(header), timestamp}
+}
+
+func (standardEncoder) ParseNonce(extranonce, noncestr string) (uint64, error) {
+	return parseNonce(extranonce, noncestr)
+}
+
+func (standardEncoder) Extranonce() bool { return true }
+
+// bigJobEncoder sends header and timestamp as a single hex string
+type bigJobEncoder struct{}
+
+func (bigJobEncoder) Name() string { return encoderBig }
+
+func (bigJobEncoder) NotifyParams(header []byte, timestamp uint64) []any {
+	return []any{GenerateLargeJobParams(header, timestamp)}
+}
+
+func (bigJobEncoder) ParseNonce(extranonce, noncestr string) (uint64, error) {
+	return parseNonce(extranonce, noncestr)
+}
+
+func (bigJobEncoder) Extranonce() bool { return true }
+
+// fullNonceEncoder is the standard job for firmware that randomizes its own
+// nonces and doesn't understand set_extranonce
+type fullNonceEncoder struct{ standardEncoder }
+
+func (fullNonceEncoder) Name() string { return encoderFullNonce }
+
+func (fullNonceEncoder) ParseNonce(_, noncestr string) (uint64, error) {
+	return parseNonce("", noncestr)
+}
+
+func (fullNonceEncoder) Extranonce() bool { return false }
+
+type encoderRule struct {
+	match   *regexp.Regexp
+	encoder JobEncoder
+}
+
+// encoderSelector resolves a miner's user agent to an encoder, first match wins
+type encoderSelector struct {
+	rules []encoderRule
+}
+
+func newEncoderSelector(rules []JobEncoderRule) (*encoderSelector, error) {
+	selector := &encoderSelector{}
+	all := append(append([]JobEncoderRule{}, rules...), defaultEncoderRules...)
+	for _, rule := range all {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid job_encoders match %q", rule.Match)
+		}
+		enc, exists := jobEncoder(rule.Encoder)
+		if !exists {
+			return nil, fmt.Errorf("unknown job encoder %q", rule.Encoder)
+		}
+		selector.rules = append(selector.rules, encoderRule{match: match, encoder: enc})
+	}
+	return selector, nil
+}
+
+func (s *encoderSelector) forApp(remoteApp string) JobEncoder {
+	if s == nil {
+		s, _ = newEncoderSelector(nil) // defaults only, can't fail
+	}
+	for _, rule := range s.rules {
+		if rule.match.MatchString(remoteApp) {
+			return rule.encoder
+		}
+	}
+	enc, _ := jobEncoder(defaultEncoderName)
+	return enc
+}
@@ -0,0 +1,99 @@
+package kaspastratum
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the job encoder golden files")
+
+// encoderGolden is what an encoder produces for the example header
+type encoderGolden struct {
+	Notify     []any         `json:"notify"`
+	Extranonce bool          `json:"extranonce"`
+	Nonces     []goldenNonce `json:"nonces"`
+}
+
+type goldenNonce struct {
+	Extranonce string `json:"extranonce"`
+	Submitted  string `json:"submitted"`
+	Nonce      uint64 `json:"nonce"`
+}
+
+func TestJobEncoderGolden(t *testing.T) {
+	block := loadExampleBlock(t)
+	header, err := SerializeBlockHeader(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submits := []goldenNonce{
+		{Extranonce: "", Submitted: "0x00000000deadbeef"},
+		{Extranonce: "ab", Submitted: "cdef"},
+		{Extranonce: "abcd", Submitted: "0x0123456789ab"},
+		{Extranonce: "abcd", Submitted: "0123456789abcdef"},
+	}
+	for _, name := range []string{encoderStandard, encoderBig, encoderFullNonce} {
+		enc, exists := jobEncoder(name)
+		if !exists {
+			t.Fatalf("encoder %s not registered", name)
+		}
+		got := encoderGolden{
+			Notify:     enc.NotifyParams(header, uint64(block.Header.Timestamp)),
+			Extranonce: enc.Extranonce(),
+		}
+		for _, s := range submits {
+			if s.Nonce, err = enc.ParseNonce(s.Extranonce, s.Submitted); err != nil {
+				t.Fatalf("%s: failed parsing %s: %s", name, s.Submitted, err)
+			}
+			got.Nonces = append(got.Nonces, s)
+		}
+		raw, _ := json.MarshalIndent(got, "", "  ")
+		path := filepath.Join("testdata", "job_encoders", name+".golden.json")
+		if *updateGolden {
+			if err := ioutil.WriteFile(path, append(raw, '\n'), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s, run with -update to create", name, err)
+		}
+		if string(expected) != string(append(raw, '\n')) {
+			t.Errorf("%s: output differs from %s\n%s", name, path, raw)
+		}
+	}
+}
+
+func TestEncoderSelector(t *testing.T) {
+	if _, err := newEncoderSelector([]JobEncoderRule{{Match: "(", Encoder: encoderBig}}); err == nil {
+		t.Errorf("expected bad pattern to be rejected")
+	}
+	if _, err := newEncoderSelector([]JobEncoderRule{{Match: "x", Encoder: "huge"}}); err == nil {
+		t.Errorf("expected unknown encoder to be rejected")
+	}
+	selector, err := newEncoderSelector([]JobEncoderRule{
+		{Match: "^IceRiver", Encoder: encoderFullNonce},
+		{Match: "lolMiner", Encoder: encoderBig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for app, expected := range map[string]string{
+		"IceRiver KS3/1.0":  encoderFullNonce,
+		"lolMiner 1.76":     encoderBig,
+		"BzMiner-v13.0.0":   encoderBig,
+		"GMiner/3.20":       encoderStandard,
+		"":                  encoderStandard,
+		"my IceRiver clone": encoderStandard,
+	} {
+		if got := selector.forApp(app).Name(); got != expected {
+			t.Errorf("%q: expected %s, got %s", app, expected, got)
+		}
+	}
+	if got := (*encoderSelector)(nil).forApp("BzMiner-v13.0.0").Name(); got != encoderBig {
+		t.Errorf("nil selector should use the defaults, got %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"go.uber.org/zap"
+)
+
+// score given to nodes that can't be used at all
+const unhealthyScore = math.MaxFloat64
+
+// score per unit of priority. Latency scores a tenth of a point per ms, so a
+// node one step down the priority list is only picked over a higher priority
+// node once the latter is priorityWeight*10 ms (1s) slower
+const priorityWeight = 100
+
+// kaspaNode tracks a single kaspad backend along with the health info used
+// to decide which node the bridge should be talking to
+type kaspaNode struct {
+	address          string
+	priority         int
+	logger           *zap.SugaredLogger
+	dial             KaspadDialer
+	lock             sync.RWMutex
+	client           KaspadBackend
+	synced           bool
+	rpcOk            bool
+	lastErr          error
+	latency          time.Duration
+	lastNotification time.Time
+	lastRegistration time.Time
+	onNotification   func(*kaspaNode)
+}
+
+type nodeHealth struct {
+	Synced           bool
+	RPCOk            bool
+	Latency          time.Duration
+	LastNotification time.Time
+}
+
+func newKaspaNode(address string, priority int, dial KaspadDialer, logger *zap.SugaredLogger) *kaspaNode {
+	if dial == nil {
+		dial = dialRPC
+	}
+	return &kaspaNode{
+		address:  address,
+		priority: priority,
+		dial:     dial,
+		logger:   logger.With(zap.String("component", "kaspaapi:"+address)),
+	}
+}
+
+func (n *kaspaNode) connect() error {
+	client, err := n.dial(n.address)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	n.client = client
+	n.rpcOk = true
+	n.lock.Unlock()
+	return nil
+}
+
+func (n *kaspaNode) getClient() KaspadBackend {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.client
+}
+
+func (n *kaspaNode) health() nodeHealth {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return nodeHealth{
+		Synced:           n.synced,
+		RPCOk:            n.rpcOk,
+		Latency:          n.latency,
+		LastNotification: n.lastNotification,
+	}
+}
+
+// score ranks the node for selection, lower is better. Priority dominates,
+// with rpc latency and a stale template subscription counting against it
+func (n *kaspaNode) score() float64 {
+	h := n.health()
+	if n.getClient() == nil || !h.RPCOk || !h.Synced {
+		return unhealthyScore
+	}
+	score := float64(n.priority*priorityWeight) + float64(h.Latency.Milliseconds())/10
+	if time.Since(h.LastNotification) > staleNotificationTime {
+		score += priorityWeight / 2
+	}
+	return score
+}
+
+func (n *kaspaNode) markFailed(err error) {
+	n.lock.Lock()
+	n.rpcOk = false
+	n.lastErr = err
+	n.lock.Unlock()
+	n.logger.Warn("kaspad node marked unhealthy: ", err)
+}
+
+// checkHealth refreshes sync state and latency for the node, reconnecting
+// and (re)subscribing to template notifications as needed
+func (n *kaspaNode) checkHealth() {
+	if n.getClient() == nil {
+		if err := n.connect(); err != nil {
+			n.markFailed(err)
+			return
+		}
+		n.logger.Info("connected to kaspad")
+	}
+	client := n.getClient()
+
+	start := time.Now()
+	info, err := client.GetInfo()
+	elapsed := time.Since(start)
+	if err != nil {
+		n.markFailed(err)
+		return
+	}
+
+	n.lock.Lock()
+	if !n.rpcOk {
+		n.logger.Info("kaspad node healthy again")
+	}
+	n.rpcOk = true
+	n.lastErr = nil
+	n.synced = info.IsSynced
+	if n.latency == 0 {
+		n.latency = elapsed
+	} else { // smooth out the odd slow call
+		n.latency = (n.latency*3 + elapsed) / 4
+	}
+	// the rpc client reconnects on its own after a drop but subscriptions
+	// don't survive that, so resubscribe if templates have dried up
+	resubscribe := time.Since(n.lastNotification) > staleNotificationTime &&
+		time.Since(n.lastRegistration) > staleNotificationTime
+	if resubscribe {
+		n.lastRegistration = time.Now()
+	}
+	n.lock.Unlock()
+
+	if resubscribe {
+		if err := client.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
+			n.lock.Lock()
+			n.lastNotification = time.Now()
+			n.lock.Unlock()
+			if n.onNotification != nil {
+				n.onNotification(n)
+			}
+		}); err != nil {
+			n.logger.Warn("failed to register for block notifications from kaspa: ", err)
+		}
+	}
+}
+
+func (n *kaspaNode) getBlockTemplate(wallet, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	client := n.getClient()
+	if client == nil {
+		return nil, fmt.Errorf("kaspad node %s not connected", n.address)
+	}
+	return client.GetBlockTemplate(wallet, extraData)
+}
+
+func (n *kaspaNode) submitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	client := n.getClient()
+	if client == nil {
+		return appmessage.RejectReasonNone, fmt.Errorf("kaspad node %s not connected", n.address)
+	}
+	return client.SubmitBlock(block)
+}
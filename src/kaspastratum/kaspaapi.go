@@ -3,90 +3,258 @@ package kaspastratum
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
-	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
 	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
+const (
+	nodeCheckInterval = 5 * time.Second
+	nodeRPCTimeout    = 10 * time.Second
+	// kaspad sends a new template every block (~1s), anything longer than
+	// this without one means the node is stuck or the subscription was lost
+	staleNotificationTime = 15 * time.Second
+)
+
 type KaspaApi struct {
-	address       string
-	blockWaitTime time.Duration
+	nodes         []*kaspaNode
+	poolAddress   string
+	blockWaitTime atomic.Duration
 	logger        *zap.SugaredLogger
-	kaspad        *rpcclient.RPCClient
-	connected     bool
+	submitToAll   bool
+	activeLock    sync.RWMutex
+	active        *kaspaNode
+	blockReady    chan struct{}
+	networkLock   sync.RWMutex
+	network       NetworkStats
 }
 
-func NewKaspaAPI(address string, blockWaitTime time.Duration, logger *zap.SugaredLogger) (*KaspaApi, error) {
-	client, err := rpcclient.NewRPCClient(address)
-	if err != nil {
-		return nil, err
-	}
+// NetworkStats is the most recent network state pulled from the active node
+type NetworkStats struct {
+	Hashrate   uint64    `json:"hashrate"`
+	BlockCount uint64    `json:"block_count"`
+	Difficulty float64   `json:"difficulty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
 
-	return &KaspaApi{
-		address:       address,
-		blockWaitTime: blockWaitTime,
-		logger:        logger.With(zap.String("component", "kaspaapi:"+address)),
-		kaspad:        client,
-		connected:     true,
-	}, nil
+type NodeStatus struct {
+	Address          string    `json:"address"`
+	Active           bool      `json:"active"`
+	Synced           bool      `json:"synced"`
+	RPCOk            bool      `json:"rpc_ok"`
+	LatencyMs        int64     `json:"latency_ms"`
+	LastNotification time.Time `json:"last_notification"`
+}
+
+// NewKaspaAPI connects to the given kaspad nodes, listed in priority order.
+// Nodes that can't be reached are retried in the background, an error is
+// only returned if none of them can be reached. A nil dial connects over rpc
+func NewKaspaAPI(addresses []string, dial KaspadDialer, submitToAll bool, blockWaitTime time.Duration, logger *zap.SugaredLogger) (*KaspaApi, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no kaspad address configured")
+	}
+	ks := &KaspaApi{
+		logger:      logger.With(zap.String("component", "kaspaapi")),
+		submitToAll: submitToAll,
+		blockReady:  make(chan struct{}, 1),
+	}
+	ks.blockWaitTime.Store(blockWaitTime)
+	var lastErr error
+	connected := 0
+	for i, address := range addresses {
+		node := newKaspaNode(address, i, dial, logger)
+		node.onNotification = func(n *kaspaNode) {
+			if ks.getActive() == n {
+				select { // non-blocking, one pending signal is enough
+				case ks.blockReady <- struct{}{}:
+				default:
+				}
+			}
+		}
+		if err := node.connect(); err != nil {
+			node.logger.Warn("failed connecting to kaspad, will retry: ", err)
+			lastErr = err
+		} else {
+			connected++
+		}
+		ks.nodes = append(ks.nodes, node)
+	}
+	if connected == 0 {
+		return nil, lastErr
+	}
+	return ks, nil
 }
 
 func (ks *KaspaApi) Start(ctx context.Context, blockCb func()) {
 	ks.waitForSync(true)
+	go ks.startHealthThread(ctx)
 	go ks.startBlockTemplateListener(ctx, blockCb)
 	go ks.startStatsThread(ctx)
 }
 
+// Close disconnects from every node, the threads started by Start should
+// already have been stopped through their context
+func (ks *KaspaApi) Close() {
+	for _, node := range ks.nodes {
+		if client := node.getClient(); client != nil {
+			if err := client.Close(); err != nil {
+				ks.logger.Warn("failed closing kaspad connection to "+node.address, zap.Error(err))
+			}
+		}
+	}
+}
+
+// SetBlockWaitTime changes how long to wait for a template notification
+// before polling, takes effect from the next block
+func (ks *KaspaApi) SetBlockWaitTime(wait time.Duration) {
+	ks.blockWaitTime.Store(wait)
+}
+
+func (ks *KaspaApi) getActive() *kaspaNode {
+	ks.activeLock.RLock()
+	defer ks.activeLock.RUnlock()
+	return ks.active
+}
+
+// selectActive picks the healthiest node to pull templates from, logging
+// and recording any failover
+func (ks *KaspaApi) selectActive() *kaspaNode {
+	var best *kaspaNode
+	bestScore := unhealthyScore
+	for _, node := range ks.nodes {
+		if score := node.score(); score < bestScore {
+			best, bestScore = node, score
+		}
+	}
+
+	ks.activeLock.Lock()
+	previous := ks.active
+	if best != nil {
+		ks.active = best
+	}
+	ks.activeLock.Unlock()
+
+	if best != nil && best != previous {
+		if previous != nil {
+			ks.logger.Warn(fmt.Sprintf("failing over kaspad node %s -> %s", previous.address, best.address))
+			RecordKaspadFailover(best.address)
+		} else {
+			ks.logger.Info("using kaspad node " + best.address)
+		}
+	}
+	for _, node := range ks.nodes {
+		RecordKaspadNodeHealth(node.address, node == ks.getActive(), node.health())
+	}
+	return best
+}
+
+func (ks *KaspaApi) NetworkStats() NetworkStats {
+	ks.networkLock.RLock()
+	defer ks.networkLock.RUnlock()
+	return ks.network
+}
+
+// Nodes reports the health of every configured kaspad node
+func (ks *KaspaApi) Nodes() []NodeStatus {
+	active := ks.getActive()
+	nodes := make([]NodeStatus, 0, len(ks.nodes))
+	for _, node := range ks.nodes {
+		h := node.health()
+		nodes = append(nodes, NodeStatus{
+			Address:          node.address,
+			Active:           node == active,
+			Synced:           h.Synced,
+			RPCOk:            h.RPCOk,
+			LatencyMs:        h.Latency.Milliseconds(),
+			LastNotification: h.LastNotification,
+		})
+	}
+	return nodes
+}
+
+func (ks *KaspaApi) startHealthThread(ctx context.Context) {
+	ticker := time.NewTicker(nodeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ks.logger.Warn("context cancelled, stopping node health thread")
+			return
+		case <-ticker.C:
+			ks.checkNodes()
+			if ks.selectActive() == nil {
+				ks.logger.Error("no healthy kaspad nodes available, miners will be idle")
+			}
+		}
+	}
+}
+
+func (ks *KaspaApi) checkNodes() {
+	wg := sync.WaitGroup{}
+	for _, node := range ks.nodes {
+		wg.Add(1)
+		go func(n *kaspaNode) {
+			defer wg.Done()
+			n.checkHealth()
+		}(node)
+	}
+	wg.Wait()
+}
+
 func (ks *KaspaApi) startStatsThread(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			ks.logger.Warn("context cancelled, stopping stats thread")
 			return
 		case <-ticker.C:
-			dagResponse, err := ks.kaspad.GetBlockDAGInfo()
+			node := ks.getActive()
+			if node == nil {
+				continue
+			}
+			client := node.getClient()
+			if client == nil {
+				continue
+			}
+			dagResponse, err := client.GetBlockDAGInfo()
 			if err != nil {
 				ks.logger.Warn("failed to get network hashrate from kaspa, prom stats will be out of date", zap.Error(err))
 				continue
 			}
-			response, err := ks.kaspad.EstimateNetworkHashesPerSecond(dagResponse.TipHashes[0], 1000)
+			response, err := client.EstimateNetworkHashesPerSecond(dagResponse.TipHashes[0], 1000)
 			if err != nil {
 				ks.logger.Warn("failed to get network hashrate from kaspa, prom stats will be out of date", zap.Error(err))
 				continue
 			}
 			RecordNetworkStats(response.NetworkHashesPerSecond, dagResponse.BlockCount, dagResponse.Difficulty)
+			ks.networkLock.Lock()
+			ks.network = NetworkStats{
+				Hashrate:   response.NetworkHashesPerSecond,
+				BlockCount: dagResponse.BlockCount,
+				Difficulty: dagResponse.Difficulty,
+				UpdatedAt:  time.Now(),
+			}
+			ks.networkLock.Unlock()
 		}
 	}
 }
 
-func (ks *KaspaApi) reconnect() error {
-	if ks.kaspad != nil {
-		return ks.kaspad.Reconnect()
-	}
-
-	client, err := rpcclient.NewRPCClient(ks.address)
-	if err != nil {
-		return err
-	}
-	ks.kaspad = client
-	return nil
-}
-
-func (s *KaspaApi) waitForSync(verbose bool) error {
+func (s *KaspaApi) waitForSync(verbose bool) {
 	if verbose {
 		s.logger.Info("checking kaspad sync state")
 	}
 	for {
-		clientInfo, err := s.kaspad.GetInfo()
-		if err != nil {
-			return errors.Wrapf(err, "error fetching server info from kaspad @ %s", s.address)
-		}
-		if clientInfo.IsSynced {
+		s.checkNodes()
+		if s.selectActive() != nil {
 			break
 		}
 		s.logger.Warn("Kaspa is not synced, waiting for sync before starting bridge")
@@ -95,46 +263,150 @@ func (s *KaspaApi) waitForSync(verbose bool) error {
 	if verbose {
 		s.logger.Info("kaspad synced, starting server")
 	}
-	return nil
 }
 
 func (s *KaspaApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func()) {
-	blockReadyChan := make(chan bool)
-	err := s.kaspad.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
-		blockReadyChan <- true
-	})
-	if err != nil {
-		s.logger.Error("fatal: failed to register for block notifications from kaspa")
-	}
-
-	ticker := time.NewTicker(s.blockWaitTime)
+	ticker := time.NewTicker(s.blockWaitTime.Load())
+	defer ticker.Stop()
 	for {
-		if err := s.waitForSync(false); err != nil {
-			s.logger.Error("error checking kaspad sync state, attempting reconnect: ", err)
-			if err := s.reconnect(); err != nil {
-				s.logger.Error("error reconnecting to kaspad, waiting before retry: ", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
 		select {
 		case <-ctx.Done():
 			s.logger.Warn("context cancelled, stopping block update listener")
 			return
-		case <-blockReadyChan:
+		case <-s.blockReady:
 			blockReadyCb()
-			ticker.Reset(s.blockWaitTime)
+			ticker.Reset(s.blockWaitTime.Load())
 		case <-ticker.C: // timeout, manually check for new blocks
 			blockReadyCb()
+			ticker.Reset(s.blockWaitTime.Load()) // picks up reloaded wait times
 		}
 	}
 }
 
 func (ks *KaspaApi) GetBlockTemplate(
 	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, error) {
-	template, err := ks.kaspad.GetBlockTemplate(client.WalletAddr,
-		fmt.Sprintf(`'%s' via onemorebsmith/kaspa-stratum-bridge_%s`, client.RemoteApp, version))
-	if err != nil {
-		return nil, errors.Wrap(err, "failed fetching new block template from kaspa")
+	extraData := fmt.Sprintf(`'%s' via onemorebsmith/kaspa-stratum-bridge_%s`, client.RemoteApp, version)
+	payAddress := client.WalletAddr
+	if ks.poolAddress != "" { // pool mode, every template pays the pool
+		payAddress = ks.poolAddress
+	}
+	var lastErr error
+	// first attempt goes to the active node, on failure the node is marked
+	// down and we move on to whatever is now the healthiest node
+	for attempt := 0; attempt < len(ks.nodes); attempt++ {
+		node := ks.getActive()
+		if node == nil {
+			break
+		}
+		template, err := node.getBlockTemplate(payAddress, extraData)
+		if err == nil {
+			return template, nil
+		}
+		lastErr = err
+		if strings.Contains(err.Error(), "Could not decode address") {
+			break // problem with the request, not the node
+		}
+		node.markFailed(err)
+		if ks.selectActive() == node {
+			break // nothing better to fail over to
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no healthy kaspad nodes available")
+	}
+	return nil, errors.Wrap(lastErr, "failed fetching new block template from kaspa")
+}
+
+// SubmitBlock sends the block to the active node, falling over to the next
+// healthiest node if the node can't be reached. If submitting to all nodes
+// is enabled the block goes to every healthy node in parallel and is
+// considered accepted if any node accepts it
+func (ks *KaspaApi) SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	if ks.submitToAll {
+		return ks.submitToAllNodes(block)
+	}
+	var lastErr error
+	for attempt := 0; attempt < len(ks.nodes); attempt++ {
+		node := ks.getActive()
+		if node == nil {
+			break
+		}
+		reason, err := node.submitBlock(block)
+		if err == nil || (reason != appmessage.RejectReasonNone && reason != appmessage.RejectReasonIsInIBD) {
+			return reason, err // accepted, or an actual verdict on the block
+		}
+		lastErr = err
+		node.markFailed(err)
+		if ks.selectActive() == node {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no healthy kaspad nodes available")
+	}
+	return appmessage.RejectReasonNone, lastErr
+}
+
+func (ks *KaspaApi) submitToAllNodes(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	type result struct {
+		node   *kaspaNode
+		reason appmessage.RejectReason
+		err    error
+	}
+	results := make(chan result, len(ks.nodes))
+	submitted := 0
+	for _, node := range ks.nodes {
+		if node.score() == unhealthyScore {
+			continue
+		}
+		submitted++
+		go func(n *kaspaNode) {
+			reason, err := n.submitBlock(block)
+			results <- result{node: n, reason: reason, err: err}
+		}(node)
+	}
+	if submitted == 0 {
+		return appmessage.RejectReasonNone, fmt.Errorf("no healthy kaspad nodes available")
+	}
+
+	var verdict *result
+	for i := 0; i < submitted; i++ {
+		r := <-results
+		if r.err == nil {
+			return r.reason, nil // any acceptance wins, the block will propagate
+		}
+		if r.reason == appmessage.RejectReasonNone {
+			r.node.markFailed(r.err)
+		}
+		// prefer the active node's opinion on why the block was rejected
+		if verdict == nil || r.node == ks.getActive() {
+			v := r
+			verdict = &v
+		}
+	}
+	return verdict.reason, verdict.err
+}
+
+func (ks *KaspaApi) GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error) {
+	node := ks.getActive()
+	if node == nil {
+		return nil, fmt.Errorf("no healthy kaspad nodes available")
+	}
+	client := node.getClient()
+	if client == nil {
+		return nil, fmt.Errorf("kaspad node %s not connected", node.address)
+	}
+	return client.GetBalancesByAddresses(addresses)
+}
+
+func (ks *KaspaApi) GetBlock(hash string, includeTransactions bool) (*appmessage.GetBlockResponseMessage, error) {
+	node := ks.getActive()
+	if node == nil {
+		return nil, fmt.Errorf("no healthy kaspad nodes available")
+	}
+	client := node.getClient()
+	if client == nil {
+		return nil, fmt.Errorf("kaspad node %s not connected", node.address)
 	}
-	return template, nil
+	return client.GetBlock(hash, includeTransactions)
 }
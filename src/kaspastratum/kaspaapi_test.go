@@ -0,0 +1,68 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testNode(address string, priority int, latency time.Duration) *kaspaNode {
+	node := newKaspaNode(address, priority, nil, zap.NewNop().Sugar())
+	node.client, _ = NewFakeKaspad(1).Dial(address) // never called, just marks the node connected
+	node.rpcOk = true
+	node.synced = true
+	node.latency = latency
+	node.lastNotification = time.Now()
+	return node
+}
+
+func TestKaspaNodeSelection(t *testing.T) {
+	primary := testNode("primary", 0, 20*time.Millisecond)
+	secondary := testNode("secondary", 1, 5*time.Millisecond)
+	tertiary := testNode("tertiary", 2, 5*time.Millisecond)
+	ks := &KaspaApi{
+		nodes:  []*kaspaNode{primary, secondary, tertiary},
+		logger: zap.NewNop().Sugar(),
+	}
+
+	if active := ks.selectActive(); active != primary {
+		t.Fatalf("expected primary to be selected, got %s", active.address)
+	}
+
+	// unsynced primary fails over to the next in line
+	primary.synced = false
+	if active := ks.selectActive(); active != secondary {
+		t.Fatalf("expected failover to secondary, got %s", active.address)
+	}
+
+	// rpc failure on secondary moves to tertiary
+	secondary.markFailed(errTest)
+	if active := ks.selectActive(); active != tertiary {
+		t.Fatalf("expected failover to tertiary, got %s", active.address)
+	}
+
+	// primary recovers but is very slow, a healthy lower priority node wins
+	primary.synced = true
+	primary.latency = 5 * time.Second
+	if active := ks.selectActive(); active != tertiary {
+		t.Fatalf("expected slow primary to be skipped, got %s", active.address)
+	}
+
+	// primary back to normal takes over again
+	primary.latency = 20 * time.Millisecond
+	if active := ks.selectActive(); active != primary {
+		t.Fatalf("expected primary to be reselected, got %s", active.address)
+	}
+
+	// nothing healthy keeps the last active node rather than dropping to nil
+	for _, n := range ks.nodes {
+		n.markFailed(errTest)
+	}
+	if active := ks.selectActive(); active != nil || ks.getActive() != primary {
+		t.Fatalf("expected no healthy node with primary kept active")
+	}
+}
+
+var errTest = fmt.Errorf("test error")
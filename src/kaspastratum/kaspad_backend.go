@@ -0,0 +1,36 @@
+package kaspastratum
+
+import (
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+)
+
+// KaspadBackend is the part of the kaspad rpc the bridge uses, implemented
+// by *rpcclient.RPCClient and by FakeKaspad for tests
+type KaspadBackend interface {
+	GetInfo() (*appmessage.GetInfoResponseMessage, error)
+	GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error)
+	SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error)
+	GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error)
+	EstimateNetworkHashesPerSecond(startHash string, windowSize uint32) (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error)
+	GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error)
+	GetBlock(hash string, includeTransactions bool) (*appmessage.GetBlockResponseMessage, error)
+	RegisterForNewBlockTemplateNotifications(onNewBlockTemplate func(*appmessage.NewBlockTemplateNotificationMessage)) error
+	Close() error
+}
+
+// KaspadDialer connects to the kaspad node at address
+type KaspadDialer func(address string) (KaspadBackend, error)
+
+var _ KaspadBackend = (*rpcclient.RPCClient)(nil)
+
+// dialRPC is the default dialer, a grpc connection to a real node
+func dialRPC(address string) (KaspadBackend, error) {
+	client, err := rpcclient.NewRPCClient(address)
+	if err != nil {
+		return nil, err
+	}
+	client.SetTimeout(nodeRPCTimeout)
+	return client, nil
+}
@@ -11,20 +11,58 @@ import (
 
 const maxjobs = 32
 
+// upper bound on the nonces remembered per job for dupe detection. A job is
+// only live for a second or two so this is only hit by a misbehaving miner,
+// further shares for the job are refused as stale
+const maxNoncesPerJob = 8192
+
+type nonceResult int
+
+const (
+	nonceNew nonceResult = iota
+	nonceDupe
+	nonceJobFull // maxNoncesPerJob already submitted for the job
+)
+
+// after a retarget, miners that apply the new diff to work already in flight
+// (rather than waiting for the next job) will submit shares at the new diff
+// for old jobs and vice versa. Within this window a share is accepted if it
+// meets either diff
+const diffChangeGrace = 10 * time.Second
+
+// MiningJob is a single unit of work sent to the miner along with the
+// stratum diff the miner was assigned when the job went out. Shares are
+// credited against the job diff so retargets don't skew hashrate
+type MiningJob struct {
+	Block        *appmessage.RPCBlock
+	id           int
+	diff         *kaspaDiff
+	nonces       map[uint64]struct{}
+	issued       time.Time
+	tipBlueScore uint64 // tip as known to the bridge when the job was issued
+}
+
 type MiningState struct {
-	Jobs        map[int]*appmessage.RPCBlock
+	Jobs        map[int]*MiningJob
 	JobLock     sync.Mutex
 	jobCounter  int
 	bigDiff     big.Int
 	initialized bool
-	useBigJob   bool
+	encoder     JobEncoder
 	connectTime time.Time
 	stratumDiff *kaspaDiff
+	prevDiff    *kaspaDiff
+	diffChanged time.Time
+	varDiff     varDiffState
+	profile     *portProfile // port the miner connected through
+	// held while a job is built and sent so overlapping templates don't
+	// interleave their updates
+	notifyLock sync.Mutex
 }
 
 func MiningStateGenerator() any {
 	return &MiningState{
-		Jobs:        map[int]*appmessage.RPCBlock{},
+		Jobs:        map[int]*MiningJob{},
 		JobLock:     sync.Mutex{},
 		connectTime: time.Now(),
 	}
@@ -34,18 +72,111 @@ func GetMiningState(ctx *gostratum.StratumContext) *MiningState {
 	return ctx.State.(*MiningState)
 }
 
-func (ms *MiningState) AddJob(job *appmessage.RPCBlock) int {
+// getEncoder is the miner's job encoder, standard until one is picked
+func (ms *MiningState) getEncoder() JobEncoder {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if ms.encoder == nil {
+		enc, _ := jobEncoder(defaultEncoderName)
+		return enc
+	}
+	return ms.encoder
+}
+
+func (ms *MiningState) setEncoder(enc JobEncoder) {
+	ms.JobLock.Lock()
+	ms.encoder = enc
+	ms.JobLock.Unlock()
+}
+
+// pickEncoder sets the encoder if the miner never subscribed, pick is only
+// called if needed
+func (ms *MiningState) pickEncoder(pick func() JobEncoder) {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if ms.encoder == nil {
+		ms.encoder = pick()
+	}
+}
+
+func (ms *MiningState) AddJob(block *appmessage.RPCBlock, tipBlueScore uint64) int {
+	ms.JobLock.Lock()
 	ms.jobCounter++
 	idx := ms.jobCounter
-	ms.JobLock.Lock()
-	ms.Jobs[idx%maxjobs] = job
+	// replacing the slot drops the nonces tracked for the evicted job
+	ms.Jobs[idx%maxjobs] = &MiningJob{
+		Block:        block,
+		id:           idx,
+		diff:         ms.stratumDiff,
+		nonces:       map[uint64]struct{}{},
+		issued:       time.Now(),
+		tipBlueScore: tipBlueScore,
+	}
 	ms.JobLock.Unlock()
 	return idx
 }
 
-func (ms *MiningState) GetJob(id int) (*appmessage.RPCBlock, bool) {
+func (ms *MiningState) GetJob(id int) (*MiningJob, bool) {
 	ms.JobLock.Lock()
 	job, exists := ms.Jobs[id%maxjobs]
 	ms.JobLock.Unlock()
+	if exists && job.id != id {
+		return nil, false // slot has been reused by a newer job
+	}
 	return job, exists
 }
+
+// trackNonce records the nonce as submitted for the job. Once the job has
+// maxNoncesPerJob nonces nothing more is accepted for it, a nonce that
+// couldn't be remembered could otherwise be replayed
+func (ms *MiningState) trackNonce(job *MiningJob, nonce uint64) nonceResult {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if _, exists := job.nonces[nonce]; exists {
+		return nonceDupe
+	}
+	if len(job.nonces) >= maxNoncesPerJob {
+		return nonceJobFull
+	}
+	job.nonces[nonce] = struct{}{}
+	return nonceNew
+}
+
+// getStratumDiff returns the diff currently assigned to the worker
+func (ms *MiningState) getStratumDiff() *kaspaDiff {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	return ms.stratumDiff
+}
+
+// setStratumDiff assigns a new diff to the worker. Jobs already sent keep
+// the diff they were issued with
+func (ms *MiningState) setStratumDiff(diff float64) *kaspaDiff {
+	d := newKaspaDiff()
+	d.setDiffValue(diff)
+	ms.JobLock.Lock()
+	ms.prevDiff = ms.stratumDiff
+	ms.stratumDiff = d
+	ms.diffChanged = time.Now()
+	ms.JobLock.Unlock()
+	return d
+}
+
+// shareDiff returns the diff a share with the given pow value should be
+// credited at, or nil if the share doesn't meet the diff assigned for the job
+func (ms *MiningState) shareDiff(job *MiningJob, powValue *big.Int, now time.Time) *kaspaDiff {
+	if powValue.Cmp(job.diff.targetValue) <= 0 {
+		return job.diff
+	}
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if now.Sub(ms.diffChanged) > diffChangeGrace {
+		return nil
+	}
+	for _, d := range []*kaspaDiff{ms.stratumDiff, ms.prevDiff} {
+		if d != nil && d != job.diff && powValue.Cmp(d.targetValue) <= 0 {
+			return d
+		}
+	}
+	return nil
+}
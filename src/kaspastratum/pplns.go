@@ -0,0 +1,476 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPPLNSWindow     = 10000
+	defaultBlockMaturity   = 100 // blue score, matches coinbase maturity
+	defaultPayoutThreshold = 100000000
+	maturityCheckInterval  = 10 * time.Second
+	payoutInterval         = time.Hour
+	// blocks walked looking for the chain block that merged a found block
+	maxMergeSearch = 256
+)
+
+// Payout is an amount (in sompi) owed to a wallet
+type Payout struct {
+	Wallet string `json:"wallet"`
+	Amount uint64 `json:"amount"`
+}
+
+// Payer sends payouts for matured balances. Balances are only debited once
+// Pay returns without error, so a failed batch is retried in full on the next
+// payout round
+type Payer interface {
+	Pay(payouts []Payout) error
+}
+
+type SplitStatus string
+
+const (
+	SplitImmature SplitStatus = "immature"
+	SplitMatured  SplitStatus = "matured"
+	SplitOrphaned SplitStatus = "orphaned"
+)
+
+// BlockSplit is the per-wallet division of a found block's reward. Shares is
+// the PPLNS window at the time the block was found, the reward isn't known
+// until the block is merged so Reward, Fee and Payouts are set on maturity
+type BlockSplit struct {
+	Hash      string             `json:"hash"`
+	BlueScore uint64             `json:"blue_score"`
+	Shares    map[string]float64 `json:"shares"`
+	Reward    uint64             `json:"reward"`
+	Fee       uint64             `json:"fee"`
+	Payouts   map[string]uint64  `json:"payouts"`
+	Status    SplitStatus        `json:"status"`
+	FoundAt   time.Time          `json:"found_at"`
+	MaturedAt time.Time          `json:"matured_at,omitempty"`
+}
+
+type pplnsShare struct {
+	wallet string
+	diff   float64
+}
+
+// pplnsWindow is a ring of the last N accepted shares
+type pplnsWindow struct {
+	shares []pplnsShare
+	next   int
+	full   bool
+}
+
+func newPPLNSWindow(size int) *pplnsWindow {
+	return &pplnsWindow{shares: make([]pplnsShare, size)}
+}
+
+func (w *pplnsWindow) add(wallet string, diff float64) {
+	w.shares[w.next] = pplnsShare{wallet: wallet, diff: diff}
+	w.next++
+	if w.next == len(w.shares) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// weights sums share difficulty per wallet across the window
+func (w *pplnsWindow) weights() (map[string]float64, float64) {
+	count := w.next
+	if w.full {
+		count = len(w.shares)
+	}
+	weights := map[string]float64{}
+	total := float64(0)
+	for _, s := range w.shares[:count] {
+		weights[s.wallet] += s.diff
+		total += s.diff
+	}
+	return weights, total
+}
+
+type blockGetter interface {
+	GetBlock(hash string, includeTransactions bool) (*appmessage.GetBlockResponseMessage, error)
+}
+
+type poolConfig struct {
+	address         string  // pool address the templates pay
+	fee             float64 // percent
+	windowSize      int
+	maturity        uint64
+	payoutThreshold uint64
+}
+
+// poolAccounting tracks the PPLNS window for pool mode, splitting each found
+// block between the wallets in the window and crediting those splits to
+// pending balances once the block matures
+type poolAccounting struct {
+	poolConfig
+	logger   *zap.SugaredLogger
+	kaspa    blockGetter
+	store    *shareStore
+	payer    Payer
+	lock     sync.Mutex
+	window   *pplnsWindow
+	splits   map[string]*BlockSplit
+	balances map[string]uint64
+}
+
+func newPoolAccounting(cfg poolConfig, kaspa blockGetter, store *shareStore, payer Payer, logger *zap.SugaredLogger) (*poolAccounting, error) {
+	if cfg.windowSize <= 0 {
+		cfg.windowSize = defaultPPLNSWindow
+	}
+	if cfg.maturity == 0 {
+		cfg.maturity = defaultBlockMaturity
+	}
+	if cfg.payoutThreshold == 0 {
+		cfg.payoutThreshold = defaultPayoutThreshold
+	}
+	pool := &poolAccounting{
+		poolConfig: cfg,
+		logger:     logger.With(zap.String("component", "pool")),
+		kaspa:      kaspa,
+		store:      store,
+		payer:      payer,
+		window:     newPPLNSWindow(cfg.windowSize),
+		splits:     map[string]*BlockSplit{},
+		balances:   map[string]uint64{},
+	}
+	if store == nil {
+		pool.logger.Warn("no store configured, pool balances will not survive a restart")
+		return pool, nil
+	}
+	splits, err := store.Splits()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range splits {
+		if s.Status != SplitImmature {
+			continue // settled, only read back for Splits
+		}
+		if s.Shares == nil {
+			// saved before shares were kept, the payouts are in proportion
+			s.Shares = map[string]float64{}
+			for wallet, amount := range s.Payouts {
+				s.Shares[wallet] = float64(amount)
+			}
+		}
+		pool.splits[s.Hash] = s
+	}
+	if pool.balances, err = store.Balances(); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (p *poolAccounting) start(ctx context.Context, tip func() uint64) {
+	go func() {
+		maturity := time.NewTicker(maturityCheckInterval)
+		defer maturity.Stop()
+		payout := time.NewTicker(payoutInterval)
+		defer payout.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-maturity.C:
+				p.checkMaturity(tip())
+			case <-payout.C:
+				p.payout()
+			}
+		}
+	}()
+}
+
+func (p *poolAccounting) addShare(wallet string, diff float64) {
+	p.lock.Lock()
+	p.window.add(wallet, diff)
+	p.lock.Unlock()
+}
+
+// blockFound credits the share that found the block to the window and
+// records the wallets then in it against the block, the reward is split
+// between them once the block matures
+func (p *poolAccounting) blockFound(hash string, blueScore uint64, wallet string, diff float64) *BlockSplit {
+	p.lock.Lock()
+	p.window.add(wallet, diff)
+	weights, _ := p.window.weights()
+	split := &BlockSplit{
+		Hash:      hash,
+		BlueScore: blueScore,
+		Shares:    weights,
+		Payouts:   map[string]uint64{},
+		Status:    SplitImmature,
+		FoundAt:   time.Now(),
+	}
+	p.splits[hash] = split
+	p.lock.Unlock()
+
+	p.logger.Info(fmt.Sprintf("block %s found with %d wallets in the window", hash, len(weights)))
+	p.persistSplit(split)
+	return split
+}
+
+// splitReward divides the reward by the split's shares. The pool fee and any
+// rounding dust stay with the pool
+func (p *poolAccounting) splitReward(split *BlockSplit, reward uint64) {
+	total := float64(0)
+	for _, weight := range split.Shares {
+		total += weight
+	}
+	split.Reward = reward
+	split.Payouts = map[string]uint64{}
+	distributable := float64(reward) * (1 - p.fee/100)
+	paid := uint64(0)
+	if total > 0 {
+		for wallet, weight := range split.Shares {
+			amount := uint64(distributable * weight / total)
+			split.Payouts[wallet] = amount
+			paid += amount
+		}
+	}
+	split.Fee = reward - paid
+}
+
+// isMissingBlock reports whether kaspad doesn't have the block at all
+func isMissingBlock(err error) bool {
+	return strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "is invalid")
+}
+
+// blockReward finds the chain block that merged the block and returns what
+// its coinbase paid the pool for it. A block's own coinbase pays for the
+// blocks it merges, not itself. merged is false only if the block is gone or
+// was merged red, it earns nothing. Anything that can't be settled yet, like
+// no merging chain block within reach, is an error so it gets retried
+func (p *poolAccounting) blockReward(hash string) (reward uint64, merged bool, err error) {
+	queue := []string{hash}
+	seen := map[string]bool{hash: true}
+	for len(queue) > 0 && len(seen) <= maxMergeSearch {
+		current := queue[0]
+		queue = queue[1:]
+		resp, err := p.kaspa.GetBlock(current, false)
+		if err != nil {
+			if current == hash && isMissingBlock(err) {
+				return 0, false, nil
+			}
+			return 0, false, err
+		}
+		if resp.Block == nil || resp.Block.VerboseData == nil {
+			return 0, false, fmt.Errorf("no verbose data for block %s", current)
+		}
+		data := resp.Block.VerboseData
+		// mergesets of chain blocks don't overlap, the first one found with
+		// the block in it is the one that paid for it
+		if current != hash && data.IsChainBlock {
+			for _, red := range data.MergeSetRedsHashes {
+				if red == hash {
+					return 0, false, nil
+				}
+			}
+			for idx, blue := range data.MergeSetBluesHashes {
+				if blue == hash {
+					return p.mergedReward(hash, current, len(data.MergeSetBluesHashes), len(data.MergeSetRedsHashes), idx)
+				}
+			}
+		}
+		for _, child := range data.ChildrenHashes {
+			if !seen[child] {
+				seen[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return 0, false, fmt.Errorf("no chain block merging block %s found in %d blocks", hash, len(seen))
+}
+
+// mergedReward reads the coinbase output the merging block paid the found
+// block, the blue at idx of its mergeset. Outputs follow mergeset order with
+// the red reward last, blues that earned nothing get no output. Only a
+// coinbase with exactly one output per blue, plus the red reward when there
+// are reds, can be lined up with the mergeset, anything else is undetermined
+func (p *poolAccounting) mergedReward(hash, merging string, blues, reds, idx int) (uint64, bool, error) {
+	resp, err := p.kaspa.GetBlock(merging, true)
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.Block == nil || len(resp.Block.Transactions) == 0 {
+		return 0, false, fmt.Errorf("no coinbase in merging block %s", merging)
+	}
+	outputs := resp.Block.Transactions[0].Outputs
+	expected := blues
+	if reds > 0 {
+		expected++ // red reward
+	}
+	if len(outputs) != expected {
+		// some blue earned nothing so the outputs no longer line up
+		return 0, false, fmt.Errorf("can't match block %s to an output of merging block %s coinbase, %d outputs for %d blues and %d reds",
+			hash, merging, len(outputs), blues, reds)
+	}
+	out := outputs[idx]
+	if out.VerboseData == nil || out.VerboseData.ScriptPublicKeyAddress != p.address {
+		return 0, false, fmt.Errorf("merging block %s didn't pay block %s to the pool address", merging, hash)
+	}
+	return out.Amount, true, nil
+}
+
+// checkMaturity settles splits for blocks far enough behind the tip, crediting
+// wallet balances for blocks merged blue by the selected chain. Settled
+// splits are dropped from memory once persisted, Splits reads them back
+func (p *poolAccounting) checkMaturity(tip uint64) {
+	p.lock.Lock()
+	var due []*BlockSplit
+	for _, s := range p.splits {
+		if s.Status == SplitImmature && tip >= s.BlueScore+p.maturity {
+			due = append(due, s)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, s := range due {
+		reward, merged, err := p.blockReward(s.Hash)
+		if err != nil {
+			p.logger.Warn(fmt.Sprintf("failed checking maturity of block %s, will retry: %s", s.Hash, err))
+			continue
+		}
+		orphaned := !merged
+
+		p.lock.Lock()
+		s.MaturedAt = time.Now()
+		if orphaned {
+			s.Status = SplitOrphaned
+		} else {
+			s.Status = SplitMatured
+			p.splitReward(s, reward)
+			for wallet, amount := range s.Payouts {
+				p.balances[wallet] += amount
+				RecordPendingBalance(wallet, p.balances[wallet])
+			}
+		}
+		balances := p.copyBalances()
+		p.lock.Unlock()
+
+		if orphaned {
+			p.logger.Warn(fmt.Sprintf("block %s wasn't merged blue, split dropped", s.Hash))
+		} else {
+			p.logger.Info(fmt.Sprintf("block %s matured, split %d sompi between %d wallets, fee %d",
+				s.Hash, s.Reward, len(s.Payouts), s.Fee))
+		}
+		if p.persistSplit(s) {
+			p.lock.Lock()
+			delete(p.splits, s.Hash)
+			p.lock.Unlock()
+		}
+		p.persistBalances(balances)
+	}
+}
+
+// payout hands balances over the threshold to the payer, no-op without one
+func (p *poolAccounting) payout() {
+	if p.payer == nil {
+		return
+	}
+	p.lock.Lock()
+	var payouts []Payout
+	for wallet, amount := range p.balances {
+		if amount >= p.payoutThreshold {
+			payouts = append(payouts, Payout{Wallet: wallet, Amount: amount})
+		}
+	}
+	p.lock.Unlock()
+	if len(payouts) == 0 {
+		return
+	}
+	sort.Slice(payouts, func(i, j int) bool { return payouts[i].Wallet < payouts[j].Wallet })
+
+	if err := p.payer.Pay(payouts); err != nil {
+		p.logger.Error("payout failed, will retry: ", err)
+		return
+	}
+
+	p.lock.Lock()
+	for _, po := range payouts {
+		// balance may have grown while paying, only debit what was sent
+		p.balances[po.Wallet] -= po.Amount
+		if p.balances[po.Wallet] == 0 {
+			delete(p.balances, po.Wallet)
+		}
+		RecordPendingBalance(po.Wallet, p.balances[po.Wallet])
+	}
+	balances := p.copyBalances()
+	p.lock.Unlock()
+	p.logger.Info(fmt.Sprintf("paid out %d wallets", len(payouts)))
+	p.persistBalances(balances)
+}
+
+func (p *poolAccounting) copyBalances() map[string]uint64 {
+	balances := make(map[string]uint64, len(p.balances))
+	for k, v := range p.balances {
+		balances[k] = v
+	}
+	return balances
+}
+
+// Splits returns every block split, settled ones from the store, newest
+// first
+func (p *poolAccounting) Splits() []BlockSplit {
+	var stored []*BlockSplit
+	if p.store != nil {
+		var err error
+		if stored, err = p.store.Splits(); err != nil {
+			p.logger.Error("failed reading stored splits: ", err)
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	splits := make([]BlockSplit, 0, len(p.splits)+len(stored))
+	for _, s := range p.splits {
+		splits = append(splits, *s)
+	}
+	for _, s := range stored {
+		if _, tracked := p.splits[s.Hash]; !tracked {
+			splits = append(splits, *s)
+		}
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i].FoundAt.After(splits[j].FoundAt) })
+	return splits
+}
+
+// Balances returns matured, unpaid balances by wallet
+func (p *poolAccounting) Balances() map[string]uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.copyBalances()
+}
+
+// persistSplit saves the split, reporting whether it made it to the store
+func (p *poolAccounting) persistSplit(s *BlockSplit) bool {
+	if p.store == nil {
+		return false
+	}
+	p.lock.Lock()
+	copied := *s
+	p.lock.Unlock()
+	if err := p.store.SaveSplit(&copied); err != nil {
+		p.logger.Error(fmt.Sprintf("failed persisting split for block %s: %s", s.Hash, err))
+		return false
+	}
+	return true
+}
+
+func (p *poolAccounting) persistBalances(balances map[string]uint64) {
+	if p.store == nil {
+		return
+	}
+	if err := p.store.SaveBalances(balances); err != nil {
+		p.logger.Error("failed persisting pool balances: ", err)
+	}
+}
@@ -0,0 +1,219 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"go.uber.org/zap"
+)
+
+const testPoolAddress = "kaspa:pool"
+
+// fakeBlockGetter is a tiny dag, blocks not in it aren't found
+type fakeBlockGetter struct {
+	blocks map[string]*appmessage.RPCBlock
+}
+
+func newFakeDag() *fakeBlockGetter {
+	return &fakeBlockGetter{blocks: map[string]*appmessage.RPCBlock{}}
+}
+
+func (f *fakeBlockGetter) GetBlock(hash string, includeTransactions bool) (*appmessage.GetBlockResponseMessage, error) {
+	block, exists := f.blocks[hash]
+	if !exists {
+		return nil, fmt.Errorf("Block %s not found", hash)
+	}
+	copied := *block
+	if !includeTransactions {
+		copied.Transactions = nil
+	}
+	return &appmessage.GetBlockResponseMessage{Block: &copied}, nil
+}
+
+func (f *fakeBlockGetter) block(hash string) *appmessage.RPCBlock {
+	if _, exists := f.blocks[hash]; !exists {
+		f.blocks[hash] = &appmessage.RPCBlock{VerboseData: &appmessage.RPCBlockVerboseData{Hash: hash}}
+	}
+	return f.blocks[hash]
+}
+
+// merge adds a block on top of parents, a chain block's coinbase pays each
+// of its blues reward at the given address, then the reds' reward
+func (f *fakeBlockGetter) merge(hash string, isChain bool, parents, blues, reds []string, address string, reward uint64) {
+	block := f.block(hash)
+	block.VerboseData.IsChainBlock = isChain
+	block.VerboseData.MergeSetBluesHashes = blues
+	block.VerboseData.MergeSetRedsHashes = reds
+	coinbase := &appmessage.RPCTransaction{}
+	for range blues {
+		coinbase.Outputs = append(coinbase.Outputs, &appmessage.RPCTransactionOutput{
+			Amount:      reward,
+			VerboseData: &appmessage.RPCTransactionOutputVerboseData{ScriptPublicKeyAddress: address},
+		})
+	}
+	if len(reds) > 0 {
+		coinbase.Outputs = append(coinbase.Outputs, &appmessage.RPCTransactionOutput{
+			Amount:      reward * uint64(len(reds)),
+			VerboseData: &appmessage.RPCTransactionOutputVerboseData{ScriptPublicKeyAddress: address},
+		})
+	}
+	block.Transactions = []*appmessage.RPCTransaction{coinbase}
+	for _, parent := range parents {
+		data := f.block(parent).VerboseData
+		data.ChildrenHashes = append(data.ChildrenHashes, hash)
+	}
+}
+
+type fakePayer struct {
+	paid [][]Payout
+	err  error
+}
+
+func (f *fakePayer) Pay(payouts []Payout) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.paid = append(f.paid, payouts)
+	return nil
+}
+
+func TestPPLNSWindowWraps(t *testing.T) {
+	w := newPPLNSWindow(3)
+	w.add("a", 1)
+	w.add("b", 2)
+	w.add("b", 2)
+	w.add("c", 4) // pushes out a
+	weights, total := w.weights()
+	if total != 8 || weights["a"] != 0 || weights["b"] != 4 || weights["c"] != 4 {
+		t.Fatalf("unexpected window weights %+v, total %f", weights, total)
+	}
+}
+
+func TestPoolSplitMaturityAndPayout(t *testing.T) {
+	// "good" is merged blue by the chain block on top of it, "late" by a
+	// chain block further on, "red" is merged red and "orphan" never made it
+	// into the dag. "unpaid" is paid to some other address, "pending" has no
+	// merging chain block yet and "short" is merged by a chain block whose
+	// coinbase is missing a blue's output, so with the red reward on the end
+	// the count matches the blues but the outputs don't line up. None of
+	// those can be settled so they're retried.
+	// The found blocks' own coinbases pay someone else entirely
+	kaspa := newFakeDag()
+	for _, hash := range []string{"parent", "good", "late", "red", "unpaid", "pending", "short", "other", "red2"} {
+		kaspa.merge(hash, false, nil, nil, nil, "kaspa:someone", 5000)
+	}
+	kaspa.merge("chain1", true, []string{"parent", "good", "red"}, []string{"parent", "good"}, []string{"red"}, testPoolAddress, 1000)
+	kaspa.merge("side", false, []string{"late"}, nil, nil, testPoolAddress, 0)
+	kaspa.merge("chain2", true, []string{"chain1", "side"}, []string{"chain1", "side", "late"}, nil, testPoolAddress, 1000)
+	kaspa.merge("chain3", true, []string{"chain2", "unpaid"}, []string{"chain2", "unpaid"}, nil, "kaspa:someone", 1000)
+	kaspa.merge("chain4", true, []string{"other", "short", "red2"}, []string{"other", "short"}, []string{"red2"}, testPoolAddress, 1000)
+	short := kaspa.blocks["chain4"].Transactions[0]
+	short.Outputs = short.Outputs[1:] // "other" earned nothing
+	payer := &fakePayer{}
+	pool, err := newPoolAccounting(poolConfig{address: testPoolAddress, fee: 1, windowSize: 10, maturity: 100, payoutThreshold: 500},
+		kaspa, nil, payer, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed creating pool: %s", err)
+	}
+	pool.addShare("a", 1)
+
+	pool.addShare("b", 2)
+
+	split := pool.blockFound("good", 1000, "b", 1) // the finding share counts too
+	if split.Shares["a"] != 1 || split.Shares["b"] != 3 || len(split.Payouts) != 0 {
+		t.Fatalf("unexpected split %+v", split)
+	}
+	for _, hash := range []string{"late", "red", "unpaid", "pending", "short", "orphan"} {
+		pool.blockFound(hash, 1000, "b", 0)
+	}
+
+	pool.checkMaturity(1099)
+	if len(pool.Balances()) != 0 {
+		t.Fatalf("credited before maturity: %+v", pool.Balances())
+	}
+	pool.checkMaturity(1100)
+	balances := pool.Balances()
+	if balances["a"] != 494 || balances["b"] != 1484 {
+		t.Fatalf("only blocks merged blue should be credited, got %+v", balances)
+	}
+	expected := map[string]SplitStatus{"good": SplitMatured, "late": SplitMatured, "red": SplitOrphaned,
+		"orphan": SplitOrphaned, "unpaid": SplitImmature, "pending": SplitImmature, "short": SplitImmature}
+	for _, s := range pool.Splits() {
+		if s.Status != expected[s.Hash] {
+			t.Fatalf("unexpected status %s for %s", s.Status, s.Hash)
+		}
+		matured := s.Status == SplitMatured
+		if matured && (s.Reward != 1000 || s.Payouts["a"] != 247 || s.Payouts["b"] != 742 || s.Fee != 11) {
+			t.Fatalf("unexpected split %+v", s)
+		}
+	}
+
+	payer.err = fmt.Errorf("wallet locked")
+	pool.payout()
+	if pool.Balances()["b"] != 1484 {
+		t.Fatalf("failed payout should leave balance intact")
+	}
+	payer.err = nil
+	pool.payout()
+	if len(payer.paid) != 1 || len(payer.paid[0]) != 1 || payer.paid[0][0] != (Payout{Wallet: "b", Amount: 1484}) {
+		t.Fatalf("expected only b over the threshold to be paid, got %+v", payer.paid)
+	}
+	if balances := pool.Balances(); balances["a"] != 494 || balances["b"] != 0 {
+		t.Fatalf("unexpected balances after payout %+v", balances)
+	}
+}
+
+// TestPoolFirstShareFindsBlock checks the share that finds a block is in its
+// own split, on a fresh window it's the only one there
+func TestPoolFirstShareFindsBlock(t *testing.T) {
+	pool, err := newPoolAccounting(poolConfig{address: testPoolAddress, fee: 1, windowSize: 10},
+		newFakeDag(), nil, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed creating pool: %s", err)
+	}
+	split := pool.blockFound("first", 100, "a", 4)
+	if len(split.Shares) != 1 || split.Shares["a"] != 4 {
+		t.Fatalf("finding share missing from its split: %+v", split.Shares)
+	}
+	pool.splitReward(split, 1000)
+	if split.Payouts["a"] != 990 || split.Fee != 10 {
+		t.Fatalf("expected the reward less the fee to go to the finder, got %+v fee %d", split.Payouts, split.Fee)
+	}
+}
+
+func TestPoolStatePersists(t *testing.T) {
+	store, err := newShareStore(filepath.Join(t.TempDir(), "bridge.db"), 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	defer store.Close()
+	kaspa := newFakeDag()
+	kaspa.merge("chain1", true, []string{"first"}, []string{"first"}, nil, testPoolAddress, 1000)
+	kaspa.merge("chain2", true, []string{"chain1", "second"}, []string{"chain1", "second"}, nil, testPoolAddress, 1000)
+	cfg := poolConfig{address: testPoolAddress, windowSize: 10, maturity: 10}
+	pool, err := newPoolAccounting(cfg, kaspa, store, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed creating pool: %s", err)
+	}
+	pool.addShare("a", 1)
+	pool.blockFound("first", 100, "a", 0)
+	pool.blockFound("second", 200, "a", 0)
+	pool.checkMaturity(110)
+	if _, tracked := pool.splits["first"]; tracked || len(pool.Splits()) != 2 {
+		t.Fatalf("settled split should be evicted once stored, got %+v", pool.splits)
+	}
+
+	restored, err := newPoolAccounting(cfg, kaspa, store, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed restoring pool: %s", err)
+	}
+	if len(restored.Splits()) != 2 || restored.Balances()["a"] != 1000 {
+		t.Fatalf("pool state not restored: %+v %+v", restored.Splits(), restored.Balances())
+	}
+	restored.checkMaturity(210)
+	if restored.Balances()["a"] != 2000 {
+		t.Fatalf("restored immature split not credited, got %+v", restored.Balances())
+	}
+}
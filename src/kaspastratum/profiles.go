@@ -0,0 +1,156 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+)
+
+// profile for miners on stratum_port/stratum_tls_port
+const defaultProfileName = "default"
+
+// PortProfile is an extra stratum port with its own difficulty settings.
+// Unset fields fall back to the top level config
+type PortProfile struct {
+	Name           string `yaml:"name"`
+	Port           string `yaml:"port"`
+	MinShareDiff   uint   `yaml:"min_share_diff"`
+	VarDiff        *bool  `yaml:"var_diff"`
+	SharesPerMin   uint   `yaml:"shares_per_min"`
+	VarDiffMin     uint   `yaml:"var_diff_min"`
+	VarDiffMax     uint   `yaml:"var_diff_max"`
+	ExtranonceSize *uint  `yaml:"extranonce_size"`
+	JobFormat      string `yaml:"job_format"`
+	RecordDir      string `yaml:"record_dir"`
+}
+
+// profileConfig overlays the profile on the top level config, the result
+// feeds the same helpers as the default port
+func profileConfig(cfg BridgeConfig, p PortProfile) BridgeConfig {
+	cfg.StratumPort = p.Port
+	cfg.StratumTLSPort = ""
+	cfg.RecordDir = p.RecordDir // recording is per listener
+	if p.MinShareDiff > 0 {
+		cfg.MinShareDiff = p.MinShareDiff
+	}
+	if p.VarDiff != nil {
+		cfg.VarDiff = *p.VarDiff
+	}
+	if p.SharesPerMin > 0 {
+		cfg.SharesPerMin = p.SharesPerMin
+	}
+	if p.VarDiffMin > 0 {
+		cfg.VarDiffMin = p.VarDiffMin
+	}
+	if p.VarDiffMax > 0 {
+		cfg.VarDiffMax = p.VarDiffMax
+	}
+	if p.ExtranonceSize != nil {
+		cfg.ExtranonceSize = *p.ExtranonceSize
+	}
+	return cfg
+}
+
+func validateProfiles(cfg BridgeConfig) error {
+	if len(cfg.Ports) > 0 && cfg.UpstreamPool != "" {
+		return fmt.Errorf("ports can't be used with upstream_pool, difficulty comes from the pool")
+	}
+	names := map[string]bool{defaultProfileName: true}
+	ports := map[string]bool{cfg.StratumPort: true, cfg.StratumTLSPort: true}
+	for _, p := range cfg.Ports {
+		if p.Name == "" || p.Port == "" {
+			return fmt.Errorf("ports entries need a name and port")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate port profile name %q", p.Name)
+		}
+		if ports[p.Port] {
+			return fmt.Errorf("port %s used by more than one profile", p.Port)
+		}
+		names[p.Name], ports[p.Port] = true, true
+		if _, exists := jobEncoder(p.JobFormat); p.JobFormat != "" && !exists {
+			return fmt.Errorf("profile %s: unknown job_format %q", p.Name, p.JobFormat)
+		}
+		pc := profileConfig(cfg, p)
+		if pc.VarDiffMax > 0 && pc.VarDiffMax < pc.VarDiffMin {
+			return fmt.Errorf("profile %s: var_diff_max (%d) is below var_diff_min (%d)", p.Name, pc.VarDiffMax, pc.VarDiffMin)
+		}
+	}
+	return nil
+}
+
+// samePortLayout compares what can't change without a restart, difficulty
+// settings within profiles reload live
+func samePortLayout(old, new []PortProfile) bool {
+	if len(old) != len(new) {
+		return false
+	}
+	for i := range old {
+		if old[i].Name != new[i].Name || old[i].Port != new[i].Port ||
+			old[i].JobFormat != new[i].JobFormat || old[i].RecordDir != new[i].RecordDir ||
+			profileExtranonce(old[i]) != profileExtranonce(new[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func profileExtranonce(p PortProfile) int {
+	if p.ExtranonceSize == nil {
+		return -1
+	}
+	return int(*p.ExtranonceSize)
+}
+
+// portProfile is the running form of a profile, shared by every miner that
+// connected through its port
+type portProfile struct {
+	name           string
+	extranonceSize int8
+	jobFormat      string // encoder name, empty to pick by miner app
+	settingsLock   sync.RWMutex
+	minShareDiff   float64
+	varDiff        varDiffConfig
+}
+
+func newPortProfile(name string, minShareDiff float64, varDiff varDiffConfig, extranonceSize int8, jobFormat string) *portProfile {
+	return &portProfile{
+		name:           name,
+		extranonceSize: extranonceSize,
+		jobFormat:      jobFormat,
+		minShareDiff:   minShareDiff,
+		varDiff:        varDiff,
+	}
+}
+
+func (p *portProfile) diffSettings() (float64, varDiffConfig) {
+	p.settingsLock.RLock()
+	defer p.settingsLock.RUnlock()
+	return p.minShareDiff, p.varDiff
+}
+
+func (p *portProfile) setDiffSettings(minShareDiff float64, varDiff varDiffConfig) {
+	p.settingsLock.Lock()
+	defer p.settingsLock.Unlock()
+	p.minShareDiff = minShareDiff
+	p.varDiff = varDiff
+}
+
+// encoderFor picks the job encoder for a miner, a job_format on the profile
+// overrides the job_encoders rules
+func (p *portProfile) encoderFor(encoders *encoderSelector, remoteApp string) JobEncoder {
+	if enc, exists := jobEncoder(p.jobFormat); exists {
+		return enc
+	}
+	return encoders.forApp(remoteApp)
+}
+
+// profileName is the profile a miner connected through, miners not handled
+// by the client listener (e.g. proxy mode) report the default
+func profileName(ctx *gostratum.StratumContext) string {
+	if state, ok := ctx.State.(*MiningState); ok && state.profile != nil {
+		return state.profile.name
+	}
+	return defaultProfileName
+}
@@ -0,0 +1,128 @@
+package kaspastratum
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestProfileConfig(t *testing.T) {
+	varDiff, extranonce := false, uint(0)
+	cfg := BridgeConfig{StratumPort: ":5555", StratumTLSPort: ":5556", MinShareDiff: 4, VarDiff: true, SharesPerMin: 30, ExtranonceSize: 2, MaxLineLength: 64 * 1024}
+	pc := profileConfig(cfg, PortProfile{Name: "asic", Port: ":6000", MinShareDiff: 8192, VarDiff: &varDiff, ExtranonceSize: &extranonce})
+	if pc.StratumPort != ":6000" || pc.StratumTLSPort != "" {
+		t.Errorf("unexpected ports %q %q", pc.StratumPort, pc.StratumTLSPort)
+	}
+	if pc.MinShareDiff != 8192 || pc.VarDiff || pc.ExtranonceSize != 0 || pc.SharesPerMin != 30 {
+		t.Errorf("profile not applied over %+v", pc)
+	}
+	auth, _ := newAuthPolicy(pc)
+	if sc := newStratumConfig(pc, zap.NewNop().Sugar(), nil, nil, nil, auth); sc.MaxLineLength != 64*1024 {
+		t.Errorf("expected max line length passed to the listener, got %d", sc.MaxLineLength)
+	}
+	if cfg.MinShareDiff != 4 || !cfg.VarDiff {
+		t.Errorf("base config modified")
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	base := BridgeConfig{StratumPort: ":5555"}
+	bad := [][]PortProfile{
+		{{Name: "gpu"}},
+		{{Name: defaultProfileName, Port: ":6000"}},
+		{{Name: "gpu", Port: ":5555"}},
+		{{Name: "gpu", Port: ":6000"}, {Name: "gpu", Port: ":6001"}},
+		{{Name: "gpu", Port: ":6000"}, {Name: "asic", Port: ":6000"}},
+		{{Name: "gpu", Port: ":6000", JobFormat: "huge"}},
+		{{Name: "gpu", Port: ":6000", VarDiffMin: 64, VarDiffMax: 8}},
+	}
+	for _, ports := range bad {
+		cfg := base
+		cfg.Ports = ports
+		if err := validateProfiles(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", ports)
+		}
+	}
+	cfg := base
+	cfg.Ports = []PortProfile{{Name: "gpu", Port: ":6000"}, {Name: "asic", Port: ":6001", JobFormat: encoderBig}}
+	if err := validateProfiles(cfg); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	cfg.UpstreamPool = "pool.example.com:5555"
+	if err := validateProfiles(cfg); err == nil {
+		t.Errorf("expected ports with upstream_pool to be rejected")
+	}
+}
+
+func TestSamePortLayout(t *testing.T) {
+	old := []PortProfile{{Name: "gpu", Port: ":6000", MinShareDiff: 4}}
+	if !samePortLayout(old, []PortProfile{{Name: "gpu", Port: ":6000", MinShareDiff: 64}}) {
+		t.Errorf("difficulty change should reload live")
+	}
+	if samePortLayout(old, []PortProfile{{Name: "gpu", Port: ":6001"}}) {
+		t.Errorf("port change should need a restart")
+	}
+	if samePortLayout(old, nil) {
+		t.Errorf("removing a port should need a restart")
+	}
+}
+
+func TestProfileClients(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	minDiff, varDiff := diffSettingsFor(BridgeConfig{MinShareDiff: 4})
+	clients := newClientListener(zap.NewNop().Sugar(), sh, minDiff, varDiff, 1)
+	asic := newPortProfile("asic", 8192, varDiff, 2, encoderBig)
+	asicListener := clients.addProfile(asic)
+
+	gpuCtx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	asicCtx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	clients.OnConnect(gpuCtx)
+	asicListener.OnConnect(asicCtx)
+
+	if profileName(gpuCtx) != defaultProfileName || profileName(asicCtx) != "asic" {
+		t.Fatalf("unexpected profiles %s %s", profileName(gpuCtx), profileName(asicCtx))
+	}
+	if len(gpuCtx.Extranonce) != 2 || len(asicCtx.Extranonce) != 4 || asicCtx.Extranonce == "0000" {
+		t.Errorf("unexpected extranonces %q %q", gpuCtx.Extranonce, asicCtx.Extranonce)
+	}
+	if asic.encoderFor(nil, "lolminer").Name() != encoderBig || clients.profile(defaultProfileName).encoderFor(nil, "lolminer").Name() != encoderStandard {
+		t.Errorf("job_format not applied")
+	}
+
+	if !clients.applyDiffSettings("asic", 16384, varDiff) || clients.applyDiffSettings("missing", 1, varDiff) {
+		t.Fatalf("unexpected applyDiffSettings result")
+	}
+	if minDiff, _ := asic.diffSettings(); minDiff != 16384 {
+		t.Errorf("asic profile not updated, got %f", minDiff)
+	}
+	if minDiff, _ := clients.diffSettings(); minDiff != 4 {
+		t.Errorf("default profile changed to %f", minDiff)
+	}
+}
+
+// TestProfileExtranoncesDisjoint checks miners on ports with different
+// extranonce sizes never get nonce ranges covering each other's
+func TestProfileExtranoncesDisjoint(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	minDiff, varDiff := diffSettingsFor(BridgeConfig{MinShareDiff: 4})
+	clients := newClientListener(zap.NewNop().Sugar(), sh, minDiff, varDiff, 1)
+	asicListener := clients.addProfile(newPortProfile("asic", 8192, varDiff, 2, ""))
+
+	short := map[string]bool{}
+	var long []string
+	for i := 0; i < 300; i++ {
+		gpuCtx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		asicCtx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		clients.OnConnect(gpuCtx)
+		asicListener.OnConnect(asicCtx)
+		short[gpuCtx.Extranonce] = true
+		long = append(long, asicCtx.Extranonce)
+	}
+	for _, extranonce := range long {
+		if short[extranonce[:2]] {
+			t.Fatalf("2 byte extranonce %s falls inside a 1 byte miner's range", extranonce)
+		}
+	}
+}
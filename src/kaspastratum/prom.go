@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
@@ -14,7 +15,7 @@ import (
 )
 
 var workerLabels = []string{
-	"worker", "miner", "wallet", "ip",
+	"worker", "miner", "wallet", "ip", "profile",
 }
 
 var shareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -32,6 +33,17 @@ var invalidCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of stale shares found by worker over time",
 }, append(workerLabels, "type"))
 
+var lateShareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ks_late_share_counter",
+	Help: "Number of accepted shares submitted for a job issued before the current tip",
+}, workerLabels)
+
+var shareLagHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ks_late_share_bluescore_lag",
+	Help:    "Blue score distance between the tip and the job of late-but-accepted shares",
+	Buckets: prometheus.LinearBuckets(1, 1, 16),
+})
+
 var blockCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "ks_blocks_mined",
 	Help: "Number of blocks mined over time",
@@ -42,6 +54,11 @@ var blockGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help: "Gauge containing 1 unique instance per block mined",
 }, append(workerLabels, "nonce", "bluescore", "hash"))
 
+var pendingBalanceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_pool_pending_balance",
+	Help: "Matured but unpaid pool balance by wallet, in sompi",
+}, []string{"wallet"})
+
 var disconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "ks_worker_disconnect_counter",
 	Help: "Number of disconnects by worker",
@@ -52,6 +69,11 @@ var jobCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of jobs sent to the miner by worker over time",
 }, workerLabels)
 
+var diffGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_worker_difficulty_gauge",
+	Help: "Gauge representing the stratum difficulty currently assigned to the worker",
+}, workerLabels)
+
 var balanceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "ks_balance_by_wallet_gauge",
 	Help: "Gauge representing the wallet balance for connected workers",
@@ -62,6 +84,16 @@ var errorByWallet = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Gauge representing errors by worker",
 }, []string{"wallet", "error"})
 
+var workerHashrateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_worker_hashrate_gauge",
+	Help: "Gauge representing the worker hashrate in GH/s over each hashrate window",
+}, []string{"worker", "window"})
+
+var hashrateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_hashrate_gauge",
+	Help: "Gauge representing the bridge hashrate in GH/s over each hashrate window",
+}, []string{"window"})
+
 var estimatedNetworkHashrate = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "ks_estimated_network_hashrate_gauge",
 	Help: "Gauge representing the estimated network hashrate",
@@ -77,12 +109,53 @@ var networkBlockCount = promauto.NewGauge(prometheus.GaugeOpts{
 	Help: "Gauge representing the network block count",
 })
 
+var upstreamGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_upstream_connected_gauge",
+	Help: "Gauge representing whether each upstream pool connection is up (proxy mode)",
+}, []string{"upstream"})
+
+var kaspadNodeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_kaspad_node_gauge",
+	Help: "Health of each configured kaspad node, 1 if the condition in `state` holds",
+}, []string{"node", "state"})
+
+var kaspadLatencyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_kaspad_node_latency_seconds",
+	Help: "Smoothed rpc latency to each configured kaspad node",
+}, []string{"node"})
+
+var kaspadNotificationAgeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ks_kaspad_node_notification_age_seconds",
+	Help: "Time since the last new block template notification from each kaspad node",
+}, []string{"node"})
+
+var kaspadFailoverCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ks_kaspad_failover_counter",
+	Help: "Number of times the bridge failed over to a kaspad node",
+}, []string{"node"})
+
+var connectionRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ks_connection_rejected_counter",
+	Help: "Number of incoming connections refused by admission control, by reason",
+}, []string{"reason"})
+
+var alertCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ks_alert_counter",
+	Help: "Number of alert notifications by rule and status (firing/resolved)",
+}, []string{"rule", "status"})
+
+var banCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ks_ban_counter",
+	Help: "Number of ips banned for repeat offenses",
+})
+
 func commonLabels(worker *gostratum.StratumContext) prometheus.Labels {
 	return prometheus.Labels{
-		"worker": worker.WorkerName,
-		"miner":  worker.RemoteApp,
-		"wallet": worker.WalletAddr,
-		"ip":     worker.RemoteAddr,
+		"worker":  worker.WorkerName,
+		"miner":   worker.RemoteApp,
+		"wallet":  worker.WalletAddr,
+		"ip":      worker.RemoteAddr,
+		"profile": profileName(worker),
 	}
 }
 
@@ -97,6 +170,11 @@ func RecordStaleShare(worker *gostratum.StratumContext) {
 	invalidCounter.With(labels).Inc()
 }
 
+func RecordLateShare(worker *gostratum.StratumContext, lag uint64) {
+	lateShareCounter.With(commonLabels(worker)).Inc()
+	shareLagHistogram.Observe(float64(lag))
+}
+
 func RecordDupeShare(worker *gostratum.StratumContext) {
 	labels := commonLabels(worker)
 	labels["type"] = "duplicate"
@@ -120,7 +198,7 @@ func RecordBlockFound(worker *gostratum.StratumContext, nonce, bluescore uint64,
 	labels := commonLabels(worker)
 	labels["nonce"] = fmt.Sprintf("%d", nonce)
 	labels["bluescore"] = fmt.Sprintf("%d", bluescore)
-	labels["hash"] = fmt.Sprintf("%d", hash)
+	labels["hash"] = hash
 	blockGauge.With(labels).Set(1)
 }
 
@@ -132,12 +210,65 @@ func RecordNewJob(worker *gostratum.StratumContext) {
 	jobCounter.With(commonLabels(worker)).Inc()
 }
 
+func RecordWorkerDifficulty(worker *gostratum.StratumContext, diff float64) {
+	diffGauge.With(commonLabels(worker)).Set(diff)
+}
+
 func RecordNetworkStats(hashrate uint64, blockCount uint64, difficulty float64) {
 	estimatedNetworkHashrate.Set(float64(hashrate))
 	networkDifficulty.Set(difficulty)
 	networkBlockCount.Set(float64(blockCount))
 }
 
+func RecordWorkerHashrate(worker string, window time.Duration, ghs float64) {
+	workerHashrateGauge.With(prometheus.Labels{"worker": worker, "window": windowLabel(window)}).Set(ghs)
+}
+
+func RecordHashrate(window time.Duration, ghs float64) {
+	hashrateGauge.With(prometheus.Labels{"window": windowLabel(window)}).Set(ghs)
+}
+
+func RecordUpstreamStatus(idx int, connected bool) {
+	upstreamGauge.With(prometheus.Labels{"upstream": fmt.Sprintf("%d", idx)}).Set(boolGauge(connected))
+}
+
+func boolGauge(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func RecordKaspadNodeHealth(node string, active bool, health nodeHealth) {
+	kaspadNodeGauge.With(prometheus.Labels{"node": node, "state": "active"}).Set(boolGauge(active))
+	kaspadNodeGauge.With(prometheus.Labels{"node": node, "state": "synced"}).Set(boolGauge(health.Synced))
+	kaspadNodeGauge.With(prometheus.Labels{"node": node, "state": "rpc_ok"}).Set(boolGauge(health.RPCOk))
+	kaspadLatencyGauge.With(prometheus.Labels{"node": node}).Set(health.Latency.Seconds())
+	if !health.LastNotification.IsZero() {
+		kaspadNotificationAgeGauge.With(prometheus.Labels{"node": node}).Set(time.Since(health.LastNotification).Seconds())
+	}
+}
+
+func RecordKaspadFailover(node string) {
+	kaspadFailoverCounter.With(prometheus.Labels{"node": node}).Inc()
+}
+
+func RecordPendingBalance(wallet string, amount uint64) {
+	pendingBalanceGauge.With(prometheus.Labels{"wallet": wallet}).Set(float64(amount))
+}
+
+func RecordConnectionRejected(reason error) {
+	connectionRejectedCounter.With(prometheus.Labels{"reason": reason.Error()}).Inc()
+}
+
+func RecordAlert(rule string, status AlertStatus) {
+	alertCounter.With(prometheus.Labels{"rule": rule, "status": string(status)}).Inc()
+}
+
+func RecordBan() {
+	banCounter.Inc()
+}
+
 func RecordWorkerError(address string, shortError ErrorShortCodeT) {
 	errorByWallet.With(prometheus.Labels{
 		"wallet": address,
@@ -156,6 +287,7 @@ func InitWorkerCounters(worker *gostratum.StratumContext) {
 
 	shareCounter.With(labels).Add(0)
 	shareDiffCounter.With(labels).Add(0)
+	lateShareCounter.With(labels).Add(0)
 
   errTypes := []string{"stale", "duplicate", "invalid", "weak"}
   for _, e := range errTypes {
@@ -2,6 +2,7 @@ package kaspastratum
 
 import (
 	"testing"
+	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
@@ -12,16 +13,24 @@ func TestPromValid(t *testing.T) {
 	// is valid to write to here
 	ctx := gostratum.StratumContext{}
 
-	RecordShareFound(&ctx)
+	RecordShareFound(&ctx, 1234)
 	RecordStaleShare(&ctx)
 	RecordDupeShare(&ctx)
+	RecordLateShare(&ctx, 2)
 	RecordInvalidShare(&ctx)
 	RecordWeakShare(&ctx)
 	RecordBlockFound(&ctx, 10000, 12345, "abcdefg")
 	RecordDisconnect(&ctx)
 	RecordNewJob(&ctx)
+	RecordWorkerDifficulty(&ctx, 4)
 	RecordNetworkStats(1234, 5678, 910)
 	RecordWorkerError("localhost", ErrDisconnected)
+	RecordUpstreamStatus(0, true)
+	RecordKaspadNodeHealth("localhost", true, nodeHealth{Synced: true, LastNotification: time.Now()})
+	RecordKaspadFailover("localhost")
+	RecordPendingBalance("kaspa:test", 1)
+	RecordConnectionRejected(gostratum.ErrorBanned)
+	RecordBan()
 	RecordBalances(&appmessage.GetBalancesByAddressesResponseMessage{
 		Entries: []*appmessage.BalancesByAddressesEntry{
 			{
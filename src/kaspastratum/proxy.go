@@ -0,0 +1,577 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const upstreamRetryDelay = 5 * time.Second
+
+// upstreamJob is a job received from the upstream pool, held in a form that
+// can be re-encoded into whichever job format the local miner speaks
+type upstreamJob struct {
+	id         int
+	upstreamId string
+	header     []byte
+	timestamp  uint64
+	diff       *kaspaDiff
+}
+
+// upstream is a single connection to the pool. Local miners assigned to it
+// mine on a slice of the extranonce space the pool handed out
+type upstream struct {
+	idx        int
+	lock       sync.RWMutex
+	client     *gostratum.StratumClient
+	extranonce string
+	diff       *kaspaDiff
+	jobs       map[int]*upstreamJob
+	jobCounter int
+	latest     *upstreamJob
+	miners     map[int32]*gostratum.StratumContext
+	usedNonces map[int32]bool
+}
+
+// proxyAssignment is the upstream a miner mines on and the slice of the
+// upstream's extranonce space it was given
+type proxyAssignment struct {
+	up    *upstream
+	local int32
+}
+
+type poolProxy struct {
+	logger         *zap.SugaredLogger
+	shareHandler   *shareHandler
+	address        string
+	user           string
+	password       string
+	extranonceSize int8
+	maxExtranonce  int32
+	upstreams      []*upstream
+	clientLock     sync.RWMutex
+	assignments    map[int32]proxyAssignment
+	clientCounter  int32
+	encoders       *encoderSelector
+}
+
+func newPoolProxy(logger *zap.SugaredLogger, shareHandler *shareHandler, address, user, password string,
+	connections uint, extranonceSize int8) *poolProxy {
+	if connections == 0 {
+		connections = 1
+	}
+	if extranonceSize < 1 {
+		extranonceSize = 1 // need at least some space to split between miners
+	}
+	proxy := &poolProxy{
+		logger:         logger.With(zap.String("component", "proxy")),
+		shareHandler:   shareHandler,
+		address:        address,
+		user:           user,
+		password:       password,
+		extranonceSize: extranonceSize,
+		maxExtranonce:  int32(math.Pow(2, (8*math.Min(float64(extranonceSize), 3))) - 1),
+		assignments:    map[int32]proxyAssignment{},
+	}
+	for i := 0; i < int(connections); i++ {
+		up := &upstream{
+			idx:        i,
+			jobs:       map[int]*upstreamJob{},
+			miners:     map[int32]*gostratum.StratumContext{},
+			usedNonces: map[int32]bool{},
+		}
+		up.diff = newKaspaDiff()
+		up.diff.setDiffValue(1)
+		proxy.upstreams = append(proxy.upstreams, up)
+	}
+	return proxy
+}
+
+func (p *poolProxy) Start(ctx context.Context) {
+	for _, up := range p.upstreams {
+		go p.maintainUpstream(ctx, up)
+	}
+}
+
+// maintainUpstream keeps the upstream connected, redialing on failure. Miners
+// on a dropped upstream are disconnected so they reconnect to a healthy one
+func (p *poolProxy) maintainUpstream(ctx context.Context, up *upstream) {
+	for {
+		client, err := gostratum.DialStratum(ctx, gostratum.StratumClientConfig{
+			Address:  p.address,
+			User:     p.user,
+			Password: p.password,
+			Agent:    fmt.Sprintf("kaspa-stratum-bridge_%s", version),
+			Logger:   p.logger.Desugar().With(zap.Int("upstream_idx", up.idx)),
+			EventHandler: func(event gostratum.JsonRpcEvent) {
+				p.handleUpstreamEvent(up, event)
+			},
+		})
+		if err != nil {
+			p.logger.Error("failed connecting to upstream pool, retrying: ", err)
+			RecordUpstreamStatus(up.idx, false)
+		} else {
+			up.lock.Lock()
+			up.client = client
+			if up.extranonce == "" {
+				up.extranonce = subscribeExtranonce(client.SubscribeResult)
+			}
+			up.lock.Unlock()
+			RecordUpstreamStatus(up.idx, true)
+
+			select {
+			case <-ctx.Done():
+				client.Close()
+				return
+			case <-client.Done():
+				p.logger.Warn("lost connection to upstream pool: ", client.Err())
+			}
+			RecordUpstreamStatus(up.idx, false)
+			p.resetUpstream(up)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(upstreamRetryDelay):
+		}
+	}
+}
+
+// resetUpstream drops all state tied to the pool session, the next session
+// may come with a different extranonce and job ids
+func (p *poolProxy) resetUpstream(up *upstream) {
+	up.lock.Lock()
+	miners := make([]*gostratum.StratumContext, 0, len(up.miners))
+	for _, m := range up.miners {
+		miners = append(miners, m)
+	}
+	up.client = nil
+	up.extranonce = ""
+	up.jobs = map[int]*upstreamJob{}
+	up.latest = nil
+	// slots are handed out again once the upstream reconnects, the miners
+	// holding them are on their way out
+	up.miners = map[int32]*gostratum.StratumContext{}
+	up.usedNonces = map[int32]bool{}
+	up.lock.Unlock()
+	for _, m := range miners {
+		m.Disconnect()
+	}
+}
+
+// subscribeExtranonce pulls the extranonce out of subscribe results shaped
+// like [subscriptions, extranonce, size], used by some pools in place of
+// set_extranonce
+func subscribeExtranonce(result any) string {
+	parts, ok := result.([]any)
+	if !ok || len(parts) < 3 {
+		return ""
+	}
+	extranonce, _ := parts[1].(string)
+	if _, err := hex.DecodeString(extranonce); err != nil {
+		return ""
+	}
+	return extranonce
+}
+
+func (p *poolProxy) handleUpstreamEvent(up *upstream, event gostratum.JsonRpcEvent) {
+	switch event.Method {
+	case "set_extranonce", "mining.set_extranonce":
+		if len(event.Params) < 1 {
+			return
+		}
+		extranonce, _ := event.Params[0].(string)
+		up.lock.Lock()
+		changed := up.extranonce != "" && up.extranonce != extranonce
+		up.extranonce = extranonce
+		up.lock.Unlock()
+		if changed {
+			// miners are mining on a slice of the old space, make them
+			// reconnect to pick up the new one
+			p.logger.Warn("upstream extranonce changed, reconnecting miners")
+			p.disconnectMiners(up)
+		}
+	case "mining.set_difficulty":
+		if len(event.Params) < 1 {
+			return
+		}
+		diffValue, err := toFloat(event.Params[0])
+		if err != nil || diffValue <= 0 {
+			p.logger.Warn("invalid difficulty from upstream: ", event.Params[0])
+			return
+		}
+		diff := newKaspaDiff()
+		diff.setDiffValue(diffValue)
+		up.lock.Lock()
+		up.diff = diff
+		up.lock.Unlock()
+		// miners pick the diff up ahead of the next notify
+	case "mining.notify":
+		job, err := parseUpstreamJob(event.Params)
+		if err != nil {
+			p.logger.Warn("failed parsing job from upstream: ", err)
+			return
+		}
+		p.distributeJob(up, job)
+	}
+}
+
+func (p *poolProxy) disconnectMiners(up *upstream) {
+	up.lock.RLock()
+	miners := make([]*gostratum.StratumContext, 0, len(up.miners))
+	for _, m := range up.miners {
+		miners = append(miners, m)
+	}
+	up.lock.RUnlock()
+	for _, m := range miners {
+		m.Disconnect()
+	}
+}
+
+// parseUpstreamJob decodes both job formats the bridge itself sends:
+// [id, [4]uint64 header, timestamp] and [id, 80 char hex header+timestamp]
+func parseUpstreamJob(params []any) (*upstreamJob, error) {
+	if len(params) < 2 {
+		return nil, fmt.Errorf("malformed notify, expected at least 2 params, got %d", len(params))
+	}
+	job := &upstreamJob{upstreamId: fmt.Sprint(params[0])}
+	switch header := params[1].(type) {
+	case string: // large job format
+		raw, err := hex.DecodeString(header)
+		if err != nil || len(raw) != 40 {
+			return nil, fmt.Errorf("malformed large job header '%s'", header)
+		}
+		job.header = raw[:32]
+		job.timestamp = binary.LittleEndian.Uint64(raw[32:])
+	case []any:
+		if len(header) != 4 || len(params) < 3 {
+			return nil, fmt.Errorf("malformed job header %+v", header)
+		}
+		job.header = make([]byte, 32)
+		for i, v := range header {
+			word, err := toUint64(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "malformed job header")
+			}
+			binary.LittleEndian.PutUint64(job.header[i*8:], word)
+		}
+		ts, err := toUint64(params[2])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed job timestamp")
+		}
+		job.timestamp = ts
+	default:
+		return nil, fmt.Errorf("unexpected job header type %T", params[1])
+	}
+	return job, nil
+}
+
+func toUint64(v any) (uint64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(n.String(), 10, 64)
+	case float64:
+		return uint64(n), nil
+	case string:
+		return strconv.ParseUint(n, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected numeric type %T", v)
+}
+
+func toFloat(v any) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("unexpected numeric type %T", v)
+}
+
+func (p *poolProxy) distributeJob(up *upstream, job *upstreamJob) {
+	up.lock.Lock()
+	up.jobCounter++
+	job.id = up.jobCounter
+	job.diff = up.diff
+	up.jobs[job.id%maxjobs] = job
+	up.latest = job
+	miners := make([]*gostratum.StratumContext, 0, len(up.miners))
+	for _, m := range up.miners {
+		miners = append(miners, m)
+	}
+	up.lock.Unlock()
+
+	for _, m := range miners {
+		if !m.Authorized() {
+			continue
+		}
+		go p.sendJob(m, job)
+	}
+}
+
+func (p *poolProxy) sendJob(client *gostratum.StratumContext, job *upstreamJob) {
+	state := GetMiningState(client)
+	state.notifyLock.Lock()
+	defer state.notifyLock.Unlock()
+	if !state.initialized {
+		state.initialized = true
+		state.pickEncoder(func() JobEncoder { return p.encoders.forApp(client.RemoteApp) })
+	}
+	if current := state.getStratumDiff(); current == nil || current.diffValue != job.diff.diffValue {
+		diff := state.setStratumDiff(job.diff.diffValue)
+		if err := sendDifficulty(client, diff); err != nil {
+			return
+		}
+	}
+
+	jobParams := append([]any{fmt.Sprintf("%d", job.id)}, state.getEncoder().NotifyParams(job.header, job.timestamp)...)
+	if err := client.Send(gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.notify",
+		Id:      job.id,
+		Params:  jobParams,
+	}); err != nil {
+		if errors.Is(err, gostratum.ErrorDisconnected) {
+			RecordWorkerError(client.WalletAddr, ErrDisconnected)
+			return
+		}
+		RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
+		client.Logger.Error(errors.Wrapf(err, "failed sending work packet %d", job.id).Error())
+		return
+	}
+	RecordNewJob(client)
+	ev := newClientEvent(EventJob, client)
+	ev.JobId = job.id
+	ev.Diff = job.diff.diffValue
+	p.shareHandler.events.publish(ev)
+}
+
+// OnSubscribe picks the miner's job encoder. The upstream's extranonce prefix
+// is always sent, miners that ignore it are caught by the upstream rejecting
+// their shares
+func (p *poolProxy) OnSubscribe(ctx *gostratum.StratumContext) {
+	GetMiningState(ctx).setEncoder(p.encoders.forApp(ctx.RemoteApp))
+}
+
+// OnConnect assigns the miner to the least loaded upstream that has an
+// extranonce and carves out a slice of that upstream's nonce space
+func (p *poolProxy) OnConnect(ctx *gostratum.StratumContext) {
+	ctx.Id = atomic.AddInt32(&p.clientCounter, 1)
+	ctx.Logger = ctx.Logger.With(zap.Int("client_id", int(ctx.Id)))
+
+	var target *upstream
+	for _, up := range p.upstreams {
+		up.lock.RLock()
+		usable := up.client != nil && up.extranonce != "" && int32(len(up.usedNonces)) <= p.maxExtranonce
+		if usable && (target == nil || len(up.miners) < len(target.miners)) {
+			target = up
+		}
+		up.lock.RUnlock()
+	}
+	if target == nil {
+		ctx.Logger.Warn("no upstream pool connection available, disconnecting")
+		RecordWorkerError(ctx.WalletAddr, ErrNoUpstream)
+		go ctx.Disconnect() // disconnect listener isn't ready for us yet
+		return
+	}
+
+	target.lock.Lock()
+	var local int32
+	for local = 0; local <= p.maxExtranonce; local++ {
+		if !target.usedNonces[local] {
+			break
+		}
+	}
+	target.usedNonces[local] = true
+	target.miners[ctx.Id] = ctx
+	ctx.Extranonce = target.extranonce + fmt.Sprintf("%0*x", p.extranonceSize*2, local)
+	latest := target.latest
+	target.lock.Unlock()
+
+	p.clientLock.Lock()
+	p.assignments[ctx.Id] = proxyAssignment{up: target, local: local}
+	p.clientLock.Unlock()
+	p.shareHandler.events.publish(newClientEvent(EventConnect, ctx))
+
+	go func() {
+		// give the authorize time to go through, then hand out the current
+		// job rather than waiting for the pool to send a new one
+		time.Sleep(5 * time.Second)
+		if !ctx.Authorized() || !ctx.Connected() {
+			return
+		}
+		p.shareHandler.getCreateStats(ctx)
+		if latest != nil {
+			p.sendJob(ctx, latest)
+		}
+	}()
+}
+
+// Clients returns the miners connected across all upstreams
+func (p *poolProxy) Clients() []*gostratum.StratumContext {
+	var clients []*gostratum.StratumContext
+	for _, up := range p.upstreams {
+		up.lock.RLock()
+		for _, miner := range up.miners {
+			clients = append(clients, miner)
+		}
+		up.lock.RUnlock()
+	}
+	return clients
+}
+
+func (p *poolProxy) OnDisconnect(ctx *gostratum.StratumContext) {
+	p.clientLock.Lock()
+	assigned, exists := p.assignments[ctx.Id]
+	delete(p.assignments, ctx.Id)
+	p.clientLock.Unlock()
+	if exists {
+		up := assigned.up
+		up.lock.Lock()
+		// the miner is gone from the upstream if it was reset, the slot may
+		// already belong to a newer miner
+		if _, ok := up.miners[ctx.Id]; ok {
+			delete(up.miners, ctx.Id)
+			delete(up.usedNonces, assigned.local)
+		}
+		up.lock.Unlock()
+	}
+	RecordDisconnect(ctx)
+	p.shareHandler.events.publish(newClientEvent(EventDisconnect, ctx))
+}
+
+// HandleSubmit relays the share to the pool and maps the pool's verdict back
+// onto the local stats
+func (p *poolProxy) HandleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+	if len(event.Params) < 3 {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return fmt.Errorf("malformed event, expected at least 2 params")
+	}
+	jobIdStr, ok := event.Params[1].(string)
+	if !ok {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return fmt.Errorf("unexpected type for param 1: %+v", event.Params...)
+	}
+	jobId, err := strconv.Atoi(jobIdStr)
+	if err != nil {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return errors.Wrap(err, "job id is not parsable as an number")
+	}
+	noncestr, ok := event.Params[2].(string)
+	if !ok {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return fmt.Errorf("unexpected type for param 2: %+v", event.Params...)
+	}
+	noncestr = strings.Replace(noncestr, "0x", "", 1)
+	if extranonce2Len := 16 - len(ctx.Extranonce); len(noncestr) <= extranonce2Len {
+		noncestr = ctx.Extranonce + fmt.Sprintf("%0*s", extranonce2Len, noncestr)
+	}
+
+	p.clientLock.RLock()
+	assigned, exists := p.assignments[ctx.Id]
+	p.clientLock.RUnlock()
+	if !exists {
+		return ctx.ReplyBadShare(event.Id)
+	}
+	up := assigned.up
+	up.lock.RLock()
+	job, jobExists := up.jobs[jobId%maxjobs]
+	client := up.client
+	up.lock.RUnlock()
+	stats := p.shareHandler.getCreateStats(ctx)
+	if !jobExists || job.id != jobId || client == nil {
+		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
+		stats.StaleShares.Add(1)
+		p.shareHandler.overall.StaleShares.Add(1)
+		RecordStaleShare(ctx)
+		p.shareHandler.recordShare(ctx, ShareStale, nil, 0)
+		return ctx.ReplyStaleShare(event.Id)
+	}
+
+	// relayed off the miner's read loop so a slow pool doesn't stall its
+	// session, counted with block submits so shutdown waits for the answer
+	p.shareHandler.pendingSubmits.Inc()
+	go func() {
+		defer p.shareHandler.pendingSubmits.Dec()
+		if err := p.relaySubmit(ctx, event, client, job, noncestr); err != nil && ctx.Connected() {
+			ctx.Logger.Warn("failed replying to relayed share", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// relaySubmit sends the share upstream and replies to the miner with the
+// pool's verdict
+func (p *poolProxy) relaySubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent,
+	client *gostratum.StratumClient, job *upstreamJob, noncestr string) error {
+	stats := p.shareHandler.getCreateStats(ctx)
+	resp, err := client.Call(context.Background(), string(gostratum.StratumMethodSubmit),
+		[]any{p.user, job.upstreamId, noncestr})
+	if err != nil {
+		RecordWorkerError(ctx.WalletAddr, ErrUpstreamSubmit)
+		ctx.Logger.Warn("failed relaying share upstream", zap.Error(err))
+		return ctx.ReplyBadShare(event.Id)
+	}
+	if accepted, _ := resp.Result.(bool); accepted && len(resp.Error) == 0 {
+		stats.SharesFound.Add(1)
+		stats.SharesDiff.Add(job.diff.hashValue)
+		now := time.Now()
+		stats.LastShare.Store(now.UnixNano())
+		stats.Hashrate.add(now, job.diff.hashValue)
+		p.shareHandler.overall.SharesFound.Add(1)
+		p.shareHandler.overall.Hashrate.add(now, job.diff.hashValue)
+		RecordShareFound(ctx, job.diff.hashValue)
+		p.shareHandler.recordShare(ctx, ShareAccepted, job.diff, 0)
+		return ctx.Reply(gostratum.JsonRpcResponse{
+			Id:     event.Id,
+			Result: true,
+		})
+	}
+
+	code := ""
+	if len(resp.Error) > 0 {
+		code = fmt.Sprint(resp.Error[0])
+	}
+	ctx.Logger.Info("share rejected upstream", zap.Any("error", resp.Error))
+	switch code {
+	case "21":
+		stats.StaleShares.Add(1)
+		p.shareHandler.overall.StaleShares.Add(1)
+		RecordStaleShare(ctx)
+		p.shareHandler.recordShare(ctx, ShareStale, job.diff, 0)
+		return ctx.ReplyStaleShare(event.Id)
+	case "22":
+		stats.DupeShares.Add(1)
+		p.shareHandler.overall.DupeShares.Add(1)
+		RecordDupeShare(ctx)
+		p.shareHandler.recordShare(ctx, ShareDupe, job.diff, 0)
+		return ctx.ReplyDupeShare(event.Id)
+	case "23":
+		stats.InvalidShares.Add(1)
+		p.shareHandler.overall.InvalidShares.Add(1)
+		RecordWeakShare(ctx)
+		p.shareHandler.recordShare(ctx, ShareWeak, job.diff, 0)
+		return ctx.ReplyLowDiffShare(event.Id)
+	default:
+		stats.InvalidShares.Add(1)
+		p.shareHandler.overall.InvalidShares.Add(1)
+		RecordInvalidShare(ctx)
+		p.shareHandler.recordShare(ctx, ShareInvalid, job.diff, 0)
+		return ctx.ReplyBadShare(event.Id)
+	}
+}
@@ -0,0 +1,232 @@
+package kaspastratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestUpstreamJobParsing(t *testing.T) {
+	header, err := SerializeBlockHeader(loadExampleBlock(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const timestamp = 1662696346
+
+	// round trip both job formats the way a miner would receive them
+	var small []any
+	for _, v := range GenerateJobHeader(header) {
+		small = append(small, json.Number(fmtUint(v)))
+	}
+	for name, params := range map[string][]any{
+		"small": {"7", small, json.Number(fmtUint(timestamp))},
+		"large": {"7", GenerateLargeJobParams(header, timestamp)},
+	} {
+		job, err := parseUpstreamJob(params)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if d := cmp.Diff(header, job.header); d != "" {
+			t.Fatalf("%s: header parsed incorrectly: %s", name, d)
+		}
+		if job.timestamp != timestamp || job.upstreamId != "7" {
+			t.Fatalf("%s: unexpected job %+v", name, job)
+		}
+	}
+
+	if _, err := parseUpstreamJob([]any{"1", "abcd"}); err == nil {
+		t.Fatal("expected error on truncated header")
+	}
+}
+
+func fmtUint(v uint64) string {
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
+
+func TestProxySubmitMapping(t *testing.T) {
+	poolConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	submitted := make(chan []any, 1)
+	go func() {
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			event, _ := gostratum.UnmarshalEvent(scanner.Text())
+			submitted <- event.Params
+			var resp gostratum.JsonRpcResponse
+			switch event.Params[1] {
+			case "10":
+				resp = gostratum.NewResponse(event, true, nil)
+			case "11":
+				resp = gostratum.NewResponse(event, nil, []any{21, "Job not found", nil})
+			case "12":
+				resp = gostratum.NewResponse(event, nil, []any{22, "Duplicate share submitted", nil})
+			default:
+				resp = gostratum.NewResponse(event, nil, []any{20, "Unknown problem", nil})
+			}
+			encoded, _ := json.Marshal(resp)
+			serverConn.Write(append(encoded, '\n'))
+		}
+	}()
+
+	sh := newShareHandler(nil, 0, 0)
+	proxy := newPoolProxy(zap.NewNop().Sugar(), sh, "pool", "kaspa:proxy.bridge", "x", 1, 1)
+	up := proxy.upstreams[0]
+	up.client = gostratum.NewStratumClient(poolConn, gostratum.StratumClientConfig{})
+	up.extranonce = "abcd"
+	diff := newKaspaDiff()
+	diff.setDiffValue(4)
+	for _, id := range []int{10, 11, 12, 13} {
+		up.jobs[id%maxjobs] = &upstreamJob{id: id, upstreamId: fmtUint(uint64(id)), diff: diff}
+	}
+
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.Extranonce = "abcd01"
+	proxy.assignments[ctx.Id] = proxyAssignment{up: up, local: 1}
+
+	tests := []struct {
+		job   string
+		code  any
+		stats func() int64
+	}{
+		{job: "10", code: nil, stats: func() int64 { return sh.overall.SharesFound.Load() }},
+		{job: "11", code: float64(21), stats: func() int64 { return sh.overall.StaleShares.Load() }},
+		{job: "12", code: float64(22), stats: func() int64 { return sh.overall.DupeShares.Load() }},
+		{job: "13", code: float64(20), stats: func() int64 { return sh.overall.InvalidShares.Load() }},
+		{job: "99", code: float64(21), stats: func() int64 { return sh.overall.StaleShares.Load() }},
+	}
+	for _, v := range tests {
+		before := v.stats()
+		go proxy.HandleSubmit(ctx, gostratum.NewEvent("1", "mining.submit", []any{"worker", v.job, "0123"}))
+		mc.ReadTestDataFromBuffer(func(b []byte) {
+			resp := gostratum.JsonRpcResponse{}
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatal(err)
+			}
+			var code any
+			if len(resp.Error) > 0 {
+				code = resp.Error[0]
+			}
+			if code != v.code {
+				t.Fatalf("job %s: expected error code %v, got %+v", v.job, v.code, resp)
+			}
+		})
+		if after := v.stats(); after != before+1 {
+			t.Fatalf("job %s: stats not updated", v.job)
+		}
+		if v.job == "10" {
+			// nonce is expanded with the miner's extranonce before relaying
+			if params := <-submitted; params[2] != "abcd010000000123" {
+				t.Fatalf("unexpected nonce relayed upstream: %+v", params)
+			}
+		} else if v.job != "99" {
+			<-submitted
+		}
+	}
+}
+
+// TestProxySubmitAsync checks a pool slow to answer doesn't hold up the
+// miner's session, the reply follows once the pool responds
+func TestProxySubmitAsync(t *testing.T) {
+	poolConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	received := make(chan gostratum.JsonRpcEvent, 1)
+	go func() {
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			event, _ := gostratum.UnmarshalEvent(scanner.Text())
+			received <- event
+		}
+	}()
+
+	sh := newShareHandler(nil, 0, 0)
+	proxy := newPoolProxy(zap.NewNop().Sugar(), sh, "pool", "kaspa:proxy.bridge", "x", 1, 1)
+	up := proxy.upstreams[0]
+	up.client = gostratum.NewStratumClient(poolConn, gostratum.StratumClientConfig{})
+	up.extranonce = "abcd"
+	diff := newKaspaDiff()
+	diff.setDiffValue(4)
+	up.jobs[10%maxjobs] = &upstreamJob{id: 10, upstreamId: "10", diff: diff}
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.Extranonce = "abcd01"
+	proxy.assignments[ctx.Id] = proxyAssignment{up: up, local: 1}
+
+	returned := make(chan error, 1)
+	go func() {
+		returned <- proxy.HandleSubmit(ctx, gostratum.NewEvent("1", "mining.submit", []any{"worker", "10", "0123"}))
+	}()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("submit blocked waiting on the pool")
+	}
+
+	event := <-received
+	encoded, _ := json.Marshal(gostratum.NewResponse(event, true, nil))
+	serverConn.Write(append(encoded, '\n'))
+	mc.ReadTestDataFromBuffer(func(b []byte) {
+		resp := gostratum.JsonRpcResponse{}
+		if err := json.Unmarshal(b, &resp); err != nil || resp.Result != true {
+			t.Fatalf("expected accepted reply once the pool answered, got %s", b)
+		}
+	})
+	if sh.overall.SharesFound.Load() != 1 {
+		t.Fatalf("accepted share not counted")
+	}
+}
+
+func TestProxyExtranonceSlots(t *testing.T) {
+	sh := newShareHandler(nil, 0, 0)
+	proxy := newPoolProxy(zap.NewNop().Sugar(), sh, "pool", "kaspa:proxy.bridge", "x", 1, 1)
+	up := proxy.upstreams[0]
+	connectUpstream := func(extranonce string) {
+		poolConn, _ := net.Pipe()
+		up.client = gostratum.NewStratumClient(poolConn, gostratum.StratumClientConfig{})
+		up.extranonce = extranonce
+	}
+	// already cancelled so disconnects don't block on a listener
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	connect := func() *gostratum.StratumContext {
+		ctx, _ := gostratum.NewMockContext(stopped, zap.NewNop(), MiningStateGenerator())
+		proxy.OnConnect(ctx)
+		return ctx
+	}
+
+	connectUpstream("abcd")
+	first, second := connect(), connect()
+	if first.Extranonce != "abcd00" || second.Extranonce != "abcd01" {
+		t.Fatalf("unexpected extranonces %s, %s", first.Extranonce, second.Extranonce)
+	}
+	proxy.OnDisconnect(first)
+	if third := connect(); third.Extranonce != "abcd00" {
+		t.Fatalf("freed slot not reused, got %s", third.Extranonce)
+	}
+
+	// the pool drops us, everything is released even though the miners'
+	// disconnects are still in flight
+	proxy.resetUpstream(up)
+	if len(up.usedNonces) != 0 || len(up.miners) != 0 {
+		t.Fatalf("slots not released on reset: %+v", up.usedNonces)
+	}
+	connectUpstream("ef")
+	fresh := []*gostratum.StratumContext{connect(), connect()}
+	if fresh[0].Extranonce != "ef00" || fresh[1].Extranonce != "ef01" {
+		t.Fatalf("unexpected extranonces after reset %s, %s", fresh[0].Extranonce, fresh[1].Extranonce)
+	}
+	// the old miners finally go away, they mustn't free the new miners' slots
+	proxy.OnDisconnect(second)
+	if len(up.usedNonces) != 2 || len(up.miners) != 2 {
+		t.Fatalf("stale disconnect freed a reassigned slot: %+v", up.usedNonces)
+	}
+}
@@ -0,0 +1,55 @@
+package kaspastratum
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+var sessionFile = flag.String("session", "", "recorded session to replay in TestReplaySessions, in place of testdata/sessions")
+
+// replayTestBridge wires up the bridge the same way ListenAndServe does, with
+// a fake kaspad serving the example header, and returns the listener along
+// with a func to send out new jobs
+func replayTestBridge(t *testing.T, cfg BridgeConfig) (*gostratum.StratumListener, func()) {
+	logger := zap.NewNop().Sugar()
+	auth, err := newAuthPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeKaspad(0) // keep the example header's own difficulty
+	fake.Script(loadExampleBlock(t))
+	fake.NewTemplate()
+	ksApi := fakeKaspaApi(t, fake)
+	sh := newShareHandler(ksApi, cfg.StaleWindow, cfg.MaxJobAge)
+	minDiff, varDiff := diffSettingsFor(cfg)
+	clients := newClientListener(logger, sh, minDiff, varDiff, extranonceSizeFor(cfg))
+	listener := gostratum.NewListener(newStratumConfig(cfg, logger, clients, sh.HandleSubmit, sh.events, auth))
+	return listener, func() { clients.NewBlockAvailable(ksApi) }
+}
+
+// TestReplaySessions replays the recorded sessions in testdata/sessions (or
+// -session) against the bridge and checks it answers the miner the same way
+func TestReplaySessions(t *testing.T) {
+	paths, _ := filepath.Glob(filepath.Join("testdata", "sessions", "*.jsonl"))
+	if *sessionFile != "" {
+		paths = []string{*sessionFile}
+	}
+	for _, path := range paths {
+		session, err := gostratum.LoadSession(path)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		listener, newBlock := replayTestBridge(t, BridgeConfig{MinShareDiff: 4, ExtranonceSize: 2, StaleWindow: 8})
+		result := listener.Replay(context.Background(), session, gostratum.ReplayConfig{
+			OnNotify: func(*gostratum.StratumContext) { newBlock() },
+		})
+		for _, mismatch := range result.Mismatches(session) {
+			t.Errorf("%s: %s", path, mismatch)
+		}
+	}
+}
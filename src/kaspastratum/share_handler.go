@@ -1,6 +1,7 @@
 package kaspastratum
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sort"
@@ -13,7 +14,6 @@ import (
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
-	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
@@ -25,26 +25,217 @@ type WorkStats struct {
 	SharesFound   atomic.Int64
 	SharesDiff    atomic.Float64
 	StaleShares   atomic.Int64
+	DupeShares    atomic.Int64
 	InvalidShares atomic.Int64
 	WorkerName    string
 	StartTime     time.Time
-	LastShare     time.Time
+	LastShare     atomic.Int64 // unix nanos, read by alerts while shares are handled
+	Hashrate      hashrateWindows
+}
+
+func (ws *WorkStats) lastShareTime() time.Time {
+	return time.Unix(0, ws.LastShare.Load())
 }
 
 type shareHandler struct {
-	kaspa        *rpcclient.RPCClient
+	kaspa        *KaspaApi
 	stats        map[string]*WorkStats
 	statsLock    sync.Mutex
 	overall      WorkStats
-	tipBlueScore uint64
+	tipBlueScore atomic.Uint64
+	staleWindow  atomic.Uint64
+	maxJobAge    atomic.Duration
+	store        *shareStore
+	pool         *poolAccounting // nil unless running in pool mode
+	blocksLock   sync.Mutex
+	recentBlocks []BlockRecord
+	events       *eventBus
+	// windows worker hashrate is tracked over, shortest first
+	hashrateWindows []time.Duration
+	// blocks handed to kaspad that haven't been answered yet, shutdown waits
+	// on these so a found block isn't lost
+	pendingSubmits atomic.Int64
+}
+
+// blocks kept in memory for reporting when there's no store
+const maxRecentBlocks = 100
+
+func newShareHandler(kaspa *KaspaApi, staleWindow uint64, maxJobAge time.Duration) *shareHandler {
+	sh := &shareHandler{
+		kaspa:           kaspa,
+		stats:           map[string]*WorkStats{},
+		statsLock:       sync.Mutex{},
+		events:          newEventBus(),
+		hashrateWindows: defaultHashrateWindows,
+	}
+	sh.setStaleLimits(staleWindow, maxJobAge)
+	return sh
+}
+
+// setStaleLimits updates how old a job can get before its shares are stale,
+// safe to call while shares are being handled
+func (sh *shareHandler) setStaleLimits(staleWindow uint64, maxJobAge time.Duration) {
+	if staleWindow == 0 {
+		staleWindow = workWindow
+	}
+	sh.staleWindow.Store(staleWindow)
+	sh.maxJobAge.Store(maxJobAge)
+}
+
+// setHashrateWindows sets the windows hashrate is tracked over, nil for the
+// defaults. Called before any shares come in, recorded hashrate is dropped
+func (sh *shareHandler) setHashrateWindows(windows []time.Duration) {
+	sh.statsLock.Lock()
+	defer sh.statsLock.Unlock()
+	sh.hashrateWindows = normalizeHashrateWindows(windows)
+	sh.overall.Hashrate.setWindows(sh.hashrateWindows)
+	for _, stats := range sh.stats {
+		stats.Hashrate.setWindows(sh.hashrateWindows)
+	}
+}
+
+// updateTip records the blue score of a fresh template if it's ahead of the
+// current tip, returns the tip after the update
+func (sh *shareHandler) updateTip(blueScore uint64) uint64 {
+	for {
+		tip := sh.tipBlueScore.Load()
+		if blueScore <= tip {
+			return tip
+		}
+		if sh.tipBlueScore.CAS(tip, blueScore) {
+			return blueScore
+		}
+	}
+}
+
+// attachStore persists shares and blocks from here on, restoring the stored
+// per-worker totals so stats survive a restart
+func (sh *shareHandler) attachStore(store *shareStore) error {
+	totals, err := store.Totals()
+	if err != nil {
+		return errors.Wrap(err, "failed restoring worker totals")
+	}
+	sh.statsLock.Lock()
+	defer sh.statsLock.Unlock()
+	for worker, t := range totals {
+		stats := &WorkStats{
+			WorkerName: worker,
+			StartTime:  t.FirstSeen,
+		}
+		if !t.LastShare.IsZero() {
+			stats.LastShare.Store(t.LastShare.UnixNano())
+		}
+		stats.Hashrate.setWindows(sh.hashrateWindows)
+		stats.BlocksFound.Store(t.BlocksFound)
+		stats.SharesFound.Store(t.SharesFound)
+		stats.SharesDiff.Store(t.SharesDiff)
+		stats.StaleShares.Store(t.StaleShares)
+		stats.DupeShares.Store(t.DupeShares)
+		stats.InvalidShares.Store(t.InvalidShares)
+		sh.stats[worker] = stats
+
+		sh.overall.BlocksFound.Add(t.BlocksFound)
+		sh.overall.SharesFound.Add(t.SharesFound)
+		sh.overall.SharesDiff.Add(t.SharesDiff)
+		sh.overall.StaleShares.Add(t.StaleShares)
+		sh.overall.DupeShares.Add(t.DupeShares)
+		sh.overall.InvalidShares.Add(t.InvalidShares)
+	}
+	sh.store = store
+	return nil
+}
+
+func storeWorkerName(ctx *gostratum.StratumContext) string {
+	if ctx.WorkerName != "" {
+		return ctx.WorkerName
+	}
+	return ctx.RemoteAddr
+}
+
+// recordShare publishes the share outcome and persists it if a store is
+// attached. diff may be nil for shares rejected before their difficulty was
+// known
+func (sh *shareHandler) recordShare(ctx *gostratum.StratumContext, shareType ShareType, diff *kaspaDiff, blueScore uint64) {
+	ev := newClientEvent(EventShareRejected, ctx)
+	if shareType == ShareAccepted {
+		ev.Type = EventShareAccepted
+	} else {
+		ev.Reason = shareType
+	}
+	ev.BlueScore = blueScore
+	if diff != nil {
+		ev.Diff = diff.diffValue
+	}
+	sh.events.publish(ev)
+
+	if sh.store == nil {
+		return
+	}
+	rec := ShareRecord{
+		Worker:    storeWorkerName(ctx),
+		Wallet:    ctx.WalletAddr,
+		Type:      shareType,
+		BlueScore: blueScore,
+		Timestamp: time.Now(),
+	}
+	if diff != nil {
+		rec.Diff = diff.diffValue
+		rec.HashValue = diff.hashValue
+	}
+	sh.store.RecordShare(rec)
+}
+
+// recordBlock keeps the block in the recent list, publishes it and persists
+// it if a store is attached
+func (sh *shareHandler) recordBlock(ctx *gostratum.StratumContext, hash string, nonce, blueScore uint64) {
+	rec := BlockRecord{
+		Worker:    storeWorkerName(ctx),
+		Wallet:    ctx.WalletAddr,
+		Hash:      hash,
+		Nonce:     nonce,
+		BlueScore: blueScore,
+		Timestamp: time.Now(),
+	}
+	sh.blocksLock.Lock()
+	sh.recentBlocks = append(sh.recentBlocks, rec)
+	if len(sh.recentBlocks) > maxRecentBlocks {
+		sh.recentBlocks = sh.recentBlocks[1:]
+	}
+	sh.blocksLock.Unlock()
+
+	ev := newClientEvent(EventBlockFound, ctx)
+	ev.Hash = hash
+	ev.BlueScore = blueScore
+	sh.events.publish(ev)
+
+	if sh.store != nil {
+		sh.store.RecordBlock(rec)
+	}
+}
+
+// RecentBlocks returns up to limit found blocks, newest first. History goes
+// back further when a store is attached
+func (sh *shareHandler) RecentBlocks(limit int) ([]BlockRecord, error) {
+	if sh.store != nil {
+		return sh.store.Blocks(limit)
+	}
+	sh.blocksLock.Lock()
+	defer sh.blocksLock.Unlock()
+	blocks := make([]BlockRecord, 0, limit)
+	for i := len(sh.recentBlocks) - 1; i >= 0 && len(blocks) < limit; i-- {
+		blocks = append(blocks, sh.recentBlocks[i])
+	}
+	return blocks, nil
 }
 
-func newShareHandler(kaspa *rpcclient.RPCClient) *shareHandler {
-	return &shareHandler{
-		kaspa:     kaspa,
-		stats:     map[string]*WorkStats{},
-		statsLock: sync.Mutex{},
+// findStats looks up the stats for the worker without creating them
+func (sh *shareHandler) findStats(ctx *gostratum.StratumContext) *WorkStats {
+	sh.statsLock.Lock()
+	defer sh.statsLock.Unlock()
+	if stats, found := sh.stats[ctx.WorkerName]; found && ctx.WorkerName != "" {
+		return stats
 	}
+	return sh.stats[ctx.RemoteAddr]
 }
 
 func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats {
@@ -66,9 +257,10 @@ func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats
 	}
 	if !found { // legit doesn't exist, create it
 		stats = &WorkStats{}
-		stats.LastShare = time.Now()
+		stats.LastShare.Store(time.Now().UnixNano())
 		stats.WorkerName = ctx.RemoteAddr
 		stats.StartTime = time.Now()
+		stats.Hashrate.setWindows(sh.hashrateWindows)
 		sh.stats[ctx.RemoteAddr] = stats
 
 		// TODO: not sure this is the best place, nor whether we shouldn't be
@@ -81,6 +273,7 @@ func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats
 }
 
 type submitInfo struct {
+	job      *MiningJob
 	block    *appmessage.RPCBlock
 	state    *MiningState
 	noncestr string
@@ -103,7 +296,7 @@ func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent)
 		return nil, errors.Wrap(err, "job id is not parsable as an number")
 	}
 	state := GetMiningState(ctx)
-	block, exists := state.GetJob(int(jobId))
+	job, exists := state.GetJob(int(jobId))
 	if !exists {
 		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
 		return nil, fmt.Errorf("job does not exist. stale?")
@@ -115,7 +308,8 @@ func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent)
 	}
 	return &submitInfo{
 		state:    state,
-		block:    block,
+		job:      job,
+		block:    job.Block,
 		noncestr: strings.Replace(noncestr, "0x", "", 1),
 	}, nil
 }
@@ -125,22 +319,28 @@ var (
 	ErrDupeShare  = fmt.Errorf("duplicate share")
 )
 
-// the max difference between tip blue score and job blue score that we'll accept
-// anything greater than this is considered a stale
+// the default max difference between tip blue score and the tip at the time
+// the job was issued that we'll accept, anything greater is considered stale
 const workWindow = 8
 
-func (sh *shareHandler) checkStales(ctx *gostratum.StratumContext, si *submitInfo) error {
-	tip := sh.tipBlueScore
-	if si.block.Header.BlueScore > tip {
-		sh.tipBlueScore = si.block.Header.BlueScore
-		return nil // can't be
+// checkStales classifies the share against the age of the job it was
+// submitted for. Returns how far (in blue score) the tip has moved since the
+// job was issued so late-but-accepted shares can be tracked
+func (sh *shareHandler) checkStales(si *submitInfo) (uint64, error) {
+	if maxJobAge := sh.maxJobAge.Load(); maxJobAge > 0 {
+		if age := time.Since(si.job.issued); age > maxJobAge {
+			return 0, errors.Wrapf(ErrStaleShare, "job age %s", age.Round(time.Millisecond))
+		}
 	}
-	if tip-si.block.Header.BlueScore > workWindow {
-		RecordStaleShare(ctx)
-		return errors.Wrapf(ErrStaleShare, "blueScore %d vs %d", si.block.Header.BlueScore, tip)
+	tip := sh.tipBlueScore.Load()
+	if si.job.tipBlueScore >= tip {
+		return 0, nil
 	}
-	// TODO (bs): dupe share tracking
-	return nil
+	lag := tip - si.job.tipBlueScore
+	if lag > sh.staleWindow.Load() {
+		return lag, errors.Wrapf(ErrStaleShare, "blueScore %d vs %d", si.job.tipBlueScore, tip)
+	}
+	return lag, nil
 }
 
 func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
@@ -149,47 +349,40 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 		return err
 	}
 
-	// add extranonce to noncestr if enabled and submitted nonce is shorter than
-	// expected (16 - <extranonce length> characters)
-	if ctx.Extranonce != "" {
-		extranonce2Len := 16 - len(ctx.Extranonce)
-		if len(submitInfo.noncestr) <= extranonce2Len {
-			submitInfo.noncestr = ctx.Extranonce + fmt.Sprintf("%0*s", extranonce2Len, submitInfo.noncestr)
-		}
-	}
-
 	//ctx.Logger.Debug(submitInfo.block.Header.BlueScore, " submit ", submitInfo.noncestr)
 	state := GetMiningState(ctx)
-	if state.useBigJob {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
-	} else {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
+	submitInfo.nonceVal, err = state.getEncoder().ParseNonce(ctx.Extranonce, submitInfo.noncestr)
+	if err != nil {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return err
 	}
+	submitInfo.noncestr = fmt.Sprintf("%016x", submitInfo.nonceVal)
 	stats := sh.getCreateStats(ctx)
-	// if err := sh.checkStales(ctx, submitInfo); err != nil {
-	// 	if err == ErrDupeShare {
-	// 		ctx.Logger.Info("dupe share "+submitInfo.noncestr, ctx.WorkerName, ctx.WalletAddr)
-	// 		atomic.AddInt64(&stats.StaleShares, 1)
-	// 		RecordDupeShare(ctx)
-	// 		return ctx.ReplyDupeShare(event.Id)
-	// 	} else if errors.Is(err, ErrStaleShare) {
-	// 		ctx.Logger.Info(err.Error(), ctx.WorkerName, ctx.WalletAddr)
-	// 		atomic.AddInt64(&stats.StaleShares, 1)
-	// 		RecordStaleShare(ctx)
-	// 		return ctx.ReplyStaleShare(event.Id)
-	// 	}
-	// 	// unknown error somehow
-	// 	ctx.Logger.Error("unknown error during check stales: ", err.Error())
-	// 	return ctx.ReplyBadShare(event.Id)
-	// }
+	switch state.trackNonce(submitInfo.job, submitInfo.nonceVal) {
+	case nonceJobFull:
+		ctx.Logger.Warn("job share limit reached, refusing share " + submitInfo.noncestr)
+		stats.StaleShares.Add(1)
+		sh.overall.StaleShares.Add(1)
+		RecordStaleShare(ctx)
+		sh.recordShare(ctx, ShareStale, submitInfo.job.diff, submitInfo.job.tipBlueScore)
+		return ctx.ReplyStaleShare(event.Id)
+	case nonceDupe:
+		ctx.Logger.Info("dupe share " + submitInfo.noncestr)
+		stats.DupeShares.Add(1)
+		sh.overall.DupeShares.Add(1)
+		RecordDupeShare(ctx)
+		sh.recordShare(ctx, ShareDupe, submitInfo.job.diff, submitInfo.job.tipBlueScore)
+		return ctx.ReplyDupeShare(event.Id)
+	}
+	lag, err := sh.checkStales(submitInfo)
+	if err != nil {
+		ctx.Logger.Info(err.Error())
+		stats.StaleShares.Add(1)
+		sh.overall.StaleShares.Add(1)
+		RecordStaleShare(ctx)
+		sh.recordShare(ctx, ShareStale, submitInfo.job.diff, submitInfo.job.tipBlueScore)
+		return ctx.ReplyStaleShare(event.Id)
+	}
 
 	converted, err := appmessage.RPCBlockToDomainBlock(submitInfo.block)
 	if err != nil {
@@ -200,24 +393,45 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	powState := pow.NewState(mutableHeader)
 	powValue := powState.CalculateProofOfWorkValue()
 
+	// credit at the diff the share actually meets, the worker may have been
+	// retargeted since the job was issued
+	shareDiff := state.shareDiff(submitInfo.job, powValue, time.Now())
+
 	// The block hash must be less or equal than the claimed target.
-	if powValue.Cmp(&powState.Target) <= 0 {
-		if err := sh.submit(ctx, converted, submitInfo.nonceVal, event.Id); err != nil {
+	foundBlock := powValue.Cmp(&powState.Target) <= 0
+	if foundBlock {
+		if shareDiff == nil { // share diff set above network diff, still a share
+			shareDiff = submitInfo.job.diff
+		}
+		if err := sh.submit(ctx, converted, submitInfo.nonceVal, event.Id, shareDiff.diffValue); err != nil {
 			return err
 		}
+	} else if shareDiff == nil {
+		ctx.Logger.Warn("weak share " + submitInfo.noncestr)
+		stats.InvalidShares.Add(1)
+		sh.overall.InvalidShares.Add(1)
+		RecordWeakShare(ctx)
+		sh.recordShare(ctx, ShareWeak, submitInfo.job.diff, submitInfo.job.tipBlueScore)
+		ctx.RecordOffense(gostratum.OffenseInvalidShares)
+		return ctx.ReplyLowDiffShare(event.Id)
 	}
-	// remove for now until I can figure it out. No harm here as we're not
-	// } else if powValue.Cmp(state.stratumDiff.targetValue) >= 0 {
-	// 	ctx.Logger.Warn("weak block")
-	// 	RecordWeakShare(ctx)
-	// 	return ctx.ReplyLowDiffShare(event.Id)
-	// }
 
 	stats.SharesFound.Add(1)
-	stats.SharesDiff.Add(state.stratumDiff.hashValue)
-	stats.LastShare = time.Now()
+	stats.SharesDiff.Add(shareDiff.hashValue)
+	now := time.Now()
+	stats.LastShare.Store(now.UnixNano())
+	stats.Hashrate.add(now, shareDiff.hashValue)
 	sh.overall.SharesFound.Add(1)
-	RecordShareFound(ctx, state.stratumDiff.hashValue)
+	sh.overall.Hashrate.add(now, shareDiff.hashValue)
+	RecordShareFound(ctx, shareDiff.hashValue)
+	if lag > 0 {
+		RecordLateShare(ctx, lag)
+	}
+	sh.recordShare(ctx, ShareAccepted, shareDiff, submitInfo.job.tipBlueScore)
+	if sh.pool != nil && !foundBlock { // block shares are credited as the block is
+		sh.pool.addShare(ctx.WalletAddr, shareDiff.diffValue)
+	}
+	state.varDiff.recordShare(shareDiff.diffValue / state.getStratumDiff().diffValue)
 
 	return ctx.Reply(gostratum.JsonRpcResponse{
 		Id:     event.Id,
@@ -225,8 +439,12 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	})
 }
 
+// submit sends a found block to kaspad, shareDiff is what the share that
+// found it is credited with in pool mode
 func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
-	block *externalapi.DomainBlock, nonce uint64, eventId any) error {
+	block *externalapi.DomainBlock, nonce uint64, eventId any, shareDiff float64) error {
+	sh.pendingSubmits.Inc()
+	defer sh.pendingSubmits.Dec()
 	mutable := block.Header.ToMutable()
 	mutable.SetNonce(nonce)
 	block = &externalapi.DomainBlock{
@@ -246,12 +464,15 @@ func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
 			sh.getCreateStats(ctx).StaleShares.Add(1)
 			sh.overall.StaleShares.Add(1)
 			RecordStaleShare(ctx)
+			sh.recordShare(ctx, ShareStale, nil, block.Header.BlueScore())
 			return ctx.ReplyStaleShare(eventId)
 		} else {
 			ctx.Logger.Warn("block rejected, unknown issue (probably bad pow", zap.Error(err))
 			sh.getCreateStats(ctx).InvalidShares.Add(1)
 			sh.overall.InvalidShares.Add(1)
 			RecordInvalidShare(ctx)
+			sh.recordShare(ctx, ShareInvalid, nil, block.Header.BlueScore())
+			ctx.RecordOffense(gostratum.OffenseInvalidShares)
 			return ctx.ReplyBadShare(eventId)
 		}
 	}
@@ -262,44 +483,96 @@ func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
 	stats.BlocksFound.Add(1)
 	sh.overall.BlocksFound.Add(1)
 	RecordBlockFound(ctx, block.Header.Nonce(), block.Header.BlueScore(), blockhash.String())
+	sh.recordBlock(ctx, blockhash.String(), block.Header.Nonce(), block.Header.BlueScore())
+	if sh.pool != nil {
+		sh.pool.blockFound(blockhash.String(), block.Header.BlueScore(), ctx.WalletAddr, shareDiff)
+	}
 
 	// nil return allows HandleSubmit to record share (blocks are shares too!) and
 	// handle the response to the client
 	return nil
 }
 
+// waitForSubmits blocks until in flight block submits finish or the deadline
+// passes, returning false if some were still pending
+func (sh *shareHandler) waitForSubmits(deadline time.Time) bool {
+	for sh.pendingSubmits.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
 func (sh *shareHandler) startStatsThread() error {
 	start := time.Now()
 	for {
 		// console formatting is terrible. Good luck whever touches anything
 		time.Sleep(10 * time.Second)
+		now := time.Now()
 		sh.statsLock.Lock()
-		str := "\n===============================================================================\n"
-		str += "  worker name   |  avg hashrate  |   acc/stl/inv  |    blocks    |    uptime   \n"
-		str += "-------------------------------------------------------------------------------\n"
+		header := "  worker name   |"
+		for _, window := range sh.hashrateWindows {
+			header += fmt.Sprintf(" %14.14s |", windowLabel(window)+" hashrate")
+		}
+		header += "   acc/stl/inv  |    blocks    |    uptime   "
+		str := "\n" + strings.Repeat("=", len(header)) + "\n"
+		str += header + "\n"
+		str += strings.Repeat("-", len(header)) + "\n"
 		var lines []string
-		totalRate := float64(0)
 		for _, v := range sh.stats {
-			rate := GetAverageHashrateGHs(v)
-			totalRate += rate
-			rateStr := fmt.Sprintf("%0.2fGH/s", rate) // todo, fix units
 			ratioStr := fmt.Sprintf("%d/%d/%d", v.SharesFound.Load(), v.StaleShares.Load(), v.InvalidShares.Load())
-			lines = append(lines, fmt.Sprintf(" %-15s| %14.14s | %14.14s | %12d | %11s",
-				v.WorkerName, rateStr, ratioStr, v.BlocksFound.Load(), time.Since(v.StartTime).Round(time.Second)))
+			lines = append(lines, fmt.Sprintf(" %-15s|%s %14.14s | %12d | %11s",
+				v.WorkerName, hashrateColumns(&v.Hashrate, now, v.StartTime), ratioStr,
+				v.BlocksFound.Load(), time.Since(v.StartTime).Round(time.Second)))
 		}
 		sort.Strings(lines)
 		str += strings.Join(lines, "\n")
-		rateStr := fmt.Sprintf("%0.2fGH/s", totalRate) // todo, fix units
 		ratioStr := fmt.Sprintf("%d/%d/%d", sh.overall.SharesFound.Load(), sh.overall.StaleShares.Load(), sh.overall.InvalidShares.Load())
-		str += "\n-------------------------------------------------------------------------------\n"
-		str += fmt.Sprintf("                | %14.14s | %14.14s | %12d | %11s",
-			rateStr, ratioStr, sh.overall.BlocksFound.Load(), time.Since(start).Round(time.Second))
-		str += "\n========================================================== ks_bridge_" + version + " ===\n"
+		str += "\n" + strings.Repeat("-", len(header)) + "\n"
+		str += fmt.Sprintf("                |%s %14.14s | %12d | %11s",
+			hashrateColumns(&sh.overall.Hashrate, now, start), ratioStr, sh.overall.BlocksFound.Load(), time.Since(start).Round(time.Second))
+		footer := " ks_bridge_" + version + " ==="
+		str += "\n" + strings.Repeat("=", len(header)-len(footer)) + footer + "\n"
 		sh.statsLock.Unlock()
 		log.Println(str)
 	}
 }
 
-func GetAverageHashrateGHs(stats *WorkStats) float64 {
-	return stats.SharesDiff.Load() / time.Since(stats.StartTime).Seconds()
+// hashrateColumns formats the hashrate over each window for the stats table
+func hashrateColumns(h *hashrateWindows, now, started time.Time) string {
+	str := ""
+	for _, rate := range h.rates(now, started) {
+		str += fmt.Sprintf(" %14.14s |", fmt.Sprintf("%0.2fGH/s", rate.GHs)) // todo, fix units
+	}
+	return str
+}
+
+// how often the hashrate gauges are refreshed
+const hashrateUpdateInterval = 10 * time.Second
+
+// startHashrateThread keeps the prom hashrate gauges current, so workers that
+// stop submitting decay to zero rather than holding their last value
+func (sh *shareHandler) startHashrateThread(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(hashrateUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sh.statsLock.Lock()
+			for _, v := range sh.stats {
+				for _, rate := range v.Hashrate.rates(now, v.StartTime) {
+					RecordWorkerHashrate(v.WorkerName, rate.Window, rate.GHs)
+				}
+			}
+			sh.statsLock.Unlock()
+			for _, rate := range sh.overall.Hashrate.rates(now, start) {
+				RecordHashrate(rate.Window, rate.GHs)
+			}
+		}
+	}
 }
@@ -0,0 +1,156 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownHandler runs the stratum listener until SIGINT/SIGTERM, then drains
+// connected miners before handing back to ListenAndServe for cleanup. If the
+// whole thing takes longer than the timeout the process is killed
+type shutdownHandler struct {
+	logger        *zap.SugaredLogger
+	timeout       time.Duration
+	reconnectHost string // miners are sent here on shutdown if set
+	reconnectPort int
+	signals       chan os.Signal
+	watchdog      *time.Timer
+}
+
+// parseReconnect splits a shutdown_reconnect address into host and port
+func parseReconnect(addr string) (string, int, error) {
+	host, rawPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid shutdown_reconnect %q", addr)
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("invalid shutdown_reconnect %q, expected host:port", addr)
+	}
+	return host, port, nil
+}
+
+func newShutdownHandler(cfg BridgeConfig, logger *zap.SugaredLogger) *shutdownHandler {
+	h := &shutdownHandler{
+		logger:  logger.With(zap.String("component", "shutdown")),
+		timeout: cfg.ShutdownTimeout,
+		signals: make(chan os.Signal, 1),
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultShutdownTimeout
+	}
+	if cfg.ShutdownReconnect != "" {
+		// validated with the rest of the config
+		h.reconnectHost, h.reconnectPort, _ = parseReconnect(cfg.ShutdownReconnect)
+	}
+	signal.Notify(h.signals, syscall.SIGINT, syscall.SIGTERM)
+	return h
+}
+
+// serve blocks until a listener fails or a shutdown signal arrives, in the
+// latter case miners are drained before returning
+func (h *shutdownHandler) serve(listeners []*gostratum.StratumListener, clients clientSource, sh *shareHandler) error {
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	defer stopListening()
+	listenErr := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *gostratum.StratumListener) {
+			listenErr <- listener.Listen(listenCtx)
+		}(listener)
+	}
+
+	select {
+	case err := <-listenErr:
+		return err
+	case sig := <-h.signals:
+		h.logger.Info(fmt.Sprintf("received %s, shutting down (deadline %s)", sig, h.timeout))
+	}
+	h.watchdog = time.AfterFunc(h.timeout, func() {
+		h.logger.Error("shutdown deadline exceeded, exiting")
+		h.logger.Sync()
+		os.Exit(1)
+	})
+
+	// leave a quarter of the deadline for flushing and closing after the drain
+	h.drain(listeners, clients, sh, time.Now().Add(h.timeout-h.timeout/4))
+	stopListening()
+	for range listeners {
+		<-listenErr
+	}
+	return nil
+}
+
+// drain stops new connections, redirects miners if configured, waits for any
+// block submits in flight and then disconnects whoever is left
+func (h *shutdownHandler) drain(listeners []*gostratum.StratumListener, clients clientSource, sh *shareHandler, deadline time.Time) {
+	for _, listener := range listeners {
+		listener.StopAccepting()
+	}
+
+	if h.reconnectHost != "" {
+		sent := 0
+		for _, client := range connectedClients(clients) {
+			if sendReconnect(client, h.reconnectHost, h.reconnectPort) == nil {
+				sent++
+			}
+		}
+		h.logger.Info(fmt.Sprintf("sent client.reconnect to %d miners -> %s:%d", sent, h.reconnectHost, h.reconnectPort))
+		for len(connectedClients(clients)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if !sh.waitForSubmits(deadline) {
+		h.logger.Warn(fmt.Sprintf("%d block submits still pending at shutdown", sh.pendingSubmits.Load()))
+	}
+
+	remaining := connectedClients(clients)
+	for _, client := range remaining {
+		client.Disconnect()
+	}
+	h.logger.Info(fmt.Sprintf("disconnected %d remaining miners", len(remaining)))
+}
+
+// finished is deferred once the bridge has cleaned up, it stops the watchdog
+// so a library caller isn't killed after ListenAndServe returns
+func (h *shutdownHandler) finished() {
+	signal.Stop(h.signals)
+	if h.watchdog != nil {
+		h.watchdog.Stop()
+		h.logger.Info("shutdown complete")
+	}
+}
+
+func connectedClients(clients clientSource) []*gostratum.StratumContext {
+	var connected []*gostratum.StratumContext
+	for _, client := range clients.Clients() {
+		if client.Connected() {
+			connected = append(connected, client)
+		}
+	}
+	return connected
+}
+
+func sendReconnect(client *gostratum.StratumContext, host string, port int) error {
+	if err := client.Send(gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "client.reconnect",
+		Params:  []any{host, port, 0},
+	}); err != nil {
+		client.Logger.Warn(errors.Wrap(err, "failed sending reconnect").Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package kaspastratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestParseReconnect(t *testing.T) {
+	host, port, err := parseReconnect("backup.example.com:5555")
+	if err != nil || host != "backup.example.com" || port != 5555 {
+		t.Fatalf("unexpected parse %s:%d, %v", host, port, err)
+	}
+	for _, bad := range []string{"backup.example.com", ":5555", "host:0", "host:port"} {
+		if _, _, err := parseReconnect(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestShutdownDrainsMiners(t *testing.T) {
+	const port = "127.0.0.1:15557"
+	logger := zap.NewNop().Sugar()
+	sh := newShareHandler(nil, 0, 0)
+	minDiff, varDiff := diffSettingsFor(BridgeConfig{})
+	clients := newClientListener(logger, sh, minDiff, varDiff, 0)
+	listener := gostratum.NewListener(gostratum.StratumListenerConfig{
+		Port:           port,
+		HandlerMap:     gostratum.DefaultHandlers(),
+		StateGenerator: MiningStateGenerator,
+		ClientListener: clients,
+		Logger:         logger.Desugar(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.Listen(ctx)
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ { // wait for the listener to come up
+		if conn, err = net.Dial("tcp", port); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed connecting to listener: %s", err)
+	}
+	defer conn.Close()
+	for len(connectedClients(clients)) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// miner follows the reconnect by hanging up
+	reconnect := make(chan gostratum.JsonRpcEvent, 1)
+	go func() {
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		if err == nil {
+			event := gostratum.JsonRpcEvent{}
+			json.Unmarshal(line, &event)
+			reconnect <- event
+		}
+		conn.Close()
+	}()
+
+	sh.pendingSubmits.Inc()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sh.pendingSubmits.Dec()
+	}()
+
+	h := newShutdownHandler(BridgeConfig{ShutdownReconnect: "backup.example.com:5555"}, logger)
+	defer h.finished()
+	h.drain([]*gostratum.StratumListener{listener}, clients, sh, time.Now().Add(5*time.Second))
+
+	select {
+	case event := <-reconnect:
+		if event.Method != "client.reconnect" || event.Params[0] != "backup.example.com" || event.Params[1] != float64(5555) {
+			t.Fatalf("unexpected reconnect %+v", event)
+		}
+	default:
+		t.Fatalf("miner was not sent client.reconnect")
+	}
+	if sh.pendingSubmits.Load() != 0 {
+		t.Fatalf("drain returned before pending submits finished")
+	}
+	if n := len(connectedClients(clients)); n != 0 {
+		t.Fatalf("expected all miners drained, %d still connected", n)
+	}
+	if c, err := net.Dial("tcp", port); err == nil {
+		c.Close()
+		t.Fatalf("listener still accepting after drain")
+	}
+}
@@ -0,0 +1,511 @@
+package kaspastratum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	storeFlushInterval       = time.Second
+	storeQueueSize           = 4096
+	defaultStoreRetention    = 7 * 24 * time.Hour
+	defaultStoreCompactEvery = 24 * time.Hour
+)
+
+var (
+	sharesBucket   = []byte("shares")
+	blocksBucket   = []byte("blocks")
+	totalsBucket   = []byte("totals")
+	splitsBucket   = []byte("splits")
+	balancesBucket = []byte("balances")
+)
+
+type ShareType string
+
+const (
+	ShareAccepted ShareType = "accepted"
+	ShareStale    ShareType = "stale"
+	ShareDupe     ShareType = "duplicate"
+	ShareInvalid  ShareType = "invalid"
+	ShareWeak     ShareType = "weak"
+)
+
+type ShareRecord struct {
+	Worker    string    `json:"worker"`
+	Wallet    string    `json:"wallet"`
+	Type      ShareType `json:"type"`
+	Diff      float64   `json:"diff"`
+	HashValue float64   `json:"hash_value"`
+	BlueScore uint64    `json:"blue_score"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type BlockRecord struct {
+	Worker    string    `json:"worker"`
+	Wallet    string    `json:"wallet"`
+	Hash      string    `json:"hash"`
+	Nonce     uint64    `json:"nonce"`
+	BlueScore uint64    `json:"blue_score"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WorkerTotals are the lifetime counters for a worker, kept up to date as
+// records are written so they can be restored without replaying history
+type WorkerTotals struct {
+	Worker        string    `json:"worker"`
+	SharesFound   int64     `json:"shares_found"`
+	SharesDiff    float64   `json:"shares_diff"`
+	StaleShares   int64     `json:"stale_shares"`
+	DupeShares    int64     `json:"dupe_shares"`
+	InvalidShares int64     `json:"invalid_shares"`
+	BlocksFound   int64     `json:"blocks_found"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastShare     time.Time `json:"last_share"`
+}
+
+type storeEntry struct {
+	share *ShareRecord
+	block *BlockRecord
+}
+
+// shareStore persists shares, blocks and per-worker totals to an embedded
+// bolt db. Share writes are queued and flushed in batches by a single
+// writer so share handling never waits on disk, blocks are rare enough to be
+// written straight away
+type shareStore struct {
+	logger       *zap.SugaredLogger
+	path         string
+	retention    time.Duration
+	compactEvery time.Duration
+	dbLock       sync.RWMutex
+	db           *bolt.DB
+	queueLock    sync.Mutex // guards sends on queue against Close
+	closed       bool
+	blockWrites  sync.WaitGroup // direct block writes Close waits out
+	queue        chan storeEntry
+	done         chan struct{}
+	seq          uint32
+}
+
+func newShareStore(path string, retention, compactEvery time.Duration, logger *zap.SugaredLogger) (*shareStore, error) {
+	if retention <= 0 {
+		retention = defaultStoreRetention
+	}
+	if compactEvery == 0 {
+		compactEvery = defaultStoreCompactEvery
+	}
+	db, err := openStoreDB(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &shareStore{
+		logger:       logger.With(zap.String("component", "store")),
+		path:         path,
+		retention:    retention,
+		compactEvery: compactEvery,
+		db:           db,
+		queue:        make(chan storeEntry, storeQueueSize),
+		done:         make(chan struct{}),
+	}
+	go s.writer()
+	return s, nil
+}
+
+func openStoreDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening share store %s", path)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{sharesBucket, blocksBucket, totalsBucket, splitsBucket, balancesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed initializing share store")
+	}
+	return db, nil
+}
+
+// Close flushes anything queued and closes the db. Shares still being
+// handled while shutting down are dropped
+func (s *shareStore) Close() error {
+	s.queueLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.queueLock.Unlock()
+	<-s.done
+	s.blockWrites.Wait()
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	return s.db.Close()
+}
+
+func (s *shareStore) RecordShare(rec ShareRecord) {
+	s.enqueue(storeEntry{share: &rec})
+}
+
+// RecordBlock writes the block before returning rather than queueing it, a
+// full queue may drop shares but never a found block
+func (s *shareStore) RecordBlock(rec BlockRecord) {
+	// registered under the queue lock so Close waits for the write, but not
+	// held across it, a write waiting out compaction mustn't stall enqueue
+	s.queueLock.Lock()
+	if s.closed {
+		s.queueLock.Unlock()
+		s.logger.Warn(fmt.Sprintf("share store closed, block %s not recorded", rec.Hash))
+		return
+	}
+	s.blockWrites.Add(1)
+	s.queueLock.Unlock()
+	defer s.blockWrites.Done()
+	s.flush([]storeEntry{{block: &rec}})
+}
+
+func (s *shareStore) enqueue(entry storeEntry) {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- entry:
+	default:
+		// never block share handling on disk, losing a record beats stalling
+		// every miner
+		s.logger.Warn("share store queue full, dropping record")
+	}
+}
+
+func (s *shareStore) writer() {
+	defer close(s.done)
+	flush := time.NewTicker(storeFlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	var compact <-chan time.Time
+	if s.compactEvery > 0 {
+		t := time.NewTicker(s.compactEvery)
+		defer t.Stop()
+		compact = t.C
+	}
+
+	var pending []storeEntry
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				s.flush(pending)
+				return
+			}
+			pending = append(pending, entry)
+			if len(pending) >= storeQueueSize/4 {
+				s.flush(pending)
+				pending = nil
+			}
+		case <-flush.C:
+			s.flush(pending)
+			pending = nil
+		case <-prune.C:
+			if err := s.prune(time.Now().Add(-s.retention)); err != nil {
+				s.logger.Error("failed pruning share store: ", err)
+			}
+		case <-compact:
+			s.flush(pending)
+			pending = nil
+			if err := s.compact(); err != nil {
+				s.logger.Error("failed compacting share store: ", err)
+			}
+		}
+	}
+}
+
+// recordKey orders records by time, the sequence keeps records landing in
+// the same nanosecond from colliding
+func (s *shareStore) recordKey(ts time.Time) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint32(key[8:], atomic.AddUint32(&s.seq, 1))
+	return key
+}
+
+func (s *shareStore) flush(entries []storeEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		totals := map[string]*WorkerTotals{}
+		totalsBkt := tx.Bucket(totalsBucket)
+		getTotals := func(worker string) (*WorkerTotals, error) {
+			if t, exists := totals[worker]; exists {
+				return t, nil
+			}
+			t := &WorkerTotals{Worker: worker}
+			if raw := totalsBkt.Get([]byte(worker)); raw != nil {
+				if err := json.Unmarshal(raw, t); err != nil {
+					return nil, err
+				}
+			}
+			totals[worker] = t
+			return t, nil
+		}
+
+		for _, e := range entries {
+			var worker string
+			var ts time.Time
+			var bucket *bolt.Bucket
+			var value []byte
+			var err error
+			if e.share != nil {
+				worker, ts, bucket = e.share.Worker, e.share.Timestamp, tx.Bucket(sharesBucket)
+				value, err = json.Marshal(e.share)
+			} else {
+				worker, ts, bucket = e.block.Worker, e.block.Timestamp, tx.Bucket(blocksBucket)
+				value, err = json.Marshal(e.block)
+			}
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(s.recordKey(ts), value); err != nil {
+				return err
+			}
+
+			t, err := getTotals(worker)
+			if err != nil {
+				return err
+			}
+			if t.FirstSeen.IsZero() {
+				t.FirstSeen = ts
+			}
+			if e.block != nil {
+				t.BlocksFound++
+				continue
+			}
+			switch e.share.Type {
+			case ShareAccepted:
+				t.SharesFound++
+				t.SharesDiff += e.share.HashValue
+				t.LastShare = ts
+			case ShareStale:
+				t.StaleShares++
+			case ShareDupe:
+				t.DupeShares++
+			default:
+				t.InvalidShares++
+			}
+		}
+
+		for worker, t := range totals {
+			raw, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := totalsBkt.Put([]byte(worker), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("failed writing %d records to share store: %s", len(entries), err))
+	}
+}
+
+// prune drops share and block records older than the cutoff. Totals are
+// kept, they're what gets restored on startup
+func (s *shareStore) prune(cutoff time.Time) error {
+	limit := make([]byte, 8)
+	binary.BigEndian.PutUint64(limit, uint64(cutoff.UnixNano()))
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{sharesBucket, blocksBucket} {
+			// collect first, deleting under a cursor skips entries
+			bucket := tx.Bucket(b)
+			var expired [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// compact rewrites the db to reclaim space freed by pruning, bolt never
+// shrinks the file on its own. The original is kept aside until the
+// compacted copy opens so a failed swap never leaves the store without a db
+func (s *shareStore) compact() error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	tmpPath := s.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, 64*1024*1024); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	dst.Close()
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	backupPath := s.path + ".precompact"
+	if err := os.Rename(s.path, backupPath); err != nil {
+		os.Remove(tmpPath)
+		return s.reopen(errors.Wrap(err, "failed moving share store aside"))
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Rename(backupPath, s.path)
+		return s.reopen(errors.Wrap(err, "failed swapping in compacted share store"))
+	}
+	db, err := openStoreDB(s.path)
+	if err != nil {
+		os.Rename(backupPath, s.path)
+		return s.reopen(errors.Wrap(err, "failed opening compacted share store"))
+	}
+	os.Remove(backupPath)
+	s.db = db
+	return nil
+}
+
+// reopen restores the store at its original path after a failed compaction,
+// returning cause. Caller holds dbLock
+func (s *shareStore) reopen(cause error) error {
+	db, err := openStoreDB(s.path)
+	if err != nil {
+		return errors.Wrapf(err, "%s, and reopening the original failed", cause)
+	}
+	s.db = db
+	return cause
+}
+
+// Totals returns the persisted lifetime counters for every worker
+func (s *shareStore) Totals() (map[string]*WorkerTotals, error) {
+	totals := map[string]*WorkerTotals{}
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(totalsBucket).ForEach(func(k, v []byte) error {
+			t := &WorkerTotals{}
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			totals[string(k)] = t
+			return nil
+		})
+	})
+	return totals, err
+}
+
+// Blocks returns up to limit of the most recently found blocks, newest first
+func (s *shareStore) Blocks(limit int) ([]BlockRecord, error) {
+	var blocks []BlockRecord
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(blocksBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(blocks) < limit; k, v = c.Prev() {
+			rec := BlockRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			blocks = append(blocks, rec)
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+// SaveSplit writes a pool reward split straight through, splits change
+// rarely and must not be lost to a crash
+func (s *shareStore) SaveSplit(split *BlockSplit) error {
+	raw, err := json.Marshal(split)
+	if err != nil {
+		return err
+	}
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(splitsBucket).Put([]byte(split.Hash), raw)
+	})
+}
+
+func (s *shareStore) Splits() ([]*BlockSplit, error) {
+	var splits []*BlockSplit
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(splitsBucket).ForEach(func(_, v []byte) error {
+			split := &BlockSplit{}
+			if err := json.Unmarshal(v, split); err != nil {
+				return err
+			}
+			splits = append(splits, split)
+			return nil
+		})
+	})
+	return splits, err
+}
+
+// SaveBalances replaces the stored pool balances with the given set
+func (s *shareStore) SaveBalances(balances map[string]uint64) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(balancesBucket); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(balancesBucket)
+		if err != nil {
+			return err
+		}
+		for wallet, amount := range balances {
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, amount)
+			if err := bucket.Put([]byte(wallet), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *shareStore) Balances() (map[string]uint64, error) {
+	balances := map[string]uint64{}
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(balancesBucket).ForEach(func(k, v []byte) error {
+			balances[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	return balances, err
+}
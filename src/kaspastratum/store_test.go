@@ -0,0 +1,179 @@
+package kaspastratum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestShareStoreRestoresTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	store, err := newShareStore(path, 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+
+	now := time.Now()
+	diff := newKaspaDiff()
+	diff.setDiffValue(4)
+	ctx := &gostratum.StratumContext{WorkerName: "rig1", WalletAddr: "kaspa:test"}
+	sh := newShareHandler(nil, 0, 0)
+	if err := sh.attachStore(store); err != nil {
+		t.Fatalf("failed attaching empty store: %s", err)
+	}
+	sh.recordShare(ctx, ShareAccepted, diff, 100)
+	sh.recordShare(ctx, ShareAccepted, diff, 101)
+	sh.recordShare(ctx, ShareStale, diff, 90)
+	sh.recordShare(ctx, ShareDupe, diff, 101)
+	sh.recordShare(ctx, ShareWeak, diff, 101)
+	sh.recordBlock(ctx, "abcd", 42, 101)
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed closing store: %s", err)
+	}
+
+	store, err = newShareStore(path, 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed reopening store: %s", err)
+	}
+	defer store.Close()
+	sh = newShareHandler(nil, 0, 0)
+	if err := sh.attachStore(store); err != nil {
+		t.Fatalf("failed restoring totals: %s", err)
+	}
+	stats, exists := sh.stats["rig1"]
+	if !exists {
+		t.Fatalf("worker totals not restored")
+	}
+	if stats.SharesFound.Load() != 2 || stats.StaleShares.Load() != 1 ||
+		stats.DupeShares.Load() != 1 || stats.InvalidShares.Load() != 1 || stats.BlocksFound.Load() != 1 {
+		t.Fatalf("unexpected restored totals: %d/%d/%d/%d blocks %d", stats.SharesFound.Load(),
+			stats.StaleShares.Load(), stats.DupeShares.Load(), stats.InvalidShares.Load(), stats.BlocksFound.Load())
+	}
+	if stats.SharesDiff.Load() != 2*diff.hashValue {
+		t.Fatalf("expected shares diff %f, got %f", 2*diff.hashValue, stats.SharesDiff.Load())
+	}
+	if stats.StartTime.Before(now.Add(-time.Second)) {
+		t.Fatalf("unexpected start time %s", stats.StartTime)
+	}
+	if sh.overall.SharesFound.Load() != 2 {
+		t.Fatalf("overall totals not restored")
+	}
+
+	blocks, err := store.Blocks(10)
+	if err != nil || len(blocks) != 1 || blocks[0].Hash != "abcd" || blocks[0].Wallet != "kaspa:test" {
+		t.Fatalf("unexpected blocks %+v, err %v", blocks, err)
+	}
+}
+
+func TestShareStorePruneAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	store, err := newShareStore(path, time.Hour, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	defer store.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 10; i++ {
+		store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "old", Timestamp: old})
+	}
+	store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "new", Timestamp: time.Now()})
+	time.Sleep(storeFlushInterval + 200*time.Millisecond)
+
+	if err := store.prune(time.Now().Add(-store.retention)); err != nil {
+		t.Fatalf("prune failed: %s", err)
+	}
+	if err := store.compact(); err != nil {
+		t.Fatalf("compact failed: %s", err)
+	}
+	blocks, err := store.Blocks(100)
+	if err != nil || len(blocks) != 1 || blocks[0].Hash != "new" {
+		t.Fatalf("expected only the recent block to survive, got %+v, err %v", blocks, err)
+	}
+	totals, err := store.Totals()
+	if err != nil || totals["rig1"].BlocksFound != 11 {
+		t.Fatalf("totals should survive pruning, got %+v, err %v", totals["rig1"], err)
+	}
+}
+
+func TestShareStoreRecordAfterClose(t *testing.T) {
+	store, err := newShareStore(filepath.Join(t.TempDir(), "bridge.db"), 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	// shares still being handled while the bridge shuts down
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			store.RecordShare(ShareRecord{Worker: "rig1", Type: ShareAccepted})
+		}
+	}()
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed closing store: %s", err)
+	}
+	<-done
+	store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "abcd"})
+}
+
+func TestShareStoreFailedCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	store, err := newShareStore(path, time.Hour, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	defer store.Close()
+
+	// blocks don't wait on the flush interval
+	store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "abcd", Timestamp: time.Now()})
+	if blocks, err := store.Blocks(10); err != nil || len(blocks) != 1 {
+		t.Fatalf("expected block written straight away, got %+v, err %v", blocks, err)
+	}
+
+	// a directory in the way of the backup makes the swap fail
+	if err := os.MkdirAll(filepath.Join(path+".precompact", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.compact(); err == nil {
+		t.Fatalf("expected compact to fail")
+	}
+	store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "efgh", Timestamp: time.Now()})
+	if blocks, err := store.Blocks(10); err != nil || len(blocks) != 2 {
+		t.Fatalf("store unusable after failed compact, got %+v, err %v", blocks, err)
+	}
+}
+
+func TestShareStoreBlockDuringCompact(t *testing.T) {
+	store, err := newShareStore(filepath.Join(t.TempDir(), "bridge.db"), 0, -1, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed opening store: %s", err)
+	}
+	defer store.Close()
+
+	store.dbLock.Lock() // compaction in progress
+	written := make(chan struct{})
+	go func() {
+		store.RecordBlock(BlockRecord{Worker: "rig1", Hash: "abcd", Timestamp: time.Now()})
+		close(written)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	queued := make(chan struct{})
+	go func() {
+		store.RecordShare(ShareRecord{Worker: "rig2", Type: ShareAccepted})
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatalf("share handling stalled behind a block write")
+	}
+	store.dbLock.Unlock()
+	<-written
+	if blocks, err := store.Blocks(10); err != nil || len(blocks) != 1 {
+		t.Fatalf("expected the block written once compaction finished, got %+v, err %v", blocks, err)
+	}
+}
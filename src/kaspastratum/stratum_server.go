@@ -2,6 +2,7 @@ package kaspastratum
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/mattn/go-colorable"
 	"github.com/onemorebsmith/kaspastratum/src/gostratum"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -16,27 +18,114 @@ import (
 const version = "v1.1.6"
 const minBlockWaitTime = 500 * time.Millisecond
 
+const (
+	defaultBanWindow   = 10 * time.Minute
+	defaultBanDuration = time.Hour
+)
+
 type BridgeConfig struct {
 	StratumPort     string        `yaml:"stratum_port"`
+	StratumTLSPort  string        `yaml:"stratum_tls_port"`
+	TLSCertFile     string        `yaml:"tls_cert_file"`
+	TLSKeyFile      string        `yaml:"tls_key_file"`
+	TLSSelfSigned   bool          `yaml:"tls_self_signed"`
 	RPCServer       string        `yaml:"kaspad_address"`
+	FallbackServers []string      `yaml:"kaspad_fallback_addresses"`
+	SubmitAllNodes  bool          `yaml:"submit_to_all_nodes"`
 	PromPort        string        `yaml:"prom_port"`
 	PrintStats      bool          `yaml:"print_stats"`
 	UseLogFile      bool          `yaml:"log_to_file"`
+	LogLevel        string        `yaml:"log_level"`
 	HealthCheckPort string        `yaml:"health_check_port"`
 	BlockWaitTime   time.Duration `yaml:"block_wait_time"`
 	MinShareDiff    uint          `yaml:"min_share_diff"`
+	VarDiff         bool          `yaml:"var_diff"`
+	SharesPerMin    uint          `yaml:"shares_per_min"`
+	VarDiffMin      uint          `yaml:"var_diff_min"`
+	VarDiffMax      uint          `yaml:"var_diff_max"`
+	VarDiffRetarget time.Duration `yaml:"var_diff_retarget"`
 	ExtranonceSize  uint          `yaml:"extranonce_size"`
+	StaleWindow     uint64        `yaml:"stale_window"`
+	MaxJobAge       time.Duration `yaml:"max_job_age"`
+	// windows hashrate is reported over in the stats table, prom and the api
+	HashrateWindows []time.Duration `yaml:"hashrate_windows"`
+	// raw stratum traffic of every session on stratum_port is written here
+	RecordDir string `yaml:"record_dir"`
+	// longest message accepted from a miner in bytes, 0 for the default
+	MaxLineLength int `yaml:"max_line_length"`
+	// on SIGINT/SIGTERM miners are drained (and optionally sent
+	// client.reconnect to ShutdownReconnect) within ShutdownTimeout
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	ShutdownReconnect string        `yaml:"shutdown_reconnect"`
+	// extra stratum ports, each with its own difficulty profile
+	Ports []PortProfile `yaml:"ports"`
+	// user agent patterns mapped to job encoders, checked in order
+	JobEncoders []JobEncoderRule `yaml:"job_encoders"`
+	// admission control, zero values leave the check off
+	MaxConns      int      `yaml:"max_connections"`
+	MaxConnsPerIP int      `yaml:"max_connections_per_ip"`
+	AcceptRate    float64  `yaml:"accept_rate"`
+	AllowCIDRs    []string `yaml:"allow_cidrs"`
+	DenyCIDRs     []string `yaml:"deny_cidrs"`
+	// ips repeating an offense BanThreshold times within BanWindow are
+	// banned for BanDuration, 0 (default) disables automatic bans
+	BanThreshold int           `yaml:"ban_threshold"`
+	BanWindow    time.Duration `yaml:"ban_window"`
+	BanDuration  time.Duration `yaml:"ban_duration"`
+	// authorize policy, see AuthMode. Passwords are the second
+	// mining.authorize param, per worker entries override the shared one
+	AuthMode        AuthMode          `yaml:"auth_mode"`
+	AllowedWallets  []string          `yaml:"allowed_wallets"`
+	DefaultWallet   string            `yaml:"default_wallet"`
+	WorkerPassword  string            `yaml:"worker_password"`
+	WorkerPasswords map[string]string `yaml:"worker_passwords"`
+	// required for api endpoints that change state, e.g. lifting bans
+	AdminToken      string        `yaml:"admin_token"`
+	UpstreamPool    string        `yaml:"upstream_pool"`
+	UpstreamUser    string        `yaml:"upstream_user"`
+	UpstreamPass    string        `yaml:"upstream_password"`
+	UpstreamConns   uint          `yaml:"upstream_connections"`
+	StorePath       string        `yaml:"store_path"`
+	StoreRetention  time.Duration `yaml:"store_retention"`
+	StoreCompact    time.Duration `yaml:"store_compact_interval"`
+	APIPort         string        `yaml:"api_port"`
+	PoolAddress     string        `yaml:"pool_address"`
+	PoolFee         float64       `yaml:"pool_fee"`
+	PPLNSWindow     uint          `yaml:"pplns_window"`
+	BlockMaturity   uint64        `yaml:"block_maturity"`
+	PayoutThreshold uint64        `yaml:"payout_threshold"`
+	// Payer sends pool payouts, only settable when embedding the bridge.
+	// Without one matured balances accumulate until paid by other means
+	Payer Payer `yaml:"-"`
+	// alert rules checked against worker stats and kaspad, and where to send
+	// the alerts
+	Alerts AlertConfig `yaml:"alerts"`
+	// AlertSinks receive alerts along with the sinks in Alerts, only settable
+	// when embedding the bridge
+	AlertSinks []AlertSink `yaml:"-"`
+	// KaspadDialer connects to kaspad_address and the fallbacks, only
+	// settable when embedding the bridge. Defaults to the kaspad rpc client
+	KaspadDialer KaspadDialer `yaml:"-"`
+	// ConfigPath is watched for changes, along with SIGHUP, to hot reload the
+	// config. ConfigLoader produces the reloaded config, defaults to parsing
+	// ConfigPath
+	ConfigPath   string                       `yaml:"-"`
+	ConfigLoader func() (BridgeConfig, error) `yaml:"-"`
 }
 
-func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, func()) {
+func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, zap.AtomicLevel, func()) {
 	pe := zap.NewProductionEncoderConfig()
 	pe.EncodeTime = zapcore.RFC3339TimeEncoder
 	fileEncoder := zapcore.NewJSONEncoder(pe)
 	consoleEncoder := zapcore.NewConsoleEncoder(pe)
+	// validated before we get here
+	initial, _ := parseLogLevel(cfg.LogLevel)
+	level := zap.NewAtomicLevelAt(initial)
 
 	if !cfg.UseLogFile {
-		return zap.New(zapcore.NewCore(consoleEncoder,
-			zapcore.AddSync(colorable.NewColorableStdout()), zap.InfoLevel)).Sugar(), func() {}
+		logger := zap.New(zapcore.NewCore(consoleEncoder,
+			zapcore.AddSync(colorable.NewColorableStdout()), level)).Sugar()
+		return logger, level, func() { logger.Sync() }
 	}
 
 	// log file fun
@@ -45,29 +134,57 @@ func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, func()) {
 		panic(err)
 	}
 	core := zapcore.NewTee(
-		zapcore.NewCore(fileEncoder, zapcore.AddSync(logFile), zap.InfoLevel),
-		zapcore.NewCore(consoleEncoder, zapcore.AddSync(colorable.NewColorableStdout()), zap.InfoLevel),
+		zapcore.NewCore(fileEncoder, zapcore.AddSync(logFile), level),
+		zapcore.NewCore(consoleEncoder, zapcore.AddSync(colorable.NewColorableStdout()), level),
 	)
-	return zap.New(core).Sugar(), func() { logFile.Close() }
+	logger := zap.New(core).Sugar()
+	return logger, level, func() {
+		logger.Sync()
+		logFile.Close()
+	}
+}
+
+func extranonceSizeFor(cfg BridgeConfig) int8 {
+	if cfg.ExtranonceSize > 3 {
+		return 3
+	}
+	return int8(cfg.ExtranonceSize)
+}
+
+func blockWaitTimeFor(cfg BridgeConfig) time.Duration {
+	if cfg.BlockWaitTime < minBlockWaitTime {
+		return minBlockWaitTime
+	}
+	return cfg.BlockWaitTime
+}
+
+func diffSettingsFor(cfg BridgeConfig) (float64, varDiffConfig) {
+	minDiff := cfg.MinShareDiff
+	if minDiff < 1 {
+		minDiff = 1
+	}
+	varDiffMin := cfg.VarDiffMin
+	if varDiffMin < 1 {
+		varDiffMin = minDiff
+	}
+	return float64(minDiff), newVarDiffConfig(cfg.VarDiff, cfg.SharesPerMin,
+		float64(varDiffMin), float64(cfg.VarDiffMax), cfg.VarDiffRetarget)
 }
 
 func ListenAndServe(cfg BridgeConfig) error {
-	logger, logCleanup := configureZap(cfg)
+	if err := cfg.Validate(); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	logger, logLevel, logCleanup := configureZap(cfg)
 	defer logCleanup()
+	reloader := newConfigReloader(cfg, logger, logLevel)
+	shutdown := newShutdownHandler(cfg, logger)
+	defer shutdown.finished()
 
 	if cfg.PromPort != "" {
 		StartPromServer(logger, cfg.PromPort)
 	}
 
-	blockWaitTime := cfg.BlockWaitTime
-	if blockWaitTime < minBlockWaitTime {
-		blockWaitTime = minBlockWaitTime
-	}
-	ksApi, err := NewKaspaAPI(cfg.RPCServer, blockWaitTime, logger)
-	if err != nil {
-		return err
-	}
-
 	if cfg.HealthCheckPort != "" {
 		logger.Info("enabling health check on port " + cfg.HealthCheckPort)
 		http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
@@ -76,21 +193,268 @@ func ListenAndServe(cfg BridgeConfig) error {
 		go http.ListenAndServe(cfg.HealthCheckPort, nil)
 	}
 
-	shareHandler := newShareHandler(ksApi.kaspad)
-	minDiff := cfg.MinShareDiff
-	if minDiff < 1 {
-		minDiff = 1
+	admission, err := newAdmission(cfg, logger)
+	if err != nil {
+		return err
+	}
+	auth, err := newAuthPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	encoders, err := newEncoderSelector(cfg.JobEncoders)
+	if err != nil {
+		return err
+	}
+
+	if cfg.UpstreamPool != "" {
+		return proxyListenAndServe(cfg, logger, extranonceSizeFor(cfg), reloader, shutdown, admission, auth, encoders)
+	}
+
+	// primary node first, fallbacks in priority order after
+	addresses := []string{}
+	if cfg.RPCServer != "" {
+		addresses = append(addresses, cfg.RPCServer)
+	}
+	addresses = append(addresses, cfg.FallbackServers...)
+	ksApi, err := NewKaspaAPI(addresses, cfg.KaspadDialer, cfg.SubmitAllNodes, blockWaitTimeFor(cfg), logger)
+	if err != nil {
+		return err
+	}
+	defer ksApi.Close()
+
+	shareHandler := newShareHandler(ksApi, cfg.StaleWindow, cfg.MaxJobAge)
+	shareHandler.setHashrateWindows(cfg.HashrateWindows)
+	closeStore, err := openStore(cfg, logger, shareHandler)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.PoolAddress != "" {
+		poolAddress, err := gostratum.CleanWallet(cfg.PoolAddress)
+		if err != nil {
+			return errors.Wrap(err, "invalid pool address")
+		}
+		pool, err := newPoolAccounting(poolConfig{
+			address:         poolAddress,
+			fee:             cfg.PoolFee,
+			windowSize:      int(cfg.PPLNSWindow),
+			maturity:        cfg.BlockMaturity,
+			payoutThreshold: cfg.PayoutThreshold,
+		}, ksApi, shareHandler.store, cfg.Payer, logger)
+		if err != nil {
+			return err
+		}
+		logger.Info("running in pool mode, paying templates to " + poolAddress)
+		ksApi.poolAddress = poolAddress
+		shareHandler.pool = pool
+		pool.start(ctx, shareHandler.tipBlueScore.Load)
+	}
+	minDiff, varDiff := diffSettingsFor(cfg)
+	clientHandler := newClientListener(logger, shareHandler, minDiff, varDiff, extranonceSizeFor(cfg))
+	clientHandler.encoders = encoders
+	stratumConfig := newStratumConfig(cfg, logger, clientHandler, shareHandler.HandleSubmit, shareHandler.events, auth)
+	stratumConfig.Admission = admission
+	listeners := []*gostratum.StratumListener{gostratum.NewListener(stratumConfig)}
+	for _, p := range cfg.Ports {
+		pc := profileConfig(cfg, p)
+		minDiff, varDiff := diffSettingsFor(pc)
+		profile := clientHandler.addProfile(newPortProfile(p.Name, minDiff, varDiff, extranonceSizeFor(pc), p.JobFormat))
+		portConfig := newStratumConfig(pc, logger, profile, shareHandler.HandleSubmit, shareHandler.events, auth)
+		portConfig.Admission = admission
+		listeners = append(listeners, gostratum.NewListener(portConfig))
+	}
+
+	ksApi.Start(ctx, func() {
+		clientHandler.NewBlockAvailable(ksApi)
+	})
+
+	if cfg.APIPort != "" {
+		api := newAPIServer(logger, clientHandler, shareHandler, ksApi)
+		api.admission, api.adminToken = admission, cfg.AdminToken
+		api.Start(cfg.APIPort)
+	}
+
+	if cfg.ConfigPath != "" {
+		reloader.kaspa = ksApi
+		reloader.clients = clientHandler
+		reloader.shareHandler = shareHandler
+		reloader.start(ctx)
+	}
+
+	if cfg.PromPort != "" {
+		go shareHandler.startHashrateThread(ctx)
+	}
+	if err := startAlerts(ctx, cfg, logger, shareHandler, ksApi); err != nil {
+		return err
+	}
+	if cfg.PrintStats {
+		go shareHandler.startStatsThread()
+	}
+
+	return shutdown.serve(listeners, clientHandler, shareHandler)
+}
+
+// proxyListenAndServe runs the bridge as a proxy in front of an upstream pool
+// rather than against a kaspad node
+func proxyListenAndServe(cfg BridgeConfig, logger *zap.SugaredLogger, extranonceSize int8,
+	reloader *configReloader, shutdown *shutdownHandler, admission *gostratum.Admission, auth *authPolicy,
+	encoders *encoderSelector) error {
+	logger.Info("running in proxy mode against upstream pool " + cfg.UpstreamPool)
+	shareHandler := newShareHandler(nil, cfg.StaleWindow, cfg.MaxJobAge)
+	shareHandler.setHashrateWindows(cfg.HashrateWindows)
+	closeStore, err := openStore(cfg, logger, shareHandler)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	proxy := newPoolProxy(logger, shareHandler, cfg.UpstreamPool, cfg.UpstreamUser, cfg.UpstreamPass,
+		cfg.UpstreamConns, extranonceSize)
+	proxy.encoders = encoders
+	stratumConfig := newStratumConfig(cfg, logger, proxy, proxy.HandleSubmit, shareHandler.events, auth)
+	stratumConfig.Admission = admission
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy.Start(ctx)
+
+	if cfg.APIPort != "" {
+		api := newAPIServer(logger, proxy, shareHandler, nil)
+		api.admission, api.adminToken = admission, cfg.AdminToken
+		api.Start(cfg.APIPort)
+	}
+
+	if cfg.ConfigPath != "" {
+		// diff and templates come from the upstream, only logging applies
+		reloader.start(ctx)
+	}
+
+	if cfg.PromPort != "" {
+		go shareHandler.startHashrateThread(ctx)
+	}
+	if err := startAlerts(ctx, cfg, logger, shareHandler, nil); err != nil {
+		return err
+	}
+	if cfg.PrintStats {
+		go shareHandler.startStatsThread()
+	}
+
+	return shutdown.serve([]*gostratum.StratumListener{gostratum.NewListener(stratumConfig)}, proxy, shareHandler)
+}
+
+// startAlerts runs the alert engine if any rules are configured
+func startAlerts(ctx context.Context, cfg BridgeConfig, logger *zap.SugaredLogger, sh *shareHandler, kaspa *KaspaApi) error {
+	if len(cfg.Alerts.Rules) == 0 {
+		return nil
+	}
+	sinks, err := newAlertSinks(cfg.Alerts)
+	if err != nil {
+		return err
+	}
+	sinks = append(sinks, cfg.AlertSinks...)
+	if len(sinks) == 0 {
+		logger.Warn("alert rules configured without any sinks, alerts will only be logged")
+	}
+	newAlertEngine(logger, cfg.Alerts, cfg.HashrateWindows, sinks, sh, kaspa).start(ctx)
+	return nil
+}
+
+// newAdmission builds the listener's admission control from the config,
+// filling in defaults for automatic bans. Bans stay off unless ban_threshold
+// is set
+func newAdmission(cfg BridgeConfig, logger *zap.SugaredLogger) (*gostratum.Admission, error) {
+	window := cfg.BanWindow
+	if window <= 0 {
+		window = defaultBanWindow
 	}
-	extranonceSize := cfg.ExtranonceSize
-	if extranonceSize > 3 {
-		extranonceSize = 3
+	duration := cfg.BanDuration
+	if duration <= 0 {
+		duration = defaultBanDuration
 	}
-	clientHandler := newClientListener(logger, shareHandler, float64(minDiff), int8(extranonceSize))
+	admission, err := gostratum.NewAdmission(gostratum.AdmissionConfig{
+		MaxConns:      cfg.MaxConns,
+		MaxConnsPerIP: cfg.MaxConnsPerIP,
+		AcceptRate:    cfg.AcceptRate,
+		Allow:         cfg.AllowCIDRs,
+		Deny:          cfg.DenyCIDRs,
+		BanThreshold:  cfg.BanThreshold,
+		BanWindow:     window,
+		BanDuration:   duration,
+		OnReject: func(ip string, reason error) {
+			RecordConnectionRejected(reason)
+		},
+		OnBan: func(ban gostratum.Ban) {
+			if logger != nil {
+				logger.Warn(fmt.Sprintf("banned %s until %s: %s", ban.IP, ban.Expires.Format(time.RFC3339), ban.Reason))
+			}
+			RecordBan()
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid admission config")
+	}
+	return admission, nil
+}
+
+// openStore attaches the share store to the handler if one is configured,
+// the returned func flushes and closes it
+func openStore(cfg BridgeConfig, logger *zap.SugaredLogger, sh *shareHandler) (func(), error) {
+	if cfg.StorePath == "" {
+		return func() {}, nil
+	}
+	store, err := newShareStore(cfg.StorePath, cfg.StoreRetention, cfg.StoreCompact, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := sh.attachStore(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	logger.Info("persisting shares to " + cfg.StorePath)
+	return func() {
+		if err := store.Close(); err != nil {
+			logger.Error("failed closing share store: ", err)
+		}
+	}, nil
+}
+
+// subscribeListener is implemented by client listeners that need to know
+// the miner's user agent before it authorizes
+type subscribeListener interface {
+	OnSubscribe(ctx *gostratum.StratumContext)
+}
+
+func newStratumConfig(cfg BridgeConfig, logger *zap.SugaredLogger, clientListener gostratum.StratumClientListener,
+	submitHandler gostratum.EventHandler, events *eventBus, auth *authPolicy) gostratum.StratumListenerConfig {
 	handlers := gostratum.DefaultHandlers()
+	if sl, ok := clientListener.(subscribeListener); ok {
+		handlers[string(gostratum.StratumMethodSubscribe)] =
+			func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+				// the encoder is in use once authorized, a late subscribe
+				// is acked but changes nothing
+				authorized := ctx.Authorized()
+				if err := gostratum.HandleSubscribe(ctx, event); err != nil {
+					return err
+				}
+				if !authorized {
+					sl.OnSubscribe(ctx)
+				}
+				return nil
+			}
+	}
+	handlers[string(gostratum.StratumMethodAuthorize)] =
+		func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+			if err := auth.handle(ctx, event); err != nil || !ctx.Authorized() {
+				return err // refused or failed
+			}
+			events.publish(newClientEvent(EventAuthorize, ctx))
+			return nil
+		}
 	// override the submit handler with an actual useful handler
 	handlers[string(gostratum.StratumMethodSubmit)] =
 		func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
-			if err := shareHandler.HandleSubmit(ctx, event); err != nil {
+			if err := submitHandler(ctx, event); err != nil {
 				ctx.Logger.Sugar().Error(err) // sink error
 			}
 			return nil
@@ -100,19 +464,18 @@ func ListenAndServe(cfg BridgeConfig) error {
 		Port:           cfg.StratumPort,
 		HandlerMap:     handlers,
 		StateGenerator: MiningStateGenerator,
-		ClientListener: clientHandler,
+		ClientListener: clientListener,
 		Logger:         logger.Desugar(),
+		RecordDir:      cfg.RecordDir,
+		MaxLineLength:  cfg.MaxLineLength,
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	ksApi.Start(ctx, func() {
-		clientHandler.NewBlockAvailable(ksApi)
-	})
-
-	if cfg.PrintStats {
-		go shareHandler.startStatsThread()
+	if cfg.StratumTLSPort != "" {
+		stratumConfig.TLS = &gostratum.TLSConfig{
+			Port:       cfg.StratumTLSPort,
+			CertFile:   cfg.TLSCertFile,
+			KeyFile:    cfg.TLSKeyFile,
+			SelfSigned: cfg.TLSSelfSigned,
+		}
 	}
-
-	return gostratum.NewListener(stratumConfig).Listen(context.Background())
+	return stratumConfig
 }
@@ -5,26 +5,18 @@ import (
 	"io/ioutil"
 	"log"
 	"math/big"
-	"net"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
 	"github.com/kaspanet/kaspad/util/difficulty"
+	"github.com/pkg/errors"
 )
 
 func TestHeaderSerialization(t *testing.T) {
-	raw, err := ioutil.ReadFile("./example_header.json")
-	if err != nil {
-		t.Fatal(err)
-	}
-	block := appmessage.RPCBlock{}
-	if err := json.Unmarshal(raw, &block.Header); err != nil {
-		t.Fatal(err)
-	}
-
-	header, err := SerializeBlockHeader(&block)
+	header, err := SerializeBlockHeader(loadExampleBlock(t))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,25 +67,155 @@ func TestPoolHzCalculation(t *testing.T) {
 	log.Println(difficulty.GetHashrateString(&rate, time.Second*1))
 }
 
-// snooper. Inspect coms between miner and pool
-func TestBridge(t *testing.T) {
-	serverConn, err := net.Dial("tcp", "pool.us.woolypooly.com:3112")
+func TestDupeShareTracking(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	state.setStratumDiff(4)
+	first := state.AddJob(&appmessage.RPCBlock{}, 0)
+	job, exists := state.GetJob(first)
+	if !exists {
+		t.Fatal("job not found")
+	}
+	if state.trackNonce(job, 1234) != nonceNew {
+		t.Fatal("first submit of nonce flagged as dupe")
+	}
+	if state.trackNonce(job, 1234) != nonceDupe {
+		t.Fatal("second submit of nonce not flagged as dupe")
+	}
+	if state.trackNonce(job, 1235) != nonceNew {
+		t.Fatal("unique nonce flagged as dupe")
+	}
+
+	// same nonce on a different job is fine
+	second, _ := state.GetJob(state.AddJob(&appmessage.RPCBlock{}, 0))
+	if state.trackNonce(second, 1234) != nonceNew {
+		t.Fatal("nonce on new job flagged as dupe")
+	}
+
+	// a full job refuses new nonces rather than forgetting them
+	for nonce := uint64(len(second.nonces)); len(second.nonces) < maxNoncesPerJob; nonce++ {
+		state.trackNonce(second, nonce+1e6)
+	}
+	if state.trackNonce(second, 99) != nonceJobFull || state.trackNonce(second, 1234) != nonceDupe {
+		t.Fatal("expected full job to refuse new nonces and still catch dupes")
+	}
+
+	// cycle the first job out of the ring, the slot is reused and the old
+	// job id should no longer resolve
+	for i := 0; i < maxjobs; i++ {
+		state.AddJob(&appmessage.RPCBlock{}, 0)
+	}
+	if _, exists := state.GetJob(first); exists {
+		t.Fatal("evicted job still resolvable")
+	}
+	if reused, _ := state.GetJob(first + maxjobs); len(reused.nonces) != 0 {
+		t.Fatal("nonces carried over to reused job slot")
+	}
+}
+
+func TestStaleClassification(t *testing.T) {
+	sh := newShareHandler(nil, 8, time.Minute)
+	sh.updateTip(100)
+	if tip := sh.updateTip(90); tip != 100 {
+		t.Fatalf("tip moved backwards to %d", tip)
+	}
+
+	tests := []struct {
+		name    string
+		jobTip  uint64
+		issued  time.Time
+		lag     uint64
+		isStale bool
+	}{
+		{name: "current", jobTip: 100, issued: time.Now()},
+		{name: "late", jobTip: 95, issued: time.Now(), lag: 5},
+		{name: "edge of window", jobTip: 92, issued: time.Now(), lag: 8},
+		{name: "stale blue score", jobTip: 91, issued: time.Now(), lag: 9, isStale: true},
+		{name: "stale age", jobTip: 100, issued: time.Now().Add(-2 * time.Minute), isStale: true},
+	}
+	for _, v := range tests {
+		si := &submitInfo{job: &MiningJob{tipBlueScore: v.jobTip, issued: v.issued}}
+		lag, err := sh.checkStales(si)
+		if isStale := errors.Is(err, ErrStaleShare); isStale != v.isStale {
+			t.Errorf("%s: expected stale %t, got %v", v.name, v.isStale, err)
+		}
+		if !v.isStale && lag != v.lag {
+			t.Errorf("%s: expected lag %d, got %d", v.name, v.lag, lag)
+		}
+	}
+}
+
+func loadExampleBlock(t *testing.T) *appmessage.RPCBlock {
+	raw, err := ioutil.ReadFile("./example_header.json")
 	if err != nil {
 		t.Fatal(err)
 	}
-	clientConn, err := net.Listen("tcp", ":4444")
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(raw, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+func examplePowValue(t *testing.T, block *appmessage.RPCBlock, nonce uint64) *big.Int {
+	converted, err := appmessage.RPCBlockToDomainBlock(block)
 	if err != nil {
 		t.Fatal(err)
 	}
-	c, _ := clientConn.Accept()
-	buff := make([]byte, 1024)
-	for {
-		time.Sleep(100 * time.Millisecond)
-		bytesRead, _ := c.Read(buff)
-		log.Printf("client -> server: %d, '%s'", bytesRead, string(buff))
-		serverConn.Write(buff)
-		bytesRead, _ = serverConn.Read(buff)
-		log.Printf("server -> client: %d, '%s'", bytesRead, string(buff))
-		c.Write(buff)
+	header := converted.Header.ToMutable()
+	header.SetNonce(nonce)
+	return pow.NewState(header).CalculateProofOfWorkValue()
+}
+
+// findNonce brute forces the example header for a nonce with a pow value
+// inside (floor, ceil]
+func findNonce(t *testing.T, block *appmessage.RPCBlock, floor, ceil *big.Int) (uint64, *big.Int) {
+	for nonce := uint64(0); nonce < 10000; nonce++ {
+		powValue := examplePowValue(t, block, nonce)
+		if powValue.Cmp(ceil) <= 0 && (floor == nil || powValue.Cmp(floor) > 0) {
+			return nonce, powValue
+		}
 	}
+	t.Fatal("failed to find nonce in range")
+	return 0, nil
+}
+
+func TestShareDiffValidation(t *testing.T) {
+	block := loadExampleBlock(t)
+	// diffs low enough to find shares quickly by brute force
+	easy := 1e-9
+	hard := easy * 4
+
+	state := MiningStateGenerator().(*MiningState)
+	easyDiff := state.setStratumDiff(easy)
+	job, _ := state.GetJob(state.AddJob(block, 0))
+
+	_, goodPow := findNonce(t, block, nil, easyDiff.targetValue)
+	_, weakPow := findNonce(t, block, easyDiff.targetValue, maxTarget256())
+
+	if d := state.shareDiff(job, goodPow, time.Now()); d != easyDiff {
+		t.Fatalf("valid share not credited at job diff")
+	}
+	if d := state.shareDiff(job, weakPow, time.Now()); d != nil {
+		t.Fatalf("weak share credited at diff %f", d.diffValue)
+	}
+
+	// retarget up, new job is issued at the harder diff. A share that only
+	// meets the previous diff is accepted during the grace period
+	hardDiff := state.setStratumDiff(hard)
+	hardJob, _ := state.GetJob(state.AddJob(block, 0))
+	_, midPow := findNonce(t, block, hardDiff.targetValue, easyDiff.targetValue)
+	if d := state.shareDiff(hardJob, midPow, time.Now()); d != easyDiff {
+		t.Fatalf("share meeting previous diff rejected during grace period")
+	}
+	if d := state.shareDiff(hardJob, midPow, time.Now().Add(diffChangeGrace*2)); d != nil {
+		t.Fatalf("share meeting previous diff accepted after grace period")
+	}
+	// the old job still validates against the diff it was issued at
+	if d := state.shareDiff(job, midPow, time.Now().Add(diffChangeGrace*2)); d != easyDiff {
+		t.Fatalf("share on job issued before retarget not credited at job diff")
+	}
+}
+
+func maxTarget256() *big.Int {
+	return new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
 }
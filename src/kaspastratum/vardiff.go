@@ -0,0 +1,111 @@
+package kaspastratum
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSharesPerMin    = 20
+	defaultVarDiffRetarget = 30 * time.Second
+	// don't bother sending a new diff unless it moves by at least this much,
+	// keeps miners from getting spammed with set_difficulty on noisy rates
+	varDiffTolerance = 0.1
+	// max factor the diff can move in a single retarget to avoid overshooting
+	// on a short burst of lucky (or unlucky) shares
+	varDiffMaxStep = 4.0
+)
+
+// varDiffConfig holds the tuning knobs for per-worker variable difficulty.
+// Shared across all clients of a listener
+type varDiffConfig struct {
+	enabled      bool
+	sharesPerMin float64
+	minDiff      float64
+	maxDiff      float64
+	retarget     time.Duration
+}
+
+func newVarDiffConfig(enabled bool, sharesPerMin uint, minDiff, maxDiff float64, retarget time.Duration) varDiffConfig {
+	if sharesPerMin == 0 {
+		sharesPerMin = defaultSharesPerMin
+	}
+	if retarget <= 0 {
+		retarget = defaultVarDiffRetarget
+	}
+	if minDiff <= 0 {
+		minDiff = 1
+	}
+	if maxDiff > 0 && maxDiff < minDiff {
+		maxDiff = minDiff
+	}
+	return varDiffConfig{
+		enabled:      enabled,
+		sharesPerMin: float64(sharesPerMin),
+		minDiff:      minDiff,
+		maxDiff:      maxDiff,
+		retarget:     retarget,
+	}
+}
+
+// varDiffState tracks the share rate of a single worker since the last retarget
+type varDiffState struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	shares      float64
+}
+
+// recordShare counts a share toward the current window. weight is the ratio
+// of the diff the share was found at vs the worker's current diff so shares
+// on jobs issued before a retarget are counted in current-diff units
+func (vs *varDiffState) recordShare(weight float64) {
+	vs.lock.Lock()
+	vs.shares += weight
+	vs.lock.Unlock()
+}
+
+func (vs *varDiffState) reset(now time.Time) {
+	vs.lock.Lock()
+	vs.windowStart = now
+	vs.shares = 0
+	vs.lock.Unlock()
+}
+
+// nextDiff calculates the diff the worker should be moved to based on the
+// observed share rate. Returns false if no change should be sent to the worker
+func (cfg *varDiffConfig) nextDiff(vs *varDiffState, current float64, now time.Time) (float64, bool) {
+	if !cfg.enabled {
+		return current, false
+	}
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	if vs.windowStart.IsZero() {
+		vs.windowStart = now
+		return current, false
+	}
+	elapsed := now.Sub(vs.windowStart)
+	if elapsed < cfg.retarget {
+		return current, false
+	}
+
+	observed := vs.shares / elapsed.Minutes()
+	ratio := observed / cfg.sharesPerMin
+	// clamp the step size, this also covers the zero share case where the
+	// worker is clearly struggling with the current diff
+	ratio = math.Max(1/varDiffMaxStep, math.Min(varDiffMaxStep, ratio))
+
+	next := current * ratio
+	next = math.Max(next, cfg.minDiff)
+	if cfg.maxDiff > 0 {
+		next = math.Min(next, cfg.maxDiff)
+	}
+
+	vs.windowStart = now
+	vs.shares = 0
+	if math.Abs(next-current)/current < varDiffTolerance {
+		return current, false
+	}
+	return next, true
+}
@@ -0,0 +1,51 @@
+package kaspastratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVarDiffRetarget(t *testing.T) {
+	cfg := newVarDiffConfig(true, 20, 1, 1024, 30*time.Second)
+	start := time.Now()
+
+	tests := []struct {
+		name     string
+		shares   float64
+		elapsed  time.Duration
+		current  float64
+		expected float64
+		changed  bool
+	}{
+		{name: "too early", shares: 100, elapsed: 10 * time.Second, current: 4, expected: 4},
+		{name: "on target", shares: 10, elapsed: 30 * time.Second, current: 4, expected: 4},
+		{name: "within tolerance", shares: 10.5, elapsed: 30 * time.Second, current: 4, expected: 4},
+		{name: "double rate", shares: 20, elapsed: 30 * time.Second, current: 4, expected: 8, changed: true},
+		{name: "half rate", shares: 5, elapsed: 30 * time.Second, current: 4, expected: 2, changed: true},
+		{name: "step clamped up", shares: 1000, elapsed: 30 * time.Second, current: 4, expected: 16, changed: true},
+		{name: "no shares", shares: 0, elapsed: 30 * time.Second, current: 16, expected: 4, changed: true},
+		{name: "min bound", shares: 0, elapsed: 30 * time.Second, current: 2, expected: 1, changed: true},
+		{name: "max bound", shares: 1000, elapsed: 30 * time.Second, current: 512, expected: 1024, changed: true},
+		{name: "at min", shares: 0, elapsed: 30 * time.Second, current: 1, expected: 1},
+	}
+
+	for _, v := range tests {
+		state := varDiffState{}
+		state.reset(start)
+		state.recordShare(v.shares)
+		next, changed := cfg.nextDiff(&state, v.current, start.Add(v.elapsed))
+		if changed != v.changed || next != v.expected {
+			t.Errorf("%s: expected (%f, %t), got (%f, %t)", v.name, v.expected, v.changed, next, changed)
+		}
+	}
+}
+
+func TestVarDiffDisabled(t *testing.T) {
+	cfg := newVarDiffConfig(false, 20, 1, 0, 30*time.Second)
+	state := varDiffState{}
+	state.reset(time.Now())
+	state.recordShare(1000)
+	if next, changed := cfg.nextDiff(&state, 4, time.Now().Add(time.Hour)); changed || next != 4 {
+		t.Fatalf("vardiff disabled but diff changed to %f", next)
+	}
+}